@@ -0,0 +1,382 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testcni/cni"
+	"testcni/consts"
+	"testcni/datastore"
+	"testcni/ipam"
+	"testcni/utils"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+/**
+ * agent 是跑在每个节点上的常驻进程, 用 testcni agent 启动
+ * cni 插件本身只在 kubelet 调用的时候跑一下就退出了, 需要一直盯着集群变化的事情都放到这里来做
+ * 比如节点被删掉之后把它的网段还回 pool 里, 以及把本机上指向它的路由删掉
+ */
+
+const (
+	DEFAULT_CNI_CONF_DIR = "/etc/cni/net.d"
+	// 节点被删掉之后等这么久还没回来的话才回收它的网段, 免得节点只是重新注册一下网段就没了
+	DEFAULT_GRACE_PERIOD = 5 * time.Minute
+	// 就算没监听到变化也每隔这么久全量对一遍
+	DEFAULT_RESYNC_PERIOD = 30 * time.Second
+	// ip 连着这么久都没有 pod 在用的话才回收, 给 ADD 到一半的 pod 留够时间
+	DEFAULT_GC_SAFETY_WINDOW = 10 * time.Minute
+
+	minionsPrefix = "/registry/minions/"
+)
+
+type Options struct {
+	// cni 配置文件或者配置文件所在的目录, 是目录的话就找第一个 type 是 testcni 的
+	ConfPath     string
+	GracePeriod  time.Duration
+	ResyncPeriod time.Duration
+	// 为 0 的话不回收泄露的 ip
+	GCSafetyWindow time.Duration
+	// 为 0 的话不写心跳, 也不管其他节点的心跳
+	HeartbeatTTL time.Duration
+}
+
+// 解析 testcni agent 后边跟着的参数然后启动 agent
+func Main(args []string) error {
+	opts := &Options{}
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfPath, "conf", DEFAULT_CNI_CONF_DIR, "cni config file or directory")
+	fs.DurationVar(&opts.GracePeriod, "grace-period", DEFAULT_GRACE_PERIOD, "how long a deleted node is kept before its blocks are reclaimed")
+	fs.DurationVar(&opts.ResyncPeriod, "resync-period", DEFAULT_RESYNC_PERIOD, "interval of the full resync")
+	fs.DurationVar(&opts.GCSafetyWindow, "gc-safety-window", DEFAULT_GC_SAFETY_WINDOW, "how long an ip is unused by any pod before it is released, 0 disables the ip gc")
+	fs.DurationVar(&opts.HeartbeatTTL, "heartbeat-ttl", DEFAULT_HEARTBEAT_TTL, "ttl of the node heartbeat lease, routes to nodes whose heartbeat expired are removed, 0 disables the heartbeat")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+	return Run(opts, stop)
+}
+
+func Run(opts *Options, stop <-chan struct{}) error {
+	conf, err := LoadPluginConf(opts.ConfPath)
+	if err != nil {
+		return err
+	}
+	services, err := initIpam(conf)
+	if err != nil {
+		return err
+	}
+	// 存储能监听的话节点或者网段的映射一有变化就对一遍, 存成 crd 的话只能等 resync
+	store, _ := services[0].Datastore.(datastore.Watchable)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	// 心跳只写在默认的池子的存储里, 所有池子都用同一份
+	var staleNodes func() (map[string]bool, error)
+	_, leasable := services[0].Datastore.(datastore.Leaser)
+	if opts.HeartbeatTTL > 0 && !leasable {
+		utils.WriteLog(services[0].Datastore.Type(), " 存储不支持心跳, 不写心跳")
+	}
+	if opts.HeartbeatTTL > 0 && leasable {
+		stopHeartbeat, err := StartHeartbeat(services[0].Datastore, hostname, opts.HeartbeatTTL)
+		if err != nil {
+			return err
+		}
+		defer stopHeartbeat()
+		staleNodes = func() (map[string]bool, error) {
+			return StaleNodes(services[0].Datastore)
+		}
+	}
+
+	// ipip 模式下 bird 的配置只有一份, 得带上所有池子的 ipv4 的网段, 第一个是默认的池子
+	birdServices := []*ipam.IpamService{}
+	for _, is := range services {
+		if !is.IsIPv6() {
+			birdServices = append(birdServices, is)
+		}
+	}
+
+	// 双栈的时候两个地址族的网段是分开存的, 具名的 ip 池也是, 回收和同步路由都得各来一遍
+	ncs := []*NodeController{}
+	rss := []*RouteSyncer{}
+	gcs := []*GarbageCollector{}
+	for _, is := range services {
+		ncs = append(ncs, NewNodeController(is, opts.GracePeriod))
+		rs := NewRouteSyncer(is, conf.Mode, staleNodes)
+		rs.birdServices = birdServices
+		rss = append(rss, rs)
+		if opts.GCSafetyWindow > 0 {
+			gcs = append(gcs, NewGarbageCollector(is, opts.GCSafetyWindow, listLocalPods(is)))
+		}
+	}
+
+	// 节点有变化或者网段的映射有变化的时候都立马对一遍, 不用等到下一次 resync
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	onChange := func(_ datastore.EventType, _, _ string) { notify() }
+	ctx, cancelWatch := context.WithCancel(context.Background())
+	defer cancelWatch()
+	watchingNodes := watchCluster(ctx, services[0].K8sClient, hostname, len(gcs) > 0, notify)
+	if store != nil {
+		// 连不上 apiserver 的话退回去监听 etcd 里 k8s 自己存节点的 key, 只有存在 etcd 里的时候才能这么监听
+		if !watchingNodes && services[0].Datastore.Type() == datastore.DATASTORE_ETCD {
+			cancel, err := store.Watch(minionsPrefix, true, onChange)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+		}
+		// 别的节点的心跳断了或者恢复了
+		if staleNodes != nil {
+			cancel, err := store.Watch(NODES_PREFIX, true, onChange)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+		}
+		for _, is := range services {
+			mapsPath, err := is.Get().HostSubnetMapPath()
+			if err != nil {
+				return err
+			}
+			cancel, err := store.Watch(mapsPath, false, onChange)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+		}
+	}
+
+	utils.WriteLog("testcni agent 启动了, 模式: ", conf.Mode, ", 网段: ", conf.Subnet)
+	ticker := time.NewTicker(opts.ResyncPeriod)
+	defer ticker.Stop()
+	for {
+		for _, nc := range ncs {
+			reclaimed, err := nc.Reconcile()
+			if err != nil {
+				utils.WriteLog("回收已删除节点的网段失败: ", err.Error())
+			}
+			if len(reclaimed) > 0 {
+				utils.WriteLog("回收了这些节点的网段: ", strings.Join(reclaimed, ","))
+			}
+		}
+		for _, gc := range gcs {
+			freed, err := gc.Collect()
+			if err != nil {
+				utils.WriteLog("回收泄露的 ip 失败: ", err.Error())
+			}
+			if len(freed) > 0 {
+				utils.WriteLog("回收了这些泄露的 ip: ", strings.Join(freed, ","))
+			}
+		}
+		// 网段可能是其他节点上的 agent 回收的, 本机上指向它的路由得自己删
+		for _, rs := range rss {
+			err = rs.Sync()
+			if err != nil {
+				utils.WriteLog("同步本机路由失败: ", err.Error())
+			}
+		}
+
+		select {
+		case <-stop:
+			utils.WriteLog("testcni agent 退出了")
+			return nil
+		case <-ticker.C:
+		case <-trigger:
+		}
+	}
+}
+
+// 通过 k8s 的 api 拿到本机上的所有 pod
+func listLocalPods(is *ipam.IpamService) func() ([]v1.Pod, error) {
+	return func() ([]v1.Pod, error) {
+		if is.K8sClient == nil {
+			return nil, errors.New("k8s client is not initialized")
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		pods, err := is.K8sClient.Get().PodsOnNode(hostname)
+		if err != nil {
+			return nil, err
+		}
+		return pods.Items, nil
+	}
+}
+
+/**
+ * 读出 cni 的配置
+ * path 是目录的话按文件名排序之后找第一个 type 是 testcni 的, .conflist 的话找 plugins 里的那个
+ */
+func LoadPluginConf(path string) (*cni.PluginConf, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadPluginConfFile(path)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		if ext != ".conf" && ext != ".conflist" && ext != ".json" {
+			continue
+		}
+		conf, err := loadPluginConfFile(file)
+		if err == nil {
+			return conf, nil
+		}
+	}
+	return nil, fmt.Errorf("no testcni config found in %s", path)
+}
+
+func loadPluginConfFile(file string) (*cni.PluginConf, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	confs := []json.RawMessage{}
+	if filepath.Ext(file) == ".conflist" {
+		list := struct {
+			CNIVersion string            `json:"cniVersion"`
+			Plugins    []json.RawMessage `json:"plugins"`
+		}{}
+		err = json.Unmarshal(content, &list)
+		if err != nil {
+			return nil, err
+		}
+		confs = list.Plugins
+	} else {
+		confs = append(confs, content)
+	}
+
+	for _, raw := range confs {
+		conf := &cni.PluginConf{}
+		err = json.Unmarshal(raw, conf)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Type != "testcni" {
+			continue
+		}
+		if conf.Mode == "" {
+			conf.Mode = consts.MODE_HOST_GW
+		}
+		if conf.Subnet == "" {
+			return nil, fmt.Errorf("subnet is empty in %s", file)
+		}
+		return conf, nil
+	}
+	return nil, errors.New("not a testcni config")
+}
+
+/**
+ * 和各个模式里初始化 ipam 的参数保持一致, 不然算出来的 etcd 路径就对不上了
+ * 双栈的时候返回两个, 第一个是 subnet 里写在前头的那个地址族的
+ */
+func initIpam(conf *cni.PluginConf) ([]*ipam.IpamService, error) {
+	// 按节点的网段路由的模式不能交给别的 ipam 插件, 和 ADD 的时候报一样的错
+	if conf.Mode != consts.MODE_IPVLAN && conf.Mode != consts.MODE_MACVLAN {
+		if err := cni.CheckBuiltinIPAM(conf, conf.Mode); err != nil {
+			return nil, err
+		}
+	}
+	// ip 是别的 ipam 插件分的话 etcd 里什么都没有, agent 也就没什么可回收的
+	if cni.IsDelegatedIPAM(conf) {
+		return nil, fmt.Errorf("the agent is not needed when ipam is delegated to %q", conf.IPAM.Type)
+	}
+	subnets, err := cni.GetSubnets(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = cni.CheckPodCIDR(conf, conf.Mode); err != nil {
+		return nil, err
+	}
+	// vxlan 模式不支持具名的 ip 池, 和 ADD 的时候报一样的错
+	if err = cni.CheckPools(conf, conf.Mode); err != nil {
+		return nil, err
+	}
+	ipam.InitDualStack(subnets, modeOptions(conf))
+	is, err := ipam.GetIpamService()
+	if err != nil {
+		return nil, fmt.Errorf("初始化 ipam 客户端失败: %s", err.Error())
+	}
+	secondary, err := ipam.GetSecondaryIpamService()
+	if err != nil {
+		return nil, fmt.Errorf("初始化 ipam 客户端失败: %s", err.Error())
+	}
+	services := []*ipam.IpamService{is}
+	if secondary != nil {
+		services = append(services, secondary)
+	}
+
+	// 每个具名的 ip 池的网段也都得回收和同步路由
+	for _, pool := range cni.GetPoolNames(conf) {
+		poolConf, err := cni.GetPoolConfig(conf, pool)
+		if err != nil {
+			return nil, err
+		}
+		poolSubnets, err := cni.GetSubnets(poolConf)
+		if err != nil {
+			return nil, err
+		}
+		ipam.InitPool(pool, poolSubnets, modeOptions(poolConf))
+		poolService, poolSecondary, err := ipam.GetPoolServices(pool)
+		if err != nil {
+			return nil, fmt.Errorf("初始化 ip 池 %s 的 ipam 客户端失败: %s", pool, err.Error())
+		}
+		services = append(services, poolService)
+		if poolSecondary != nil {
+			services = append(services, poolSecondary)
+		}
+	}
+	return services, nil
+}
+
+// 和各个模式 ADD 的时候用的 ipam 参数一样, 具名的 ip 池的 range 也在 conf 里
+func modeOptions(conf *cni.PluginConf) *ipam.IPAMOptions {
+	options := ipam.OptionsFromCNI(conf)
+	switch conf.Mode {
+	case consts.MODE_VXLAN:
+		options.MaskSegment = "16"
+		options.PodIpMaskSegment = "32"
+	case consts.MODE_IPVLAN, consts.MODE_MACVLAN:
+		if conf.IPAM != nil {
+			options.RangeStart = conf.IPAM.RangeStart
+			options.RangeEnd = conf.IPAM.RangeEnd
+		}
+	}
+	return options
+}
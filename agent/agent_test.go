@@ -0,0 +1,543 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testcni/client"
+	"testcni/cni"
+	"testcni/consts"
+	"testcni/datastore"
+	"testcni/etcd"
+	"testcni/ipam"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/server/v3/embed"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// 在本地起一个内嵌的 etcd, 不依赖真实的 k8s 集群
+func startEmbedEtcd(t *testing.T) (*etcd.EtcdClient, func()) {
+	test := assert.New(t)
+	clientPort, err := getFreePort()
+	test.Nil(err)
+	peerPort, err := getFreePort()
+	test.Nil(err)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", clientPort))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", peerPort))
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("embed etcd start timeout")
+	}
+
+	client, err := etcd.NewEtcdClient(&etcd.EtcdConfig{
+		EtcdEndpoints: clientURL.String(),
+	})
+	if err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		e.Close()
+	}
+}
+
+/**
+ * 节点被删掉之后要过了 grace period 才回收它的网段
+ * 在这之前回来了的话就什么都不做
+ */
+func TestNodeControllerReconcile(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := ipam.Init("10.40.0.0/16", &ipam.IPAMOptions{
+		EtcdClient: client,
+	})
+	defer clear()
+	is, err := ipam.GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, err := os.Hostname()
+	test.Nil(err)
+
+	// 两个假节点各占一个网段, 当前主机占的网段是随机挑的, 得避开
+	networks := fakeNetworks(is, "10.40", 2)
+	for i, node := range []string{"node-a", "node-b"} {
+		network := networks[i]
+		test.Nil(client.Set("/testcni/ipam/10.40.0.0/16/blocks/"+network, node))
+		test.Nil(client.Set("/testcni/ipam/10.40.0.0/16/"+node, network))
+		test.Nil(client.Set("/testcni/ipam/10.40.0.0/16/"+network+"/ips/"+strings.TrimSuffix(network, "0")+"2", node))
+		test.Nil(client.Set(minionsPrefix+node, "{}"))
+		test.Nil(client.Set(registeredKey(node), "2026-10-18T00:00:00Z"))
+	}
+	test.Nil(client.Set(minionsPrefix+hostname, "{}"))
+
+	now := time.Now()
+	nc := NewNodeController(is, time.Minute)
+	nc.now = func() time.Time { return now }
+
+	reclaimed, err := nc.Reconcile()
+	test.Nil(err)
+	test.Empty(reclaimed)
+
+	// node-a 被删了, 还没过 grace period
+	test.Nil(client.Del(minionsPrefix + "node-a"))
+	reclaimed, err = nc.Reconcile()
+	test.Nil(err)
+	test.Empty(reclaimed)
+	now = now.Add(30 * time.Second)
+	reclaimed, err = nc.Reconcile()
+	test.Nil(err)
+	test.Empty(reclaimed)
+
+	// 过了 grace period 就回收
+	now = now.Add(time.Minute)
+	reclaimed, err = nc.Reconcile()
+	test.Nil(err)
+	test.Equal([]string{"node-a"}, reclaimed)
+	hosts, err := is.Get().AllocatedHosts()
+	test.Nil(err)
+	test.NotContains(hosts, "node-a")
+	test.Contains(hosts, "node-b")
+	ips, err := is.Get().IPsOfNetwork(networks[0])
+	test.Nil(err)
+	test.Empty(ips)
+	// 心跳记录也跟着删掉
+	registered, err := client.Get(registeredKey("node-a"))
+	test.Nil(err)
+	test.Empty(registered)
+	registered, err = client.Get(registeredKey("node-b"))
+	test.Nil(err)
+	test.NotEmpty(registered)
+
+	// node-b 被删了又在 grace period 里回来了, 不能回收
+	test.Nil(client.Del(minionsPrefix + "node-b"))
+	reclaimed, err = nc.Reconcile()
+	test.Nil(err)
+	test.Empty(reclaimed)
+	test.Nil(client.Set(minionsPrefix+"node-b", "{}"))
+	now = now.Add(2 * time.Minute)
+	reclaimed, err = nc.Reconcile()
+	test.Nil(err)
+	test.Empty(reclaimed)
+	hosts, err = is.Get().AllocatedHosts()
+	test.Nil(err)
+	test.Contains(hosts, "node-b")
+	test.Contains(hosts, hostname)
+
+	// 一个节点都读不到的时候什么都不回收
+	test.Nil(client.Del(minionsPrefix + "node-b"))
+	test.Nil(client.Del(minionsPrefix + hostname))
+	for i := 0; i < 2; i++ {
+		now = now.Add(2 * time.Minute)
+		reclaimed, err = nc.Reconcile()
+		test.Nil(err)
+		test.Empty(reclaimed)
+	}
+}
+
+// 从 prefix.200.0 开始挑 n 个不是当前主机的网段
+func fakeNetworks(is *ipam.IpamService, prefix string, n int) []string {
+	res := []string{}
+	for i := 200; len(res) < n; i++ {
+		network := fmt.Sprintf("%s.%d.0", prefix, i)
+		if network != is.CurrentHostNetwork {
+			res = append(res, network)
+		}
+	}
+	return res
+}
+
+/**
+ * 没有 pod 在用的 ip 要连着 safety window 这么久都没人用才回收
+ * 有 pod 在用的, 刚分出去的都不能动
+ */
+func TestGarbageCollectorCollect(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := ipam.Init("10.41.0.0/16", &ipam.IPAMOptions{
+		EtcdClient: client,
+	})
+	defer clear()
+	is, err := ipam.GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	live, err := is.Get().AllocateIP("container-live", "eth0", "host-gw")
+	test.Nil(err)
+	leaked, err := is.Get().AllocateIP("container-leaked", "eth0", "host-gw")
+	test.Nil(err)
+	// 老版本留下来的没有分配记录的 ip
+	legacy := strings.TrimSuffix(leaked.Network, "0") + "9"
+	test.Nil(client.Set("/testcni/ipam/10.41.0.0/16/"+leaked.Network+"/ips/"+legacy, getHostname(t)))
+
+	pods := []v1.Pod{
+		{Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: live.IP}},
+		// 跑完了的 pod 的 ip 不算
+		{Status: v1.PodStatus{Phase: v1.PodSucceeded, PodIP: leaked.IP}},
+	}
+	var listErr error
+	gc := NewGarbageCollector(is, time.Minute, func() ([]v1.Pod, error) { return pods, listErr })
+	gc.now = func() time.Time { return now }
+
+	// 刚发现没人用的先记着, 分配记录是刚写的就连记都不记
+	freed, err := gc.Collect()
+	test.Nil(err)
+	test.Empty(freed)
+	now = now.Add(2 * time.Minute)
+	freed, err = gc.Collect()
+	test.Nil(err)
+	test.Equal([]string{legacy}, freed)
+
+	// 读 pod 失败的时候什么都不回收
+	listErr = errors.New("apiserver is down")
+	now = now.Add(2 * time.Minute)
+	_, err = gc.Collect()
+	test.NotNil(err)
+	listErr = nil
+
+	freed, err = gc.Collect()
+	test.Nil(err)
+	test.Equal([]string{leaked.IP}, freed)
+	alloc, err := is.Get().Allocation("container-leaked", "eth0")
+	test.Nil(err)
+	test.Nil(alloc)
+	alloc, err = is.Get().Allocation("container-live", "eth0")
+	test.Nil(err)
+	test.NotNil(alloc)
+	ips, err := is.Get().IPsOfNetwork(leaked.Network)
+	test.Nil(err)
+	test.Equal([]string{live.IP}, ips)
+
+	// 中途又有 pod 用上了的话重新计时
+	reused, err := is.Get().AllocateIP("container-reused", "eth0", "host-gw")
+	test.Nil(err)
+	pods = append(pods, v1.Pod{Status: v1.PodStatus{Phase: v1.PodPending}})
+	now = now.Add(2 * time.Minute)
+	freed, err = gc.Collect()
+	test.Nil(err)
+	test.Empty(freed)
+	pods[2].Status.PodIPs = []v1.PodIP{{IP: reused.IP}}
+	now = now.Add(2 * time.Minute)
+	freed, err = gc.Collect()
+	test.Nil(err)
+	test.Empty(freed)
+}
+
+func getHostname(t *testing.T) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hostname
+}
+
+func TestLoadPluginConf(t *testing.T) {
+	test := assert.New(t)
+	dir := t.TempDir()
+
+	test.Nil(os.WriteFile(filepath.Join(dir, "00-other.conf"), []byte(`{"cniVersion":"0.3.0","name":"other","type":"bridge"}`), 0600))
+	test.Nil(os.WriteFile(filepath.Join(dir, "10-testcni.conflist"), []byte(`{
+		"cniVersion": "0.3.0",
+		"name": "testcni",
+		"plugins": [
+			{"type": "testcni", "subnet": "10.244.0.0/16", "ipam": {"blockSize": 26}},
+			{"type": "portmap"}
+		]
+	}`), 0600))
+
+	conf, err := LoadPluginConf(dir)
+	test.Nil(err)
+	test.Equal("10.244.0.0/16", conf.Subnet)
+	test.Equal(consts.MODE_HOST_GW, conf.Mode)
+	test.Equal(26, conf.IPAM.BlockSize)
+
+	_, err = LoadPluginConf(filepath.Join(dir, "00-other.conf"))
+	test.NotNil(err)
+}
+
+func TestInitIpamDelegated(t *testing.T) {
+	test := assert.New(t)
+	conf := &cni.PluginConf{Subnet: "10.244.0.0/16", IPAM: &cni.IPAM{Type: "dhcp"}}
+
+	// 按节点的网段路由的模式配了别的 ipam 插件的话和 ADD 的时候报一样的错
+	for _, mode := range []string{consts.MODE_HOST_GW, consts.MODE_IPIP, consts.MODE_VXLAN} {
+		conf.Mode = mode
+		_, err := initIpam(conf)
+		test.Equal(cni.CheckBuiltinIPAM(conf, mode), err, mode)
+	}
+	// ipvlan 和 macvlan 是可以的, 只是用不着 agent
+	conf.Mode = consts.MODE_MACVLAN
+	_, err := initIpam(conf)
+	test.NotNil(err)
+	test.Contains(err.Error(), "the agent is not needed")
+}
+
+func TestInitIpamPools(t *testing.T) {
+	test := assert.New(t)
+	conf := &cni.PluginConf{
+		Subnet: "10.244.0.0/16",
+		IPAM:   &cni.IPAM{Pools: []cni.Pool{{Name: "ingress", Subnet: "192.168.100.0/24"}}},
+	}
+
+	// vxlan 模式不支持具名的 ip 池, 和 ADD 的时候报一样的错
+	conf.Mode = consts.MODE_VXLAN
+	_, err := initIpam(conf)
+	test.NotNil(err)
+	test.Equal(cni.CheckPools(conf, consts.MODE_VXLAN), err)
+
+	// ipam service 是按名字存在进程里的, 换一套配置之前得先清掉, 已经初始化过的话 InitPool 返回的就是它的 clear
+	clearPools := func() {
+		for _, pool := range []string{ipam.DEFAULT_POOL_NAME, "ingress"} {
+			ipam.InitPool(pool, []string{conf.Subnet}, nil)()
+		}
+	}
+
+	// 别的模式下每个池子都有自己的 ipam, 存储和默认的池子是同一个
+	for _, mode := range []string{consts.MODE_HOST_GW, consts.MODE_IPIP} {
+		conf.Mode = mode
+		conf.IPAM.Datastore = datastore.DATASTORE_FILE
+		conf.IPAM.DatastorePath = filepath.Join(t.TempDir(), "ipam.json")
+		services, err := initIpam(conf)
+		test.Nil(err, mode)
+		test.Len(services, 2, mode)
+		test.Equal("192.168.100.0", services[1].Subnet, mode)
+		clearPools()
+	}
+
+	// ipvlan 和 macvlan 模式下池子是另一段 subnet 和 range, 初始化的时候就占网段, 只从 range 里分
+	conf.Mode = consts.MODE_MACVLAN
+	conf.Subnet = "192.168.64.0/24"
+	conf.IPAM.RangeStart = "192.168.64.90"
+	conf.IPAM.RangeEnd = "192.168.64.99"
+	conf.IPAM.Pools[0].RangeStart = "192.168.100.10"
+	conf.IPAM.Pools[0].RangeEnd = "192.168.100.11"
+	conf.IPAM.DatastorePath = filepath.Join(t.TempDir(), "ipam.json")
+	services, err := initIpam(conf)
+	test.Nil(err)
+	defer clearPools()
+	test.Len(services, 2)
+	test.NotEmpty(services[1].CurrentHostNetwork)
+	alloc, err := services[1].Get().AllocateIP("container-0", "eth0", consts.MODE_MACVLAN)
+	test.Nil(err)
+	test.Contains([]string{"192.168.100.10", "192.168.100.11"}, alloc.IP)
+}
+
+/**
+ * 停止续约的节点过了 ttl 就算心跳断了, 重新开始心跳之后就恢复了
+ * 从来没跑过 agent 的节点不算心跳断了
+ */
+func TestHeartbeat(t *testing.T) {
+	test := assert.New(t)
+	store := datastore.NewMemoryDatastore()
+	ttl := 50 * time.Millisecond
+
+	stopA, err := StartHeartbeat(store, "node-a", ttl)
+	test.Nil(err)
+	defer stopA()
+	stopB, err := StartHeartbeat(store, "node-b", ttl)
+	test.Nil(err)
+	nodes, err := ListNodeHealth(store)
+	test.Nil(err)
+	test.Len(nodes, 2)
+	for _, node := range nodes {
+		test.True(node.Alive)
+		test.NotEmpty(node.Since)
+		test.NotEmpty(node.Registered)
+	}
+	registered := nodes[1].Registered
+	stale, err := StaleNodes(store)
+	test.Nil(err)
+	test.Empty(stale)
+
+	stopB()
+	test.Eventually(func() bool {
+		stale, err := StaleNodes(store)
+		return err == nil && stale["node-b"] && !stale["node-a"]
+	}, 2*time.Second, 10*time.Millisecond)
+
+	out := &strings.Builder{}
+	nodes, err = ListNodeHealth(store)
+	test.Nil(err)
+	test.Nil(printNodeHealth(out, nodes, ""))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	test.Len(lines, 3)
+	test.Equal([]string{"HOSTNAME", "STATUS", "SINCE", "REGISTERED"}, strings.Fields(lines[0]))
+	test.Equal([]string{"node-a", "Alive"}, strings.Fields(lines[1])[:2])
+	test.Equal([]string{"node-b", "Stale", "-", registered}, strings.Fields(lines[2]))
+	out.Reset()
+	test.Nil(printNodeHealth(out, nodes, "json"))
+	test.Contains(out.String(), `"hostname": "node-b"`)
+	test.NotNil(printNodeHealth(out, nodes, "yaml"))
+
+	// 重新开始心跳, 第一次注册的时间不变
+	stopB, err = StartHeartbeat(store, "node-b", ttl)
+	test.Nil(err)
+	defer stopB()
+	stale, err = StaleNodes(store)
+	test.Nil(err)
+	test.Empty(stale)
+	nodes, err = ListNodeHealth(store)
+	test.Nil(err)
+	test.Equal(registered, nodes[1].Registered)
+
+	// 网段被回收之后心跳记录也没了
+	test.Nil(forgetNode(store, "node-b"))
+	nodes, err = ListNodeHealth(store)
+	test.Nil(err)
+	test.Len(nodes, 1)
+}
+
+// 心跳断了的节点的网段不算其他节点的网段, 指向它的路由会被删掉
+func TestRouteSyncerStaleNodes(t *testing.T) {
+	test := assert.New(t)
+	store := datastore.NewMemoryDatastore()
+	clear := ipam.Init("10.42.0.0/16", &ipam.IPAMOptions{
+		Datastore: store,
+	})
+	defer clear()
+	is, err := ipam.GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks := fakeNetworks(is, "10.42", 2)
+	mapsPath, err := is.Get().HostSubnetMapPath()
+	test.Nil(err)
+	test.Nil(store.Set(mapsPath, fmt.Sprintf(`{%q:%q,%q:"node-a",%q:"node-b"}`, is.CurrentHostNetwork, getHostname(t), networks[0], networks[1])))
+
+	stale := map[string]bool{}
+	rs := NewRouteSyncer(is, consts.MODE_HOST_GW, func() (map[string]bool, error) { return stale, nil })
+	cidrs, err := rs.otherHostCIDRs()
+	test.Nil(err)
+	test.Equal(map[string]bool{networks[0] + "/24": true, networks[1] + "/24": true}, cidrs)
+
+	stale["node-b"] = true
+	cidrs, err = rs.otherHostCIDRs()
+	test.Nil(err)
+	test.Equal(map[string]bool{networks[0] + "/24": true}, cidrs)
+
+	// 不看心跳的时候都算
+	rs = NewRouteSyncer(is, consts.MODE_HOST_GW, nil)
+	cidrs, err = rs.otherHostCIDRs()
+	test.Nil(err)
+	test.Len(cidrs, 2)
+}
+
+// 起一个假的 apiserver, list 的时候什么都没有, watch 的时候把 events 里对应路径的事件发出去, 403 里的路径直接回 403
+func startWatchApiserver(t *testing.T, events map[string]chan watch.Event, forbidden ...string) *client.LightK8sClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, consts.KUBE_API)
+		for _, p := range forbidden {
+			if p == path {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"kind":"Status","code":403,"reason":"Forbidden"}`))
+				return
+			}
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			w.Write([]byte(`{"metadata":{"resourceVersion":"1"},"items":[]}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case event := <-events[path]:
+				encoder.Encode(map[string]interface{}{"type": event.Type, "object": event.Object})
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return client.NewLightK8sClient(server.URL, server.Client())
+}
+
+func TestWatchCluster(t *testing.T) {
+	test := assert.New(t)
+	events := map[string]chan watch.Event{
+		"/nodes": make(chan watch.Event),
+		"/pods":  make(chan watch.Event),
+	}
+	k8sClient := startWatchApiserver(t, events)
+	notified := make(chan struct{}, 10)
+	notify := func() { notified <- struct{}{} }
+	wasNotified := func() bool {
+		select {
+		case <-notified:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	test.False(watchCluster(ctx, nil, "node-1", true, notify))
+	test.True(watchCluster(ctx, k8sClient, "node-1", true, notify))
+	node := &v1.Node{}
+	node.Name, node.ResourceVersion = "node-2", "2"
+	events["/nodes"] <- watch.Event{Type: watch.Added, Object: node}
+	test.True(wasNotified())
+
+	// 还在跑的 pod 有变化的话不用管, 跑完了或者被删掉了才去回收 ip
+	pod := &v1.Pod{}
+	pod.Name, pod.Namespace, pod.ResourceVersion = "busybox", "default", "3"
+	pod.Status.Phase = v1.PodRunning
+	events["/pods"] <- watch.Event{Type: watch.Modified, Object: pod.DeepCopy()}
+	test.False(wasNotified())
+	pod.ResourceVersion, pod.Status.Phase = "4", v1.PodSucceeded
+	events["/pods"] <- watch.Event{Type: watch.Modified, Object: pod.DeepCopy()}
+	test.True(wasNotified())
+	pod.ResourceVersion = "5"
+	events["/pods"] <- watch.Event{Type: watch.Deleted, Object: pod.DeepCopy()}
+	test.True(wasNotified())
+
+	// 没权限监听节点的话让调用方自己想办法
+	test.False(watchCluster(ctx, startWatchApiserver(t, events, "/nodes"), "node-1", false, notify))
+}
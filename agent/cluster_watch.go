@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+	"testcni/client"
+	"testcni/utils"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+/**
+ * 通过 k8s 的 api 监听集群的变化, 有需要的时候调 notify 让 agent 马上对一遍
+ * 节点加进来, 被删掉或者改了(比如刚分到 podCIDR)的时候同步路由和回收网段
+ * watchPods 为 true 的话还监听本机上的 pod, pod 没了或者跑完了的时候去看看它的 ip 是不是泄露了
+ * 返回节点是不是监听上了, 没监听上的话调用方可以退回去监听 etcd 里的节点
+ */
+func watchCluster(ctx context.Context, k8sClient *client.LightK8sClient, hostname string, watchPods bool, notify func()) bool {
+	if k8sClient == nil {
+		return false
+	}
+	watchingNodes := true
+	err := k8sClient.Watch().Nodes(ctx, func(watch.EventType, *v1.Node) { notify() })
+	if err != nil {
+		utils.WriteLog("监听 k8s 中的节点失败: ", err.Error())
+		watchingNodes = false
+	}
+	if !watchPods {
+		return watchingNodes
+	}
+	err = k8sClient.Watch().PodsOnNode(ctx, hostname, func(eventType watch.EventType, pod *v1.Pod) {
+		if podGone(eventType, pod) {
+			notify()
+		}
+	})
+	if err != nil {
+		utils.WriteLog("监听本机上的 pod 失败, 只能等定时回收泄露的 ip: ", err.Error())
+	}
+	return watchingNodes
+}
+
+// pod 被删掉了或者已经跑完了, 它的 ip 不该再被占着了
+func podGone(eventType watch.EventType, pod *v1.Pod) bool {
+	if eventType == watch.Deleted {
+		return true
+	}
+	return pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+}
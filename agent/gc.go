@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"sync"
+	"testcni/ipam"
+	"testcni/utils"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+/**
+ * 把本机上已经没有 pod 在用的 ip 还回去
+ * ADD 做到一半挂了, 或者 DEL 没被调用到的话, etcd 里的 ip 和分配记录就一直占着, 时间长了网段会被用完
+ * 拿本机上的 pod 的 ip 和 etcd 里本机占着的 ip 对一遍, 连着 safetyWindow 这么久都没有 pod 用的才回收
+ * 正在 ADD 的 pod 还没来得及把 ip 报上去, 所以不能一发现就回收
+ */
+type GarbageCollector struct {
+	ipam         *ipam.IpamService
+	safetyWindow time.Duration
+	// 拿到本机上的 pod, 读失败的话这一轮就不回收了
+	listPods func() ([]v1.Pod, error)
+	// ip 是从什么时候开始没人用的, key 里带着 owner, ip 被释放之后又分给了别人的话得重新算
+	orphanSince map[string]time.Time
+	lock        sync.Mutex
+	now         func() time.Time
+}
+
+func NewGarbageCollector(is *ipam.IpamService, safetyWindow time.Duration, listPods func() ([]v1.Pod, error)) *GarbageCollector {
+	return &GarbageCollector{
+		ipam:         is,
+		safetyWindow: safetyWindow,
+		listPods:     listPods,
+		orphanSince:  map[string]time.Time{},
+		now:          time.Now,
+	}
+}
+
+// 本机上还活着的 pod 在用的 ip, 已经跑完了的 pod 的 sandbox 已经没了, 它们的 ip 不算
+func livePodIPs(pods []v1.Pod) map[string]bool {
+	res := map[string]bool{}
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if pod.Status.PodIP != "" {
+			res[pod.Status.PodIP] = true
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			res[podIP.IP] = true
+		}
+	}
+	return res
+}
+
+/**
+ * 对一遍本机的 pod 和 etcd 里本机占着的 ip, 返回这次回收掉的 ip
+ * 刚发现没人用的 ip 先记下时间, 过了 safetyWindow 还是没人用才回收
+ */
+func (gc *GarbageCollector) Collect() ([]string, error) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	pods, err := gc.listPods()
+	if err != nil {
+		return nil, err
+	}
+	live := livePodIPs(pods)
+
+	used, err := gc.ipam.Get().HostUsedIPs()
+	if err != nil {
+		return nil, err
+	}
+	now := gc.now()
+	orphans := map[string]bool{}
+	freed := []string{}
+	for _, u := range used {
+		if live[u.IP] {
+			continue
+		}
+		// 分配记录是刚写的话多半是 ADD 还没做完
+		if u.Allocation != nil && now.Sub(time.Unix(u.Allocation.Timestamp, 0)) < gc.safetyWindow {
+			continue
+		}
+
+		key := u.Network + "/" + u.IP + "/" + u.Owner
+		orphans[key] = true
+		since, ok := gc.orphanSince[key]
+		if !ok {
+			gc.orphanSince[key] = now
+			continue
+		}
+		if now.Sub(since) < gc.safetyWindow {
+			continue
+		}
+
+		released, err := gc.ipam.Release().OrphanIP(u)
+		if err != nil {
+			return freed, err
+		}
+		delete(gc.orphanSince, key)
+		if released {
+			utils.WriteLog("ip ", u.String(), " 已经超过 ", gc.safetyWindow.String(), " 没有 pod 在用了, 回收掉")
+			freed = append(freed, u.IP)
+		}
+	}
+
+	// 已经有 pod 在用了或者已经被释放了的就不用再记着了
+	for key := range gc.orphanSince {
+		if !orphans[key] {
+			delete(gc.orphanSince, key)
+		}
+	}
+	return freed, nil
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testcni/datastore"
+	"time"
+)
+
+/**
+ * 每个节点上的 agent 在 /testcni/nodes/<hostname>/alive 上写一个带 lease 的 key 并且一直续约
+ * agent 挂了或者节点宕机了的话续约就停了, 过了 ttl 之后 key 会被 etcd 自己删掉
+ * /testcni/nodes/<hostname>/registered 是第一次跑 agent 的时候写的, 不会过期
+ * 所以 registered 在而 alive 不在的节点就是心跳断了的节点, 其他节点会把指向它的路由和 ding_ip 里它的 pod ip 删掉, 心跳恢复之后再加回来
+ * 从来没跑过 agent 的节点没有 registered, 不会被当成心跳断了
+ */
+
+const (
+	NODES_PREFIX = "/testcni/nodes/"
+	// 续约停了之后过这么久 alive 才会被删掉
+	DEFAULT_HEARTBEAT_TTL = 30 * time.Second
+)
+
+func aliveKey(hostname string) string {
+	return NODES_PREFIX + hostname + "/alive"
+}
+
+func registeredKey(hostname string) string {
+	return NODES_PREFIX + hostname + "/registered"
+}
+
+type NodeHealth struct {
+	Hostname string `json:"hostname"`
+	Alive    bool   `json:"alive"`
+	// 这次的 agent 是什么时候起来的, 心跳断了的话是空的
+	Since string `json:"since,omitempty"`
+	// 第一次在这个节点上跑 agent 的时间
+	Registered string `json:"registered"`
+}
+
+/**
+ * 开始心跳, 调用返回的函数停止续约
+ * 存储得能写带过期时间的 key, 目前只有 etcd 支持
+ */
+func StartHeartbeat(store datastore.Datastore, hostname string, ttl time.Duration) (func(), error) {
+	leaser, ok := store.(datastore.Leaser)
+	if !ok {
+		return nil, fmt.Errorf("heartbeats are not supported by the %s datastore", store.Type())
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := store.Txn(
+		[]datastore.Cmp{datastore.KeyMissing(registeredKey(hostname))},
+		datastore.OpPut(registeredKey(hostname), now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return leaser.KeepAlive(aliveKey(hostname), now, ttl)
+}
+
+// 所有跑过 agent 的节点的心跳情况, 按主机名排好序
+func ListNodeHealth(store datastore.Datastore) ([]NodeHealth, error) {
+	kvs, err := store.List(NODES_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[string]*NodeHealth{}
+	for key, value := range kvs {
+		parts := strings.Split(strings.TrimPrefix(key, NODES_PREFIX), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		node, ok := nodes[parts[0]]
+		if !ok {
+			node = &NodeHealth{Hostname: parts[0]}
+			nodes[parts[0]] = node
+		}
+		switch parts[1] {
+		case "alive":
+			node.Alive = true
+			node.Since = value
+		case "registered":
+			node.Registered = value
+		}
+	}
+	res := []NodeHealth{}
+	for _, node := range nodes {
+		res = append(res, *node)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Hostname < res[j].Hostname
+	})
+	return res, nil
+}
+
+// 心跳断了的节点
+func StaleNodes(store datastore.Datastore) (map[string]bool, error) {
+	nodes, err := ListNodeHealth(store)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]bool{}
+	for _, node := range nodes {
+		if node.Registered != "" && !node.Alive {
+			res[node.Hostname] = true
+		}
+	}
+	return res, nil
+}
+
+// 节点的网段被回收之后它的心跳记录也删掉, 不然会一直显示成心跳断了
+func forgetNode(store datastore.Datastore, hostname string) error {
+	_, err := store.Txn(nil, datastore.OpDeletePrefix(NODES_PREFIX+hostname+"/"))
+	return err
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"os"
+	"sync"
+	"testcni/ipam"
+	"testcni/utils"
+	"time"
+)
+
+/**
+ * 盯着集群里的节点, 节点被删掉超过 gracePeriod 之后把它占着的网段还回 pool 里
+ * 每个节点上的 agent 都会跑这个, 回收是在存储的事务里做的, 几个 agent 一起回收同一个节点也没关系
+ */
+type NodeController struct {
+	ipam        *ipam.IpamService
+	gracePeriod time.Duration
+	// 节点是从什么时候开始不在集群里的
+	missingSince map[string]time.Time
+	lock         sync.Mutex
+	now          func() time.Time
+}
+
+func NewNodeController(is *ipam.IpamService, gracePeriod time.Duration) *NodeController {
+	return &NodeController{
+		ipam:         is,
+		gracePeriod:  gracePeriod,
+		missingSince: map[string]time.Time{},
+		now:          time.Now,
+	}
+}
+
+/**
+ * 对一遍占着网段的主机和集群里的节点, 返回这次回收了网段的主机名
+ * 刚发现不在的节点先记下时间, 等过了 gracePeriod 还没回来才回收
+ */
+func (nc *NodeController) Reconcile() ([]string, error) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	nodes, err := nc.ipam.Get().NodeNames()
+	if err != nil {
+		return nil, err
+	}
+	// 一个节点都没读到的话多半是读 etcd 出了问题, 这时候回收的话会把大家的网段都回收掉
+	if len(nodes) == 0 {
+		utils.WriteLog("没有读到集群中的节点, 先不回收网段")
+		return nil, nil
+	}
+	alive := map[string]bool{}
+	for _, node := range nodes {
+		alive[node] = true
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, err := nc.ipam.Get().AllocatedHosts()
+	if err != nil {
+		return nil, err
+	}
+	now := nc.now()
+	allocated := map[string]bool{}
+	reclaimed := []string{}
+	for _, host := range hosts {
+		allocated[host] = true
+		// 自己肯定还在集群里, 只是可能还没注册上
+		if alive[host] || host == hostname {
+			delete(nc.missingSince, host)
+			continue
+		}
+
+		since, ok := nc.missingSince[host]
+		if !ok {
+			utils.WriteLog("节点 ", host, " 已经不在集群中了, 过了 ", nc.gracePeriod.String(), " 还没回来的话就回收它的网段")
+			nc.missingSince[host] = now
+			continue
+		}
+		if now.Sub(since) < nc.gracePeriod {
+			continue
+		}
+
+		err = nc.ipam.Release().Node(host)
+		if err != nil {
+			return reclaimed, err
+		}
+		err = forgetNode(nc.ipam.Datastore, host)
+		if err != nil {
+			return reclaimed, err
+		}
+		delete(nc.missingSince, host)
+		reclaimed = append(reclaimed, host)
+	}
+
+	// 已经被别人回收掉了的就不用再记着了
+	for host := range nc.missingSince {
+		if !allocated[host] {
+			delete(nc.missingSince, host)
+		}
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"testcni/cni"
+	"testcni/etcd"
+	"testcni/ipam"
+	"text/tabwriter"
+)
+
+// 解析 testcni nodes 后边跟着的参数, 列出集群里所有跑过 agent 的节点的心跳情况
+func NodesMain(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("nodes", flag.ContinueOnError)
+	confPath := fs.String("conf", DEFAULT_CNI_CONF_DIR, "cni config file or directory")
+	output := fs.String("o", "", "output format, json or empty for a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	conf, err := LoadPluginConf(*confPath)
+	if err != nil {
+		return err
+	}
+	// 只是读数据, 不用初始化 ipam, 不然会给当前主机占一个网段
+	store, err := ipam.OpenDatastore(&ipam.IPAMOptions{
+		DatastoreType: cni.GetDatastoreType(conf),
+		DatastorePath: cni.GetDatastorePath(conf),
+		EtcdConfig:    etcd.ConfigFromCNI(cni.GetEtcdConf(conf)),
+	})
+	if err != nil {
+		return err
+	}
+	nodes, err := ListNodeHealth(store)
+	if err != nil {
+		return err
+	}
+	return printNodeHealth(out, nodes, *output)
+}
+
+func printNodeHealth(out io.Writer, nodes []NodeHealth, format string) error {
+	switch format {
+	case "json":
+		content, err := json.MarshalIndent(nodes, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(content))
+		return err
+	case "":
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOSTNAME\tSTATUS\tSINCE\tREGISTERED")
+	for _, node := range nodes {
+		status, since := "Alive", node.Since
+		if !node.Alive {
+			status, since = "Stale", "-"
+		}
+		registered := node.Registered
+		if registered == "" {
+			registered = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", node.Hostname, status, since, registered)
+	}
+	return w.Flush()
+}
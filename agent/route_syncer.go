@@ -0,0 +1,323 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testcni/consts"
+	"testcni/ipam"
+	"testcni/nettools"
+	"testcni/plugins/ipip/bird"
+	bpfmap "testcni/plugins/vxlan/map"
+	"testcni/utils"
+
+	"github.com/vishvananda/netlink"
+)
+
+/**
+ * 把本机上指向已经不在的网段的东西删掉
+ * host-gw 模式是主机网卡上的路由, ipip 模式是 bird 的配置和 tunl0 上的路由, vxlan 模式是 ding_ip 这个 ebpf map
+ * ipvlan 和 macvlan 模式下不用管
+ */
+type RouteSyncer struct {
+	ipam *ipam.IpamService
+	mode string
+	// 心跳断了的节点, 这些节点也当成不在了, 为 nil 的话不看心跳
+	staleNodes func() (map[string]bool, error)
+	// 上一次心跳断了的节点, 有变化的时候打日志
+	lastStale map[string]bool
+	// ipip 模式下生成 bird 的配置用的所有池子的 ipv4 的 ipam, 第一个是默认的池子, 为空的话只用 ipam
+	birdServices []*ipam.IpamService
+}
+
+func NewRouteSyncer(is *ipam.IpamService, mode string, staleNodes func() (map[string]bool, error)) *RouteSyncer {
+	return &RouteSyncer{
+		ipam:       is,
+		mode:       mode,
+		staleNodes: staleNodes,
+		lastStale:  map[string]bool{},
+	}
+}
+
+func (rs *RouteSyncer) stale() (map[string]bool, error) {
+	if rs.staleNodes == nil {
+		return map[string]bool{}, nil
+	}
+	stale, err := rs.staleNodes()
+	if err != nil {
+		return nil, err
+	}
+	for host := range stale {
+		if !rs.lastStale[host] {
+			utils.WriteLog("节点 ", host, " 的心跳断了, 删掉本机上指向它的路由")
+		}
+	}
+	for host := range rs.lastStale {
+		if !stale[host] {
+			utils.WriteLog("节点 ", host, " 的心跳恢复了, 把指向它的路由加回来")
+		}
+	}
+	rs.lastStale = stale
+	return stale, nil
+}
+
+func (rs *RouteSyncer) Sync() error {
+	switch rs.mode {
+	case consts.MODE_HOST_GW:
+		linkName, err := rs.addHostRoutes()
+		if err != nil {
+			return err
+		}
+		return rs.syncRoutes(linkName)
+	case consts.MODE_IPIP:
+		// ipv6 的网段不走 tunl0, 和 host-gw 一样是主机网卡上的路由
+		if rs.ipam.IsIPv6() {
+			linkName, err := rs.addHostRoutes()
+			if err != nil {
+				return err
+			}
+			return rs.syncRoutes(linkName)
+		}
+		err := rs.syncBird()
+		if err != nil {
+			return err
+		}
+		return rs.syncRoutes("tunl0")
+	case consts.MODE_VXLAN:
+		return rs.syncPodMap()
+	}
+	return nil
+}
+
+/**
+ * 把其他主机(心跳断了的不算)占着的网段的路由补到本机网卡上, 返回本机网卡的名字
+ * 具名的 ip 池是用到的时候才占网段的, 其他节点新占的网段的路由也得在这儿补上
+ */
+func (rs *RouteSyncer) addHostRoutes() (string, error) {
+	hostNetwork, err := rs.ipam.Get().HostNetwork()
+	if err != nil {
+		return "", err
+	}
+	networks, err := rs.ipam.Get().AllHostNetwork()
+	if err != nil {
+		return "", err
+	}
+	stale, err := rs.stale()
+	if err != nil {
+		return "", err
+	}
+	alive := []*ipam.Network{}
+	for _, network := range networks {
+		if !stale[network.Hostname] {
+			alive = append(alive, network)
+		}
+	}
+	err = nettools.SetOtherHostRouteToCurrentHost(alive, hostNetwork)
+	if err != nil {
+		return "", err
+	}
+	return hostNetwork.Name, nil
+}
+
+// 其他主机现在占着的网段, 形如 10.244.1.0/24, 心跳断了的主机的不算
+func (rs *RouteSyncer) otherHostCIDRs() (map[string]bool, error) {
+	maps, err := rs.ipam.Get().HostSubnetMap()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	stale, err := rs.stale()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]bool{}
+	for network, owner := range maps {
+		if owner == hostname || stale[owner] {
+			continue
+		}
+		_, block, err := net.ParseCIDR(network + "/" + rs.ipam.BlockMaskSegment)
+		if err != nil {
+			continue
+		}
+		res[block.String()] = true
+	}
+	return res, nil
+}
+
+/**
+ * 删掉设备上那些目的地是集群里的某个网段, 但是这个网段已经不被其他主机占着了的路由
+ * 只看带网关的并且掩码和 block 一样的, 本机 pod 的路由和别人加的路由都不会动
+ */
+func (rs *RouteSyncer) syncRoutes(linkName string) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		if nettools.IsLinkNotFoundErr(err) {
+			return nil
+		}
+		return err
+	}
+	_, subnet, err := net.ParseCIDR(rs.ipam.Subnet + "/" + rs.ipam.MaskSegment)
+	if err != nil {
+		return err
+	}
+	blockMask, err := strconv.Atoi(rs.ipam.BlockMaskSegment)
+	if err != nil {
+		return err
+	}
+	cidrs, err := rs.otherHostCIDRs()
+	if err != nil {
+		return err
+	}
+
+	family := netlink.FAMILY_V4
+	if rs.ipam.IsIPv6() {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(link, family)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.Gw == nil {
+			continue
+		}
+		ones, _ := route.Dst.Mask.Size()
+		if ones != blockMask || !subnet.Contains(route.Dst.IP) || cidrs[route.Dst.String()] {
+			continue
+		}
+		err = nettools.DelRoute(route.Dst, link)
+		if err != nil {
+			return err
+		}
+		utils.WriteLog("网段 ", route.Dst.String(), " 已经不被其他节点占着了, 删掉 ", linkName, " 上指向它的路由")
+	}
+	return nil
+}
+
+/**
+ * 节点被删掉之后 bird 的邻居里也得把它去掉, bird 在跑的话让它重新加载配置
+ * 每个池子的 RouteSyncer 生成的都是同一份带着所有池子的网段的配置, 第二次开始就不会有变化了
+ */
+func (rs *RouteSyncer) syncBird() error {
+	if !utils.FileIsExisted(consts.KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH) {
+		// 还没有 pod 在本机上起来过, bird 也还没配置
+		return nil
+	}
+	services := rs.birdServices
+	if len(services) == 0 {
+		services = []*ipam.IpamService{rs.ipam}
+	}
+	changed, err := bird.UpdateConfigFile(services[0], services[1:]...)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	pid, err := bird.GetRunningBirdPid()
+	if err != nil {
+		return err
+	}
+	if pid <= 0 {
+		return nil
+	}
+	utils.WriteLog("bird 的配置变了, 重新加载")
+	return bird.ReloadBirdDaemon()
+}
+
+/**
+ * ding_ip 里的 pod ip 正常情况下会被 watcher 在监听到 ip 被删掉的时候删掉
+ * watcher 那会儿没在跑的话就会漏掉, 这里把不在其他主机的记录里的 pod ip 都删掉
+ * 心跳断了的主机上的 pod ip 也删掉, 心跳恢复了之后 watcher 不会再收到这些 ip 的变化, 所以缺了的在这里补上
+ */
+func (rs *RouteSyncer) syncPodMap() error {
+	if !utils.PathExists(bpfmap.POD_MAP_DEFAULT_PATH) {
+		return nil
+	}
+	mm, err := bpfmap.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	keys, err := mm.AllPodMapKeys()
+	if err != nil {
+		return err
+	}
+
+	maps, err := rs.ipam.Get().HostSubnetMap()
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	stale, err := rs.stale()
+	if err != nil {
+		return err
+	}
+	// map[pod ip]pod 所在的主机
+	used := map[uint32]string{}
+	for network, owner := range maps {
+		if owner == hostname || stale[owner] {
+			continue
+		}
+		ips, err := rs.ipam.Get().IPsOfNetwork(network)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			used[utils.InetIpToUInt32(ip)] = owner
+		}
+	}
+
+	existing := map[uint32]bool{}
+	staleKeys := []bpfmap.PodNodeMapKey{}
+	for _, key := range keys {
+		existing[key.IP] = true
+		if _, ok := used[key.IP]; !ok {
+			staleKeys = append(staleKeys, key)
+		}
+	}
+	if len(staleKeys) > 0 {
+		n, err := mm.BatchDelPodMap(staleKeys)
+		if err != nil {
+			return err
+		}
+		utils.WriteLog("从 ding_ip 中删掉了已经不在的 pod ip, 数量: ", strconv.Itoa(n))
+	}
+	if rs.staleNodes == nil {
+		return nil
+	}
+
+	nodeIPs := map[string]uint32{}
+	missingKeys := []bpfmap.PodNodeMapKey{}
+	missingValues := []bpfmap.PodNodeMapValue{}
+	for ip, owner := range used {
+		if existing[ip] {
+			continue
+		}
+		nodeIP, ok := nodeIPs[owner]
+		if !ok {
+			_nodeIP, err := rs.ipam.Get().NodeIp(owner)
+			if err != nil {
+				return err
+			}
+			nodeIP = utils.InetIpToUInt32(_nodeIP)
+			nodeIPs[owner] = nodeIP
+		}
+		missingKeys = append(missingKeys, bpfmap.PodNodeMapKey{IP: ip})
+		missingValues = append(missingValues, bpfmap.PodNodeMapValue{IP: nodeIP})
+	}
+	if len(missingKeys) == 0 {
+		return nil
+	}
+	n, err := mm.BatchSetPodMap(missingKeys, missingValues)
+	if err != nil {
+		return err
+	}
+	utils.WriteLog("往 ding_ip 中补上了缺的 pod ip, 数量: ", strconv.Itoa(n))
+	return nil
+}
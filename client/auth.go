@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// token 文件隔多久重新读一次
+var tokenFileRefreshInterval = time.Minute
+
+/**
+ * 按 config 建连 apiserver 用的 http.RoundTripper
+ * 客户端证书放在 tls 里, token, 用户名密码这些放在每个请求的 Authorization 头里
+ */
+func transportFor(config *Config) (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+	if len(config.CAData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(config.CAData) {
+			return nil, errors.New("failed to parse the certificate authority of the apiserver")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	var execAuth *execAuthenticator
+	if config.Exec != nil {
+		execAuth = &execAuthenticator{config: config.Exec}
+	}
+	if len(config.CertData) > 0 || len(config.KeyData) > 0 {
+		cert, err := tls.X509KeyPair(config.CertData, config.KeyData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if execAuth != nil {
+		// 证书可能是 exec 插件给的, 每次握手的时候再去拿
+		tlsConfig.GetClientCertificate = execAuth.clientCertificate
+	}
+
+	var base http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if config.BearerToken == "" && config.BearerTokenFile == "" && config.Username == "" && execAuth == nil {
+		return base, nil
+	}
+	return &authTransport{
+		base:      base,
+		token:     config.BearerToken,
+		tokenFile: config.BearerTokenFile,
+		username:  config.Username,
+		password:  config.Password,
+		exec:      execAuth,
+	}, nil
+}
+
+// 给每个请求加上 Authorization 头
+type authTransport struct {
+	base               http.RoundTripper
+	token              string
+	tokenFile          string
+	username, password string
+	exec               *execAuthenticator
+
+	lock sync.Mutex
+	// 从 tokenFile 里读到的 token 和读的时间
+	fileToken string
+	readAt    time.Time
+}
+
+func (t *authTransport) readTokenFile() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.fileToken != "" && time.Since(t.readAt) < tokenFileRefreshInterval {
+		return t.fileToken, nil
+	}
+	content, err := ioutil.ReadFile(t.tokenFile)
+	if err != nil {
+		// 读不到新的就先用老的
+		if t.fileToken != "" {
+			return t.fileToken, nil
+		}
+		return "", err
+	}
+	t.fileToken = strings.TrimSpace(string(content))
+	t.readAt = time.Now()
+	return t.fileToken, nil
+}
+
+// exec 插件给的 token 优先, 然后是 token, token 文件, 最后是用户名密码
+func (t *authTransport) authorization() (string, error) {
+	if t.exec != nil {
+		cred, err := t.exec.get()
+		if err != nil {
+			return "", err
+		}
+		if cred.Token != "" {
+			return "Bearer " + cred.Token, nil
+		}
+	}
+	if t.token != "" {
+		return "Bearer " + t.token, nil
+	}
+	if t.tokenFile != "" {
+		token, err := t.readTokenFile()
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", nil
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+	auth, err := t.authorization()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	} else if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && t.exec != nil {
+		// 凭证可能被提前吊销了, 下次请求重新执行一遍插件
+		t.exec.reset()
+	}
+	return resp, err
+}
+
+/**
+ * 执行 kubeconfig 里 exec 配的命令拿凭证, 和 kubectl 的 client-go credential plugin 是一个协议
+ * 命令往标准输出打一个 ExecCredential, 里边有 token 或者客户端证书, 带过期时间的话过期之前一直用这一个
+ */
+type execAuthenticator struct {
+	config *ExecConfig
+
+	lock sync.Mutex
+	cred *execCredentialStatus
+}
+
+type execCredentialStatus struct {
+	Token                 string     `json:"token"`
+	ClientCertificateData string     `json:"clientCertificateData"`
+	ClientKeyData         string     `json:"clientKeyData"`
+	ExpirationTimestamp   *time.Time `json:"expirationTimestamp"`
+}
+
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+func (e *execAuthenticator) reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.cred = nil
+}
+
+func (e *execAuthenticator) get() (*execCredentialStatus, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.cred != nil && (e.cred.ExpirationTimestamp == nil || time.Now().Before(*e.cred.ExpirationTimestamp)) {
+		return e.cred, nil
+	}
+	cred, err := e.run()
+	if err != nil {
+		return nil, err
+	}
+	e.cred = cred
+	return cred, nil
+}
+
+func (e *execAuthenticator) run() (*execCredentialStatus, error) {
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": e.config.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(e.config.Command, e.config.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, env := range e.config.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exec plugin %s failed: %v: %s", e.config.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	cred := &execCredential{}
+	err = json.Unmarshal(out, cred)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the output of exec plugin %s: %v", e.config.Command, err)
+	}
+	if e.config.APIVersion != "" && cred.APIVersion != e.config.APIVersion {
+		return nil, fmt.Errorf("exec plugin %s returned apiVersion %q, expected %q", e.config.Command, cred.APIVersion, e.config.APIVersion)
+	}
+	if cred.Status == nil || (cred.Status.Token == "" && cred.Status.ClientCertificateData == "") {
+		return nil, fmt.Errorf("exec plugin %s returned no credentials", e.config.Command)
+	}
+	return cred.Status, nil
+}
+
+// tls 握手的时候用 exec 插件给的证书, 插件只给了 token 的话不带证书
+func (e *execAuthenticator) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cred, err := e.get()
+	if err != nil {
+		return nil, err
+	}
+	if cred.ClientCertificateData == "" {
+		return &tls.Certificate{}, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(cred.ClientCertificateData), []byte(cred.ClientKeyData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the client certificate from exec plugin %s: %v", e.config.Command, err)
+	}
+	return &cert, nil
+}
@@ -1,159 +1,220 @@
 package client
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testcni/consts"
-	"testcni/helper"
+	"testcni/utils"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type Get struct {
-	httpsClient *http.Client
-	client      *LightK8sClient
+	client *LightK8sClient
 }
 
-type operators struct {
-	Get *Get
+type LightK8sClient struct {
+	client         *http.Client
+	masterEndpoint string
+	kubeApi        string
 }
 
-type operator struct {
-	*operators
+// 直接用现成的 http 客户端连 apiserver, 比如测试里用 httptest 起一个假的 apiserver
+func NewLightK8sClient(masterEndpoint string, httpClient *http.Client) *LightK8sClient {
+	return &LightK8sClient{
+		client:         httpClient,
+		kubeApi:        consts.KUBE_API,
+		masterEndpoint: masterEndpoint,
+	}
 }
 
-type LightK8sClient struct {
-	caCertPath, certFile, keyFile string
-	pool                          *x509.CertPool
-	client                        *http.Client
-	masterEndpoint                string
-	kubeApi                       string
-	*operator
-}
-
-var getGet = func() func() *Get {
-	var _get *Get
-	return func() *Get {
-		if _get != nil {
-			return _get
-		}
-		_get = &Get{}
-		client, _ := GetLightK8sClient()
-		if client != nil {
-			_get.httpsClient = client.client
-		}
-		_get.client = client
-		return _get
-	}
-}()
+const (
+	// 分页读的时候每页多少个
+	listPageSize = 500
+)
 
 func (get *Get) getRoute(api string) string {
-	return get.client.masterEndpoint + get.client.kubeApi + api
+	return get.client.route(api)
 }
 
-func (o *operator) Get() *Get {
-	return getGet()
+func (c *LightK8sClient) route(api string) string {
+	return c.masterEndpoint + c.kubeApi + api
 }
 
-func (get *Get) getBody(resp *http.Response) ([]byte, error) {
-	defer resp.Body.Close()
+func (c *LightK8sClient) Get() *Get {
+	return &Get{client: c}
+}
 
+// GET 一个对象, 返回的不是 2xx 的话返回 StatusError
+func (c *LightK8sClient) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return body, nil
+	if err = checkStatus(http.MethodGet, url, resp.StatusCode, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// 各种 List 共有的部分, items 先不解析, 翻完页之后一起解析
+type rawList struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   metav1.ListMeta   `json:"metadata"`
+	Items      []json.RawMessage `json:"items"`
+}
+
+/**
+ * 按 continue 一页一页地读完, 拼成一个 List 解析到 out 里, out 是对应的 List 结构体
+ * 读到一半 continue 过期了的话(中间隔得太久, 数据被压缩掉了)不分页从头读一遍
+ */
+func (c *LightK8sClient) list(ctx context.Context, url string, query neturl.Values, out interface{}) error {
+	all := &rawList{}
+	paginate := true
+	continueToken := ""
+	for {
+		q := neturl.Values{}
+		for key, values := range query {
+			q[key] = values
+		}
+		if paginate {
+			q.Set("limit", strconv.Itoa(listPageSize))
+		}
+		if continueToken != "" {
+			q.Set("continue", continueToken)
+		}
+		page := &rawList{}
+		err := c.getJSON(ctx, url+"?"+q.Encode(), page)
+		if err != nil && continueToken != "" && IsExpired(err) {
+			utils.WriteLog("分页读 ", url, " 的时候 continue 过期了, 不分页重新读一遍")
+			all.Items, paginate, continueToken = nil, false, ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		all.APIVersion, all.Kind = page.APIVersion, page.Kind
+		all.Items = append(all.Items, page.Items...)
+		// 每一页的 resourceVersion 都是第一页的那个
+		all.Metadata.ResourceVersion = page.Metadata.ResourceVersion
+		continueToken = page.Metadata.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+	if all.Items == nil {
+		all.Items = []json.RawMessage{}
+	}
+	content, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, out)
 }
 
 func (get *Get) Nodes() (*v1.NodeList, error) {
-	url := get.getRoute("/nodes?limit=500")
-	resp, err := get.httpsClient.Get(url)
+	nodes := &v1.NodeList{}
+	err := get.client.list(context.Background(), get.getRoute("/nodes"), nil, nodes)
 	if err != nil {
 		return nil, err
 	}
-	body, err := get.getBody(resp)
+	return nodes, nil
+}
+
+// 节点不存在的话返回的错误 IsNotFound
+func (get *Get) Node(name string) (*v1.Node, error) {
+	node := &v1.Node{}
+	err := get.client.getJSON(context.Background(), get.getRoute(fmt.Sprintf("/nodes/%s", name)), node)
 	if err != nil {
 		return nil, err
 	}
-	var nodes *v1.NodeList
-	err = json.Unmarshal(body, &nodes)
+	return node, nil
+}
+
+func (get *Get) Pod(namespace, name string) (*v1.Pod, error) {
+	pod := &v1.Pod{}
+	err := get.client.getJSON(context.Background(), get.getRoute(fmt.Sprintf("/namespaces/%s/pods/%s", namespace, name)), pod)
 	if err != nil {
 		return nil, err
 	}
-	return nodes, nil
+	return pod, nil
 }
 
-func (get *Get) Node(name string) (*v1.Node, error) {
-	url := get.getRoute(fmt.Sprintf("/nodes/%s", name))
-	resp, err := get.httpsClient.Get(url)
+func podsOnNodeQuery(nodeName string) neturl.Values {
+	return neturl.Values{"fieldSelector": []string{"spec.nodeName=" + nodeName}}
+}
+
+// 某个节点上的所有 pod, 读失败的时候一定要报错, 不然调用方会以为节点上一个 pod 都没有
+func (get *Get) PodsOnNode(nodeName string) (*v1.PodList, error) {
+	pods := &v1.PodList{}
+	err := get.client.list(context.Background(), get.getRoute("/pods"), podsOnNodeQuery(nodeName), pods)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to list pods on node %s: %v", nodeName, err)
 	}
-	body, err := get.getBody(resp)
+	return pods, nil
+}
+
+func (get *Get) Namespace(name string) (*v1.Namespace, error) {
+	namespace := &v1.Namespace{}
+	err := get.client.getJSON(context.Background(), get.getRoute(fmt.Sprintf("/namespaces/%s", name)), namespace)
 	if err != nil {
 		return nil, err
 	}
-	var node *v1.Node
-	err = json.Unmarshal(body, &node)
+	return namespace, nil
+}
+
+// 按 config 建客户端, config 可以用 LoadKubeconfig, InClusterConfig 或者 LoadConfig 拿到
+func NewLightK8sClientFromConfig(config *Config) (*LightK8sClient, error) {
+	if config == nil || config.Host == "" {
+		return nil, errors.New("the apiserver address is empty")
+	}
+	transport, err := transportFor(config)
 	if err != nil {
 		return nil, err
 	}
-	return node, nil
+	return NewLightK8sClient(strings.TrimSuffix(config.Host, "/"), &http.Client{Transport: transport}), nil
 }
 
 var __GetLightK8sClient func() (*LightK8sClient, error)
 
-func _GetLightK8sClient(caCertPath, certFile, keyFile string) func() (*LightK8sClient, error) {
+func _GetLightK8sClient() func() (*LightK8sClient, error) {
+	var client *LightK8sClient
+	var lock sync.Mutex
 	return func() (*LightK8sClient, error) {
-		var client *LightK8sClient
+		lock.Lock()
+		defer lock.Unlock()
 		if client != nil {
 			return client, nil
-		} else {
-			// 读取 k8s 的证书
-			caCrt, err := ioutil.ReadFile(caCertPath)
-			if err != nil {
-				return nil, err
-			}
-			// new 个 pool
-			pool := x509.NewCertPool()
-			// 解析一系列PEM编码的证书, 从 base64 中解析证书到池子中
-			pool.AppendCertsFromPEM(caCrt)
-			// 加载客户端的证书和私钥
-			cliCrt, err := tls.LoadX509KeyPair(certFile, keyFile)
-			if err != nil {
-				return nil, err
-			}
-			// 创建一个 https 客户端
-			_client := &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						RootCAs:      pool,
-						Certificates: []tls.Certificate{cliCrt},
-					},
-				},
-			}
-
-			masterEndpoint, err := helper.GetMasterEndpoint()
-			if err != nil {
-				return nil, err
-			}
-			client = &LightK8sClient{
-				caCertPath:     caCertPath,
-				certFile:       certFile,
-				keyFile:        keyFile,
-				pool:           pool,
-				client:         _client,
-				kubeApi:        consts.KUBE_API,
-				masterEndpoint: masterEndpoint,
-			}
-
-			return client, nil
 		}
+		config, err := LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err = NewLightK8sClientFromConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
 	}
 }
 
@@ -169,8 +230,9 @@ func GetLightK8sClient() (*LightK8sClient, error) {
 	return lightK8sClient, nil
 }
 
-func Init(caCertPath, certFile, keyFile string) {
+// 配置的查找顺序见 LoadConfig
+func Init() {
 	if __GetLightK8sClient == nil {
-		__GetLightK8sClient = _GetLightK8sClient(caCertPath, certFile, keyFile)
+		__GetLightK8sClient = _GetLightK8sClient()
 	}
 }
@@ -1,18 +1,19 @@
 package client
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"testcni/helper"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestClient(t *testing.T) {
 	test := assert.New(t)
-	paths, err := helper.GetHostAuthenticationInfoPath()
-	test.Nil(err)
-	Init(paths.CaPath, paths.CertPath, paths.KeyPath)
+	Init()
 	client, err := GetLightK8sClient()
 	test.Nil(err)
 	nodes, err := client.Get().Nodes()
@@ -26,3 +27,46 @@ func TestClient(t *testing.T) {
 	test.NotNil(node)
 	test.Equal(node.ObjectMeta.Name, hostname)
 }
+
+func TestListPagination(t *testing.T) {
+	test := assert.New(t)
+	fake, client := newFakeApiserver(t, "node-1", "node-2", "node-3")
+	fake.set(func() { fake.pageSize = 2 })
+	nodes, err := client.Get().Nodes()
+	test.Nil(err)
+	test.Len(nodes.Items, 3)
+	test.Equal("3", nodes.ResourceVersion)
+	test.Empty(nodes.Continue)
+
+	// continue 过期了的话不分页从头读一遍
+	fake.set(func() { fake.expireContinue = true })
+	nodes, err = client.Get().Nodes()
+	test.Nil(err)
+	test.Len(nodes.Items, 3)
+}
+
+func TestStatusError(t *testing.T) {
+	test := assert.New(t)
+	_, client := newFakeApiserver(t)
+	_, err := client.Get().Node("node-1")
+	test.True(IsNotFound(err))
+	test.Contains(err.Error(), "NotFound by the fake apiserver")
+
+	// 回的不是 Status 的话按状态码来
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/nodes") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("forbidden by proxy"))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client = NewLightK8sClient(server.URL, server.Client())
+	_, err = client.Get().Nodes()
+	test.True(IsForbidden(err))
+	test.Contains(err.Error(), "forbidden by proxy")
+	_, err = client.Get().Pod("default", "busybox")
+	test.Equal(metav1.StatusReasonInternalError, ReasonForError(err))
+	test.False(IsNotFound(err))
+}
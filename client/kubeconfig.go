@@ -0,0 +1,258 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testcni/consts"
+	"testcni/utils"
+
+	"sigs.k8s.io/yaml"
+)
+
+/**
+ * 连 apiserver 要用的地址和凭证
+ * 可以从 kubeconfig 里读(按 current-context 挑 cluster 和 user), 也可以是 pod 里挂进来的 ServiceAccount
+ * 证书和私钥都直接读到内存里, 不再拷一份到 /opt/testcni 下
+ */
+type Config struct {
+	// 比如 https://192.168.64.19:6443
+	Host string
+	// apiserver 的 ca, 空的话用系统的
+	CAData   []byte
+	Insecure bool
+	// 客户端证书
+	CertData []byte
+	KeyData  []byte
+	// 和 BearerTokenFile 二选一, 都配了的话用 BearerToken
+	BearerToken string
+	// 每隔一会儿重新读一次, ServiceAccount 的 token 会定期轮换
+	BearerTokenFile string
+	Username        string
+	Password        string
+	// 通过执行外部命令拿凭证, 比如云厂商的 kubectl 插件
+	Exec *ExecConfig
+}
+
+type ExecEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type ExecConfig struct {
+	Command    string    `json:"command"`
+	Args       []string  `json:"args"`
+	Env        []ExecEnv `json:"env"`
+	APIVersion string    `json:"apiVersion"`
+}
+
+/**
+ * kubeconfig 里用得到的字段, 格式和 kubectl config view 看到的一样
+ * xxx-data 都是 base64 编码的, 解析成 []byte 的时候 json 会自动解码
+ */
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string      `json:"name"`
+		Cluster kubeCluster `json:"cluster"`
+	} `json:"clusters"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Users []struct {
+		Name string   `json:"name"`
+		User kubeUser `json:"user"`
+	} `json:"users"`
+}
+
+type kubeCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	ClientCertificate     string      `json:"client-certificate"`
+	ClientCertificateData []byte      `json:"client-certificate-data"`
+	ClientKey             string      `json:"client-key"`
+	ClientKeyData         []byte      `json:"client-key-data"`
+	Token                 string      `json:"token"`
+	TokenFile             string      `json:"tokenFile"`
+	Username              string      `json:"username"`
+	Password              string      `json:"password"`
+	Exec                  *ExecConfig `json:"exec"`
+	AuthProvider          interface{} `json:"auth-provider"`
+}
+
+// kubeconfig 里的相对路径是相对于 kubeconfig 所在的目录的
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// data 是空的话从 file 里读
+func dataOrFile(data []byte, file string) ([]byte, error) {
+	if len(data) > 0 || file == "" {
+		return data, nil
+	}
+	return ioutil.ReadFile(file)
+}
+
+/**
+ * 解析 kubeconfig, contextName 是空的话用 current-context
+ * 没配 current-context 并且只有一个 context 的话就用那一个
+ */
+func LoadKubeconfig(path, contextName string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kc := &kubeconfig{}
+	err = yaml.Unmarshal(content, kc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %v", path, err)
+	}
+
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	if contextName == "" && len(kc.Contexts) == 1 {
+		contextName = kc.Contexts[0].Name
+	}
+	if contextName == "" {
+		return nil, fmt.Errorf("no current-context in kubeconfig %s", path)
+	}
+	clusterName, userName, found := "", "", false
+	for _, ctx := range kc.Contexts {
+		if ctx.Name == contextName {
+			clusterName, userName, found = ctx.Context.Cluster, ctx.Context.User, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", contextName, path)
+	}
+	var cluster *kubeCluster
+	for i := range kc.Clusters {
+		if kc.Clusters[i].Name == clusterName {
+			cluster = &kc.Clusters[i].Cluster
+			break
+		}
+	}
+	if cluster == nil || cluster.Server == "" {
+		return nil, fmt.Errorf("cluster %q of context %q not found in kubeconfig %s", clusterName, contextName, path)
+	}
+	user := &kubeUser{}
+	for i := range kc.Users {
+		if kc.Users[i].Name == userName {
+			user = &kc.Users[i].User
+			break
+		}
+	}
+	if user.AuthProvider != nil {
+		return nil, fmt.Errorf("auth-provider of user %q is not supported, use exec instead", userName)
+	}
+
+	dir := filepath.Dir(path)
+	config := &Config{
+		Host:            cluster.Server,
+		Insecure:        cluster.InsecureSkipTLSVerify,
+		BearerToken:     user.Token,
+		BearerTokenFile: resolvePath(dir, user.TokenFile),
+		Username:        user.Username,
+		Password:        user.Password,
+		Exec:            user.Exec,
+	}
+	config.CAData, err = dataOrFile(cluster.CertificateAuthorityData, resolvePath(dir, cluster.CertificateAuthority))
+	if err != nil {
+		return nil, err
+	}
+	config.CertData, err = dataOrFile(user.ClientCertificateData, resolvePath(dir, user.ClientCertificate))
+	if err != nil {
+		return nil, err
+	}
+	config.KeyData, err = dataOrFile(user.ClientKeyData, resolvePath(dir, user.ClientKey))
+	if err != nil {
+		return nil, err
+	}
+	// 和 kubectl 一样, 带目录的相对路径的命令按 kubeconfig 所在的目录来找
+	if config.Exec != nil && filepath.Base(config.Exec.Command) != config.Exec.Command {
+		exec := *config.Exec
+		exec.Command = resolvePath(dir, exec.Command)
+		config.Exec = &exec
+	}
+	return config, nil
+}
+
+// 以 DaemonSet 跑在集群里的时候, 用挂进 pod 里的 ServiceAccount 的 token 和 ca
+func InClusterConfig() (*Config, error) {
+	return inClusterConfig(consts.KUBE_SERVICE_ACCOUNT_PATH)
+}
+
+func inClusterConfig(saDir string) (*Config, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is empty")
+	}
+	tokenFile := filepath.Join(saDir, "token")
+	if !utils.PathExists(tokenFile) {
+		return nil, fmt.Errorf("service account token %s not found", tokenFile)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(saDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		CAData:          ca,
+		BearerTokenFile: tokenFile,
+	}, nil
+}
+
+/**
+ * 按顺序找 kubeconfig: KUBECONFIG 环境变量, admin.conf, kubelet.conf, ~/.kube/config
+ * 都没有的话返回空字符串
+ */
+func DefaultKubeconfigPath() string {
+	paths := []string{}
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		paths = append(paths, filepath.SplitList(env)[0])
+	}
+	paths = append(paths, consts.KUBE_CONF_ADMIN_DEFAULT_PATH, consts.KUBELET_CONFIG_DEFAULT_PATH)
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, consts.KUBE_LOCAL_DEFAULT_PATH))
+	}
+	for _, path := range paths {
+		if utils.PathExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+/**
+ * 拿到连 apiserver 的配置
+ * 配了 KUBECONFIG 的话用它, 不然跑在 pod 里的话用 ServiceAccount, 再不然按顺序找 admin.conf, kubelet.conf 和 ~/.kube/config
+ */
+func LoadConfig() (*Config, error) {
+	if os.Getenv("KUBECONFIG") == "" {
+		if config, err := InClusterConfig(); err == nil {
+			return config, nil
+		}
+	}
+	path := DefaultKubeconfigPath()
+	if path == "" {
+		return nil, errors.New("no kubeconfig or service account found")
+	}
+	return LoadKubeconfig(path, "")
+}
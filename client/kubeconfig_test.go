@@ -0,0 +1,221 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testcni/consts"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+// 起一个 https 的假 apiserver, 只会回 nodes/<name>, 请求的 Authorization 头不在 allowed 里的话回 401
+func startAuthApiserver(t *testing.T, allowed ...string) (*httptest.Server, []byte) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		ok := false
+		for _, a := range allowed {
+			ok = ok || auth == a
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"kind":"Status","code":401,"reason":"Unauthorized"}`))
+			return
+		}
+		node := v1.Node{}
+		node.Name = strings.TrimPrefix(r.URL.Path, consts.KUBE_API+"/nodes/")
+		json.NewEncoder(w).Encode(node)
+	}))
+	t.Cleanup(server.Close)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return server, ca
+}
+
+func writeFile(t *testing.T, path, content string, perm os.FileMode) {
+	err := ioutil.WriteFile(path, []byte(content), perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	test := assert.New(t)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ca.crt"), "ca from file", 0600)
+	path := filepath.Join(dir, "config")
+	writeFile(t, path, fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: dev
+  cluster:
+    server: https://10.0.0.1:6443
+    insecure-skip-tls-verify: true
+- name: prod
+  cluster:
+    server: https://10.0.0.2:6443
+    certificate-authority: ca.crt
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+users:
+- name: dev
+  user:
+    username: admin
+    password: secret
+- name: prod
+  user:
+    client-certificate-data: %s
+    client-key-data: %s
+    tokenFile: token
+`, base64.StdEncoding.EncodeToString([]byte("cert")), base64.StdEncoding.EncodeToString([]byte("key"))), 0600)
+
+	// 不是第一个 cluster, 而是 current-context 指向的那个
+	config, err := LoadKubeconfig(path, "")
+	test.Nil(err)
+	test.Equal("https://10.0.0.2:6443", config.Host)
+	test.Equal([]byte("ca from file"), config.CAData)
+	test.Equal([]byte("cert"), config.CertData)
+	test.Equal([]byte("key"), config.KeyData)
+	test.Equal(filepath.Join(dir, "token"), config.BearerTokenFile)
+	test.False(config.Insecure)
+
+	config, err = LoadKubeconfig(path, "dev")
+	test.Nil(err)
+	test.Equal("https://10.0.0.1:6443", config.Host)
+	test.True(config.Insecure)
+	test.Equal("admin", config.Username)
+	test.Equal("secret", config.Password)
+	test.Empty(config.CertData)
+
+	_, err = LoadKubeconfig(path, "staging")
+	test.NotNil(err)
+
+	t.Setenv("KUBECONFIG", path)
+	test.Equal(path, DefaultKubeconfigPath())
+}
+
+func TestInClusterConfig(t *testing.T) {
+	test := assert.New(t)
+	dir := t.TempDir()
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+	_, err := inClusterConfig(dir)
+	test.NotNil(err)
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "fd00::1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	_, err = inClusterConfig(dir)
+	test.NotNil(err)
+
+	writeFile(t, filepath.Join(dir, "token"), "sa-token\n", 0600)
+	writeFile(t, filepath.Join(dir, "ca.crt"), "sa ca", 0600)
+	config, err := inClusterConfig(dir)
+	test.Nil(err)
+	test.Equal("https://[fd00::1]:443", config.Host)
+	test.Equal([]byte("sa ca"), config.CAData)
+	test.Equal(filepath.Join(dir, "token"), config.BearerTokenFile)
+}
+
+func TestClientAuth(t *testing.T) {
+	test := assert.New(t)
+	server, ca := startAuthApiserver(t,
+		"Bearer static",
+		"Bearer rotated",
+		"Bearer from-exec",
+		"Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")),
+	)
+	getNode := func(config *Config) error {
+		config.Host = server.URL
+		config.CAData = ca
+		client, err := NewLightK8sClientFromConfig(config)
+		if err != nil {
+			return err
+		}
+		node, err := client.Get().Node("node-1")
+		if err != nil {
+			return err
+		}
+		if node.Name != "node-1" {
+			return fmt.Errorf("unauthorized")
+		}
+		return nil
+	}
+
+	test.Nil(getNode(&Config{BearerToken: "static"}))
+	test.Nil(getNode(&Config{Username: "admin", Password: "secret"}))
+	test.NotNil(getNode(&Config{BearerToken: "wrong"}))
+	// ca 不对的话连不上
+	_, err := NewLightK8sClientFromConfig(&Config{Host: server.URL, CAData: []byte("not a pem")})
+	test.NotNil(err)
+
+	// ServiceAccount 的 token 轮换了之后要能读到新的
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	writeFile(t, tokenFile, "static\n", 0600)
+	config := &Config{Host: server.URL, CAData: ca, BearerTokenFile: tokenFile}
+	client, err := NewLightK8sClientFromConfig(config)
+	test.Nil(err)
+	node, err := client.Get().Node("node-1")
+	test.Nil(err)
+	test.Equal("node-1", node.Name)
+	interval := tokenFileRefreshInterval
+	tokenFileRefreshInterval = 0
+	defer func() { tokenFileRefreshInterval = interval }()
+	writeFile(t, tokenFile, "rotated", 0600)
+	node, err = client.Get().Node("node-2")
+	test.Nil(err)
+	test.Equal("node-2", node.Name)
+
+	// exec 插件, 和 kubectl 一样在 kubeconfig 所在的目录下找带路径的命令
+	writeFile(t, filepath.Join(dir, "plugin.sh"), `#!/bin/sh
+echo "$KUBERNETES_EXEC_INFO" | grep -q ExecCredential || exit 1
+echo '{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"'"$PLUGIN_TOKEN"'"}}'
+`, 0700)
+	kubeconfig := filepath.Join(dir, "config")
+	writeFile(t, kubeconfig, fmt.Sprintf(`
+clusters:
+- name: c
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+contexts:
+- name: c
+  context:
+    cluster: c
+    user: u
+users:
+- name: u
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: ./plugin.sh
+      env:
+      - name: PLUGIN_TOKEN
+        value: from-exec
+`, server.URL, base64.StdEncoding.EncodeToString(ca)), 0600)
+	config, err = LoadKubeconfig(kubeconfig, "")
+	test.Nil(err)
+	test.Equal(filepath.Join(dir, "plugin.sh"), config.Exec.Command)
+	client, err = NewLightK8sClientFromConfig(config)
+	test.Nil(err)
+	node, err = client.Get().Node("node-3")
+	test.Nil(err)
+	test.Equal("node-3", node.Name)
+}
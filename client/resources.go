@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+)
+
+/**
+ * 集群级别的自定义资源(crd)的增删改查
+ * in 和 out 都是能被 json 序列化的结构体, 和 apiserver 收发的对象是一样的
+ */
+type Resources struct {
+	client *LightK8sClient
+	// 比如 /apis/testcni.io/v1
+	apiPrefix string
+}
+
+// 创建的时候已经有了, 或者更新/删除的时候 resourceVersion 对不上
+var ErrConflict = errors.New("the object has been modified or already exists")
+
+func (c *LightK8sClient) Resources(group, version string) *Resources {
+	return &Resources{client: c, apiPrefix: "/apis/" + group + "/" + version}
+}
+
+func (r *Resources) route(plural, name string) string {
+	url := r.client.masterEndpoint + r.apiPrefix + "/" + plural
+	if name != "" {
+		url += "/" + name
+	}
+	return url
+}
+
+func (r *Resources) do(method, url string, in interface{}) (int, []byte, error) {
+	body := bytes.NewReader(nil)
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return resp.StatusCode, data, ErrConflict
+	}
+	return resp.StatusCode, data, nil
+}
+
+// 对象不存在的话返回 false
+func (r *Resources) Get(plural, name string, out interface{}) (bool, error) {
+	url := r.route(plural, name)
+	status, body, err := r.do(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	if err = checkStatus(http.MethodGet, url, status, body); err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(body, out)
+}
+
+// out 是对应的 List 结构体, 对象多的话会分页读完
+func (r *Resources) List(plural, labelSelector string, out interface{}) error {
+	query := neturl.Values{}
+	if labelSelector != "" {
+		query.Set("labelSelector", labelSelector)
+	}
+	return r.client.list(context.Background(), r.route(plural, ""), query, out)
+}
+
+func (r *Resources) Create(plural string, in, out interface{}) error {
+	url := r.route(plural, "")
+	status, body, err := r.do(http.MethodPost, url, in)
+	if err != nil {
+		return err
+	}
+	if err = checkStatus(http.MethodPost, url, status, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// in 里要带着读出来时的 resourceVersion, 对不上的话返回 ErrConflict
+func (r *Resources) Update(plural, name string, in, out interface{}) error {
+	url := r.route(plural, name)
+	status, body, err := r.do(http.MethodPut, url, in)
+	if err != nil {
+		return err
+	}
+	if err = checkStatus(http.MethodPut, url, status, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// resourceVersion 不为空的话只有对象没被改过才删, 对象本来就不存在的话不报错
+func (r *Resources) Delete(plural, name, resourceVersion string) error {
+	url := r.route(plural, name)
+	var in interface{}
+	if resourceVersion != "" {
+		in = map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "DeleteOptions",
+			"preconditions": map[string]string{
+				"resourceVersion": resourceVersion,
+			},
+		}
+	}
+	status, body, err := r.do(http.MethodDelete, url, in)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return checkStatus(http.MethodDelete, url, status, body)
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+ * apiserver 返回的不是 2xx 的时候的错误
+ * apiserver 出错的时候回的是一个 metav1.Status, 里边的 reason 和 message 比状态码有用得多
+ * 比如 rbac 没配对的时候是 Forbidden: nodes is forbidden: User "system:serviceaccount:kube-system:testcni-agent" cannot list resource "nodes"
+ */
+type StatusError struct {
+	Method string
+	URL    string
+	Status metav1.Status
+}
+
+func (e *StatusError) Error() string {
+	message := e.Status.Message
+	if message == "" {
+		message = http.StatusText(int(e.Status.Code))
+	}
+	return fmt.Sprintf("%s %s failed: %s: %s (%d)", e.Method, e.URL, e.Status.Reason, message, e.Status.Code)
+}
+
+// 回的不是 Status 的时候(比如前面挡了个代理)按状态码猜一个 reason
+func reasonForCode(code int) metav1.StatusReason {
+	switch code {
+	case http.StatusUnauthorized:
+		return metav1.StatusReasonUnauthorized
+	case http.StatusForbidden:
+		return metav1.StatusReasonForbidden
+	case http.StatusNotFound:
+		return metav1.StatusReasonNotFound
+	case http.StatusConflict:
+		return metav1.StatusReasonConflict
+	case http.StatusGone:
+		return metav1.StatusReasonGone
+	case http.StatusTooManyRequests:
+		return metav1.StatusReasonTooManyRequests
+	case http.StatusServiceUnavailable:
+		return metav1.StatusReasonServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return metav1.StatusReasonTimeout
+	}
+	if code >= 500 {
+		return metav1.StatusReasonInternalError
+	}
+	return metav1.StatusReasonUnknown
+}
+
+// 从响应里解析出 Status, 解析不出来的话用状态码和响应的内容拼一个
+func parseStatus(code int, body []byte) metav1.Status {
+	status := metav1.Status{}
+	if json.Unmarshal(body, &status) == nil && status.Kind == "Status" {
+		if status.Code == 0 {
+			status.Code = int32(code)
+		}
+		if status.Reason == "" {
+			status.Reason = reasonForCode(code)
+		}
+		return status
+	}
+	return metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    int32(code),
+		Reason:  reasonForCode(code),
+		Message: strings.TrimSpace(string(body)),
+	}
+}
+
+func checkStatus(method, url string, code int, body []byte) error {
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	return &StatusError{Method: method, URL: url, Status: parseStatus(code, body)}
+}
+
+// 不是 apiserver 返回的错误的话返回 StatusReasonUnknown
+func ReasonForError(err error) metav1.StatusReason {
+	statusErr := &StatusError{}
+	if errors.As(err, &statusErr) {
+		return statusErr.Status.Reason
+	}
+	return metav1.StatusReasonUnknown
+}
+
+func IsNotFound(err error) bool {
+	return ReasonForError(err) == metav1.StatusReasonNotFound
+}
+
+func IsForbidden(err error) bool {
+	return ReasonForError(err) == metav1.StatusReasonForbidden
+}
+
+// 翻页用的 continue 或者监听用的 resourceVersion 太老了, 已经被压缩掉了, 只能从头再读一遍
+func IsExpired(err error) bool {
+	statusErr := &StatusError{}
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	reason := statusErr.Status.Reason
+	return statusErr.Status.Code == http.StatusGone || reason == metav1.StatusReasonExpired || reason == metav1.StatusReasonGone
+}
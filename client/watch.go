@@ -0,0 +1,295 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"testcni/utils"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// 监听被断开之后隔多久重新监听
+var watchRetryInterval = time.Second
+
+const (
+	// 让 apiserver 过这么久主动断开, 免得连接在中间的负载均衡上被悄悄掐掉了还一直等着
+	watchTimeoutSeconds = 300
+)
+
+type NodeWatchCallback func(eventType watch.EventType, node *v1.Node)
+type PodWatchCallback func(eventType watch.EventType, pod *v1.Pod)
+
+type Watch struct {
+	client *LightK8sClient
+}
+
+func (c *LightK8sClient) Watch() *Watch {
+	return &Watch{client: c}
+}
+
+/**
+ * 不会丢事件的监听, 和 etcd 包里的监听是一个思路
+ * 先把对象全读一遍记下 resourceVersion, 再从这个 resourceVersion 开始监听
+ * 开着 bookmark, 没有变化的时候 apiserver 也会时不时把最新的 resourceVersion 发过来, 断开之后从最新的 resourceVersion 接着监听
+ * resourceVersion 太老了(410 Gone)的话, 就重新读一遍, 和记着的对一下, 中间少掉的变化补成 ADDED, MODIFIED 和 DELETED 回调出去
+ */
+type listWatch struct {
+	client *LightK8sClient
+	url    string
+	query  neturl.Values
+	cb     func(eventType watch.EventType, object []byte)
+	// 已经处理到的 resourceVersion
+	resourceVersion string
+	// 现在有哪些对象, key 是 namespace/name
+	known         map[string]watchedObject
+	retryInterval time.Duration
+}
+
+type watchedObject struct {
+	resourceVersion string
+	object          json.RawMessage
+}
+
+type watchEvent struct {
+	Type   watch.EventType `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type objectMeta struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+}
+
+func parseObjectMeta(object []byte) (*metav1.ObjectMeta, error) {
+	meta := &objectMeta{}
+	err := json.Unmarshal(object, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &meta.Metadata, nil
+}
+
+func objectKey(meta *metav1.ObjectMeta) string {
+	return meta.Namespace + "/" + meta.Name
+}
+
+/**
+ * 把对象全读一遍, 记下当前的 resourceVersion
+ * notify 为 true 的话把和上次记着的不一样的地方回调出去, 先是没了的, 再是新加的和改过的
+ */
+func (w *listWatch) resync(ctx context.Context, notify bool) error {
+	list := &rawList{}
+	err := w.client.list(ctx, w.url, w.query, list)
+	if err != nil {
+		return err
+	}
+	current := map[string]watchedObject{}
+	keys := []string{}
+	for _, object := range list.Items {
+		meta, err := parseObjectMeta(object)
+		if err != nil {
+			return err
+		}
+		key := objectKey(meta)
+		current[key] = watchedObject{resourceVersion: meta.ResourceVersion, object: object}
+		keys = append(keys, key)
+	}
+	if notify {
+		deleted := []string{}
+		for key := range w.known {
+			if _, ok := current[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+		sort.Strings(deleted)
+		for _, key := range deleted {
+			w.cb(watch.Deleted, w.known[key].object)
+		}
+		for _, key := range keys {
+			old, ok := w.known[key]
+			if !ok {
+				w.cb(watch.Added, current[key].object)
+			} else if old.resourceVersion != current[key].resourceVersion {
+				w.cb(watch.Modified, current[key].object)
+			}
+		}
+	}
+	w.known = current
+	w.resourceVersion = list.Metadata.ResourceVersion
+	return nil
+}
+
+// 从处理到的 resourceVersion 开始监听, 返回的是事件流, 状态码不是 200 的话返回 StatusError
+func (w *listWatch) open(ctx context.Context) (io.ReadCloser, error) {
+	q := neturl.Values{}
+	for key, values := range w.query {
+		q[key] = values
+	}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", w.resourceVersion)
+	q.Set("allowWatchBookmarks", "true")
+	q.Set("timeoutSeconds", strconv.Itoa(watchTimeoutSeconds))
+	url := w.url + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := w.client.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, checkStatus(http.MethodGet, url, resp.StatusCode, body)
+	}
+	return resp.Body, nil
+}
+
+// 一直处理到事件流断开, 返回要监听的 resourceVersion 是不是已经太老了
+func (w *listWatch) consume(ctx context.Context, body io.ReadCloser) bool {
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for {
+		event := &watchEvent{}
+		err := decoder.Decode(event)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				utils.WriteLog("监听 ", w.url, " 断开了: ", err.Error())
+			}
+			return false
+		}
+		if event.Type == watch.Error {
+			status := &metav1.Status{}
+			json.Unmarshal(event.Object, status)
+			if status.Code == http.StatusGone || status.Reason == metav1.StatusReasonExpired || status.Reason == metav1.StatusReasonGone {
+				utils.WriteLog("监听 ", w.url, " 时 resourceVersion ", w.resourceVersion, " 已经太老了, 重新同步一遍")
+				return true
+			}
+			utils.WriteLog("监听 ", w.url, " 出错: ", status.Message)
+			return false
+		}
+		meta, err := parseObjectMeta(event.Object)
+		if err != nil {
+			utils.WriteLog("解析 ", w.url, " 的事件失败: ", err.Error())
+			continue
+		}
+		w.resourceVersion = meta.ResourceVersion
+		switch event.Type {
+		case watch.Bookmark:
+			// 只是告诉我们最新的 resourceVersion, 不用回调
+			continue
+		case watch.Deleted:
+			delete(w.known, objectKey(meta))
+		case watch.Added, watch.Modified:
+			w.known[objectKey(meta)] = watchedObject{resourceVersion: meta.ResourceVersion, object: event.Object}
+		default:
+			continue
+		}
+		w.cb(event.Type, event.Object)
+	}
+}
+
+// 等 d 这么久, ctx 被取消了的话返回 false
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (w *listWatch) run(ctx context.Context, body io.ReadCloser) {
+	for {
+		needResync := w.consume(ctx, body)
+		body = nil
+		for body == nil {
+			if !sleepWithContext(ctx, w.retryInterval) {
+				return
+			}
+			if needResync {
+				err := w.resync(ctx, true)
+				if err != nil {
+					utils.WriteLog("重新同步 ", w.url, " 失败: ", err.Error())
+					continue
+				}
+				needResync = false
+			}
+			var err error
+			body, err = w.open(ctx)
+			if err != nil {
+				needResync = IsExpired(err)
+				utils.WriteLog("重新监听 ", w.url, " 失败: ", err.Error())
+			}
+		}
+	}
+}
+
+/**
+ * 先把对象全读一遍记下 resourceVersion, 再从这个 resourceVersion 开始监听
+ * 返回的时候监听已经建好了, 之后的变化都能收到, 一开始就有的对象不会回调, ctx 被取消之后就不再监听了
+ */
+func (c *LightK8sClient) watch(ctx context.Context, url string, query neturl.Values, cb func(watch.EventType, []byte)) error {
+	w := &listWatch{
+		client: c,
+		url:    url,
+		query:  query,
+		cb:     cb,
+		// 建的时候就定下来, 测试里改了也不影响已经在跑的监听
+		retryInterval: watchRetryInterval,
+	}
+	err := w.resync(ctx, false)
+	if err != nil {
+		return fmt.Errorf("failed to list %s before watching: %v", url, err)
+	}
+	body, err := w.open(ctx)
+	if err != nil {
+		return err
+	}
+	go w.run(ctx, body)
+	return nil
+}
+
+// 监听集群里的节点, 直到 ctx 被取消
+func (w *Watch) Nodes(ctx context.Context, cb NodeWatchCallback) error {
+	if cb == nil {
+		return errors.New("the watch callback is nil")
+	}
+	return w.client.watch(ctx, w.client.route("/nodes"), nil, func(eventType watch.EventType, object []byte) {
+		node := &v1.Node{}
+		if err := json.Unmarshal(object, node); err != nil {
+			utils.WriteLog("解析节点失败: ", err.Error())
+			return
+		}
+		cb(eventType, node)
+	})
+}
+
+// 监听某个节点上的 pod, 直到 ctx 被取消
+func (w *Watch) PodsOnNode(ctx context.Context, nodeName string, cb PodWatchCallback) error {
+	if cb == nil {
+		return errors.New("the watch callback is nil")
+	}
+	return w.client.watch(ctx, w.client.route("/pods"), podsOnNodeQuery(nodeName), func(eventType watch.EventType, object []byte) {
+		pod := &v1.Pod{}
+		if err := json.Unmarshal(object, pod); err != nil {
+			utils.WriteLog("解析 pod 失败: ", err.Error())
+			return
+		}
+		cb(eventType, pod)
+	})
+}
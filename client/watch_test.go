@@ -0,0 +1,294 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testcni/consts"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+/**
+ * 只会 list 和 watch 节点的假 apiserver
+ * list 按 pageSize 分页, continue 就是下一页开始的下标
+ * watch 从 history 里把比 resourceVersion 新的事件发出去, resourceVersion 比 compacted 老的话回一个 410 的 ERROR 事件
+ */
+type fakeApiserver struct {
+	lock     sync.Mutex
+	rv       int
+	nodes    map[string]v1.Node
+	history  []watchEvent
+	historyV []int
+	// 这个 resourceVersion 以及之前的事件都没了
+	compacted int
+	pageSize  int
+	// 翻页的时候 continue 都当成过期了
+	expireContinue bool
+	// watch 的时候直接回 503
+	rejectWatch bool
+	// 有变化的时候关掉, 叫醒所有的 watch
+	changed chan struct{}
+	// 关掉的话所有的 watch 都断开
+	kicked chan struct{}
+	// 最近一次 watch 带的 resourceVersion
+	lastWatchRV string
+}
+
+func newFakeApiserver(t *testing.T, names ...string) (*fakeApiserver, *LightK8sClient) {
+	f := &fakeApiserver{
+		nodes:   map[string]v1.Node{},
+		changed: make(chan struct{}),
+		kicked:  make(chan struct{}),
+	}
+	for _, name := range names {
+		f.put(name, nil)
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(func() {
+		f.kick()
+		server.Close()
+	})
+	return f, NewLightK8sClient(server.URL, server.Client())
+}
+
+func (f *fakeApiserver) record(eventType watch.EventType, object interface{}) {
+	content, _ := json.Marshal(object)
+	f.history = append(f.history, watchEvent{Type: eventType, Object: content})
+	f.historyV = append(f.historyV, f.rv)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeApiserver) put(name string, labels map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rv++
+	eventType := watch.Modified
+	if _, ok := f.nodes[name]; !ok {
+		eventType = watch.Added
+	}
+	node := v1.Node{}
+	node.Name = name
+	node.Labels = labels
+	node.ResourceVersion = strconv.Itoa(f.rv)
+	f.nodes[name] = node
+	f.record(eventType, node)
+}
+
+func (f *fakeApiserver) delete(name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rv++
+	node := f.nodes[name]
+	node.ResourceVersion = strconv.Itoa(f.rv)
+	delete(f.nodes, name)
+	f.record(watch.Deleted, node)
+}
+
+func (f *fakeApiserver) bookmark() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rv++
+	node := v1.Node{}
+	node.ResourceVersion = strconv.Itoa(f.rv)
+	f.record(watch.Bookmark, node)
+	return node.ResourceVersion
+}
+
+func (f *fakeApiserver) compact() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.compacted = f.rv
+	f.history, f.historyV = nil, nil
+}
+
+func (f *fakeApiserver) kick() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	close(f.kicked)
+	f.kicked = make(chan struct{})
+}
+
+func (f *fakeApiserver) set(fn func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fn()
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Code:     int32(code),
+		Reason:   reason,
+		Message:  string(reason) + " by the fake apiserver",
+	})
+}
+
+func (f *fakeApiserver) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != consts.KUBE_API+"/nodes" {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("watch") == "true" {
+		f.serveWatch(w, r)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	names := []string{}
+	for name := range f.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	start, end := 0, len(names)
+	if token := query.Get("continue"); token != "" {
+		if f.expireContinue {
+			writeStatus(w, http.StatusGone, metav1.StatusReasonExpired)
+			return
+		}
+		start, _ = strconv.Atoi(token)
+	}
+	list := v1.NodeList{}
+	list.ResourceVersion = strconv.Itoa(f.rv)
+	if query.Get("limit") != "" && f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+		list.Continue = strconv.Itoa(end)
+	}
+	for _, name := range names[start:end] {
+		list.Items = append(list.Items, f.nodes[name])
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeApiserver) serveWatch(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.lastWatchRV = r.URL.Query().Get("resourceVersion")
+	reject := f.rejectWatch
+	kicked := f.kicked
+	f.lock.Unlock()
+	if reject {
+		writeStatus(w, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable)
+		return
+	}
+	sent, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	encoder := json.NewEncoder(w)
+	flush := func() {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	flush()
+	for {
+		f.lock.Lock()
+		if sent < f.compacted {
+			f.lock.Unlock()
+			status := metav1.Status{TypeMeta: metav1.TypeMeta{Kind: "Status"}, Code: http.StatusGone, Reason: metav1.StatusReasonExpired}
+			content, _ := json.Marshal(status)
+			encoder.Encode(watchEvent{Type: watch.Error, Object: content})
+			return
+		}
+		events := []watchEvent{}
+		for i, event := range f.history {
+			if f.historyV[i] > sent {
+				events = append(events, event)
+				sent = f.historyV[i]
+			}
+		}
+		changed := f.changed
+		f.lock.Unlock()
+		for _, event := range events {
+			encoder.Encode(event)
+		}
+		flush()
+		select {
+		case <-changed:
+		case <-kicked:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestWatchNodes(t *testing.T) {
+	test := assert.New(t)
+	interval := watchRetryInterval
+	watchRetryInterval = 10 * time.Millisecond
+	defer func() { watchRetryInterval = interval }()
+
+	fake, client := newFakeApiserver(t, "node-1", "node-2")
+	fake.set(func() { fake.pageSize = 1 })
+	events := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := client.Watch().Nodes(ctx, func(eventType watch.EventType, node *v1.Node) {
+		events <- string(eventType) + "/" + node.Name
+	})
+	test.Nil(err)
+	next := func() string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+	noMore := func() {
+		select {
+		case event := <-events:
+			test.Fail("unexpected event " + event)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// 一开始就有的节点不会回调
+	fake.put("node-3", nil)
+	test.Equal("ADDED/node-3", next())
+	fake.put("node-1", map[string]string{"a": "b"})
+	test.Equal("MODIFIED/node-1", next())
+	noMore()
+
+	// 断开之后从 bookmark 的 resourceVersion 接着监听, 不会重复回调
+	rv := fake.bookmark()
+	noMore()
+	fake.kick()
+	fake.delete("node-2")
+	test.Equal("DELETED/node-2", next())
+	fake.set(func() { test.Equal(rv, fake.lastWatchRV) })
+	noMore()
+
+	// 断开的时候错过的变化被压缩掉了的话, 重新读一遍补出来
+	fake.set(func() { fake.rejectWatch = true })
+	fake.kick()
+	fake.put("node-4", nil)
+	fake.delete("node-1")
+	fake.compact()
+	time.Sleep(50 * time.Millisecond)
+	fake.set(func() { fake.rejectWatch = false })
+	test.Equal("DELETED/node-1", next())
+	test.Equal("ADDED/node-4", next())
+	noMore()
+	fake.put("node-5", nil)
+	test.Equal("ADDED/node-5", next())
+
+	// 取消之后就不再回调了
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	fake.put("node-6", nil)
+	noMore()
+}
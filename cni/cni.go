@@ -3,15 +3,23 @@ package cni
 import (
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
+	"testcni/consts"
 	"testcni/skel"
 	"testcni/utils"
 
 	cniTypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ipam"
 )
 
 type IPAM struct {
+	// 不配或者配 testcni 的话用自带的 ipam, 配别的 ipam 插件的名字(比如 dhcp)的话 ip 交给这个插件去分
+	// 只有 ipvlan 和 macvlan 模式能交给别的插件, 其他模式按节点的网段路由, 配了的话会报错
 	Type       string                     `json:"type"`
 	Subnet     string                     `json:"subnet"`
 	RangeStart string                     `json:"rangeStart"`
@@ -19,6 +27,57 @@ type IPAM struct {
 	Gateway    string                     `json:"gateway"`
 	Addresses  []struct{ Address string } `json:"addresses"`
 	Routes     interface{}                `json:"routes"`
+
+	// 每个节点分到的网段的掩码位数, 比如 subnet 是 10.244.0.0/16, 这里配 26 的话每个节点分到一个 /26
+	// 不配的话 ipam 会根据 subnet 的掩码自己算一个
+	BlockSize int `json:"blockSize"`
+	// subnet 是 ipv6 的时候每个节点分到的网段的掩码位数, 比如 subnet 是 fd00:10:244::/56, 这里配 64 的话每个节点分到一个 /64
+	BlockSizeV6 int `json:"blockSizeV6"`
+
+	// 除了 subnet 这个默认的池子之外的具名 ip 池, pod 或者它所在的 namespace 上打了注解的话就从对应的池子里分
+	// vxlan 模式不支持, 配了的话会报错
+	Pools []Pool `json:"pools"`
+
+	// ipam 的数据存在哪儿, etcd(默认), kubernetes 或者 file
+	// kubernetes 的话通过 k8s 的 api 存成 crd, file 的话存在本机的一个文件里, 只适合单节点或者边缘节点
+	Datastore string `json:"datastore"`
+	// 只有 datastore 是 file 的时候才用得到, 数据存在哪个文件里, 不配的话存在 /opt/testcni/ipam.json
+	// 同一个节点上的所有 cni 进程和 agent 得用同一个文件, 具名的 ip 池也和外层共用这个文件
+	DatastorePath string `json:"datastorePath"`
+
+	// 为 true 的话每个节点的网段直接用 k8s 给 node 分的 spec.podCIDR(s), 只有 host-gw 和 ipip 模式支持
+	// kube-controller-manager 要开着 --allocate-node-cidrs, 并且 --cluster-cidr 要在 subnet 里面
+	UsePodCIDR bool `json:"usePodCIDR"`
+
+	// 存在 etcd 里的时候怎么连 etcd, 不配的话用 kubeconfig 里 apiserver 的地址加上 2379 端口和 kubeadm 的 healthcheck 证书
+	Etcd *Etcd `json:"etcd"`
+}
+
+// 连 etcd 的配置, 节点上的 /opt/testcni/etcd.json 也是这个格式
+type Etcd struct {
+	// 逗号隔开的多个地址, 比如 "https://10.0.0.1:2379,https://10.0.0.2:2379"
+	Endpoints string `json:"endpoints"`
+	// 没配 endpoints 的话通过 dns 的 srv 记录找 etcd, 配 example.com 会去查 _etcd-client-ssl._tcp.example.com 和 _etcd-client._tcp.example.com
+	DiscoverySrv string `json:"discoverySrv"`
+	// 开了认证的话用的用户名和密码
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// 客户端证书, 不配的话不走双向认证, 只配 caCertFile 的话只校验 etcd 的证书
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+	CACertFile string `json:"caCertFile"`
+}
+
+// 具名的 ip 池, 每个池子在 etcd 中都按自己的 subnet 存着一套网段
+type Pool struct {
+	Name string `json:"name"`
+	// 和外层的 subnet 一样, 可以是逗号隔开的一个 ipv4 和一个 ipv6 的网段
+	Subnet      string `json:"subnet"`
+	BlockSize   int    `json:"blockSize"`
+	BlockSizeV6 int    `json:"blockSizeV6"`
+	// ipvlan 和 macvlan 模式下池子里能分出去的 ip, 和外层 ipam 的 rangeStart/rangeEnd 一样得在这个池子的 subnet 里
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
 }
 
 type PluginConf struct {
@@ -36,17 +95,407 @@ type PluginConf struct {
 	// cni 源码中实现: /cni/libcni/api.go:injectRuntimeConfig
 	RuntimeConfig *struct {
 		TestConfig map[string]interface{} `json:"testConfig"`
+		// 对应 "capabilities": {"ips": true}, pod 想要的固定 ip, 可以带掩码, 比如 ["10.244.1.10/24", "fd00:10:244:1::10"]
+		IPs []string `json:"ips"`
 	} `json:"runtimeConfig"`
 
 	IPAM *IPAM `json:"ipam"`
 	// 这里可以自由定义自己的 plugin 中配置了的参数然后自由处理
 	Bridge string `json:"bridge"`
+	// ipvlan/macvlan 的 parent 网卡, 只有 ip 交给别的 ipam 插件分的时候才用, 不配的话用默认路由走的那块儿网卡
+	Master string `json:"master"`
 	Subnet string `json:"subnet"`
 	Mode   string `json:"mode" default:"host-gw"`
 }
 
+// 插件自己定义的错误码, 按照 cni 的规范要 >= 100
+const (
+	// CHECK 的时候发现当前的网络和 ADD 时返回的结果对不上
+	ERR_CHECK_FAILED uint = 100
+	// pod 指定的 ip 已经被别人用了, 或者不在当前节点的网段/range 里
+	ERR_REQUESTED_IP_UNAVAILABLE uint = 101
+)
+
 var manager *CNIManager
 
+// 拿到配置的 block 掩码, 没配的话返回空字符串
+func GetBlockMaskSegment(pluginConfig *PluginConf) string {
+	if pluginConfig.IPAM == nil || pluginConfig.IPAM.BlockSize <= 0 {
+		return ""
+	}
+	return strconv.Itoa(pluginConfig.IPAM.BlockSize)
+}
+
+// 拿到配置的 ipv6 的 block 掩码, 没配的话返回空字符串
+func GetBlockMaskSegmentV6(pluginConfig *PluginConf) string {
+	if pluginConfig.IPAM == nil || pluginConfig.IPAM.BlockSizeV6 <= 0 {
+		return ""
+	}
+	return strconv.Itoa(pluginConfig.IPAM.BlockSizeV6)
+}
+
+// 拿到配置的 ipam 的存储类型, 没配的话返回空字符串, 交给 ipam 用默认的
+func GetDatastoreType(pluginConfig *PluginConf) string {
+	if pluginConfig.IPAM == nil {
+		return ""
+	}
+	return pluginConfig.IPAM.Datastore
+}
+
+// datastore 是 file 的时候数据存在哪个文件里, 没配的话返回空字符串, 交给 ipam 用默认的
+func GetDatastorePath(pluginConfig *PluginConf) string {
+	if pluginConfig.IPAM == nil {
+		return ""
+	}
+	return pluginConfig.IPAM.DatastorePath
+}
+
+// 配置的连 etcd 的配置, 没配的话返回 nil
+func GetEtcdConf(pluginConfig *PluginConf) *Etcd {
+	if pluginConfig.IPAM == nil {
+		return nil
+	}
+	return pluginConfig.IPAM.Etcd
+}
+
+// 默认的池子是不是直接用 node 的 podCIDR 当网段
+func UsePodCIDR(pluginConfig *PluginConf) bool {
+	return pluginConfig.IPAM != nil && pluginConfig.IPAM.UsePodCIDR
+}
+
+// 别的模式的网段不是按节点路由的, 配了 usePodCIDR 的话直接报错
+func CheckPodCIDR(pluginConfig *PluginConf, mode string) error {
+	if !UsePodCIDR(pluginConfig) || mode == consts.MODE_HOST_GW || mode == consts.MODE_IPIP {
+		return nil
+	}
+	return fmt.Errorf("usePodCIDR is not supported in the %s mode", mode)
+}
+
+/**
+ * 拿到配置的 subnet, 双栈的时候 subnet 里是用逗号隔开的一个 ipv4 和一个 ipv6 的网段
+ * 比如 "10.244.0.0/16,fd00:10:244::/56", 第一个是主地址族, 写在前头的那个
+ */
+func GetSubnets(pluginConfig *PluginConf) ([]string, error) {
+	subnets := []string{}
+	for _, subnet := range strings.Split(pluginConfig.Subnet, ",") {
+		subnet = strings.TrimSpace(subnet)
+		if subnet != "" {
+			subnets = append(subnets, subnet)
+		}
+	}
+	switch len(subnets) {
+	case 0:
+		return nil, errors.New("subnet is empty")
+	case 1:
+		return subnets, nil
+	case 2:
+		if isIPv6Subnet(subnets[0]) == isIPv6Subnet(subnets[1]) {
+			return nil, fmt.Errorf("dual-stack subnet %q must be one ipv4 and one ipv6 subnet", pluginConfig.Subnet)
+		}
+		return subnets, nil
+	}
+	return nil, fmt.Errorf("too many subnets in %q, at most one ipv4 and one ipv6 subnet", pluginConfig.Subnet)
+}
+
+// 只支持 ipv4 的模式用这个拿 subnet, 配了 ipv6 的话直接报错
+func GetIPv4Subnet(pluginConfig *PluginConf, mode string) (string, error) {
+	subnets, err := GetSubnets(pluginConfig)
+	if err != nil {
+		return "", err
+	}
+	if len(subnets) > 1 || isIPv6Subnet(subnets[0]) {
+		return "", fmt.Errorf("ipv6 is not supported in the %s mode", mode)
+	}
+	return subnets[0], nil
+}
+
+// 配置里所有具名的 ip 池的名字
+func GetPoolNames(pluginConfig *PluginConf) []string {
+	names := []string{}
+	if pluginConfig.IPAM == nil {
+		return names
+	}
+	for _, pool := range pluginConfig.IPAM.Pools {
+		names = append(names, pool.Name)
+	}
+	return names
+}
+
+/**
+ * vxlan 模式不会按 pod 的注解挑池子, 配了具名的 ip 池的话直接报错, 免得 pod 悄悄从默认的池子里分了 ip
+ * vxlan 模式下其他节点的 pod ip 是节点上唯一的那个 watcher 进程按默认的池子的网段监听的, 网段的掩码也固定是 /16
+ */
+func CheckPools(pluginConfig *PluginConf, mode string) error {
+	if len(GetPoolNames(pluginConfig)) == 0 || mode != consts.MODE_VXLAN {
+		return nil
+	}
+	return fmt.Errorf("ip pools are not supported in the %s mode", mode)
+}
+
+/**
+ * 拿到 name 这个 ip 池的配置, 除了 subnet, blockSize 和 range 之外都和 pluginConfig 一样
+ * name 是空的话就是 pluginConfig 本身, 也就是默认的那个池子
+ * 池子的名字不能重复, 各个池子(包括默认的)的网段也不能有重叠, 不然 ip 会被分重
+ */
+func GetPoolConfig(pluginConfig *PluginConf, name string) (*PluginConf, error) {
+	err := validatePools(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return pluginConfig, nil
+	}
+	for _, pool := range pluginConfig.IPAM.Pools {
+		if pool.Name != name {
+			continue
+		}
+		conf := *pluginConfig
+		_ipam := *pluginConfig.IPAM
+		_ipam.BlockSize = pool.BlockSize
+		_ipam.BlockSizeV6 = pool.BlockSizeV6
+		_ipam.RangeStart = pool.RangeStart
+		_ipam.RangeEnd = pool.RangeEnd
+		_ipam.Pools = nil
+		// 节点的 podCIDR 只有一个, 给默认的池子用
+		_ipam.UsePodCIDR = false
+		conf.IPAM = &_ipam
+		conf.Subnet = pool.Subnet
+		return &conf, nil
+	}
+	return nil, fmt.Errorf("ip pool %q not found", name)
+}
+
+func validatePools(pluginConfig *PluginConf) error {
+	if pluginConfig.IPAM == nil || len(pluginConfig.IPAM.Pools) == 0 {
+		return nil
+	}
+	subnets, err := GetSubnets(pluginConfig)
+	if err != nil {
+		return err
+	}
+	blocks := map[string]*net.IPNet{}
+	for _, subnet := range subnets {
+		blocks[subnet], err = parseSubnet(subnet)
+		if err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{}
+	for _, pool := range pluginConfig.IPAM.Pools {
+		if pool.Name == "" {
+			return errors.New("name of ip pool is empty")
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("duplicate ip pool %q", pool.Name)
+		}
+		names[pool.Name] = true
+
+		poolSubnets, err := GetSubnets(&PluginConf{Subnet: pool.Subnet})
+		if err != nil {
+			return fmt.Errorf("invalid subnet of ip pool %q: %s", pool.Name, err.Error())
+		}
+		for _, subnet := range poolSubnets {
+			block, err := parseSubnet(subnet)
+			if err != nil {
+				return fmt.Errorf("invalid subnet of ip pool %q: %s", pool.Name, err.Error())
+			}
+			for other, otherBlock := range blocks {
+				if block.Contains(otherBlock.IP) || otherBlock.Contains(block.IP) {
+					return fmt.Errorf("subnet %s of ip pool %q overlaps with %s", subnet, pool.Name, other)
+				}
+			}
+			blocks[subnet] = block
+		}
+	}
+	return nil
+}
+
+// subnet 里没写掩码的话和 ipam 一样用默认的掩码
+func parseSubnet(subnet string) (*net.IPNet, error) {
+	if !strings.Contains(subnet, "/") {
+		if isIPv6Subnet(subnet) {
+			subnet += "/" + consts.DEFAULT_MASK_NUM_V6
+		} else {
+			subnet += "/" + consts.DEFAULT_MASK_NUM
+		}
+	}
+	_, block, err := net.ParseCIDR(subnet)
+	return block, err
+}
+
+func isIPv6Subnet(subnet string) bool {
+	ip := net.ParseIP(strings.Split(subnet, "/")[0])
+	return ip != nil && ip.To4() == nil
+}
+
+// ipam.type 没配或者配的是这个的时候用自带的基于 etcd 的 ipam
+const BUILTIN_IPAM_TYPE = "testcni"
+
+// ipam.type 配的是别的 ipam 插件(比如 host-local, static, dhcp)的话, ip 交给这个插件去分
+func IsDelegatedIPAM(pluginConfig *PluginConf) bool {
+	return pluginConfig.IPAM != nil && pluginConfig.IPAM.Type != "" && pluginConfig.IPAM.Type != BUILTIN_IPAM_TYPE
+}
+
+/**
+ * 只支持自带的 ipam 的模式用这个检查一下, 配了别的 ipam 插件的话直接报错
+ * host-gw, ipip 和 vxlan 是按节点分网段, 再按网段在节点之间配路由(或者 fdb)的, 节点和网段的对应关系只有自带的 ipam 知道
+ * 别的 ipam 插件分出来的 ip 不在本节点的网段里, 别的节点上不知道往哪儿转, 所以这几个模式不能交给别的插件
+ */
+func CheckBuiltinIPAM(pluginConfig *PluginConf, mode string) error {
+	if !IsDelegatedIPAM(pluginConfig) {
+		return nil
+	}
+	return cniTypes.NewError(
+		cniTypes.ErrInvalidNetworkConfig,
+		fmt.Sprintf("ipam type %q is not supported in the %s mode", pluginConfig.IPAM.Type, mode),
+		fmt.Sprintf(
+			"the %s mode routes pods by the per-node blocks of the builtin ipam, ips from another ipam plugin can not be routed between nodes; "+
+				"remove ipam.type or set it to %q, or use the %s or %s mode to delegate to another ipam plugin",
+			mode, BUILTIN_IPAM_TYPE, consts.MODE_IPVLAN, consts.MODE_MACVLAN,
+		),
+	)
+}
+
+/**
+ * 通过 cni 的 invoke 调用 ipam.type 对应的插件, 插件到 CNI_PATH 下去找
+ * stdin 就是 runtime 传给我们的那份配置, 其他的 CNI_XXX 环境变量原样传下去
+ * 插件返回的错误本来就是 cni 的错误, 直接往上抛
+ */
+func DelegateIPAMAdd(args *skel.CmdArgs, pluginConfig *PluginConf) (*types.Result, error) {
+	r, err := ipam.ExecAdd(pluginConfig.IPAM.Type, args.StdinData)
+	if err != nil {
+		return nil, err
+	}
+	return types.NewResultFromResult(r)
+}
+
+func DelegateIPAMDel(args *skel.CmdArgs, pluginConfig *PluginConf) error {
+	return ipam.ExecDel(pluginConfig.IPAM.Type, args.StdinData)
+}
+
+func DelegateIPAMCheck(args *skel.CmdArgs, pluginConfig *PluginConf) error {
+	return ipam.ExecCheck(pluginConfig.IPAM.Type, args.StdinData)
+}
+
+// 生成一个 CHECK 失败的错误, msg 里要写清楚是哪儿对不上了
+func NewCheckError(msg string, details ...string) *cniTypes.Error {
+	return cniTypes.NewError(ERR_CHECK_FAILED, msg, strings.Join(details, "; "))
+}
+
+// 生成一个指定的 ip 分不出来的错误, 这种时候不会换一个 ip 分给 pod
+func NewRequestedIPError(msg string, details ...string) *cniTypes.Error {
+	return cniTypes.NewError(ERR_REQUESTED_IP_UNAVAILABLE, msg, strings.Join(details, "; "))
+}
+
+/**
+ * 拿到 pod 指定要用的 ip, 没指定的话返回空
+ * 先看 runtimeConfig 里的 ips, 没有的话再看 CNI_ARGS 里的 IP=, 双栈的时候用逗号隔开, 比如 IP=10.244.1.10,fd00:10:244:1::10
+ * 带了掩码的话只要前面的 ip, pod 的掩码还是和节点的网段一致
+ * 每个地址族最多只能指定一个 ip
+ */
+func GetRequestedIPs(args *skel.CmdArgs, pluginConfig *PluginConf) ([]string, error) {
+	if pluginConfig.RuntimeConfig != nil && len(pluginConfig.RuntimeConfig.IPs) > 0 {
+		ips, err := parseRequestedIPs(pluginConfig.RuntimeConfig.IPs)
+		if err != nil {
+			return nil, cniTypes.NewError(cniTypes.ErrInvalidNetworkConfig, "invalid ips in runtimeConfig", err.Error())
+		}
+		return ips, nil
+	}
+
+	if ip := GetCNIArg(args, "IP"); ip != "" {
+		ips, err := parseRequestedIPs(strings.Split(ip, ","))
+		if err != nil {
+			return nil, cniTypes.NewError(cniTypes.ErrInvalidEnvironmentVariables, "invalid IP in CNI_ARGS", err.Error())
+		}
+		return ips, nil
+	}
+	return nil, nil
+}
+
+// 从 CNI_ARGS 里拿某个参数, CNI_ARGS 形如 K8S_POD_NAMESPACE=default;K8S_POD_NAME=busybox, 没有的话返回空
+func GetCNIArg(args *skel.CmdArgs, key string) string {
+	for _, pair := range strings.Split(args.Args, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+func parseRequestedIPs(items []string) ([]string, error) {
+	ips := []string{}
+	families := map[bool]bool{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ip := net.ParseIP(strings.Split(item, "/")[0])
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a valid ip", item)
+		}
+		isIPv6 := ip.To4() == nil
+		if families[isIPv6] {
+			return nil, fmt.Errorf("at most one ipv4 and one ipv6 ip can be requested, got %q", strings.Join(items, ","))
+		}
+		families[isIPv6] = true
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+/**
+ * 从 config 中拿到 ADD 时返回的结果
+ * runtime 在调用 CHECK 和 DEL 的时候会把上次 ADD 的结果塞到 prevResult 中
+ */
+func GetPrevResult(pluginConfig *PluginConf) (*types.Result, error) {
+	if pluginConfig.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&pluginConfig.NetConf); err != nil {
+			return nil, err
+		}
+	}
+	if pluginConfig.PrevResult == nil {
+		return nil, errors.New("prevResult is required")
+	}
+	return types.NewResultFromResult(pluginConfig.PrevResult)
+}
+
+/**
+ * 从 prevResult 中找到 pod 中名为 ifName 的网卡对应的那些 ip
+ * 如果 prevResult 中没有记网卡信息的话就当所有 ip 都是这块儿网卡的
+ */
+func GetIPConfigsOfInterface(result *types.Result, ifName string) []*types.IPConfig {
+	if len(result.Interfaces) == 0 {
+		return result.IPs
+	}
+	ips := []*types.IPConfig{}
+	for _, ip := range result.IPs {
+		if ip.Interface == nil {
+			ips = append(ips, ip)
+			continue
+		}
+		index := *ip.Interface
+		if index >= 0 && index < len(result.Interfaces) && result.Interfaces[index].Name == ifName {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// 检查 ipam 中给这块儿网卡的分配记录里的 ip 是不是 prevResult 中的那个
+func CheckAllocatedIP(ips []*types.IPConfig, allocatedIP string) *cniTypes.Error {
+	for _, ip := range ips {
+		if ip.Address.IP.String() == allocatedIP {
+			return nil
+		}
+	}
+	return NewCheckError(
+		"ip in allocation record drifted",
+		fmt.Sprintf("allocation record has %s, which is not in prevResult", allocatedIP),
+	)
+}
+
 type CNI interface {
 	Bootstrap(
 		args *skel.CmdArgs,
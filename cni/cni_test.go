@@ -1,12 +1,14 @@
 package cni
 
 import (
+	"encoding/json"
 	"errors"
 	"testcni/skel"
 	"testing"
 
 	// currentTypes "github.com/containernetworking/cni/pkg/types"
 	// types "github.com/containernetworking/cni/pkg/types/100"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -121,3 +123,196 @@ func TestCNI(t *testing.T) {
 	// test.Nil(err)
 	// test.EqualValues(tmpRealCNIResult, testRealCNIResult)
 }
+
+func TestGetSubnets(t *testing.T) {
+	test := assert.New(t)
+
+	subnets, err := GetSubnets(&PluginConf{Subnet: "10.244.0.0/16"})
+	test.Nil(err)
+	test.Equal([]string{"10.244.0.0/16"}, subnets)
+
+	subnets, err = GetSubnets(&PluginConf{Subnet: "fd00:10:244::/56, 10.244.0.0/16"})
+	test.Nil(err)
+	test.Equal([]string{"fd00:10:244::/56", "10.244.0.0/16"}, subnets)
+
+	_, err = GetSubnets(&PluginConf{Subnet: "10.244.0.0/16,10.245.0.0/16"})
+	test.NotNil(err)
+	_, err = GetSubnets(&PluginConf{Subnet: ""})
+	test.NotNil(err)
+
+	subnet, err := GetIPv4Subnet(&PluginConf{Subnet: "10.244.0.0"}, "vxlan")
+	test.Nil(err)
+	test.Equal("10.244.0.0", subnet)
+	_, err = GetIPv4Subnet(&PluginConf{Subnet: "10.244.0.0/16,fd00:10:244::/56"}, "vxlan")
+	test.NotNil(err)
+}
+
+func TestGetRequestedIPs(t *testing.T) {
+	test := assert.New(t)
+
+	conf := &PluginConf{}
+	ips, err := GetRequestedIPs(&skel.CmdArgs{Args: "K8S_POD_NAMESPACE=default;K8S_POD_NAME=busybox"}, conf)
+	test.Nil(err)
+	test.Empty(ips)
+
+	ips, err = GetRequestedIPs(&skel.CmdArgs{Args: "IgnoreUnknown=1;IP=10.244.1.10,fd00:10:244:1::10"}, conf)
+	test.Nil(err)
+	test.Equal([]string{"10.244.1.10", "fd00:10:244:1::10"}, ips)
+
+	_, err = GetRequestedIPs(&skel.CmdArgs{Args: "IP=10.244.1.10,10.244.1.11"}, conf)
+	test.NotNil(err)
+	_, err = GetRequestedIPs(&skel.CmdArgs{Args: "IP=10.244.1"}, conf)
+	test.NotNil(err)
+
+	// runtimeConfig 里的 ips 优先
+	err = json.Unmarshal([]byte(`{"runtimeConfig": {"ips": ["10.244.1.20/24"]}}`), conf)
+	test.Nil(err)
+	ips, err = GetRequestedIPs(&skel.CmdArgs{Args: "IP=10.244.1.10"}, conf)
+	test.Nil(err)
+	test.Equal([]string{"10.244.1.20"}, ips)
+}
+
+func TestGetPoolConfig(t *testing.T) {
+	test := assert.New(t)
+
+	conf := &PluginConf{}
+	err := json.Unmarshal([]byte(`{
+		"subnet": "10.244.0.0/16",
+		"ipam": {
+			"blockSize": 24,
+			"pools": [
+				{"name": "ingress", "subnet": "192.168.100.0/24", "blockSize": 28, "rangeStart": "192.168.100.10", "rangeEnd": "192.168.100.20"},
+				{"name": "private", "subnet": "10.245.0.0/16,fd00:10:245::/56"}
+			]
+		}
+	}`), conf)
+	test.Nil(err)
+	test.Equal([]string{"ingress", "private"}, GetPoolNames(conf))
+
+	poolConf, err := GetPoolConfig(conf, "")
+	test.Nil(err)
+	test.Equal(conf, poolConf)
+	poolConf, err = GetPoolConfig(conf, "ingress")
+	test.Nil(err)
+	test.Equal("192.168.100.0/24", poolConf.Subnet)
+	test.Equal("28", GetBlockMaskSegment(poolConf))
+	test.Equal("192.168.100.10", poolConf.IPAM.RangeStart)
+	test.Equal("192.168.100.20", poolConf.IPAM.RangeEnd)
+	// 原来的配置不能被改掉
+	test.Equal("10.244.0.0/16", conf.Subnet)
+	test.Equal("24", GetBlockMaskSegment(conf))
+	_, err = GetPoolConfig(conf, "public")
+	test.NotNil(err)
+
+	// 网段和默认的池子重叠了
+	conf.IPAM.Pools[0].Subnet = "10.244.1.0/24"
+	_, err = GetPoolConfig(conf, "ingress")
+	test.NotNil(err)
+	conf.IPAM.Pools[0].Subnet = "192.168.100.0/24"
+	conf.IPAM.Pools[0].Name = "private"
+	_, err = GetPoolConfig(conf, "private")
+	test.NotNil(err)
+}
+
+func TestCheckPools(t *testing.T) {
+	test := assert.New(t)
+
+	conf := &PluginConf{}
+	test.Nil(CheckPools(conf, "ipip"))
+	err := json.Unmarshal([]byte(`{
+		"subnet": "10.244.0.0/16",
+		"ipam": {"pools": [{"name": "ingress", "subnet": "192.168.100.0/24"}]}
+	}`), conf)
+	test.Nil(err)
+	for _, mode := range []string{"host-gw", "ipip", "ipvlan", "macvlan"} {
+		test.Nil(CheckPools(conf, mode), mode)
+	}
+	err = CheckPools(conf, "vxlan")
+	test.NotNil(err)
+	test.Contains(err.Error(), "ip pools are not supported in the vxlan mode")
+}
+
+func TestDelegatedIPAM(t *testing.T) {
+	test := assert.New(t)
+
+	conf := &PluginConf{}
+	test.False(IsDelegatedIPAM(conf))
+	test.Nil(CheckBuiltinIPAM(conf, "host-gw"))
+
+	err := json.Unmarshal([]byte(`{
+		"mode": "macvlan",
+		"master": "eth1",
+		"ipam": {"type": "testcni"}
+	}`), conf)
+	test.Nil(err)
+	test.Equal("eth1", conf.Master)
+	test.False(IsDelegatedIPAM(conf))
+
+	conf.IPAM.Type = "dhcp"
+	test.True(IsDelegatedIPAM(conf))
+	err = CheckBuiltinIPAM(conf, "host-gw")
+	test.NotNil(err)
+	cniErr, ok := err.(*cniTypes.Error)
+	test.True(ok)
+	test.Equal(uint(cniTypes.ErrInvalidNetworkConfig), cniErr.Code)
+	// 得告诉用户为什么不行以及怎么改
+	test.Contains(cniErr.Details, "routes pods by the per-node blocks")
+	test.Contains(cniErr.Details, "macvlan")
+}
+
+func TestUsePodCIDR(t *testing.T) {
+	test := assert.New(t)
+
+	conf := &PluginConf{}
+	test.False(UsePodCIDR(conf))
+	err := json.Unmarshal([]byte(`{
+		"subnet": "10.244.0.0/16",
+		"ipam": {
+			"usePodCIDR": true,
+			"pools": [{"name": "ingress", "subnet": "192.168.100.0/24"}]
+		}
+	}`), conf)
+	test.Nil(err)
+	test.True(UsePodCIDR(conf))
+	test.Nil(CheckPodCIDR(conf, "host-gw"))
+	test.Nil(CheckPodCIDR(conf, "ipip"))
+	test.NotNil(CheckPodCIDR(conf, "vxlan"))
+	test.NotNil(CheckPodCIDR(conf, "macvlan"))
+
+	// 具名的池子还是自己从 pool 里占网段
+	poolConf, err := GetPoolConfig(conf, "ingress")
+	test.Nil(err)
+	test.False(UsePodCIDR(poolConf))
+	test.True(UsePodCIDR(conf))
+}
+
+func TestGetEtcdConf(t *testing.T) {
+	test := assert.New(t)
+
+	conf := &PluginConf{}
+	test.Nil(GetEtcdConf(conf))
+	err := json.Unmarshal([]byte(`{
+		"subnet": "10.244.0.0/16",
+		"ipam": {
+			"etcd": {
+				"endpoints": "https://10.0.0.1:2379,https://10.0.0.2:2379",
+				"username": "root",
+				"password": "123456",
+				"caCertFile": "/etc/etcd/ca.crt"
+			},
+			"pools": [{"name": "ingress", "subnet": "192.168.100.0/24"}]
+		}
+	}`), conf)
+	test.Nil(err)
+	test.Equal(&Etcd{
+		Endpoints:  "https://10.0.0.1:2379,https://10.0.0.2:2379",
+		Username:   "root",
+		Password:   "123456",
+		CACertFile: "/etc/etcd/ca.crt",
+	}, GetEtcdConf(conf))
+
+	// 具名的池子和默认的池子连的是同一个 etcd
+	poolConf, err := GetPoolConfig(conf, "ingress")
+	test.Nil(err)
+	test.Equal(GetEtcdConf(conf), GetEtcdConf(poolConf))
+}
@@ -11,22 +11,25 @@ const (
 const (
 	DEFAULT_TEST_CNI_API = "/testcni/api/v1"
 	DEFAULT_MASK_NUM     = "24"
+	DEFAULT_MASK_NUM_V6  = "64"
 	DEFAULT_MASK_IP      = "255.255.0.0"
 	DEFAULT_TMP_PORT     = "3190"
 )
 
 const (
-	KUBE_API                               = "/api/v1"
-	KUBE_DEFAULT_PATH                      = "/etc/kubernetes"
-	KUBE_LOCAL_DEFAULT_PATH                = "~/.kube/conf"
-	KUBE_DEFAULT_CA_PATH                   = KUBE_DEFAULT_PATH + "/pki/ca.crt"
+	KUBE_API                = "/api/v1"
+	KUBE_IP_POOL_ANNOTATION = "testcni.io/ip-pool"
+	KUBE_DEFAULT_PATH       = "/etc/kubernetes"
+	// 相对于 home 目录
+	KUBE_LOCAL_DEFAULT_PATH                = ".kube/config"
+	KUBE_SERVICE_ACCOUNT_PATH              = "/var/run/secrets/kubernetes.io/serviceaccount"
 	KUBELET_CONFIG_DEFAULT_PATH            = KUBE_DEFAULT_PATH + "/kubelet.conf"
 	KUBE_CONF_ADMIN_DEFAULT_PATH           = KUBE_DEFAULT_PATH + "/admin.conf"
 	KUBE_TEST_CNI_DEFAULT_PATH             = "/opt/testcni"
 	KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH  = KUBE_TEST_CNI_DEFAULT_PATH + "/deamon"
-	KUBE_TEST_CNI_TMP_CA_DEFAULT_PATH      = KUBE_TEST_CNI_DEFAULT_PATH + "/ca.crt"
-	KUBE_TEST_CNI_TMP_CERT_DEFAULT_PATH    = KUBE_TEST_CNI_DEFAULT_PATH + "/cert.crt"
-	KUBE_TEST_CNI_TMP_KEY_DEFAULT_PATH     = KUBE_TEST_CNI_DEFAULT_PATH + "/key.key"
 	KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/bird.cfg"
 	KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/bird_deamon"
+	KUBE_TEST_CNI_DEFAULT_PROMISC_PATH     = KUBE_TEST_CNI_DEFAULT_PATH + "/promisc"
+	KUBE_TEST_CNI_DEFAULT_DATASTORE_PATH   = KUBE_TEST_CNI_DEFAULT_PATH + "/ipam.json"
+	KUBE_TEST_CNI_DEFAULT_ETCD_CONFIG_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/etcd.json"
 )
@@ -0,0 +1,163 @@
+package datastore
+
+/**
+ * ipam 的数据存在哪儿
+ * etcd: 直接读写集群的 etcd, 用的是 apiserver 的 healthcheck 证书
+ * kubernetes: 通过 k8s 的 api 存成 crd, 托管的集群连不上 etcd 的时候用这个
+ * file: 存在本机的一个文件里, 用文件锁做并发控制, 单节点或者边缘节点(比如用 sqlite 的 k3s)没有 etcd 的时候用这个
+ * memory: 存在进程的内存里, 进程退出就没了, 只给测试用
+ *
+ * ipam 里的数据都是按 etcd 的 key 组织的, 每种存储都按 key 来读写
+ * 并发控制也和 etcd 一样, 用 revision 加事务来做
+ */
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	DATASTORE_ETCD       = "etcd"
+	DATASTORE_KUBERNETES = "kubernetes"
+	DATASTORE_FILE       = "file"
+	DATASTORE_MEMORY     = "memory"
+)
+
+type Datastore interface {
+	// etcd, kubernetes, file 或者 memory
+	Type() string
+	// key 不存在的话返回空字符串
+	Get(key string) (string, error)
+	// 拿到 key 的值以及它最后一次被修改时的 revision, key 不存在的话 revision 是 0
+	GetWithRevision(key string) (string, int64, error)
+	// 返回 map[key]value, 前缀下一个 key 都没有的话返回空的 map
+	List(prefix string) (map[string]string, error)
+	Set(key, value string) error
+	/**
+	 * 在一个事务里执行 ops, 只有 cmps 全都成立的时候 ops 才会被执行
+	 * 返回值表示 cmps 是否成立, 也就是 ops 有没有被执行
+	 */
+	Txn(cmps []Cmp, ops ...Op) (bool, error)
+}
+
+type cmpKind int
+
+const (
+	cmpMissing cmpKind = iota
+	cmpExists
+	cmpModRevision
+	cmpValue
+	cmpPrefixEmpty
+)
+
+// 事务的前置条件, 用下面的几个函数创建
+type Cmp struct {
+	kind     cmpKind
+	key      string
+	value    string
+	revision int64
+}
+
+// key 不存在
+func KeyMissing(key string) Cmp {
+	return Cmp{kind: cmpMissing, key: key}
+}
+
+// key 存在
+func KeyExists(key string) Cmp {
+	return Cmp{kind: cmpExists, key: key}
+}
+
+// key 最后一次被修改时的 revision 是 revision, 配合 GetWithRevision 做 cas
+func ModRevisionIs(key string, revision int64) Cmp {
+	return Cmp{kind: cmpModRevision, key: key, revision: revision}
+}
+
+// key 存在并且值是 value
+func ValueIs(key, value string) Cmp {
+	return Cmp{kind: cmpValue, key: key, value: value}
+}
+
+// 前缀下一个 key 都没有
+func PrefixEmpty(prefix string) Cmp {
+	return Cmp{kind: cmpPrefixEmpty, key: prefix}
+}
+
+// 事务里要执行的写操作, 用下面的几个函数创建
+type Op struct {
+	key    string
+	value  string
+	delete bool
+	prefix bool
+}
+
+func OpPut(key, value string) Op {
+	return Op{key: key, value: value}
+}
+
+func OpDelete(key string) Op {
+	return Op{key: key, delete: true}
+}
+
+// 删掉前缀下所有的 key
+func OpDeletePrefix(prefix string) Op {
+	return Op{key: prefix, delete: true, prefix: true}
+}
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "DELETE"
+	}
+	return "PUT"
+}
+
+// 监听到变化之后的回调, 删除的时候 value 是空的
+type WatchCallback func(_type EventType, key, value string)
+
+/**
+ * 能监听变化的存储, etcd, file 和 memory 都支持, 存成 crd 的话不支持, 只能定时去读
+ * 用的时候对 Datastore 做类型断言
+ */
+type Watchable interface {
+	/**
+	 * 监听 key 的变化, prefix 为 true 的话监听前缀下所有 key 的变化
+	 * 返回的时候监听已经建好了, 之后的每个变化都会按顺序回调 cb, 调用返回的函数取消监听
+	 */
+	Watch(key string, prefix bool, cb WatchCallback) (func(), error)
+}
+
+/**
+ * 能写带过期时间的 key 的存储, etcd 是用 lease 做的, memory 是给测试用的
+ * 用的时候对 Datastore 做类型断言
+ */
+type Leaser interface {
+	/**
+	 * 写一个 ttl 之后过期的 key, 并且在后台一直续约
+	 * 调用返回的函数停止续约, key 不会马上被删掉, 而是过了 ttl 之后自己过期, 和进程挂掉的效果是一样的
+	 */
+	KeepAlive(key, value string, ttl time.Duration) (func(), error)
+}
+
+// 并发改同一份数据的时候重试了这么多次还是没成功
+var ErrTooManyConflicts = errors.New("too many conflicts")
+
+// 存储的类型没配的话用 etcd, 配错了的话报错
+func CheckType(_type string) (string, error) {
+	switch strings.ToLower(_type) {
+	case "", DATASTORE_ETCD:
+		return DATASTORE_ETCD, nil
+	case DATASTORE_KUBERNETES:
+		return DATASTORE_KUBERNETES, nil
+	case DATASTORE_FILE:
+		return DATASTORE_FILE, nil
+	}
+	return "", errors.New("unknown datastore type " + _type + ", it must be etcd, kubernetes or file")
+}
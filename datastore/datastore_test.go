@@ -0,0 +1,568 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testcni/client"
+	"testcni/etcd"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// 在本地起一个内嵌的 etcd, 不依赖真实的 k8s 集群
+func startEmbedEtcd(t *testing.T) (*etcd.EtcdClient, func()) {
+	test := assert.New(t)
+	clientPort, err := getFreePort()
+	test.Nil(err)
+	peerPort, err := getFreePort()
+	test.Nil(err)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", clientPort))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", peerPort))
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("embed etcd start timeout")
+	}
+
+	client, err := etcd.NewEtcdClient(&etcd.EtcdConfig{
+		EtcdEndpoints: clientURL.String(),
+	})
+	if err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		e.Close()
+	}
+}
+
+/**
+ * 内存里的 apiserver, 和真的一样每次写都会换一个 resourceVersion
+ * failWrite 返回错误的话这次写就失败, 用来模拟写到一半进程挂了
+ */
+type fakeResources struct {
+	lock      sync.Mutex
+	objects   map[string][]byte
+	version   int
+	failWrite func(plural, name string) error
+}
+
+func newFakeResources() *fakeResources {
+	return &fakeResources{objects: map[string][]byte{}}
+}
+
+func (f *fakeResources) Get(plural, name string, out interface{}) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, ok := f.objects[plural+"/"+name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, out)
+}
+
+func (f *fakeResources) List(plural, labelSelector string, out interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	kv := strings.SplitN(labelSelector, "=", 2)
+	list := &ResourceList{}
+	for key, data := range f.objects {
+		if !strings.HasPrefix(key, plural+"/") {
+			continue
+		}
+		obj := Resource{}
+		err := json.Unmarshal(data, &obj)
+		if err != nil {
+			return err
+		}
+		if obj.Labels[kv[0]] == kv[1] {
+			list.Items = append(list.Items, obj)
+		}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (f *fakeResources) save(plural string, in, out interface{}) error {
+	obj := &Resource{}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, obj)
+	if err != nil {
+		return err
+	}
+	f.version++
+	obj.ResourceVersion = strconv.Itoa(f.version)
+	data, err = json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	f.objects[plural+"/"+obj.Name] = data
+	return json.Unmarshal(data, out)
+}
+
+func (f *fakeResources) Create(plural string, in, out interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failWrite != nil {
+		if err := f.failWrite(plural, in.(*Resource).Name); err != nil {
+			return err
+		}
+	}
+	if _, ok := f.objects[plural+"/"+in.(*Resource).Name]; ok {
+		return client.ErrConflict
+	}
+	return f.save(plural, in, out)
+}
+
+func (f *fakeResources) Update(plural, name string, in, out interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failWrite != nil {
+		if err := f.failWrite(plural, name); err != nil {
+			return err
+		}
+	}
+	data, ok := f.objects[plural+"/"+name]
+	if !ok {
+		return errors.New("not found")
+	}
+	current := &Resource{}
+	err := json.Unmarshal(data, current)
+	if err != nil {
+		return err
+	}
+	if current.ResourceVersion != in.(*Resource).ResourceVersion {
+		return client.ErrConflict
+	}
+	return f.save(plural, in, out)
+}
+
+func (f *fakeResources) count(plural string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	res := 0
+	for key := range f.objects {
+		if strings.HasPrefix(key, plural+"/") {
+			res++
+		}
+	}
+	return res
+}
+
+/**
+ * 同样的读写在每种存储上的结果得是一样的
+ */
+func testDatastore(test *assert.Assertions, ds Datastore) {
+	const pool = "/testcni/ipam/10.244.0.0/16/"
+	hostPath := pool + "ding-1"
+	allocPath := pool + "ding-1/allocations/cid-1/eth0"
+	blockPath := pool + "blocks/10.244.1.0"
+	ipPath := pool + "10.244.1.0/ips/10.244.1.2"
+
+	val, revision, err := ds.GetWithRevision(hostPath)
+	test.Nil(err)
+	test.Equal("", val)
+	test.Equal(int64(0), revision)
+	kvs, err := ds.List(pool + "blocks/")
+	test.Nil(err)
+	test.Len(kvs, 0)
+
+	// 占网段
+	succeeded, err := ds.Txn(
+		[]Cmp{KeyMissing(blockPath), KeyMissing(hostPath)},
+		OpPut(blockPath, "ding-1"),
+		OpPut(hostPath, "10.244.1.0"),
+	)
+	test.Nil(err)
+	test.True(succeeded)
+	succeeded, err = ds.Txn([]Cmp{KeyMissing(blockPath)}, OpPut(blockPath, "ding-2"))
+	test.Nil(err)
+	test.False(succeeded)
+	val, err = ds.Get(blockPath)
+	test.Nil(err)
+	test.Equal("ding-1", val)
+
+	// 分 ip, 写分配记录
+	succeeded, err = ds.Txn(
+		[]Cmp{KeyMissing(ipPath), KeyMissing(allocPath), ValueIs(blockPath, "ding-1")},
+		OpPut(ipPath, "ding-1/cid-1/eth0"),
+		OpPut(pool+"10.244.1.0/cursor", "10.244.1.2"),
+		OpPut(allocPath, "{}"),
+	)
+	test.Nil(err)
+	test.True(succeeded)
+	succeeded, err = ds.Txn([]Cmp{ValueIs(blockPath, "ding-2")}, OpPut(ipPath, "ding-2"))
+	test.Nil(err)
+	test.False(succeeded)
+
+	kvs, err = ds.List(pool + "10.244.1.0/ips/")
+	test.Nil(err)
+	test.Equal(map[string]string{ipPath: "ding-1/cid-1/eth0"}, kvs)
+	kvs, err = ds.List(pool + "ding-1/allocations/")
+	test.Nil(err)
+	test.Equal(map[string]string{allocPath: "{}"}, kvs)
+
+	// cas
+	_, revision, err = ds.GetWithRevision(allocPath)
+	test.Nil(err)
+	test.NotEqual(int64(0), revision)
+	succeeded, err = ds.Txn([]Cmp{ModRevisionIs(allocPath, revision)}, OpPut(allocPath, `{"ip":"10.244.1.2"}`))
+	test.Nil(err)
+	test.True(succeeded)
+	succeeded, err = ds.Txn([]Cmp{ModRevisionIs(allocPath, revision)}, OpDelete(allocPath))
+	test.Nil(err)
+	test.False(succeeded)
+	_, newRevision, err := ds.GetWithRevision(allocPath)
+	test.Nil(err)
+	test.True(newRevision > revision)
+	succeeded, err = ds.Txn([]Cmp{KeyExists(allocPath)}, OpPut(allocPath, `{"ip":"10.244.1.3"}`))
+	test.Nil(err)
+	test.True(succeeded)
+	succeeded, err = ds.Txn([]Cmp{KeyExists(pool + "ding-2")}, OpPut(pool+"ding-2", "10.244.2.0"))
+	test.Nil(err)
+	test.False(succeeded)
+
+	// 网段里还有 ip 的时候不能还
+	succeeded, err = ds.Txn([]Cmp{PrefixEmpty(pool + "10.244.1.0/ips/")}, OpDelete(blockPath))
+	test.Nil(err)
+	test.False(succeeded)
+	succeeded, err = ds.Txn(nil, OpDelete(ipPath), OpDelete(allocPath))
+	test.Nil(err)
+	test.True(succeeded)
+	succeeded, err = ds.Txn([]Cmp{PrefixEmpty(pool + "10.244.1.0/ips/")}, OpDelete(blockPath))
+	test.Nil(err)
+	test.True(succeeded)
+
+	err = ds.Set(pool+"maps", `{"10.244.1.0":"ding-1"}`)
+	test.Nil(err)
+	val, err = ds.Get(pool + "maps")
+	test.Nil(err)
+	test.Equal(`{"10.244.1.0":"ding-1"}`, val)
+	kvs, err = ds.List(pool)
+	test.Nil(err)
+	test.Len(kvs, 3)
+
+	succeeded, err = ds.Txn(nil, OpDeletePrefix(pool))
+	test.Nil(err)
+	test.True(succeeded)
+	kvs, err = ds.List(pool)
+	test.Nil(err)
+	test.Len(kvs, 0)
+}
+
+func TestEtcdDatastore(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	ds := NewEtcdDatastore(client)
+	test.Equal(DATASTORE_ETCD, ds.Type())
+	testDatastore(test, ds)
+	testWatch(test, ds)
+	// etcd 的 lease 最短也有一两秒
+	testLease(test, ds, time.Second, 3*time.Second)
+}
+
+func TestKubernetesDatastore(t *testing.T) {
+	test := assert.New(t)
+	resources := newFakeResources()
+	ds := NewKubernetesDatastore(resources)
+	test.Equal(DATASTORE_KUBERNETES, ds.Type())
+	testDatastore(test, ds)
+	// crd 没法监听, 只能定时去读
+	_, ok := interface{}(ds).(Watchable)
+	test.False(ok)
+
+	// 每个 ipam 一个 IPPool, 每个网段一个 BlockAffinity, 每台主机一个 IPAllocation
+	test.Equal(1, resources.count(KindIPPool.Plural))
+	test.Equal(1, resources.count(KindBlockAffinity.Plural))
+	test.Equal(1, resources.count(KindIPAllocation.Plural))
+
+	_, err := ds.Get("/registry/minions/ding-1")
+	test.NotNil(err)
+	_, err = ds.Txn(nil, OpPut("/testcni/ipam/10.244.0.0/16/a", "1"), OpPut("/testcni/ipam/10.245.0.0/16/a", "1"))
+	test.NotNil(err)
+}
+
+/**
+ * 一堆进程同时用 cas 改同一个 key, 一次都不能丢
+ * 第 i 个进程用的是 open(i) 拿到的存储
+ */
+func testConcurrentCAS(test *assert.Assertions, open func(i int) Datastore) {
+	const key = "/testcni/ipam/10.244.0.0/16/10.244.1.0/cursor"
+	const workers = 8
+	const times = 10
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		ds := open(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; {
+				val, revision, err := ds.GetWithRevision(key)
+				test.Nil(err)
+				count, _ := strconv.Atoi(val)
+				succeeded, err := ds.Txn(
+					[]Cmp{ModRevisionIs(key, revision)},
+					OpPut(key, strconv.Itoa(count+1)),
+				)
+				test.Nil(err)
+				if succeeded {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := open(0).Get(key)
+	test.Nil(err)
+	test.Equal(strconv.Itoa(workers*times), val)
+}
+
+func TestKubernetesDatastoreConcurrentCAS(t *testing.T) {
+	ds := NewKubernetesDatastore(newFakeResources())
+	testConcurrentCAS(assert.New(t), func(int) Datastore { return ds })
+}
+
+/**
+ * 事务提交之后写各个对象的时候挂了, 之后谁读到了都会接着把它做完
+ */
+func TestKubernetesDatastoreRecover(t *testing.T) {
+	test := assert.New(t)
+	resources := newFakeResources()
+	ds := NewKubernetesDatastore(resources)
+	const pool = "/testcni/ipam/10.244.0.0/16/"
+
+	err := ds.Set(pool+"ding-1", "10.244.1.0")
+	test.Nil(err)
+	resources.failWrite = func(plural, name string) error {
+		pending := &Resource{}
+		found, err := resources.getLocked(KindIPPool.Plural, poolName(strings.TrimSuffix(pool, "/")), pending)
+		if err != nil {
+			return err
+		}
+		// 日志已经写进去了, 再写别的都失败
+		if found && pending.Spec.Pending != nil {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	succeeded, err := ds.Txn(
+		[]Cmp{KeyMissing(pool + "blocks/10.244.1.0")},
+		OpPut(pool+"blocks/10.244.1.0", "ding-1"),
+		OpPut(pool+"maps", `{"10.244.1.0":"ding-1"}`),
+	)
+	test.Nil(err)
+	test.True(succeeded)
+	test.Equal(0, resources.count(KindBlockAffinity.Plural))
+
+	// 恢复之后第一次读的时候把没做完的事务做完
+	resources.failWrite = nil
+	val, err := ds.Get(pool + "blocks/10.244.1.0")
+	test.Nil(err)
+	test.Equal("ding-1", val)
+	val, err = ds.Get(pool + "maps")
+	test.Nil(err)
+	test.Equal(`{"10.244.1.0":"ding-1"}`, val)
+	val, err = ds.Get(pool + "ding-1")
+	test.Nil(err)
+	test.Equal("10.244.1.0", val)
+	poolObj, err := ds.syncedPool(strings.TrimSuffix(pool, "/"))
+	test.Nil(err)
+	test.Nil(poolObj.Spec.Pending)
+}
+
+// 在已经拿着锁的时候读对象
+func (f *fakeResources) getLocked(plural, name string, out interface{}) (bool, error) {
+	data, ok := f.objects[plural+"/"+name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, out)
+}
+
+/**
+ * 监听前缀和单个 key, 变化要按顺序收到, 取消之后就收不到了
+ */
+func testWatch(test *assert.Assertions, ds Datastore) {
+	const pool = "/testcni/ipam/10.246.0.0/16/"
+	watchable, ok := ds.(Watchable)
+	test.True(ok)
+
+	type event struct {
+		_type EventType
+		key   string
+		value string
+	}
+	ipEvents := make(chan event, 10)
+	mapsEvents := make(chan event, 10)
+	cancelIPs, err := watchable.Watch(pool+"10.246.1.0/ips/", true, func(_type EventType, key, value string) {
+		ipEvents <- event{_type, key, value}
+	})
+	test.Nil(err)
+	cancelMaps, err := watchable.Watch(pool+"maps", false, func(_type EventType, key, value string) {
+		mapsEvents <- event{_type, key, value}
+	})
+	test.Nil(err)
+	defer cancelMaps()
+
+	receive := func(events chan event) event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			test.Fail("timeout waiting for the watch event")
+			return event{}
+		}
+	}
+
+	ipPath := pool + "10.246.1.0/ips/10.246.1.2"
+	test.Nil(ds.Set(ipPath, "ding-1"))
+	test.Equal(event{EventPut, ipPath, "ding-1"}, receive(ipEvents))
+	// 别的前缀和 maps 这个 key 的前缀都不算
+	test.Nil(ds.Set(pool+"10.246.2.0/ips/10.246.2.2", "ding-2"))
+	test.Nil(ds.Set(pool+"maps-old", "{}"))
+	test.Nil(ds.Set(pool+"maps", `{"10.246.1.0":"ding-1"}`))
+	test.Equal(event{EventPut, pool + "maps", `{"10.246.1.0":"ding-1"}`}, receive(mapsEvents))
+	_, err = ds.Txn(nil, OpDelete(ipPath))
+	test.Nil(err)
+	test.Equal(event{EventDelete, ipPath, ""}, receive(ipEvents))
+
+	cancelIPs()
+	test.Nil(ds.Set(ipPath, "ding-1"))
+	test.Nil(ds.Set(pool+"maps", "{}"))
+	test.Equal(event{EventPut, pool + "maps", "{}"}, receive(mapsEvents))
+	select {
+	case ev := <-ipEvents:
+		test.Fail("unexpected event after cancel", ev)
+	default:
+	}
+	select {
+	case ev := <-mapsEvents:
+		test.Fail("unexpected event", ev)
+	default:
+	}
+}
+
+/**
+ * 一直续约的时候过了 ttl 也还在, 停止续约之后过一会儿就自己没了
+ * renewFor 要比 ttl 长, 确保真的续过约
+ */
+func testLease(test *assert.Assertions, ds Datastore, ttl, renewFor time.Duration) {
+	leaser, ok := ds.(Leaser)
+	test.True(ok)
+	const key = "/testcni/nodes/node-a/alive"
+	stop, err := leaser.KeepAlive(key, "2026-10-18T00:00:00Z", ttl)
+	test.Nil(err)
+	val, err := ds.Get(key)
+	test.Nil(err)
+	test.Equal("2026-10-18T00:00:00Z", val)
+
+	time.Sleep(renewFor)
+	val, err = ds.Get(key)
+	test.Nil(err)
+	test.Equal("2026-10-18T00:00:00Z", val)
+
+	stop()
+	test.Eventually(func() bool {
+		val, err := ds.Get(key)
+		return err == nil && val == ""
+	}, renewFor+5*time.Second, 20*time.Millisecond)
+}
+
+func TestMemoryDatastore(t *testing.T) {
+	test := assert.New(t)
+	ds := NewMemoryDatastore()
+	test.Equal(DATASTORE_MEMORY, ds.Type())
+	testDatastore(test, ds)
+	testWatch(test, ds)
+	testConcurrentCAS(test, func(int) Datastore { return ds })
+	testLease(test, ds, 50*time.Millisecond, 150*time.Millisecond)
+}
+
+func TestFileDatastore(t *testing.T) {
+	test := assert.New(t)
+	path := filepath.Join(t.TempDir(), "ipam", "ipam.json")
+	open := func() *FileDatastore {
+		ds, err := NewFileDatastore(path)
+		test.Nil(err)
+		ds.pollInterval = 20 * time.Millisecond
+		return ds
+	}
+	ds := open()
+	test.Equal(DATASTORE_FILE, ds.Type())
+	testDatastore(test, ds)
+	testWatch(test, ds)
+	// 每个进程都自己打开文件, 靠文件锁来互斥
+	testConcurrentCAS(test, func(int) Datastore { return open() })
+
+	// 换一个进程打开还是原来的数据, 文件只有自己能读写
+	val, err := open().Get("/testcni/ipam/10.246.0.0/16/maps")
+	test.Nil(err)
+	test.Equal("{}", val)
+	info, err := os.Stat(path)
+	test.Nil(err)
+	test.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// 别的进程改的也能监听到
+	events := make(chan string, 1)
+	cancel, err := ds.Watch("/testcni/ipam/10.246.0.0/16/maps", false, func(_ EventType, _, value string) {
+		events <- value
+	})
+	test.Nil(err)
+	defer cancel()
+	test.Nil(open().Set("/testcni/ipam/10.246.0.0/16/maps", `{"a":"b"}`))
+	select {
+	case value := <-events:
+		test.Equal(`{"a":"b"}`, value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the watch event")
+	}
+
+	_, err = NewFileDatastore("")
+	test.NotNil(err)
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"context"
+	"testcni/etcd"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	oriEtcd "go.etcd.io/etcd/client/v3"
+)
+
+// 直接存在 etcd 里, 事务就是 etcd 的事务
+type EtcdDatastore struct {
+	client *etcd.EtcdClient
+}
+
+func NewEtcdDatastore(client *etcd.EtcdClient) *EtcdDatastore {
+	return &EtcdDatastore{client: client}
+}
+
+// 底层的 etcd 客户端, 比如 vxlan 模式下要监听 ip 的变化
+func (ds *EtcdDatastore) Client() *etcd.EtcdClient {
+	return ds.client
+}
+
+func (ds *EtcdDatastore) Type() string {
+	return DATASTORE_ETCD
+}
+
+func (ds *EtcdDatastore) Get(key string) (string, error) {
+	return ds.client.Get(key)
+}
+
+func (ds *EtcdDatastore) GetWithRevision(key string) (string, int64, error) {
+	return ds.client.GetWithRevision(key)
+}
+
+func (ds *EtcdDatastore) List(prefix string) (map[string]string, error) {
+	return ds.client.GetAllKeyValue(prefix, oriEtcd.WithPrefix())
+}
+
+func (ds *EtcdDatastore) Set(key, value string) error {
+	return ds.client.Set(key, value)
+}
+
+func (ds *EtcdDatastore) Txn(cmps []Cmp, ops ...Op) (bool, error) {
+	etcdCmps := make([]oriEtcd.Cmp, 0, len(cmps))
+	for _, cmp := range cmps {
+		etcdCmps = append(etcdCmps, toEtcdCmp(cmp))
+	}
+	etcdOps := make([]oriEtcd.Op, 0, len(ops))
+	for _, op := range ops {
+		etcdOps = append(etcdOps, toEtcdOp(op))
+	}
+	return ds.client.Txn(etcdCmps, etcdOps...)
+}
+
+func (ds *EtcdDatastore) Watch(key string, prefix bool, cb WatchCallback) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := []oriEtcd.OpOption{}
+	if prefix {
+		opts = append(opts, oriEtcd.WithPrefix())
+	}
+	err := ds.client.WatchContext(ctx, key, func(_type mvccpb.Event_EventType, key, value []byte) {
+		if _type == mvccpb.DELETE {
+			cb(EventDelete, string(key), "")
+			return
+		}
+		cb(EventPut, string(key), string(value))
+	}, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancel, nil
+}
+
+func (ds *EtcdDatastore) KeepAlive(key, value string, ttl time.Duration) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// lease 的 ttl 是按秒算的, 不满一秒的按一秒算
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	err := ds.client.KeepAlive(ctx, key, value, seconds)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancel, nil
+}
+
+func toEtcdCmp(cmp Cmp) oriEtcd.Cmp {
+	switch cmp.kind {
+	case cmpExists:
+		return oriEtcd.Compare(oriEtcd.CreateRevision(cmp.key), "!=", 0)
+	case cmpModRevision:
+		return oriEtcd.Compare(oriEtcd.ModRevision(cmp.key), "=", cmp.revision)
+	case cmpValue:
+		return oriEtcd.Compare(oriEtcd.Value(cmp.key), "=", cmp.value)
+	case cmpPrefixEmpty:
+		return oriEtcd.Compare(oriEtcd.CreateRevision(cmp.key), "=", 0).WithPrefix()
+	}
+	return oriEtcd.Compare(oriEtcd.CreateRevision(cmp.key), "=", 0)
+}
+
+func toEtcdOp(op Op) oriEtcd.Op {
+	if !op.delete {
+		return oriEtcd.OpPut(op.key, op.value)
+	}
+	if op.prefix {
+		return oriEtcd.OpDelete(op.key, oriEtcd.WithPrefix())
+	}
+	return oriEtcd.OpDelete(op.key)
+}
@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testcni/utils"
+	"time"
+)
+
+/**
+ * 存在本机的一个 json 文件里, 单节点或者边缘节点上没有 etcd 可用的时候用这个
+ * 同一时间可能有好几个 cni 进程在分 ip, 所以每次读写都要先拿 <path>.lock 的文件锁, 写的时候拿的是排他锁
+ * 写的时候先写到临时文件再 rename 过去, 写到一半挂了也不会把原来的数据写坏
+ * 监听是定时去读文件, 看 revision 有没有变
+ */
+type FileDatastore struct {
+	path string
+	// flock 管的是进程之间, 同一个进程里的 goroutine 之间还得再加一把锁
+	lock         sync.Mutex
+	pollInterval time.Duration
+}
+
+// 默认每秒读一次文件看有没有变化
+const DEFAULT_FILE_POLL_INTERVAL = time.Second
+
+func NewFileDatastore(path string) (*FileDatastore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("the path of the file datastore is empty")
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDatastore{path: path, pollInterval: DEFAULT_FILE_POLL_INTERVAL}, nil
+}
+
+func (ds *FileDatastore) Type() string {
+	return DATASTORE_FILE
+}
+
+// 拿着文件锁读出数据交给 fn, fn 返回 true 的话再把数据写回去
+func (ds *FileDatastore) withLock(exclusive bool, fn func(data *kvData) (bool, error)) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	lockFile, err := os.OpenFile(ds.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(lockFile.Fd()), how)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", ds.path, err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	data, err := ds.load()
+	if err != nil {
+		return err
+	}
+	dirty, err := fn(data)
+	if err != nil || !dirty {
+		return err
+	}
+	return ds.save(data)
+}
+
+func (ds *FileDatastore) load() (*kvData, error) {
+	content, err := os.ReadFile(ds.path)
+	if os.IsNotExist(err) {
+		return newKVData(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := newKVData()
+	err = json.Unmarshal(content, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", ds.path, err)
+	}
+	if data.Entries == nil {
+		data.Entries = map[string]kvEntry{}
+	}
+	return data, nil
+}
+
+func (ds *FileDatastore) save(data *kvData) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp := ds.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp, ds.path)
+}
+
+func (ds *FileDatastore) Get(key string) (string, error) {
+	val, _, err := ds.GetWithRevision(key)
+	return val, err
+}
+
+func (ds *FileDatastore) GetWithRevision(key string) (string, int64, error) {
+	var val string
+	var revision int64
+	err := ds.withLock(false, func(data *kvData) (bool, error) {
+		val, revision = data.get(key)
+		return false, nil
+	})
+	return val, revision, err
+}
+
+func (ds *FileDatastore) List(prefix string) (map[string]string, error) {
+	var res map[string]string
+	err := ds.withLock(false, func(data *kvData) (bool, error) {
+		res = data.list(prefix)
+		return false, nil
+	})
+	return res, err
+}
+
+func (ds *FileDatastore) Set(key, value string) error {
+	_, err := ds.Txn(nil, OpPut(key, value))
+	return err
+}
+
+func (ds *FileDatastore) Txn(cmps []Cmp, ops ...Op) (bool, error) {
+	succeeded := false
+	err := ds.withLock(true, func(data *kvData) (bool, error) {
+		if !data.compare(cmps) {
+			return false, nil
+		}
+		succeeded = true
+		return len(data.apply(ops)) > 0, nil
+	})
+	return succeeded && err == nil, err
+}
+
+func (ds *FileDatastore) snapshot() (*kvData, error) {
+	var res *kvData
+	err := ds.withLock(false, func(data *kvData) (bool, error) {
+		res = data
+		return false, nil
+	})
+	return res, err
+}
+
+func (ds *FileDatastore) Watch(key string, prefix bool, cb WatchCallback) (func(), error) {
+	prev, err := ds.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ds.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			current, err := ds.snapshot()
+			if err != nil {
+				utils.WriteLog("读取 ", ds.path, " 失败: ", err.Error())
+				continue
+			}
+			if current.Revision == prev.Revision {
+				continue
+			}
+			for _, ev := range current.diff(prev) {
+				if watchMatches(key, prefix, ev.key) {
+					cb(ev._type, ev.key, ev.value)
+				}
+			}
+			prev = current
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(stop) })
+	}, nil
+}
@@ -0,0 +1,711 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testcni/client"
+	"testcni/utils"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+ * 通过 k8s 的 api 把 ipam 的数据存成 crd, crd 的定义在项目根目录的 testcni-crds.yaml 里
+ * 每个 ipam(也就是 etcd 里的 /testcni/ipam/<subnet>/<mask>) 的数据分成三种对象:
+ * IPPool: 每个 ipam 一个, 存着 maps, version 这些整个 ipam 共用的 key, 以及事务的 revision 和日志
+ * BlockAffinity: 每个网段一个, 存着网段被谁占着, 网段里用了哪些 ip 以及 cursor
+ * IPAllocation: 每台主机一个, 存着主机拿到的第一个网段以及主机上每块儿网卡的分配记录
+ *
+ * k8s 的对象只能一个一个地按 resourceVersion 做 cas, 没办法像 etcd 一样同时改好几个 key
+ * 所以事务是这么做的:
+ * 1. 读 IPPool, 上一个事务的日志还在的话先帮它做完
+ * 2. 读出事务涉及到的对象, 检查 cmps
+ * 3. 把要写的东西作为日志写到 IPPool 里, 写的时候带着第 1 步读出来的 resourceVersion, 写成功了事务就算提交了
+ * 4. 把日志里的东西写到各个对象里, 再把日志清掉
+ * 提交之后谁读到了日志谁就接着做, 所以进程在第 4 步挂了也没关系
+ */
+
+const (
+	CRD_GROUP   = "testcni.io"
+	CRD_VERSION = "v1"
+	// 每个对象都带着这个 label, 值是它所在的 IPPool 的名字
+	POOL_LABEL = "testcni.io/pool"
+)
+
+// ipam 的 key 都在这个前缀下
+const keyPrefix = "/testcni/ipam/"
+
+// 这几个是整个 ipam 共用的 key, 存在 IPPool 里
+var poolKeys = map[string]bool{"maps": true, "version": true, "pool": true}
+
+// 对象之间 cas 冲突的时候最多重试这么多次
+const conflictRetryTimes = 64
+
+// crd 的增删改查, 用的是 client 包里的 Resources, 测试的时候可以换成内存里的
+type ResourceClient interface {
+	// 对象不存在的话返回 false
+	Get(plural, name string, out interface{}) (bool, error)
+	List(plural, labelSelector string, out interface{}) error
+	// 已经有了的话返回 client.ErrConflict
+	Create(plural string, in, out interface{}) error
+	// resourceVersion 对不上的话返回 client.ErrConflict
+	Update(plural, name string, in, out interface{}) error
+}
+
+type resourceKind struct {
+	Kind   string
+	Plural string
+}
+
+var (
+	KindIPPool        = resourceKind{Kind: "IPPool", Plural: "ippools"}
+	KindBlockAffinity = resourceKind{Kind: "BlockAffinity", Plural: "blockaffinities"}
+	KindIPAllocation  = resourceKind{Kind: "IPAllocation", Plural: "ipallocations"}
+)
+
+// 一个 key 的值和它的 revision, 和 etcd 里的 CreateRevision/ModRevision 是一个意思
+type Entry struct {
+	Value          string `json:"value"`
+	CreateRevision int64  `json:"createRevision"`
+	ModRevision    int64  `json:"modRevision"`
+}
+
+// 已经提交了但是还没写到各个对象里的事务
+type PendingTxn struct {
+	Revision int64          `json:"revision"`
+	Writes   []PendingWrite `json:"writes"`
+}
+
+type PendingWrite struct {
+	Key    string `json:"key"`
+	Delete bool   `json:"delete,omitempty"`
+	Entry  Entry  `json:"entry"`
+}
+
+type ResourceSpec struct {
+	// 对象属于哪个 ipam, 比如 /testcni/ipam/10.244.0.0/16
+	Pool string `json:"pool"`
+	// key 是相对于 Pool 的, 比如 blocks/10.244.1.0
+	Entries map[string]Entry `json:"entries,omitempty"`
+	// IPPool 里是最后一个提交了的事务的 revision, 其他对象里是最后一个写到这个对象里的事务的 revision
+	Revision int64 `json:"revision,omitempty"`
+	// 只有 IPPool 有
+	Pending *PendingTxn `json:"pending,omitempty"`
+}
+
+type Resource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ResourceSpec `json:"spec"`
+}
+
+type ResourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Resource `json:"items"`
+}
+
+type objectRef struct {
+	kind resourceKind
+	name string
+}
+
+func (ref objectRef) id() string {
+	return ref.kind.Plural + "/" + ref.name
+}
+
+type KubernetesDatastore struct {
+	client ResourceClient
+}
+
+func NewKubernetesDatastore(client ResourceClient) *KubernetesDatastore {
+	return &KubernetesDatastore{client: client}
+}
+
+func (ds *KubernetesDatastore) Type() string {
+	return DATASTORE_KUBERNETES
+}
+
+// k8s 的对象名只能有小写字母, 数字和 -, 后面带上一截 hash 防止不同的 key 转完之后撞了
+func sanitizeName(name string) string {
+	builder := strings.Builder{}
+	lastDash := true
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			builder.WriteRune(c)
+			lastDash = false
+		} else if !lastDash {
+			builder.WriteRune('-')
+			lastDash = true
+		}
+	}
+	res := strings.TrimSuffix(builder.String(), "-")
+	if len(res) > 180 {
+		res = res[:180]
+	}
+	return res
+}
+
+func shortHash(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// IPPool 的名字, 同时也是其他对象上的 POOL_LABEL 的值, 比如 10-244-0-0-16-1a2b3c4d
+func poolName(pool string) string {
+	return sanitizeName(strings.TrimPrefix(pool, keyPrefix)) + "-" + shortHash(pool)
+}
+
+func objectName(pool, part string) string {
+	return poolName(pool) + "-" + sanitizeName(part) + "-" + shortHash(pool+"/"+part)
+}
+
+/**
+ * 把 key 拆成 ipam 的前缀和相对的 key
+ * 比如 /testcni/ipam/10.244.0.0/16/blocks/10.244.1.0 拆成 /testcni/ipam/10.244.0.0/16 和 blocks/10.244.1.0
+ * key 是前缀的时候相对的部分可以是空的
+ */
+func splitKey(key string) (string, string, error) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return "", "", fmt.Errorf("key %s is not supported by the kubernetes datastore", key)
+	}
+	segs := strings.SplitN(strings.TrimPrefix(key, keyPrefix), "/", 3)
+	if len(segs) < 3 || segs[0] == "" || segs[1] == "" {
+		return "", "", fmt.Errorf("key %s is not supported by the kubernetes datastore", key)
+	}
+	return keyPrefix + segs[0] + "/" + segs[1], segs[2], nil
+}
+
+// 相对的 key 存在哪个对象里
+func refOf(pool, rel string) objectRef {
+	segs := strings.Split(rel, "/")
+	switch {
+	case len(segs) == 1 && poolKeys[segs[0]]:
+		return objectRef{kind: KindIPPool, name: poolName(pool)}
+	case segs[0] == "blocks" && len(segs) > 1:
+		return objectRef{kind: KindBlockAffinity, name: objectName(pool, segs[1])}
+	case len(segs) > 1 && (segs[1] == "ips" || segs[1] == "cursor"):
+		return objectRef{kind: KindBlockAffinity, name: objectName(pool, segs[0])}
+	}
+	return objectRef{kind: KindIPAllocation, name: objectName(pool, segs[0])}
+}
+
+/**
+ * 前缀下的 key 可能在哪些对象里
+ * 第一段是完整的话(比如 <network>/ips/)只可能在那个网段或者主机的对象里, 否则就得把整种对象都列出来
+ */
+func refsOfPrefix(pool, relPrefix string) ([]resourceKind, []objectRef) {
+	i := strings.Index(relPrefix, "/")
+	if i < 0 {
+		return []resourceKind{KindBlockAffinity, KindIPAllocation}, nil
+	}
+	seg := relPrefix[:i]
+	if seg == "blocks" {
+		return []resourceKind{KindBlockAffinity}, nil
+	}
+	return nil, []objectRef{
+		{kind: KindBlockAffinity, name: objectName(pool, seg)},
+		{kind: KindIPAllocation, name: objectName(pool, seg)},
+	}
+}
+
+func backoff() {
+	time.Sleep(time.Duration(utils.GetRandomNumber(20)) * time.Millisecond)
+}
+
+func (ds *KubernetesDatastore) getObject(ref objectRef) (*Resource, error) {
+	obj := &Resource{}
+	found, err := ds.client.Get(ref.kind.Plural, ref.name, obj)
+	if err != nil || !found {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (ds *KubernetesDatastore) listObjects(kind resourceKind, pool string) ([]*Resource, error) {
+	list := &ResourceList{}
+	err := ds.client.List(kind.Plural, POOL_LABEL+"="+poolName(pool), list)
+	if err != nil {
+		return nil, err
+	}
+	res := []*Resource{}
+	for i := range list.Items {
+		if list.Items[i].Spec.Pool == pool {
+			res = append(res, &list.Items[i])
+		}
+	}
+	return res, nil
+}
+
+func newResource(ref objectRef, pool string) *Resource {
+	return &Resource{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: CRD_GROUP + "/" + CRD_VERSION,
+			Kind:       ref.kind.Kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   ref.name,
+			Labels: map[string]string{POOL_LABEL: poolName(pool)},
+		},
+		Spec: ResourceSpec{
+			Pool:    pool,
+			Entries: map[string]Entry{},
+		},
+	}
+}
+
+/**
+ * 读 IPPool, 有还没做完的事务的话先帮它做完
+ * IPPool 还不存在的话返回 nil, 说明这个 ipam 下还什么都没有
+ */
+func (ds *KubernetesDatastore) syncedPool(pool string) (*Resource, error) {
+	ref := objectRef{kind: KindIPPool, name: poolName(pool)}
+	for i := 0; i < conflictRetryTimes; i++ {
+		poolObj, err := ds.getObject(ref)
+		if err != nil {
+			return nil, err
+		}
+		if poolObj == nil || poolObj.Spec.Pending == nil {
+			return poolObj, nil
+		}
+		err = ds.finish(poolObj)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed to read ip pool %s: %w", pool, ErrTooManyConflicts)
+}
+
+/**
+ * 把 IPPool 里的日志写到各个对象里, 再把日志清掉
+ * 整个 ipam 共用的 key 和清日志是在同一次更新 IPPool 的时候做的
+ */
+func (ds *KubernetesDatastore) finish(poolObj *Resource) error {
+	pending := poolObj.Spec.Pending
+	pool := poolObj.Spec.Pool
+	grouped := map[string][]PendingWrite{}
+	refs := map[string]objectRef{}
+	for _, write := range pending.Writes {
+		ref := refOf(pool, write.Key)
+		if ref.kind == KindIPPool {
+			continue
+		}
+		grouped[ref.id()] = append(grouped[ref.id()], write)
+		refs[ref.id()] = ref
+	}
+	for id, writes := range grouped {
+		err := ds.applyWrites(refs[id], pool, pending.Revision, writes)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < conflictRetryTimes; i++ {
+		if poolObj.Spec.Entries == nil {
+			poolObj.Spec.Entries = map[string]Entry{}
+		}
+		for _, write := range pending.Writes {
+			if refOf(pool, write.Key).kind != KindIPPool {
+				continue
+			}
+			if write.Delete {
+				delete(poolObj.Spec.Entries, write.Key)
+			} else {
+				poolObj.Spec.Entries[write.Key] = write.Entry
+			}
+		}
+		poolObj.Spec.Pending = nil
+		err := ds.client.Update(KindIPPool.Plural, poolObj.Name, poolObj, &Resource{})
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, client.ErrConflict) {
+			return err
+		}
+		// 别人已经把这个事务做完了的话就不用再做了
+		current, err := ds.getObject(objectRef{kind: KindIPPool, name: poolObj.Name})
+		if err != nil {
+			return err
+		}
+		if current == nil || current.Spec.Pending == nil || current.Spec.Pending.Revision != pending.Revision {
+			return nil
+		}
+		poolObj = current
+	}
+	return fmt.Errorf("failed to finish the transaction %d of %s: %w", pending.Revision, pool, ErrTooManyConflicts)
+}
+
+/**
+ * 把一个事务要写到某个对象里的东西写进去
+ * 对象里记着最后一个写到它里面的事务, 不比这个事务旧的话说明别人已经写过了, 不能再写一遍
+ * 对象里的 key 都被删光了也不删对象, 不然慢了一步的进程会把这个事务重新写到新建的对象里
+ */
+func (ds *KubernetesDatastore) applyWrites(ref objectRef, pool string, revision int64, writes []PendingWrite) error {
+	for i := 0; i < conflictRetryTimes; i++ {
+		obj, err := ds.getObject(ref)
+		if err != nil {
+			return err
+		}
+		create := obj == nil
+		if create {
+			obj = newResource(ref, pool)
+		}
+		if obj.Spec.Revision >= revision {
+			return nil
+		}
+		if obj.Spec.Entries == nil {
+			obj.Spec.Entries = map[string]Entry{}
+		}
+		for _, write := range writes {
+			if write.Delete {
+				delete(obj.Spec.Entries, write.Key)
+			} else {
+				obj.Spec.Entries[write.Key] = write.Entry
+			}
+		}
+		obj.Spec.Revision = revision
+
+		if create {
+			err = ds.client.Create(ref.kind.Plural, obj, &Resource{})
+		} else {
+			err = ds.client.Update(ref.kind.Plural, ref.name, obj, &Resource{})
+		}
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, client.ErrConflict) {
+			return err
+		}
+		backoff()
+	}
+	return fmt.Errorf("failed to write %s: %w", ref.id(), ErrTooManyConflicts)
+}
+
+/**
+ * 一次事务里读到的对象
+ * 读之前 IPPool 里没有没做完的事务, 之后只要 IPPool 没被改过, 这些对象就都是这个时间点的样子
+ */
+type snapshot struct {
+	ds      *KubernetesDatastore
+	pool    string
+	poolObj *Resource
+	// ref.id() -> 对象, 不存在的是 nil
+	objects map[string]*Resource
+	listed  map[string]bool
+}
+
+func (ds *KubernetesDatastore) newSnapshot(pool string, poolObj *Resource) *snapshot {
+	s := &snapshot{
+		ds:      ds,
+		pool:    pool,
+		poolObj: poolObj,
+		objects: map[string]*Resource{},
+		listed:  map[string]bool{},
+	}
+	if poolObj != nil {
+		s.objects[objectRef{kind: KindIPPool, name: poolObj.Name}.id()] = poolObj
+	}
+	return s
+}
+
+func (s *snapshot) loadRef(ref objectRef) error {
+	if _, ok := s.objects[ref.id()]; ok || s.listed[ref.kind.Plural] || ref.kind == KindIPPool {
+		return nil
+	}
+	obj, err := s.ds.getObject(ref)
+	if err != nil {
+		return err
+	}
+	s.objects[ref.id()] = obj
+	return nil
+}
+
+func (s *snapshot) loadKey(rel string) error {
+	return s.loadRef(refOf(s.pool, rel))
+}
+
+func (s *snapshot) loadPrefix(relPrefix string) error {
+	kinds, refs := refsOfPrefix(s.pool, relPrefix)
+	for _, kind := range kinds {
+		if s.listed[kind.Plural] {
+			continue
+		}
+		objs, err := s.ds.listObjects(kind, s.pool)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			s.objects[objectRef{kind: kind, name: obj.Name}.id()] = obj
+		}
+		s.listed[kind.Plural] = true
+	}
+	for _, ref := range refs {
+		err := s.loadRef(ref)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) entry(rel string) (Entry, bool) {
+	obj := s.objects[refOf(s.pool, rel).id()]
+	if obj == nil {
+		return Entry{}, false
+	}
+	entry, ok := obj.Spec.Entries[rel]
+	return entry, ok
+}
+
+// 前缀下所有的 key, 要先 loadPrefix
+func (s *snapshot) entriesWithPrefix(relPrefix string) map[string]Entry {
+	res := map[string]Entry{}
+	for _, obj := range s.objects {
+		if obj == nil {
+			continue
+		}
+		for rel, entry := range obj.Spec.Entries {
+			if strings.HasPrefix(rel, relPrefix) {
+				res[rel] = entry
+			}
+		}
+	}
+	return res
+}
+
+func (ds *KubernetesDatastore) GetWithRevision(key string) (string, int64, error) {
+	pool, rel, err := splitKey(key)
+	if err != nil {
+		return "", 0, err
+	}
+	poolObj, err := ds.syncedPool(pool)
+	if err != nil || poolObj == nil {
+		return "", 0, err
+	}
+	s := ds.newSnapshot(pool, poolObj)
+	err = s.loadKey(rel)
+	if err != nil {
+		return "", 0, err
+	}
+	entry, ok := s.entry(rel)
+	if !ok {
+		return "", 0, nil
+	}
+	return entry.Value, entry.ModRevision, nil
+}
+
+func (ds *KubernetesDatastore) Get(key string) (string, error) {
+	val, _, err := ds.GetWithRevision(key)
+	return val, err
+}
+
+func (ds *KubernetesDatastore) List(prefix string) (map[string]string, error) {
+	pool, relPrefix, err := splitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	poolObj, err := ds.syncedPool(pool)
+	if err != nil || poolObj == nil {
+		return res, err
+	}
+	s := ds.newSnapshot(pool, poolObj)
+	err = s.loadPrefix(relPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for rel, entry := range s.entriesWithPrefix(relPrefix) {
+		res[pool+"/"+rel] = entry.Value
+	}
+	return res, nil
+}
+
+func (ds *KubernetesDatastore) Set(key, value string) error {
+	_, err := ds.Txn(nil, OpPut(key, value))
+	return err
+}
+
+// 事务里的 key 必须都在同一个 ipam 下
+func txnPool(cmps []Cmp, ops []Op) (string, error) {
+	pool := ""
+	check := func(key string) error {
+		_pool, _, err := splitKey(key)
+		if err != nil {
+			return err
+		}
+		if pool != "" && pool != _pool {
+			return fmt.Errorf("keys of a transaction must be in the same pool, got %s and %s", pool, _pool)
+		}
+		pool = _pool
+		return nil
+	}
+	for _, cmp := range cmps {
+		if err := check(cmp.key); err != nil {
+			return "", err
+		}
+	}
+	for _, op := range ops {
+		if err := check(op.key); err != nil {
+			return "", err
+		}
+	}
+	return pool, nil
+}
+
+func (ds *KubernetesDatastore) Txn(cmps []Cmp, ops ...Op) (bool, error) {
+	pool, err := txnPool(cmps, ops)
+	if err != nil {
+		return false, err
+	}
+	if pool == "" {
+		return true, nil
+	}
+
+	for i := 0; i < conflictRetryTimes; i++ {
+		poolObj, err := ds.syncedPool(pool)
+		if err != nil {
+			return false, err
+		}
+		if poolObj == nil {
+			// 这个 ipam 下的第一个事务, 先把 IPPool 建出来
+			ref := objectRef{kind: KindIPPool, name: poolName(pool)}
+			err = ds.client.Create(KindIPPool.Plural, newResource(ref, pool), &Resource{})
+			if err != nil && !errors.Is(err, client.ErrConflict) {
+				return false, err
+			}
+			continue
+		}
+
+		s := ds.newSnapshot(pool, poolObj)
+		succeeded, err := s.compare(cmps)
+		if err != nil {
+			return false, err
+		}
+		if !succeeded {
+			// IPPool 没被改过的话读到的东西就是一致的, cmps 确实不成立
+			current, err := ds.getObject(objectRef{kind: KindIPPool, name: poolObj.Name})
+			if err != nil {
+				return false, err
+			}
+			if current != nil && current.ResourceVersion == poolObj.ResourceVersion {
+				return false, nil
+			}
+			continue
+		}
+
+		revision := poolObj.Spec.Revision + 1
+		writes, err := s.writes(ops, revision)
+		if err != nil {
+			return false, err
+		}
+		poolObj.Spec.Revision = revision
+		poolObj.Spec.Pending = &PendingTxn{Revision: revision, Writes: writes}
+		committed := &Resource{}
+		err = ds.client.Update(KindIPPool.Plural, poolObj.Name, poolObj, committed)
+		if errors.Is(err, client.ErrConflict) {
+			backoff()
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// 事务已经提交了, 这里写失败了的话下一个读到 IPPool 的会接着写
+		err = ds.finish(committed)
+		if err != nil {
+			utils.WriteLog("事务 ", fmt.Sprint(revision), " 已经提交了, 但是写到各个对象里的时候失败了: ", err.Error())
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("failed to commit the transaction of %s: %w", pool, ErrTooManyConflicts)
+}
+
+func (s *snapshot) compare(cmps []Cmp) (bool, error) {
+	for _, cmp := range cmps {
+		_, rel, err := splitKey(cmp.key)
+		if err != nil {
+			return false, err
+		}
+		if cmp.kind == cmpPrefixEmpty {
+			err = s.loadPrefix(rel)
+			if err != nil {
+				return false, err
+			}
+			if len(s.entriesWithPrefix(rel)) > 0 {
+				return false, nil
+			}
+			continue
+		}
+
+		err = s.loadKey(rel)
+		if err != nil {
+			return false, err
+		}
+		entry, exists := s.entry(rel)
+		var ok bool
+		switch cmp.kind {
+		case cmpMissing:
+			ok = !exists
+		case cmpExists:
+			ok = exists
+		case cmpModRevision:
+			ok = entry.ModRevision == cmp.revision
+		case cmpValue:
+			ok = exists && entry.Value == cmp.value
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// 把 ops 转成要写进日志里的东西, 删前缀的话展开成前缀下现有的每个 key
+func (s *snapshot) writes(ops []Op, revision int64) ([]PendingWrite, error) {
+	res := []PendingWrite{}
+	for _, op := range ops {
+		_, rel, err := splitKey(op.key)
+		if err != nil {
+			return nil, err
+		}
+		if op.prefix {
+			err = s.loadPrefix(rel)
+			if err != nil {
+				return nil, err
+			}
+			for key := range s.entriesWithPrefix(rel) {
+				res = append(res, PendingWrite{Key: key, Delete: true})
+			}
+			continue
+		}
+
+		err = s.loadKey(rel)
+		if err != nil {
+			return nil, err
+		}
+		entry, exists := s.entry(rel)
+		if op.delete {
+			if exists {
+				res = append(res, PendingWrite{Key: rel, Delete: true})
+			}
+			continue
+		}
+		createRevision := revision
+		if exists {
+			createRevision = entry.CreateRevision
+		}
+		res = append(res, PendingWrite{
+			Key: rel,
+			Entry: Entry{
+				Value:          op.value,
+				CreateRevision: createRevision,
+				ModRevision:    revision,
+			},
+		})
+	}
+	return res, nil
+}
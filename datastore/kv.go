@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+)
+
+/**
+ * memory 和 file 两种存储共用的数据
+ * 和 etcd 一样整个存储只有一个递增的 revision, 每个改了东西的事务加一
+ * 事务里改到的 key 的 ModRevision 都是这个事务的 revision
+ */
+
+type kvEntry struct {
+	Value       string `json:"value"`
+	ModRevision int64  `json:"modRevision"`
+}
+
+type kvData struct {
+	Revision int64              `json:"revision"`
+	Entries  map[string]kvEntry `json:"entries"`
+}
+
+type kvEvent struct {
+	_type EventType
+	key   string
+	value string
+}
+
+func newKVData() *kvData {
+	return &kvData{Entries: map[string]kvEntry{}}
+}
+
+func (d *kvData) get(key string) (string, int64) {
+	entry, ok := d.Entries[key]
+	if !ok {
+		return "", 0
+	}
+	return entry.Value, entry.ModRevision
+}
+
+func (d *kvData) list(prefix string) map[string]string {
+	res := map[string]string{}
+	for key, entry := range d.Entries {
+		if strings.HasPrefix(key, prefix) {
+			res[key] = entry.Value
+		}
+	}
+	return res
+}
+
+func (d *kvData) compare(cmps []Cmp) bool {
+	for _, cmp := range cmps {
+		if cmp.kind == cmpPrefixEmpty {
+			if len(d.list(cmp.key)) > 0 {
+				return false
+			}
+			continue
+		}
+		entry, exists := d.Entries[cmp.key]
+		var ok bool
+		switch cmp.kind {
+		case cmpMissing:
+			ok = !exists
+		case cmpExists:
+			ok = exists
+		case cmpModRevision:
+			ok = entry.ModRevision == cmp.revision
+		case cmpValue:
+			ok = exists && entry.Value == cmp.value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// 执行 ops, 返回改了哪些 key, 一个都没改的话 revision 不变
+func (d *kvData) apply(ops []Op) []kvEvent {
+	revision := d.Revision + 1
+	events := []kvEvent{}
+	for _, op := range ops {
+		if !op.delete {
+			d.Entries[op.key] = kvEntry{Value: op.value, ModRevision: revision}
+			events = append(events, kvEvent{_type: EventPut, key: op.key, value: op.value})
+			continue
+		}
+		keys := []string{op.key}
+		if op.prefix {
+			keys = sortedKeys(d.list(op.key))
+		}
+		for _, key := range keys {
+			if _, ok := d.Entries[key]; !ok {
+				continue
+			}
+			delete(d.Entries, key)
+			events = append(events, kvEvent{_type: EventDelete, key: key})
+		}
+	}
+	if len(events) > 0 {
+		d.Revision = revision
+	}
+	return events
+}
+
+/**
+ * prev 之后发生的变化, 给只能定时去读的 file 存储用
+ * 两次之间同一个 key 的几次变化会被合并成一次, 只保证最后的状态是对的
+ * 先是删掉的 key, 再按 revision 的顺序是改过的 key
+ */
+func (d *kvData) diff(prev *kvData) []kvEvent {
+	events := []kvEvent{}
+	for _, key := range sortedKeys(prev.list("")) {
+		if _, ok := d.Entries[key]; !ok {
+			events = append(events, kvEvent{_type: EventDelete, key: key})
+		}
+	}
+	changed := []string{}
+	for key, entry := range d.Entries {
+		if old, ok := prev.Entries[key]; !ok || old.ModRevision != entry.ModRevision {
+			changed = append(changed, key)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		ri, rj := d.Entries[changed[i]].ModRevision, d.Entries[changed[j]].ModRevision
+		if ri != rj {
+			return ri < rj
+		}
+		return changed[i] < changed[j]
+	})
+	for _, key := range changed {
+		events = append(events, kvEvent{_type: EventPut, key: key, value: d.Entries[key].Value})
+	}
+	return events
+}
+
+func sortedKeys(kvs map[string]string) []string {
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func watchMatches(watchKey string, prefix bool, key string) bool {
+	if prefix {
+		return strings.HasPrefix(key, watchKey)
+	}
+	return key == watchKey
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// 存在进程的内存里, 进程退出数据就没了, 给测试用
+type MemoryDatastore struct {
+	lock     sync.Mutex
+	data     *kvData
+	watchers map[int]*memoryWatcher
+	nextID   int
+}
+
+/**
+ * 每个监听者一个 goroutine, 变化先放到队列里再按顺序回调
+ * 这样写的那一方不用等回调执行完, 回调里再去读写存储也不会死锁
+ */
+type memoryWatcher struct {
+	key     string
+	prefix  bool
+	cb      WatchCallback
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []kvEvent
+	stopped bool
+}
+
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{
+		data:     newKVData(),
+		watchers: map[int]*memoryWatcher{},
+	}
+}
+
+func (ds *MemoryDatastore) Type() string {
+	return DATASTORE_MEMORY
+}
+
+func (ds *MemoryDatastore) Get(key string) (string, error) {
+	val, _, err := ds.GetWithRevision(key)
+	return val, err
+}
+
+func (ds *MemoryDatastore) GetWithRevision(key string) (string, int64, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	val, revision := ds.data.get(key)
+	return val, revision, nil
+}
+
+func (ds *MemoryDatastore) List(prefix string) (map[string]string, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.data.list(prefix), nil
+}
+
+func (ds *MemoryDatastore) Set(key, value string) error {
+	_, err := ds.Txn(nil, OpPut(key, value))
+	return err
+}
+
+func (ds *MemoryDatastore) Txn(cmps []Cmp, ops ...Op) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.txnLocked(cmps, ops), nil
+}
+
+func (ds *MemoryDatastore) txnLocked(cmps []Cmp, ops []Op) bool {
+	if !ds.data.compare(cmps) {
+		return false
+	}
+	events := ds.data.apply(ops)
+	// 拿着锁往队列里放, 保证每个监听者看到的顺序和事务提交的顺序是一样的
+	for _, w := range ds.watchers {
+		w.push(events)
+	}
+	return true
+}
+
+func (ds *MemoryDatastore) Watch(key string, prefix bool, cb WatchCallback) (func(), error) {
+	w := &memoryWatcher{key: key, prefix: prefix, cb: cb}
+	w.cond = sync.NewCond(&w.lock)
+	go w.run()
+
+	ds.lock.Lock()
+	id := ds.nextID
+	ds.nextID++
+	ds.watchers[id] = w
+	ds.lock.Unlock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			ds.lock.Lock()
+			delete(ds.watchers, id)
+			ds.lock.Unlock()
+			w.stop()
+		})
+	}, nil
+}
+
+// 停止续约之后过了 ttl, key 没被别人改过的话就删掉
+func (ds *MemoryDatastore) KeepAlive(key, value string, ttl time.Duration) (func(), error) {
+	ds.lock.Lock()
+	ds.txnLocked(nil, []Op{OpPut(key, value)})
+	_, revision := ds.data.get(key)
+	ds.lock.Unlock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			time.AfterFunc(ttl, func() {
+				ds.Txn([]Cmp{ModRevisionIs(key, revision)}, OpDelete(key))
+			})
+		})
+	}, nil
+}
+
+func (w *memoryWatcher) push(events []kvEvent) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, ev := range events {
+		if watchMatches(w.key, w.prefix, ev.key) {
+			w.queue = append(w.queue, ev)
+		}
+	}
+	w.cond.Signal()
+}
+
+func (w *memoryWatcher) stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.stopped = true
+	w.cond.Signal()
+}
+
+func (w *memoryWatcher) run() {
+	for {
+		w.lock.Lock()
+		for len(w.queue) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.lock.Unlock()
+			return
+		}
+		events := w.queue
+		w.queue = nil
+		w.lock.Unlock()
+
+		for _, ev := range events {
+			w.cb(ev._type, ev.key, ev.value)
+		}
+	}
+}
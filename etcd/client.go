@@ -4,10 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"strings"
-	"testcni/helper"
+	"testcni/consts"
 	"testcni/utils"
 	"time"
 
@@ -50,31 +47,35 @@ const (
 )
 
 func newEtcdClient(config *EtcdConfig) (*etcd.Client, error) {
-	var etcdLocation []string
-	if config.EtcdAuthority != "" {
-		etcdLocation = []string{config.EtcdScheme + "://" + config.EtcdAuthority}
-	}
-	if config.EtcdEndpoints != "" {
-		etcdLocation = strings.Split(config.EtcdEndpoints, ",")
+	etcdLocation, err := config.endpoints()
+	if err != nil {
+		return nil, err
 	}
 
-	if len(etcdLocation) == 0 {
-		return nil, errors.New("找不到 etcd")
+	etcdConfig := etcd.Config{
+		Endpoints:   etcdLocation,
+		DialTimeout: clientTimeout,
 	}
 
+	// 没给证书的话就不走 tls
 	tlsInfo := transport.TLSInfo{
 		CertFile:      config.EtcdCertFile,
 		KeyFile:       config.EtcdKeyFile,
 		TrustedCAFile: config.EtcdCACertFile,
 	}
+	if !tlsInfo.Empty() || tlsInfo.TrustedCAFile != "" {
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		etcdConfig.TLS = tlsConfig
+	}
+	if config.EtcdUsername != "" {
+		etcdConfig.Username = config.EtcdUsername
+		etcdConfig.Password = config.EtcdPassword
+	}
 
-	tlsConfig, err := tlsInfo.ClientConfig()
-
-	client, err := etcd.New(etcd.Config{
-		Endpoints:   etcdLocation,
-		TLS:         tlsConfig,
-		DialTimeout: clientTimeout,
-	})
+	client, err := etcd.New(etcdConfig)
 
 	if err != nil {
 		return nil, err
@@ -85,84 +86,79 @@ func newEtcdClient(config *EtcdConfig) (*etcd.Client, error) {
 
 var __GetEtcdClient func() (*EtcdClient, error)
 
+/**
+ * 直接根据配置创建一个 etcd 客户端
+ * 和 GetEtcdClient 不同, 这里不去读 kubeconfig, 也不是单例
+ * 主要给需要连到别的 etcd(比如测试中内嵌的 etcd)的地方用
+ */
+func NewEtcdClient(config *EtcdConfig) (*EtcdClient, error) {
+	client, err := newEtcdClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdClient{client: client}, nil
+}
+
+func (c *EtcdClient) Close() error {
+	return c.client.Close()
+}
+
 func GetEtcdClient() (*EtcdClient, error) {
 
 	if __GetEtcdClient == nil {
-		return nil, nil
+		return nil, errors.New("etcd client 需要初始化")
 	}
 	return __GetEtcdClient()
 
 }
 
-func _GetEtcdClient() func() (*EtcdClient, error) {
+/**
+ * config 是 cni 配置里的 etcd 配置, 可以是 nil
+ * 会再合并上节点上的配置文件和环境变量, 都没配的话用 kubeadm 的默认配置
+ */
+func _GetEtcdClient(config *EtcdConfig) func() (*EtcdClient, error) {
 	var _client *EtcdClient
 
 	return func() (*EtcdClient, error) {
 		if _client != nil {
 			return _client, nil
-		} else {
-			// curl https://192.168.64.19:6443/openapi/v2 --cacert ./ca.crt --cert ./tmp_ca.crt --key ./tmp.key
-			// ETCDCTL_API=3 etcdctl --endpoints https://192.168.64.19:2379 --cacert /etc/kubernetes/pki/etcd/ca.crt --cert /etc/kubernetes/pki/etcd/healthcheck-client.crt --key /etc/kubernetes/pki/etcd/healthcheck-client.key get / --prefix --keys-only
-
-			configPath := helper.GetClientConfigPath()
-			confByte, err := ioutil.ReadFile(configPath)
-			if err != nil {
-				panic(fmt.Sprintf("读取 path: %s 失败: %s", configPath, err.Error()))
-			}
-			master, err := helper.GetLineFromYaml(string(confByte), "server")
-			if err != nil {
-				panic(fmt.Sprintf("在 etcd 初始化时尝试获取 master 节点失败: %s", err.Error()))
-			}
-			etcdEp := ""
-			if master != "" {
-				masteIp := strings.Split(master, ":")
-				if len(masteIp) == 3 {
-					etcdEp = fmt.Sprintf("%s:%s:2379", masteIp[0], masteIp[1])
-				}
-			}
-			if os.Getenv("ETCD_ENDPOINT") != "" {
-				etcdEp = os.Getenv("ETCD_ENDPOINT")
-			}
-			if etcdEp == "" {
-				panic("get etcd endpoint failed from env")
-			}
-			client, err := newEtcdClient(&EtcdConfig{
-				EtcdEndpoints:  etcdEp,
-				EtcdCertFile:   "/etc/kubernetes/pki/etcd/healthcheck-client.crt",
-				EtcdKeyFile:    "/etc/kubernetes/pki/etcd/healthcheck-client.key",
-				EtcdCACertFile: "/etc/kubernetes/pki/etcd/ca.crt",
-			})
-
-			if err != nil {
-				return nil, err
-			}
-
-			status, err := client.Status(context.TODO(), etcdEp)
-
-			if err != nil {
-				utils.WriteLog("无法获取到 etcd 版本")
-				return nil, err
-			}
-
-			if client != nil {
-				_client = &EtcdClient{
-					client: client,
-				}
-
-				if status != nil && status.Version != "" {
-					_client.Version = status.Version
-				}
-				// fmt.Println("etcd 客户端初始化成功")
-				return _client, nil
-			}
 		}
-		return nil, errors.New("初始化 etcd client 失败")
+		conf, err := resolveConfig(config, consts.KUBE_TEST_CNI_DEFAULT_ETCD_CONFIG_PATH)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newEtcdClient(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		defer cancel()
+		status, err := client.Status(ctx, client.Endpoints()[0])
+		if err != nil {
+			utils.WriteLog("无法获取到 etcd 版本: ", err.Error())
+			client.Close()
+			return nil, fmt.Errorf("failed to connect to etcd %v: %v", client.Endpoints(), err)
+		}
+
+		_client = &EtcdClient{
+			client: client,
+		}
+		if status != nil && status.Version != "" {
+			_client.Version = status.Version
+		}
+		return _client, nil
 	}
 }
 
 func Init() {
+	InitWithConfig(nil)
+}
+
+// 用 cni 配置里的 etcd 配置初始化, 一个进程里只有第一次初始化的配置生效
+func InitWithConfig(config *EtcdConfig) {
 	if __GetEtcdClient == nil {
-		__GetEtcdClient = _GetEtcdClient()
+		__GetEtcdClient = _GetEtcdClient(config)
 	}
 }
 
@@ -211,6 +207,31 @@ func (c *EtcdClient) Get(key string, opts ...etcd.OpOption) (string, error) {
 	return "", nil
 }
 
+// 拿到 key 的值以及它最后一次被修改时的 revision, key 不存在的话 revision 是 0
+func (c *EtcdClient) GetWithRevision(key string) (string, int64, error) {
+	resp, err := c.client.Get(context.TODO(), key)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(resp.Kvs) > 0 {
+		kv := resp.Kvs[len(resp.Kvs)-1]
+		return string(kv.Value), kv.ModRevision, nil
+	}
+	return "", 0, nil
+}
+
+/**
+ * 在一个事务里执行 ops, 只有 cmps 全都成立的时候 ops 才会被执行
+ * 返回值表示 cmps 是否成立, 也就是 ops 有没有被执行
+ */
+func (c *EtcdClient) Txn(cmps []etcd.Cmp, ops ...etcd.Op) (bool, error) {
+	resp, err := c.client.Txn(context.TODO()).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
 func (c *EtcdClient) GetKey(key string, opts ...etcd.OpOption) (string, error) {
 	resp, err := c.client.Get(context.TODO(), key, opts...)
 	if err != nil {
@@ -260,68 +281,16 @@ func (c *EtcdClient) GetAllKey(key string, opts ...etcd.OpOption) ([]string, err
 	return res, nil
 }
 
-func (c *EtcdClient) Watch(key string, cb WatchCallback) {
-	go func() {
-		for {
-			change := c.client.Watch(context.Background(), key)
-			for wresp := range change {
-				for _, ev := range wresp.Events {
-					cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
-				}
-			}
-		}
-	}()
-}
-
-func (w *Watcher) Done() <-chan struct{} {
-	return w.ctx.Done()
-}
-
-func (w *Watcher) Deadline() (deadline time.Time, ok bool) {
-	return w.ctx.Deadline()
-}
-
-func (w *Watcher) Error() error {
-	return w.ctx.Err()
-}
-
-func (w *Watcher) Value(_any interface{}) interface{} {
-	return w.ctx.Value(_any)
-}
-
-func (w *Watcher) Cancel() {
-	w.cancelWatcher()
-}
-
-func (w *Watcher) Watch(key string, cb WatchCallback) {
-	go func() {
-		defer func() {
-			w.Cancel()
-			time.Sleep(2 * time.Second)
-		}()
-		for {
-			change := w.watcher.Watch(context.Background(), key)
-			for wresp := range change {
-				for _, ev := range wresp.Events {
-					cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
-				}
-			}
-		}
-	}()
-	// TODO: sleep change to sync
-	time.Sleep(1 * time.Second)
-}
+// 返回 map[key]value, 一般配合 WithPrefix 使用
+func (c *EtcdClient) GetAllKeyValue(key string, opts ...etcd.OpOption) (map[string]string, error) {
+	resp, err := c.client.Get(context.TODO(), key, opts...)
+	if err != nil {
+		return nil, err
+	}
 
-func (c *EtcdClient) GetWatcher() (*Watcher, error) {
-	if c.watcher != nil {
-		return c.watcher, nil
+	res := map[string]string{}
+	for _, ev := range resp.Kvs {
+		res[string(ev.Key)] = string(ev.Value)
 	}
-	watcher := &Watcher{client: c}
-	_watcher := etcd.NewWatcher(c.client)
-	watcher.watcher = _watcher
-	ctx, cancelFunc := context.WithCancel(context.TODO())
-	watcher.cancelWatcher = cancelFunc
-	watcher.ctx = ctx
-
-	return watcher, nil
+	return res, nil
 }
@@ -58,7 +58,6 @@ func TestIpam(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	nums := 0
-	// NOTE: 这里建立连接需要一点点时间, 如果刚建立完连接下头马上就 put 的话有可能收不到响应
 	watcher.Watch("/ding-test-1", func(_type mvccpb.Event_EventType, key, value []byte) {
 		fmt.Printf("%s, %q, %q", _type, key, value)
 		fmt.Print("\n")
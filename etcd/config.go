@@ -0,0 +1,212 @@
+package etcd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"testcni/client"
+	"testcni/cni"
+
+	"go.etcd.io/etcd/client/pkg/v3/srv"
+)
+
+/**
+ * 连 etcd 的配置从这几个地方拿, 后面的会覆盖前面的:
+ * 1. 节点上的配置文件 /opt/testcni/etcd.json, 格式和 cni 配置里的 ipam.etcd 一样
+ * 2. APIV1_ETCD_* 环境变量
+ * 3. cni 配置里的 ipam.etcd
+ * 都没配 etcd 地址的话和以前一样, 用 kubeconfig 里 apiserver 的地址加上 2379 端口以及 kubeadm 生成的 healthcheck 证书
+ */
+
+// kubeadm 搭的集群里 apiserver 用来检查 etcd 的证书
+const (
+	kubeadmEtcdCertFile   = "/etc/kubernetes/pki/etcd/healthcheck-client.crt"
+	kubeadmEtcdKeyFile    = "/etc/kubernetes/pki/etcd/healthcheck-client.key"
+	kubeadmEtcdCACertFile = "/etc/kubernetes/pki/etcd/ca.crt"
+)
+
+// 把 cni 配置里的 ipam.etcd 转成 EtcdConfig, 没配的话返回 nil
+func ConfigFromCNI(conf *cni.Etcd) *EtcdConfig {
+	if conf == nil {
+		return nil
+	}
+	return &EtcdConfig{
+		EtcdEndpoints:    conf.Endpoints,
+		EtcdDiscoverySrv: conf.DiscoverySrv,
+		EtcdUsername:     conf.Username,
+		EtcdPassword:     conf.Password,
+		EtcdCertFile:     conf.CertFile,
+		EtcdKeyFile:      conf.KeyFile,
+		EtcdCACertFile:   conf.CACertFile,
+	}
+}
+
+// 节点上的配置文件, 文件不存在的话返回 nil
+func loadConfigFile(path string) (*EtcdConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf := &cni.Etcd{}
+	err = json.Unmarshal(content, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return ConfigFromCNI(conf), nil
+}
+
+func configFromEnv() *EtcdConfig {
+	return &EtcdConfig{
+		EtcdScheme:       os.Getenv("APIV1_ETCD_SCHEME"),
+		EtcdAuthority:    os.Getenv("APIV1_ETCD_AUTHORITY"),
+		EtcdEndpoints:    os.Getenv("APIV1_ETCD_ENDPOINTS"),
+		EtcdDiscoverySrv: os.Getenv("APIV1_ETCD_DISCOVERY_SRV"),
+		EtcdUsername:     os.Getenv("APIV1_ETCD_USERNAME"),
+		EtcdPassword:     os.Getenv("APIV1_ETCD_PASSWORD"),
+		EtcdKeyFile:      os.Getenv("APIV1_ETCD_KEY_FILE"),
+		EtcdCertFile:     os.Getenv("APIV1_ETCD_CERT_FILE"),
+		EtcdCACertFile:   os.Getenv("APIV1_ETCD_CA_CERT_FILE"),
+	}
+}
+
+// other 里不是空的字段覆盖掉 c 里的
+func (c *EtcdConfig) merge(other *EtcdConfig) {
+	if other == nil {
+		return
+	}
+	override := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	override(&c.EtcdScheme, other.EtcdScheme)
+	override(&c.EtcdAuthority, other.EtcdAuthority)
+	override(&c.EtcdEndpoints, other.EtcdEndpoints)
+	override(&c.EtcdDiscoverySrv, other.EtcdDiscoverySrv)
+	override(&c.EtcdUsername, other.EtcdUsername)
+	override(&c.EtcdPassword, other.EtcdPassword)
+	override(&c.EtcdKeyFile, other.EtcdKeyFile)
+	override(&c.EtcdCertFile, other.EtcdCertFile)
+	override(&c.EtcdCACertFile, other.EtcdCACertFile)
+}
+
+// 有没有配 etcd 在哪儿
+func (c *EtcdConfig) hasLocation() bool {
+	return c.EtcdEndpoints != "" || c.EtcdAuthority != "" || c.EtcdDiscoverySrv != ""
+}
+
+/**
+ * 以前的默认配置: ETCD_ENDPOINT 环境变量或者 kubeconfig 里 apiserver 的地址加上 2379 端口
+ * 证书用 kubeadm 生成的 healthcheck 证书, 只适合 etcd 和 apiserver 跑在同一台机器上的 kubeadm 集群
+ */
+func kubeadmConfig() (*EtcdConfig, error) {
+	// ETCDCTL_API=3 etcdctl --endpoints https://192.168.64.19:2379 --cacert /etc/kubernetes/pki/etcd/ca.crt --cert /etc/kubernetes/pki/etcd/healthcheck-client.crt --key /etc/kubernetes/pki/etcd/healthcheck-client.key get / --prefix --keys-only
+	etcdEp := os.Getenv("ETCD_ENDPOINT")
+	if etcdEp == "" {
+		configPath := client.DefaultKubeconfigPath()
+		if configPath == "" {
+			return nil, errors.New("etcd is not configured and no kubeconfig found")
+		}
+		kubeconfig, err := client.LoadKubeconfig(configPath, "")
+		if err != nil {
+			return nil, fmt.Errorf("etcd is not configured and failed to load kubeconfig %s: %v", configPath, err)
+		}
+		master, err := url.Parse(kubeconfig.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the master endpoint %s from %s: %v", kubeconfig.Host, configPath, err)
+		}
+		if master.Hostname() != "" {
+			etcdEp = master.Scheme + "://" + net.JoinHostPort(master.Hostname(), "2379")
+		}
+	}
+	if etcdEp == "" {
+		return nil, errors.New("failed to get the etcd endpoint from the kubeconfig or the ETCD_ENDPOINT env")
+	}
+	return &EtcdConfig{
+		EtcdEndpoints:  etcdEp,
+		EtcdCertFile:   kubeadmEtcdCertFile,
+		EtcdKeyFile:    kubeadmEtcdKeyFile,
+		EtcdCACertFile: kubeadmEtcdCACertFile,
+	}, nil
+}
+
+/**
+ * 按顺序合并节点上的配置文件, 环境变量和 cni 配置
+ * 合并完了还是不知道 etcd 在哪儿的话用 kubeadm 的默认配置, 配了的证书和用户名密码还是以配的为准
+ */
+func resolveConfig(config *EtcdConfig, configFile string) (*EtcdConfig, error) {
+	fileConfig, err := loadConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	res := &EtcdConfig{}
+	for _, layer := range []*EtcdConfig{fileConfig, configFromEnv(), config} {
+		res.merge(layer)
+	}
+	if res.hasLocation() {
+		return res, nil
+	}
+	defaults, err := kubeadmConfig()
+	if err != nil {
+		return nil, err
+	}
+	defaults.merge(res)
+	return defaults, nil
+}
+
+// 通过 dns 的 srv 记录找 etcd 的地址, 测试的时候换掉
+var lookupSRVEndpoints = func(domain string) ([]string, error) {
+	clients, err := srv.GetClient("etcd-client", domain, "")
+	if err != nil {
+		return nil, err
+	}
+	return clients.Endpoints, nil
+}
+
+/**
+ * etcd 的地址, 优先级是 endpoints > authority > srv 记录
+ * authority 没配 scheme 的话, 配了证书就是 https, 不然是 http
+ */
+func (c *EtcdConfig) endpoints() ([]string, error) {
+	if c.EtcdEndpoints != "" {
+		res := []string{}
+		for _, ep := range strings.Split(c.EtcdEndpoints, ",") {
+			ep = strings.TrimSpace(ep)
+			if ep != "" {
+				res = append(res, ep)
+			}
+		}
+		if len(res) > 0 {
+			return res, nil
+		}
+	}
+	if c.EtcdAuthority != "" {
+		scheme := c.EtcdScheme
+		if scheme == "" {
+			scheme = "http"
+			if c.EtcdCACertFile != "" || c.EtcdCertFile != "" {
+				scheme = "https"
+			}
+		}
+		return []string{scheme + "://" + c.EtcdAuthority}, nil
+	}
+	if c.EtcdDiscoverySrv != "" {
+		eps, err := lookupSRVEndpoints(c.EtcdDiscoverySrv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover etcd from the srv records of %s: %v", c.EtcdDiscoverySrv, err)
+		}
+		if len(eps) == 0 {
+			return nil, fmt.Errorf("no etcd found in the srv records of %s", c.EtcdDiscoverySrv)
+		}
+		return eps, nil
+	}
+	return nil, errors.New("找不到 etcd")
+}
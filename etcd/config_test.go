@@ -0,0 +1,92 @@
+package etcd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveConfig(t *testing.T) {
+	test := assert.New(t)
+	for _, env := range []string{"APIV1_ETCD_ENDPOINTS", "APIV1_ETCD_USERNAME", "APIV1_ETCD_PASSWORD", "ETCD_ENDPOINT"} {
+		t.Setenv(env, "")
+	}
+	configFile := filepath.Join(t.TempDir(), "etcd.json")
+
+	// 节点上的配置文件
+	test.Nil(os.WriteFile(configFile, []byte(`{
+		"endpoints": "https://10.0.0.1:2379,https://10.0.0.2:2379",
+		"username": "root",
+		"password": "file",
+		"caCertFile": "/etc/etcd/ca.crt"
+	}`), 0600))
+	conf, err := resolveConfig(nil, configFile)
+	test.Nil(err)
+	test.Equal(&EtcdConfig{
+		EtcdEndpoints:  "https://10.0.0.1:2379,https://10.0.0.2:2379",
+		EtcdUsername:   "root",
+		EtcdPassword:   "file",
+		EtcdCACertFile: "/etc/etcd/ca.crt",
+	}, conf)
+
+	// 环境变量覆盖配置文件, cni 配置再覆盖环境变量, 没配的字段保留前面的
+	t.Setenv("APIV1_ETCD_PASSWORD", "env")
+	t.Setenv("APIV1_ETCD_ENDPOINTS", "https://10.0.0.3:2379")
+	conf, err = resolveConfig(&EtcdConfig{EtcdEndpoints: "https://etcd.example.com:2379"}, configFile)
+	test.Nil(err)
+	test.Equal("https://etcd.example.com:2379", conf.EtcdEndpoints)
+	test.Equal("root", conf.EtcdUsername)
+	test.Equal("env", conf.EtcdPassword)
+	test.Equal("/etc/etcd/ca.crt", conf.EtcdCACertFile)
+
+	// 都没配地址的话用 kubeadm 的默认配置, 配了的证书还是以配的为准
+	t.Setenv("APIV1_ETCD_ENDPOINTS", "")
+	t.Setenv("ETCD_ENDPOINT", "https://192.168.64.19:2379")
+	test.Nil(os.WriteFile(configFile, []byte(`{"caCertFile": "/etc/etcd/ca.crt"}`), 0600))
+	conf, err = resolveConfig(nil, configFile)
+	test.Nil(err)
+	test.Equal("https://192.168.64.19:2379", conf.EtcdEndpoints)
+	test.Equal(kubeadmEtcdCertFile, conf.EtcdCertFile)
+	test.Equal(kubeadmEtcdKeyFile, conf.EtcdKeyFile)
+	test.Equal("/etc/etcd/ca.crt", conf.EtcdCACertFile)
+
+	// 配置文件写坏了要报错
+	test.Nil(os.WriteFile(configFile, []byte(`{`), 0600))
+	_, err = resolveConfig(nil, configFile)
+	test.NotNil(err)
+}
+
+func TestEndpoints(t *testing.T) {
+	test := assert.New(t)
+
+	eps, err := (&EtcdConfig{EtcdEndpoints: " https://10.0.0.1:2379, https://10.0.0.2:2379,"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"https://10.0.0.1:2379", "https://10.0.0.2:2379"}, eps)
+
+	eps, err = (&EtcdConfig{EtcdAuthority: "10.0.0.1:2379"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"http://10.0.0.1:2379"}, eps)
+	eps, err = (&EtcdConfig{EtcdAuthority: "10.0.0.1:2379", EtcdCACertFile: "/etc/etcd/ca.crt"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"https://10.0.0.1:2379"}, eps)
+
+	lookup := lookupSRVEndpoints
+	defer func() { lookupSRVEndpoints = lookup }()
+	lookupSRVEndpoints = func(domain string) ([]string, error) {
+		if domain != "example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"https://etcd-0.example.com:2379", "https://etcd-1.example.com:2379"}, nil
+	}
+	eps, err = (&EtcdConfig{EtcdDiscoverySrv: "example.com"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"https://etcd-0.example.com:2379", "https://etcd-1.example.com:2379"}, eps)
+	_, err = (&EtcdConfig{EtcdDiscoverySrv: "example.org"}).endpoints()
+	test.NotNil(err)
+
+	_, err = (&EtcdConfig{}).endpoints()
+	test.NotNil(err)
+}
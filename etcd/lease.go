@@ -0,0 +1,54 @@
+package etcd
+
+import (
+	"context"
+	"testcni/utils"
+
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// 申请一个 ttl 秒的 lease, 用它写 key, 返回续约的 channel
+func (c *EtcdClient) putWithLease(ctx context.Context, key, value string, ttl int64) (<-chan *etcd.LeaseKeepAliveResponse, error) {
+	lease, err := c.client.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.client.Put(ctx, key, value, etcd.WithLease(lease.ID))
+	if err != nil {
+		return nil, err
+	}
+	return c.client.KeepAlive(ctx, lease.ID)
+}
+
+/**
+ * 用一个 ttl 秒的 lease 写 key, 并且在后台一直续约直到 ctx 被取消
+ * 续约断了(比如和 etcd 断开太久, lease 已经过期了)的话重新申请一个 lease 再写一遍
+ * ctx 被取消之后不会主动删掉 key, 等 lease 自己过期
+ */
+func (c *EtcdClient) KeepAlive(ctx context.Context, key, value string, ttl int64) error {
+	ch, err := c.putWithLease(ctx, key, value, ttl)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			for range ch {
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			utils.WriteLog(key, " 的 lease 续约断了, 重新申请一个")
+			for {
+				if !sleepWithContext(ctx, watchRetryInterval) {
+					return
+				}
+				ch, err = c.putWithLease(ctx, key, value, ttl)
+				if err == nil {
+					break
+				}
+				utils.WriteLog("重新申请 ", key, " 的 lease 失败: ", err.Error())
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,219 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testcni/utils"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// 监听被断开之后隔多久重新监听
+var watchRetryInterval = time.Second
+
+/**
+ * 不会丢事件的监听
+ * 记着已经处理到了哪个 revision, channel 被关掉(etcd 换了 leader, 连接断了之类的)之后从下一个 revision 接着监听
+ * 要接着的 revision 已经被压缩掉了的话, 就把监听的 key 重新读一遍, 和记着的对一下, 中间少掉的变化补成 put 和 delete 回调出去
+ * 补出来的变化只保证最后的状态是对的, 同一个 key 中间的几次修改会被合并成一次
+ */
+type resilientWatch struct {
+	kv      etcd.KV
+	watcher etcd.Watcher
+	key     string
+	opts    []etcd.OpOption
+	cb      WatchCallback
+	// 已经处理到的 revision
+	revision int64
+	// 监听的范围里现在有哪些 key, 以及它们的 ModRevision
+	known         map[string]int64
+	retryInterval time.Duration
+}
+
+/**
+ * 把监听的 key 读一遍, 记下当前的 revision
+ * notify 为 true 的话把和上次记着的不一样的地方回调出去, 先是没了的 key, 再是新加的和改过的
+ */
+func (w *resilientWatch) resync(ctx context.Context, notify bool) error {
+	resp, err := w.kv.Get(ctx, w.key, w.opts...)
+	if err != nil {
+		return err
+	}
+	current := map[string]int64{}
+	for _, kv := range resp.Kvs {
+		current[string(kv.Key)] = kv.ModRevision
+	}
+	if notify {
+		deleted := []string{}
+		for key := range w.known {
+			if _, ok := current[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+		sort.Strings(deleted)
+		for _, key := range deleted {
+			w.cb(mvccpb.DELETE, []byte(key), nil)
+		}
+		for _, kv := range resp.Kvs {
+			if w.known[string(kv.Key)] != kv.ModRevision {
+				w.cb(mvccpb.PUT, kv.Key, kv.Value)
+			}
+		}
+	}
+	w.known = current
+	w.revision = resp.Header.Revision
+	return nil
+}
+
+// 从处理到的 revision 的下一个开始监听, 第一个响应是监听已经建好了的通知
+func (w *resilientWatch) open(ctx context.Context) etcd.WatchChan {
+	opts := append([]etcd.OpOption{}, w.opts...)
+	opts = append(opts, etcd.WithRev(w.revision+1), etcd.WithCreatedNotify())
+	// etcd 节点和集群断开了的话, 监听会被关掉, 而不是一直卡在一个收不到变化的节点上
+	return w.watcher.Watch(etcd.WithRequireLeader(ctx), w.key, opts...)
+}
+
+// 一直处理到 channel 被关掉, 返回要监听的 revision 是不是已经被压缩掉了
+func (w *resilientWatch) consume(change etcd.WatchChan) bool {
+	compacted := false
+	for wresp := range change {
+		if wresp.CompactRevision != 0 {
+			utils.WriteLog("监听 ", w.key, " 时 revision ", fmt.Sprint(w.revision+1), " 已经被压缩掉了, 重新同步一遍")
+			compacted = true
+			continue
+		}
+		if err := wresp.Err(); err != nil {
+			utils.WriteLog("监听 ", w.key, " 出错: ", err.Error())
+			continue
+		}
+		for _, ev := range wresp.Events {
+			if ev.Type == mvccpb.DELETE {
+				delete(w.known, string(ev.Kv.Key))
+			} else {
+				w.known[string(ev.Kv.Key)] = ev.Kv.ModRevision
+			}
+			w.revision = ev.Kv.ModRevision
+			w.cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
+		}
+	}
+	return compacted
+}
+
+// 等 d 这么久, ctx 被取消了的话返回 false
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (w *resilientWatch) run(ctx context.Context, change etcd.WatchChan) {
+	for {
+		if w.consume(change) {
+			for ctx.Err() == nil {
+				err := w.resync(ctx, true)
+				if err == nil {
+					break
+				}
+				utils.WriteLog("重新同步 ", w.key, " 失败: ", err.Error())
+				sleepWithContext(ctx, w.retryInterval)
+			}
+		}
+		if !sleepWithContext(ctx, w.retryInterval) {
+			return
+		}
+		change = w.open(ctx)
+	}
+}
+
+/**
+ * 先把 key 读一遍记下 revision, 再从下一个 revision 开始监听
+ * 返回的时候监听已经建好了, 之后的变化都能收到, ctx 被取消之后就不再监听了
+ */
+func (c *EtcdClient) watch(ctx context.Context, watcher etcd.Watcher, key string, cb WatchCallback, opts ...etcd.OpOption) error {
+	w := &resilientWatch{
+		kv:      c.client.KV,
+		watcher: watcher,
+		key:     key,
+		opts:    opts,
+		cb:      cb,
+		// 建的时候就定下来, 测试里改了也不影响已经在跑的监听
+		retryInterval: watchRetryInterval,
+	}
+	err := w.resync(ctx, false)
+	if err != nil {
+		return fmt.Errorf("failed to get %s before watching: %v", key, err)
+	}
+	change := w.open(ctx)
+	select {
+	case wresp, ok := <-change:
+		if !ok {
+			return fmt.Errorf("failed to watch %s: %v", key, ctx.Err())
+		}
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	go w.run(ctx, change)
+	return nil
+}
+
+// 监听 key 的变化直到 ctx 被取消, 要监听一整个前缀的话 opts 传 etcd.WithPrefix()
+func (c *EtcdClient) WatchContext(ctx context.Context, key string, cb WatchCallback, opts ...etcd.OpOption) error {
+	return c.watch(ctx, c.client.Watcher, key, cb, opts...)
+}
+
+// 一直监听下去, 停不下来
+func (c *EtcdClient) Watch(key string, cb WatchCallback, opts ...etcd.OpOption) error {
+	return c.WatchContext(context.Background(), key, cb, opts...)
+}
+
+func (w *Watcher) Done() <-chan struct{} {
+	return w.ctx.Done()
+}
+
+func (w *Watcher) Deadline() (deadline time.Time, ok bool) {
+	return w.ctx.Deadline()
+}
+
+func (w *Watcher) Error() error {
+	return w.ctx.Err()
+}
+
+func (w *Watcher) Value(_any interface{}) interface{} {
+	return w.ctx.Value(_any)
+}
+
+// 停掉这个 Watcher 上所有的监听
+func (w *Watcher) Cancel() {
+	w.cancelWatcher()
+	w.watcher.Close()
+}
+
+// 要监听一整个前缀的话 opts 传 etcd.WithPrefix(), Cancel 之前一直监听
+func (w *Watcher) Watch(key string, cb WatchCallback, opts ...etcd.OpOption) error {
+	return w.client.watch(w.ctx, w.watcher, key, cb, opts...)
+}
+
+func (c *EtcdClient) GetWatcher() (*Watcher, error) {
+	if c.watcher != nil {
+		return c.watcher, nil
+	}
+	watcher := &Watcher{client: c}
+	_watcher := etcd.NewWatcher(c.client)
+	watcher.watcher = _watcher
+	ctx, cancelFunc := context.WithCancel(context.TODO())
+	watcher.cancelWatcher = cancelFunc
+	watcher.ctx = ctx
+
+	return watcher, nil
+}
@@ -0,0 +1,197 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// 在本地起一个内嵌的 etcd, 不依赖真实的 k8s 集群
+func startEmbedEtcd(t *testing.T) (*EtcdClient, func()) {
+	test := assert.New(t)
+	clientPort, err := getFreePort()
+	test.Nil(err)
+	peerPort, err := getFreePort()
+	test.Nil(err)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", clientPort))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", peerPort))
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("embed etcd start timeout")
+	}
+
+	client, err := NewEtcdClient(&EtcdConfig{
+		EtcdEndpoints: clientURL.String(),
+	})
+	if err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		e.Close()
+	}
+}
+
+/**
+ * 可以模拟断线的 Watcher
+ * disconnect 之后已经建好的监听都会被关掉, reconnect 之前新建的监听直接返回一个关掉的 channel
+ */
+type flakyWatcher struct {
+	etcd.Watcher
+	lock    sync.Mutex
+	down    bool
+	cancels []context.CancelFunc
+	opened  int
+}
+
+func (w *flakyWatcher) Watch(ctx context.Context, key string, opts ...etcd.OpOption) etcd.WatchChan {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.opened++
+	if w.down {
+		change := make(chan etcd.WatchResponse)
+		close(change)
+		return change
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w.cancels = append(w.cancels, cancel)
+	return w.Watcher.Watch(ctx, key, opts...)
+}
+
+func (w *flakyWatcher) disconnect() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.down = true
+	for _, cancel := range w.cancels {
+		cancel()
+	}
+	w.cancels = nil
+}
+
+func (w *flakyWatcher) reconnect() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.down = false
+}
+
+func (w *flakyWatcher) openedTimes() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.opened
+}
+
+type watchedEvent struct {
+	_type mvccpb.Event_EventType
+	key   string
+	value string
+}
+
+func TestResilientWatch(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+	interval := watchRetryInterval
+	watchRetryInterval = 10 * time.Millisecond
+	defer func() { watchRetryInterval = interval }()
+
+	flaky := &flakyWatcher{Watcher: client.client.Watcher}
+	client.client.Watcher = flaky
+	prefix := "/testcni-watch/"
+	test.Nil(client.Set(prefix+"a", "1"))
+
+	events := make(chan watchedEvent, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := client.WatchContext(ctx, prefix, func(_type mvccpb.Event_EventType, key, value []byte) {
+		events <- watchedEvent{_type, string(key), string(value)}
+	}, etcd.WithPrefix())
+	test.Nil(err)
+
+	expect := func(expected ...watchedEvent) {
+		for _, e := range expected {
+			select {
+			case ev := <-events:
+				test.Equal(e, ev)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %v", e)
+			}
+		}
+	}
+
+	test.Nil(client.Set(prefix+"b", "2"))
+	expect(watchedEvent{mvccpb.PUT, prefix + "b", "2"})
+
+	// 断线的时候发生的变化, 重新连上之后从断开的地方接着收
+	flaky.disconnect()
+	test.Nil(client.Set(prefix+"c", "3"))
+	test.Nil(client.Del(prefix + "a"))
+	time.Sleep(50 * time.Millisecond)
+	flaky.reconnect()
+	expect(
+		watchedEvent{mvccpb.PUT, prefix + "c", "3"},
+		watchedEvent{mvccpb.DELETE, prefix + "a", ""},
+	)
+
+	// 断线的时候 revision 被压缩掉了, 重新读一遍把少掉的变化补上
+	flaky.disconnect()
+	test.Nil(client.Set(prefix+"d", "4"))
+	test.Nil(client.Del(prefix + "b"))
+	resp, err := client.client.Get(context.Background(), prefix)
+	test.Nil(err)
+	_, err = client.client.Compact(context.Background(), resp.Header.Revision)
+	test.Nil(err)
+	flaky.reconnect()
+	expect(
+		watchedEvent{mvccpb.DELETE, prefix + "b", ""},
+		watchedEvent{mvccpb.PUT, prefix + "d", "4"},
+	)
+	test.Nil(client.Set(prefix+"e", "5"))
+	expect(watchedEvent{mvccpb.PUT, prefix + "e", "5"})
+
+	// 取消之后不再重连, 也收不到变化
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	opened := flaky.openedTimes()
+	test.Nil(client.Set(prefix+"f", "6"))
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event after cancel: %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+	test.Equal(opened, flaky.openedTimes())
+}
@@ -0,0 +1,354 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testcni/datastore"
+	"testcni/utils"
+	"time"
+)
+
+/**
+ * 每个容器的每块儿网卡在 ADD 的时候都会留下一条分配记录
+ * 存在 etcd 的 /testcni/ipam/<subnet>/<mask>/<hostname>/allocations/<containerID>/<ifName> 下
+ * DEL 和 CHECK 的时候就算 pod 的 netns 已经没了也能通过它找到 ADD 时都创建了些啥
+ */
+type Allocation struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	IP          string `json:"ip"`
+	Gateway     string `json:"gateway"`
+	// 留在主机上的那块儿网卡, veth 模式下是主机上那半拉 veth, ipvlan/macvlan 模式下是 parent 网卡
+	HostIfName string `json:"hostIfName"`
+	Mode       string `json:"mode"`
+	// ip 是从哪个网段里分出来的, 一台主机可能占着好几个网段
+	Network   string `json:"network"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (is *IpamService) allocationPath(containerID, ifName string) string {
+	return is.hostPath() + "/allocations/" + containerID + "/" + ifName
+}
+
+// 分配给容器的 ip 的 owner 是 <hostname>/<containerID>/<ifName>, 方便出问题的时候查是谁占着的
+func getAllocationOwner(containerID, ifName string) string {
+	return getDefaultOwner() + "/" + containerID + "/" + ifName
+}
+
+func unmarshalAllocation(val string) (*Allocation, error) {
+	if val == "" {
+		return nil, nil
+	}
+	alloc := &Allocation{}
+	err := json.Unmarshal(([]byte)(val), alloc)
+	if err != nil {
+		return nil, err
+	}
+	return alloc, nil
+}
+
+/**
+ * 获取 containerID/ifName 的分配记录, 没有的话返回 nil
+ */
+func (g *Get) Allocation(containerID, ifName string) (*Allocation, error) {
+	val, err := g.store.Get(g.ipam.allocationPath(containerID, ifName))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalAllocation(val)
+}
+
+/**
+ * 给 containerID 的 ifName 这块儿网卡分配一个 ip
+ * 创建 ip 对应的 key 和写分配记录是在同一个 etcd 事务里做的
+ * 同一块儿网卡已经分配过的话(比如 runtime 重试了 ADD)直接返回之前的那条记录
+ * requested 是 pod 指定要用的 ip, 里头有和当前 ipam 同一个地址族的话就只分这个 ip, 分不了也不会换别的
+ */
+func (g *Get) AllocateIP(containerID, ifName, mode string, requested ...string) (*Allocation, error) {
+	if containerID == "" || ifName == "" {
+		return nil, errors.New("containerID and ifName are required")
+	}
+
+	for _, ip := range requested {
+		if g.ipam.sameFamily(ip) {
+			return g.allocateRequestedIP(containerID, ifName, mode, net.ParseIP(ip).String())
+		}
+	}
+
+	alloc, err := g.Allocation(containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+	if alloc != nil {
+		return alloc, nil
+	}
+
+	primary, err := g.store.Get(g.ipam.hostPath())
+	if err != nil {
+		return nil, err
+	}
+	allocPath := g.ipam.allocationPath(containerID, ifName)
+
+	for i := 0; i < txnRetryTimes; i++ {
+		network, ip, err := g.nextUnusedIP()
+		if err != nil {
+			return nil, err
+		}
+
+		ipPath := g.ipam.ipPath(network, ip)
+		alloc = &Allocation{
+			ContainerID: containerID,
+			IfName:      ifName,
+			IP:          ip,
+			Mode:        mode,
+			Network:     network,
+			Timestamp:   time.Now().Unix(),
+		}
+		allocStr, err := json.Marshal(alloc)
+		if err != nil {
+			return nil, err
+		}
+
+		// ip 还没被别人占走并且这块儿网卡还没有分配记录的时候才写
+		// 如果 ip 是在多占的网段里的, 还得保证这个网段还没被还回去
+		succeeded, err := g.store.Txn(
+			append(
+				[]datastore.Cmp{
+					datastore.KeyMissing(ipPath),
+					datastore.KeyMissing(allocPath),
+				},
+				g.ipam.blockOwnedCmps(network, primary)...,
+			),
+			datastore.OpPut(ipPath, getAllocationOwner(containerID, ifName)),
+			datastore.OpPut(g.ipam.cursorPath(network), ip),
+			datastore.OpPut(allocPath, string(allocStr)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if succeeded {
+			return alloc, nil
+		}
+		txnBackoff()
+
+		// 事务失败了, 有可能是别的进程已经给同一块儿网卡分配过了
+		exist, err := g.Allocation(containerID, ifName)
+		if err != nil {
+			return nil, err
+		}
+		if exist != nil {
+			return exist, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to allocate ip for %s/%s after %d retries", containerID, ifName, txnRetryTimes)
+}
+
+/**
+ * pod 指定的 ip 得有对应地址族的 ipam 来分, 比如 subnet 只配了 ipv4 的话就不能指定 ipv6 的 ip
+ * services 里可以有 nil, 比如单栈的时候的 secondary
+ */
+func CheckRequestedIPs(requested []string, services ...*IpamService) error {
+	for _, ip := range requested {
+		matched := false
+		for _, is := range services {
+			if is != nil && is.sameFamily(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("there is no subnet for the requested ip %s: %w", ip, ErrIPOutOfRange)
+		}
+	}
+	return nil
+}
+
+// 判断 err 是不是因为 pod 指定的 ip 分不出来
+func IsRequestedIPError(err error) bool {
+	return errors.Is(err, ErrIPInUse) || errors.Is(err, ErrIPOutOfRange)
+}
+
+/**
+ * 把 pod 指定的 ip 分给 containerID 的 ifName 这块儿网卡
+ * ip 得在当前主机占着的某个网段(配置了 range 的话是 range)里, 并且还没被别人用
+ * 指定的 ip 不挪 cursor, 之后按顺序分的时候碰到了会自己跳过去
+ */
+func (g *Get) allocateRequestedIP(containerID, ifName, mode, ip string) (*Allocation, error) {
+	alloc, err := g.Allocation(containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+	if alloc != nil {
+		if alloc.IP != ip {
+			return nil, fmt.Errorf("%s/%s already has ip %s, not the requested %s", containerID, ifName, alloc.IP, ip)
+		}
+		return alloc, nil
+	}
+
+	primary, err := g.store.Get(g.ipam.hostPath())
+	if err != nil {
+		return nil, err
+	}
+	allocPath := g.ipam.allocationPath(containerID, ifName)
+
+	for i := 0; i < txnRetryTimes; i++ {
+		network, err := g.networkOfRequestedIP(ip)
+		if err != nil {
+			return nil, err
+		}
+
+		ipPath := g.ipam.ipPath(network, ip)
+		alloc = &Allocation{
+			ContainerID: containerID,
+			IfName:      ifName,
+			IP:          ip,
+			Mode:        mode,
+			Network:     network,
+			Timestamp:   time.Now().Unix(),
+		}
+		allocStr, err := json.Marshal(alloc)
+		if err != nil {
+			return nil, err
+		}
+
+		succeeded, err := g.store.Txn(
+			append(
+				[]datastore.Cmp{
+					datastore.KeyMissing(ipPath),
+					datastore.KeyMissing(allocPath),
+				},
+				g.ipam.blockOwnedCmps(network, primary)...,
+			),
+			datastore.OpPut(ipPath, getAllocationOwner(containerID, ifName)),
+			datastore.OpPut(allocPath, string(allocStr)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if succeeded {
+			return alloc, nil
+		}
+
+		// 事务失败了, 先看是不是别的进程已经给同一块儿网卡分配过了
+		exist, err := g.Allocation(containerID, ifName)
+		if err != nil {
+			return nil, err
+		}
+		if exist != nil {
+			if exist.IP != ip {
+				return nil, fmt.Errorf("%s/%s already has ip %s, not the requested %s", containerID, ifName, exist.IP, ip)
+			}
+			return exist, nil
+		}
+		// 再看 ip 是不是被别人占了, 都不是的话就是网段刚好被还回去了, 重新找一遍网段
+		owner, err := g.store.Get(ipPath)
+		if err != nil {
+			return nil, err
+		}
+		if owner != "" {
+			return nil, fmt.Errorf("ip %s is used by %s: %w", ip, owner, ErrIPInUse)
+		}
+		txnBackoff()
+	}
+	return nil, fmt.Errorf("failed to allocate ip %s for %s/%s after %d retries", ip, containerID, ifName, txnRetryTimes)
+}
+
+// 找到 pod 指定的 ip 在当前主机的哪个网段里, 都不在的话返回 ErrIPOutOfRange
+func (g *Get) networkOfRequestedIP(ip string) (string, error) {
+	networks, err := g.allocatableBlocks()
+	if err != nil {
+		return "", err
+	}
+	for _, network := range networks {
+		candidates, _, err := g.candidateIPs(network)
+		if err != nil {
+			return "", err
+		}
+		if candidates.indexOf(ip) >= 0 {
+			return network, nil
+		}
+	}
+	return "", fmt.Errorf("ip %s is not in the blocks or ip range of %s: %w", ip, getDefaultOwner(), ErrIPOutOfRange)
+}
+
+/**
+ * 更新分配记录, 比如等网卡都创建好了之后再把 gateway 和主机上的网卡名补上
+ * 记录不存在的话(已经被释放了)就报错, 不能凭空造出一条来
+ */
+func (s *Set) Allocation(alloc *Allocation) error {
+	allocPath := s.ipam.allocationPath(alloc.ContainerID, alloc.IfName)
+	allocStr, err := json.Marshal(alloc)
+	if err != nil {
+		return err
+	}
+	succeeded, err := s.store.Txn(
+		[]datastore.Cmp{
+			datastore.KeyExists(allocPath),
+		},
+		datastore.OpPut(allocPath, string(allocStr)),
+	)
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return fmt.Errorf("allocation of %s/%s not found", alloc.ContainerID, alloc.IfName)
+	}
+	return nil
+}
+
+/**
+ * 释放 containerID/ifName 分配到的 ip, ip 和分配记录在同一个事务里一起删掉
+ * 返回被删掉的那条记录, 本来就没有的话返回 nil
+ */
+func (r *Release) Allocation(containerID, ifName string) (*Allocation, error) {
+	allocPath := r.ipam.allocationPath(containerID, ifName)
+
+	primary, err := r.store.Get(r.ipam.hostPath())
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < txnRetryTimes; i++ {
+		val, revision, err := r.store.GetWithRevision(allocPath)
+		if err != nil {
+			return nil, err
+		}
+		alloc, err := unmarshalAllocation(val)
+		if err != nil {
+			return nil, err
+		}
+		if alloc == nil {
+			return nil, nil
+		}
+
+		// 老版本的分配记录里没有网段, 那时候每台主机也只有一个网段
+		network := alloc.Network
+		if network == "" {
+			network = primary
+		}
+
+		// 分配记录在读出来之后没被别人改过才删
+		succeeded, err := r.store.Txn(
+			[]datastore.Cmp{
+				datastore.ModRevisionIs(allocPath, revision),
+			},
+			datastore.OpDelete(r.ipam.ipPath(network, alloc.IP)),
+			datastore.OpDelete(allocPath),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if succeeded {
+			// 多占的网段空出来了的话就还回去, 还不回去也不影响这次的释放
+			err = r.blockIfEmpty(network)
+			if err != nil {
+				utils.WriteLog("归还网段 ", network, " 失败: ", err.Error())
+			}
+			return alloc, nil
+		}
+		txnBackoff()
+	}
+	return nil, fmt.Errorf("failed to release ip of %s/%s after %d retries", containerID, ifName, txnRetryTimes)
+}
@@ -0,0 +1,254 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testcni/datastore"
+	"testcni/utils"
+)
+
+/**
+ * 一台主机可以占着好几个网段(block)
+ * 初始化的时候拿到的第一个网段存在 <hostname> 这个 key 下, 这个网段不会被还回去
+ * 之后网段里的 ip 用完了就再从 pool 里占一个, 这些多占的网段里的 ip 都被释放了之后再还回 pool 里
+ * 不管是哪个网段, 被谁占着都记在 blocks/<network> 这个 key 里
+ */
+
+func (is *IpamService) blockPath(network string) string {
+	return is.blocksPrefix() + network
+}
+
+func (is *IpamService) hostPathByName(hostname string) string {
+	return getEtcdPathWithPrefix("/" + is.Subnet + "/" + is.MaskSegment + "/" + hostname)
+}
+
+/**
+ * 获取某台主机占着的所有网段
+ * 第一个是初始化的时候拿到的那个, 后面的是之后按需多占的, 按照地址从小到大排
+ */
+func (g *Get) HostBlocks(hostname string) ([]string, error) {
+	primary, err := g.store.Get(g.ipam.hostPathByName(hostname))
+	if err != nil {
+		return nil, err
+	}
+	blocksPrefix := g.ipam.blocksPrefix()
+	kvs, err := g.store.List(blocksPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	others := []string{}
+	for key, owner := range kvs {
+		network := strings.TrimPrefix(key, blocksPrefix)
+		if owner == hostname && network != primary {
+			others = append(others, network)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return ipToInt(net.ParseIP(others[i])).Cmp(ipToInt(net.ParseIP(others[j]))) < 0
+	})
+
+	res := []string{}
+	if primary != "" {
+		res = append(res, primary)
+	}
+	return append(res, others...), nil
+}
+
+// 获取某台主机占着的所有网段 + mask
+func (g *Get) CIDRs(hostname string) ([]string, error) {
+	// 用 podCIDR 的话每台主机就只有 podCIDR 这一个网段
+	if g.ipam.UsePodCIDR {
+		cidr, err := g.CIDR(hostname)
+		if err != nil || cidr == "" {
+			return []string{}, err
+		}
+		return []string{cidr}, nil
+	}
+	networks, err := g.HostBlocks(hostname)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, network := range networks {
+		res = append(res, network+"/"+g.ipam.BlockMaskSegment)
+	}
+	return res, nil
+}
+
+// 某个网段下存放已使用 ip 的前缀, 要用 WithPrefix 去读或者监听
+func (g *Get) RecordPathByNetwork(network string) string {
+	return g.ipam.ipsPrefix(network)
+}
+
+// 某个网段下已经被使用的全部 ip
+func (g *Get) IPsOfNetwork(network string) ([]string, error) {
+	return g.ipam.listUsedIPs(network)
+}
+
+// ip 在当前主机的哪个网段里, 都不在的话(比如配置了 range)就当做是在第一个网段里
+func (g *Get) networkOfIP(ip string) (string, error) {
+	networks, err := g.HostBlocks(getDefaultOwner())
+	if err != nil {
+		return "", err
+	}
+	if len(networks) == 0 {
+		return "", fmt.Errorf("current host has no network")
+	}
+	_ip := net.ParseIP(ip)
+	for _, network := range networks {
+		block, err := parseBlock(network, g.ipam.BlockMaskSegment)
+		if err != nil {
+			return "", err
+		}
+		if _ip != nil && block.Contains(_ip) {
+			return network, nil
+		}
+	}
+	return networks[0], nil
+}
+
+/**
+ * 往某个网段里写 ip 的时候的前置条件
+ * 多占的网段有可能在这期间被还回去了, 这时候就不能再往里写了
+ */
+func (is *IpamService) blockOwnedCmps(network, primary string) []datastore.Cmp {
+	if network == primary {
+		return nil
+	}
+	return []datastore.Cmp{
+		datastore.ValueIs(is.blockPath(network), getDefaultOwner()),
+	}
+}
+
+/**
+ * 当前主机的网段都用完了的时候再从 pool 里占一个
+ * pool 里也没有了的话返回 ErrBlockExhausted
+ */
+func (s *Set) claimBlock() (string, error) {
+	is := s.ipam
+	blocksPrefix := is.blocksPrefix()
+	hostname := getDefaultOwner()
+
+	for i := 0; i < txnRetryTimes; i++ {
+		available, err := is.availableNetworks(blocksPrefix)
+		if err != nil {
+			return "", err
+		}
+		if len(available) == 0 {
+			return "", fmt.Errorf("there is no available network in the pool: %w", ErrBlockExhausted)
+		}
+		network := available[utils.GetRandomNumber(len(available))]
+		blockPath := blocksPrefix + network
+
+		succeeded, err := s.store.Txn(
+			[]datastore.Cmp{datastore.KeyMissing(blockPath)},
+			datastore.OpPut(blockPath, hostname),
+		)
+		if err != nil {
+			return "", err
+		}
+		if succeeded {
+			mapsPath, err := is.Get().HostSubnetMapPath()
+			if err != nil {
+				return "", err
+			}
+			err = addToHostSubnetMap(s.store, mapsPath, network, hostname)
+			if err != nil {
+				return "", err
+			}
+			utils.WriteLog("当前主机的网段都用完了, 又占了一个网段: ", network)
+			return network, nil
+		}
+		txnBackoff()
+	}
+	return "", fmt.Errorf("failed to claim a new block after %d retries", txnRetryTimes)
+}
+
+/**
+ * 多占的网段里的 ip 都被释放完了的话就把网段还回 pool 里
+ * 网段里还有 ip 或者是初始化时拿到的第一个网段的话就什么都不做
+ */
+func (r *Release) blockIfEmpty(network string) error {
+	primary, err := r.store.Get(r.ipam.hostPath())
+	if err != nil {
+		return err
+	}
+	if network == "" || network == primary {
+		return nil
+	}
+
+	blockPath := r.ipam.blockPath(network)
+	// 网段还被当前主机占着, 并且网段下一个 ip 都没有的时候才还
+	succeeded, err := r.store.Txn(
+		[]datastore.Cmp{
+			datastore.ValueIs(blockPath, getDefaultOwner()),
+			datastore.PrefixEmpty(r.ipam.ipsPrefix(network)),
+		},
+		datastore.OpDelete(blockPath),
+		datastore.OpDelete(r.ipam.cursorPath(network)),
+	)
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return nil
+	}
+
+	mapsPath, err := r.get().HostSubnetMapPath()
+	if err != nil {
+		return err
+	}
+	utils.WriteLog("网段 ", network, " 中的 ip 都被释放了, 还回到 pool 中")
+	return delFromHostSubnetMap(r.store, mapsPath, network)
+}
+
+// 往主机名和网段的映射里加一个网段
+func addToHostSubnetMap(store datastore.Datastore, mapsPath, network, hostname string) error {
+	return casUpdate(store, mapsPath, func(maps string) (string, bool, error) {
+		_tmpMaps := map[string]string{}
+		if len(maps) > 0 {
+			err := json.Unmarshal(([]byte)(maps), &_tmpMaps)
+			if err != nil {
+				return "", false, err
+			}
+		}
+
+		if _, ok := _tmpMaps[network]; ok {
+			return "", false, nil
+		}
+		_tmpMaps[network] = hostname
+		mapsStr, err := json.Marshal(_tmpMaps)
+		if err != nil {
+			return "", false, err
+		}
+		return string(mapsStr), true, nil
+	})
+}
+
+// 从主机名和网段的映射里删掉一个网段
+func delFromHostSubnetMap(store datastore.Datastore, mapsPath, network string) error {
+	return casUpdate(store, mapsPath, func(maps string) (string, bool, error) {
+		if len(maps) == 0 {
+			return "", false, nil
+		}
+		_tmpMaps := map[string]string{}
+		err := json.Unmarshal(([]byte)(maps), &_tmpMaps)
+		if err != nil {
+			return "", false, err
+		}
+
+		if _, ok := _tmpMaps[network]; !ok {
+			return "", false, nil
+		}
+		delete(_tmpMaps, network)
+		mapsStr, err := json.Marshal(_tmpMaps)
+		if err != nil {
+			return "", false, err
+		}
+		return string(mapsStr), true, nil
+	})
+}
@@ -0,0 +1,140 @@
+package ipam
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+)
+
+// 一个网段最多能拆出来这么多个 block, 再多的话 etcd 里的 key 和遍历的开销都太大了
+const maxBlocksCount = 1 << 16
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return big.NewInt(0).SetBytes(v4)
+	}
+	return big.NewInt(0).SetBytes(ip.To16())
+}
+
+func intToIP(i *big.Int, isV4 bool) net.IP {
+	size := net.IPv6len
+	if isV4 {
+		size = net.IPv4len
+	}
+	res := make(net.IP, size)
+	i.FillBytes(res)
+	return res
+}
+
+// ip 加上 offset 之后的 ip, offset 可以是负数
+func ipAdd(ip net.IP, offset int64) net.IP {
+	isV4 := ip.To4() != nil
+	return intToIP(big.NewInt(0).Add(ipToInt(ip), big.NewInt(offset)), isV4)
+}
+
+// 把 "10.244.1.0" 和 "24" 这样的网段和掩码拼起来解析成 *net.IPNet, ip 会被 mask 成网段地址
+func parseBlock(network, maskSegment string) (*net.IPNet, error) {
+	_, block, err := net.ParseCIDR(network + "/" + maskSegment)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// 网段中的第一个地址, 也就是网段号
+func networkAddr(block *net.IPNet) net.IP {
+	return block.IP.Mask(block.Mask)
+}
+
+// 网段中的最后一个地址, 也就是广播地址
+func broadcastAddr(block *net.IPNet) net.IP {
+	network := networkAddr(block)
+	res := make(net.IP, len(network))
+	for i := range network {
+		res[i] = network[i] | ^block.Mask[i]
+	}
+	return res
+}
+
+// 把网段中的第一个可用的地址当做网关
+func gatewayAddr(block *net.IPNet) net.IP {
+	return ipAdd(networkAddr(block), 1)
+}
+
+// 网段中一共有多少个地址
+func blockSize(block *net.IPNet) *big.Int {
+	ones, bits := block.Mask.Size()
+	return big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// 网段中能分给 pod 的地址有多少个, 网段号, 网关和广播地址都不能用
+// ipv6 的网段可能大到 int64 都装不下, 这时候就当它有 math.MaxInt64 个, 反正也不可能真用完
+func blockHostsCount(block *net.IPNet) int64 {
+	size := blockSize(block)
+	if !size.IsInt64() {
+		return math.MaxInt64
+	}
+	return size.Int64() - 3
+}
+
+/**
+ * 把 subnet 按照 blockMask 拆成一个个小网段
+ * 比如 10.244.0.0/16 按照 26 拆的话就会得到
+ * 	10.244.0.0/26, 10.244.0.64/26, 10.244.0.128/26, ......, 10.244.255.192/26
+ */
+func splitSubnet(subnet *net.IPNet, blockMask int) ([]*net.IPNet, error) {
+	ones, bits := subnet.Mask.Size()
+	if blockMask < ones || blockMask > bits {
+		return nil, fmt.Errorf("block mask /%d is out of the range of subnet %s", blockMask, subnet.String())
+	}
+	if blockMask-ones > 16 {
+		return nil, fmt.Errorf("too many blocks to split subnet %s into /%d, the max is %d", subnet.String(), blockMask, maxBlocksCount)
+	}
+	count := 1 << uint(blockMask-ones)
+	step := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-blockMask))
+	current := ipToInt(networkAddr(subnet))
+	isV4 := subnet.IP.To4() != nil
+
+	res := make([]*net.IPNet, 0, count)
+	for i := 0; i < count; i++ {
+		res = append(res, &net.IPNet{
+			IP:   intToIP(current, isV4),
+			Mask: net.CIDRMask(blockMask, bits),
+		})
+		current = big.NewInt(0).Add(current, step)
+	}
+	return res, nil
+}
+
+/**
+ * 没有配置 block 掩码的时候沿用之前的规则
+ * 也就是把 subnet 的掩码向上凑到 8 的倍数之后再往后挪一个字节
+ * 比如 /16 的 subnet 拆成 /24, /20 的 subnet 也拆成 /24, /24 的 subnet 就拆成一个个的 ip
+ * ipv6 的话是按 16 位一段来凑, 比如 /48 的 subnet 拆成 /64, /56 的 subnet 也拆成 /64
+ * 这样一个 subnet 最多也就拆出来 maxBlocksCount 个网段
+ */
+func defaultBlockMask(maskSegment, bits int) int {
+	step := 8
+	if bits == net.IPv6len*8 {
+		step = 16
+	}
+	res := (maskSegment/step + 1) * step
+	if res > bits {
+		return bits
+	}
+	return res
+}
+
+// 把 "24" 这样的掩码位数转成 "255.255.255.0" 的样子, ipv6 的话是 "ffff:ffff:ffff:ffff::" 这样的
+func maskNumToIP(numStr string, bits int) (string, error) {
+	num, err := strconv.Atoi(numStr)
+	if err != nil {
+		return "", err
+	}
+	if num < 0 || num > bits {
+		return "", fmt.Errorf("mask segment must be between 0 and %d", bits)
+	}
+	return net.IP(net.CIDRMask(num, bits)).String(), nil
+}
@@ -0,0 +1,95 @@
+package ipam
+
+import (
+	"fmt"
+	"strings"
+	"testcni/datastore"
+	"testcni/utils"
+)
+
+/**
+ * ADD 做到一半挂了, 或者 DEL 没有被调用到的话, 分出去的 ip 就一直占着, 网段迟早会被用完
+ * agent 会拿这里列出来的 ip 和本机上的 pod 对一遍, 把没人用的还回去
+ */
+
+// 当前主机的某个网段里被占着的一个 ip
+type UsedIP struct {
+	Network string
+	IP      string
+	// ip 对应的 key 里存的值, 有分配记录的是 <hostname>/<containerID>/<ifName>, 老版本留下来的是 <hostname>
+	Owner string
+	// 没有分配记录的话是 nil
+	Allocation *Allocation
+}
+
+// 列出当前主机占着的所有网段里被占着的 ip, 顺便带上对应的分配记录
+func (g *Get) HostUsedIPs() ([]*UsedIP, error) {
+	networks, err := g.HostBlocks(getDefaultOwner())
+	if err != nil {
+		return nil, err
+	}
+
+	allocsPrefix := g.ipam.hostPath() + "/allocations/"
+	kvs, err := g.store.List(allocsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	allocs := map[string]*Allocation{}
+	for _, val := range kvs {
+		alloc, err := unmarshalAllocation(val)
+		if err != nil || alloc == nil {
+			continue
+		}
+		allocs[getAllocationOwner(alloc.ContainerID, alloc.IfName)] = alloc
+	}
+
+	res := []*UsedIP{}
+	for _, network := range networks {
+		prefix := g.ipam.ipsPrefix(network)
+		ips, err := g.store.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for key, owner := range ips {
+			res = append(res, &UsedIP{
+				Network:    network,
+				IP:         strings.TrimPrefix(key, prefix),
+				Owner:      owner,
+				Allocation: allocs[owner],
+			})
+		}
+	}
+	return res, nil
+}
+
+/**
+ * 释放一个没人用的 ip, 有分配记录的话分配记录也一起删掉
+ * ip 在这期间已经被释放然后又分给了别人的话(owner 变了)就什么都不做, 返回 false
+ */
+func (r *Release) OrphanIP(used *UsedIP) (bool, error) {
+	ipPath := r.ipam.ipPath(used.Network, used.IP)
+	ops := []datastore.Op{datastore.OpDelete(ipPath)}
+	if used.Allocation != nil {
+		ops = append(ops, datastore.OpDelete(r.ipam.allocationPath(used.Allocation.ContainerID, used.Allocation.IfName)))
+	}
+	succeeded, err := r.store.Txn(
+		[]datastore.Cmp{datastore.ValueIs(ipPath, used.Owner)},
+		ops...,
+	)
+	if err != nil {
+		return false, err
+	}
+	if !succeeded {
+		return false, nil
+	}
+	// 多占的网段空出来了的话就还回去, 还不回去也不影响这次的释放
+	err = r.blockIfEmpty(used.Network)
+	if err != nil {
+		utils.WriteLog("归还网段 ", used.Network, " 失败: ", err.Error())
+	}
+	return true, nil
+}
+
+func (u *UsedIP) String() string {
+	return fmt.Sprintf("%s(%s)", u.IP, u.Owner)
+}
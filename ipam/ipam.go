@@ -9,17 +9,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"testcni/client"
+	"testcni/cni"
 	"testcni/consts"
+	"testcni/datastore"
 	"testcni/etcd"
-	"testcni/helper"
 	"testcni/utils"
+	"time"
 
 	"github.com/vishvananda/netlink"
-	oriEtcd "go.etcd.io/etcd/client/v3"
 )
 
 const (
@@ -27,19 +31,25 @@ const (
 )
 
 type Get struct {
-	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	// 每个 operator 都绑在创建它的 ipam service 上, 路径里的 subnet 和掩码都从这里拿
+	ipam      *IpamService
+	store     datastore.Datastore
+	k8sClient *client.LightK8sClient
 	// 有些不会发生改变的东西可以做缓存
 	nodeIpCache map[string]string
 	cidrCache   map[string]string
+	// 同一个进程里可能有好几个 goroutine 同时在读写缓存
+	cacheLock sync.Mutex
 }
 type Release struct {
-	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	ipam      *IpamService
+	store     datastore.Datastore
+	k8sClient *client.LightK8sClient
 }
 type Set struct {
-	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	ipam      *IpamService
+	store     datastore.Datastore
+	k8sClient *client.LightK8sClient
 }
 
 type operators struct {
@@ -53,96 +63,279 @@ type operator struct {
 }
 
 type Network struct {
-	Name          string
-	IP            string
-	Hostname      string
-	CIDR          string
+	Name     string
+	IP       string
+	Hostname string
+	// 主机初始化时拿到的第一个网段
+	CIDR string
+	// 主机占着的所有网段, 第一个和 CIDR 是一样的
+	CIDRs         []string
 	IsCurrentHost bool
 }
 
 type IpamService struct {
-	Subnet             string
-	MaskSegment        string
-	MaskIP             string
-	PodMaskSegment     string
-	PodMaskIP          string
+	Subnet         string
+	MaskSegment    string
+	MaskIP         string
+	PodMaskSegment string
+	PodMaskIP      string
+	// 每个节点分到的网段的掩码, 比如 subnet 是 10.244.0.0/16, 这里是 26 的话每个节点就分到一个 /26
+	BlockMaskSegment   string
 	CurrentHostNetwork string
-	EtcdClient         *etcd.EtcdClient
-	K8sClient          *client.LightK8sClient
+	// 为 true 的话节点的网段就是 k8s 给节点分的 podCIDR, BlockMaskSegment 也跟着 podCIDR 走
+	UsePodCIDR bool
+	// ipam 的数据存在哪儿, etcd 或者 crd
+	Datastore datastore.Datastore
+	K8sClient *client.LightK8sClient
+	// 在进程里注册的名字, 双栈的时候 ipv4 和 ipv6 各有一个
+	name string
 	*operator
 }
 
+// 这个 ipam service 管的是不是 ipv6 的网段
+func (is *IpamService) IsIPv6() bool {
+	ip := net.ParseIP(is.Subnet)
+	return ip != nil && ip.To4() == nil
+}
+
+// ip 和 subnet 是不是同一个地址族的
+func (is *IpamService) sameFamily(ip string) bool {
+	_ip := net.ParseIP(ip)
+	return _ip != nil && (_ip.To4() == nil) == is.IsIPv6()
+}
+
+func (is *IpamService) netlinkFamily() int {
+	if is.IsIPv6() {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
 type IPAMOptions struct {
 	MaskSegment      string
 	PodIpMaskSegment string
 	RangeStart       string
 	RangeEnd         string
+	// 不传的话就根据 subnet 的掩码算一个
+	BlockMaskSegment string
+	// subnet 是 ipv6 的时候用这个, 双栈的时候两个地址族可以共用一份 options
+	BlockMaskSegmentV6 string
+	// 为 true 的话初始化的时候不占网段, 第一次分 ip 的时候才从 pool 里占, 网段里的 ip 都释放了之后再还回去
+	// 具名的 ip 池用这个, 不然每个节点一起来就在每个池子里都占一个网段, 小的池子很快就被分光了
+	ClaimOnDemand bool
+	// 为 true 的话不从 pool 里挑网段, 直接用 node 的 spec.podCIDR(s), 和 ClaimOnDemand 不能一起用
+	UsePodCIDR bool
+	// etcd, kubernetes 或者 file, 不传的话存在 etcd 里
+	DatastoreType string
+	// DatastoreType 是 file 的时候数据存在哪个文件里, 不传的话用 /opt/testcni/ipam.json
+	DatastorePath string
+	// 存在 etcd 里的时候怎么连 etcd, 不传的话用节点上的配置文件, 环境变量或者 kubeadm 的默认配置
+	EtcdConfig *etcd.EtcdConfig
+	// 直接指定存储, 比如测试里用的内嵌的 etcd, 优先级比 EtcdClient 和 DatastoreType 高
+	Datastore datastore.Datastore
+	// 不传的话就用默认的 etcd 和 k8s 客户端
+	EtcdClient *etcd.EtcdClient
+	K8sClient  *client.LightK8sClient
 }
 
-var _lock sync.Mutex
-var _isLocking bool
-
-func unlock() {
-	if _isLocking {
-		_lock.Unlock()
-		_isLocking = false
+/**
+ * 把 cni 配置里和模式无关的那些 ipam 参数转成 IPAMOptions, 各个模式和 agent 都用这个
+ * 各个模式和 agent 算出来的参数得一模一样, 不然存储里的路径或者网段的大小就对不上了
+ * 掩码, range 这些和模式有关的参数调用方自己再填
+ */
+func OptionsFromCNI(conf *cni.PluginConf) *IPAMOptions {
+	return &IPAMOptions{
+		BlockMaskSegment:   cni.GetBlockMaskSegment(conf),
+		BlockMaskSegmentV6: cni.GetBlockMaskSegmentV6(conf),
+		DatastoreType:      cni.GetDatastoreType(conf),
+		DatastorePath:      cni.GetDatastorePath(conf),
+		EtcdConfig:         etcd.ConfigFromCNI(cni.GetEtcdConf(conf)),
+		UsePodCIDR:         cni.UsePodCIDR(conf),
 	}
 }
 
-func lock() {
-	if !_isLocking {
-		_lock.Lock()
-		_isLocking = true
-	}
+// 当前网段中所有能分的 ip 都被用了
+var ErrBlockExhausted = errors.New("no available ip in the block")
+
+// pod 指定的 ip 已经被别人用了
+var ErrIPInUse = errors.New("the requested ip is already in use")
+
+// pod 指定的 ip 不在当前主机的网段或者 range 里, 或者是网段号, 网关和广播地址
+var ErrIPOutOfRange = errors.New("the requested ip is out of range")
+
+// 并发修改同一个 key 的时候事务可能会失败, 最多重试这么多次
+const txnRetryTimes = 64
+
+// 事务失败之后随机等一小会儿再重试, 免得大家一起撞车
+func txnBackoff() {
+	time.Sleep(time.Duration(utils.GetRandomNumber(20)) * time.Millisecond)
 }
 
-func getEtcdClient() *etcd.EtcdClient {
-	etcd.Init()
+func getEtcdClient(config *etcd.EtcdConfig) (*etcd.EtcdClient, error) {
+	etcd.InitWithConfig(config)
 	etcdClient, err := etcd.GetEtcdClient()
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to init etcd client: %v", err)
 	}
-	return etcdClient
+	return etcdClient, nil
 }
 
-func getLightK8sClient() *client.LightK8sClient {
-	paths, err := helper.GetHostAuthenticationInfoPath()
+/**
+ * options 里直接给了存储或者 etcd 客户端的话就用给的
+ * 否则按 DatastoreType 创建, 默认存在 etcd 里
+ */
+func getDatastore(options *IPAMOptions, k8sClient *client.LightK8sClient) (datastore.Datastore, error) {
+	if options != nil && options.Datastore != nil {
+		return options.Datastore, nil
+	}
+	if options != nil && options.EtcdClient != nil {
+		return datastore.NewEtcdDatastore(options.EtcdClient), nil
+	}
+	_type := ""
+	if options != nil {
+		_type = options.DatastoreType
+	}
+	_type, err := datastore.CheckType(_type)
 	if err != nil {
-		utils.WriteLog("GetHostAuthenticationInfoPath 执行失败")
-		return nil
+		return nil, err
+	}
+	if _type == datastore.DATASTORE_KUBERNETES {
+		if k8sClient == nil {
+			return nil, errors.New("k8s client not found")
+		}
+		return datastore.NewKubernetesDatastore(k8sClient.Resources(datastore.CRD_GROUP, datastore.CRD_VERSION)), nil
 	}
-	client.Init(paths.CaPath, paths.CertPath, paths.KeyPath)
+	if _type == datastore.DATASTORE_FILE {
+		path := consts.KUBE_TEST_CNI_DEFAULT_DATASTORE_PATH
+		if options != nil && options.DatastorePath != "" {
+			path = options.DatastorePath
+		}
+		return datastore.NewFileDatastore(path)
+	}
+	var etcdConfig *etcd.EtcdConfig
+	if options != nil {
+		etcdConfig = options.EtcdConfig
+	}
+	etcdClient, err := getEtcdClient(etcdConfig)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewEtcdDatastore(etcdClient), nil
+}
+
+// 不初始化 ipam, 只打开 ipam 的存储, 只是读数据的话用这个, 不会给当前主机占网段
+func OpenDatastore(options *IPAMOptions) (datastore.Datastore, error) {
+	if options != nil && options.K8sClient != nil {
+		return getDatastore(options, options.K8sClient)
+	}
+	return getDatastore(options, getLightK8sClient())
+}
+
+func getLightK8sClient() *client.LightK8sClient {
+	client.Init()
 	k8sClient, err := client.GetLightK8sClient()
 	if err != nil {
+		utils.WriteLog("初始化 k8s client 失败: ", err.Error())
 		return nil
 	}
 	return k8sClient
 }
 
-func getIpamSubnet() string {
-	ipam, _ := GetIpamService()
-	return ipam.Subnet
+// 当前主机分到的网段
+func (is *IpamService) currentBlock() (*net.IPNet, error) {
+	currentNetwork, err := is.Datastore.Get(is.hostPath())
+	if err != nil {
+		return nil, err
+	}
+	if currentNetwork == "" {
+		return nil, errors.New("current host has no network")
+	}
+	return parseBlock(currentNetwork, is.BlockMaskSegment)
+}
+
+func (is *IpamService) hostPath() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "/test-error-path"
+	}
+	return is.hostPathByName(hostname)
+}
+
+// 老版本中当前主机已经使用的 ip 都用 ; 拼起来存在这一个 key 下, 现在只在迁移的时候用
+func getLegacyRecordPath(subnet, mask, hostname, hostNetwork string) string {
+	return getEtcdPathWithPrefix("/" + subnet + "/" + mask + "/" + hostname + "/" + hostNetwork)
+}
+
+/**
+ * 某个网段下已经被使用的 ip 都存在这个前缀下, 每个 ip 一个 key, value 是这个 ip 的 owner
+ * 比如 /testcni/ipam/10.244.0.0/16/10.244.1.0/ips/10.244.1.2
+ */
+func (is *IpamService) ipsPrefix(network string) string {
+	return getIPsPrefixWithSubnet(is.Subnet, is.MaskSegment, network)
 }
 
-func getIpamMaskSegment() string {
-	ipam, _ := GetIpamService()
-	return ipam.MaskSegment
+// 初始化的时候 ipam service 还没创建好, 只能直接把 subnet 和 mask 传进来
+func getIPsPrefixWithSubnet(subnet, mask, network string) string {
+	return getEtcdPathWithPrefix("/" + subnet + "/" + mask + "/" + network + "/ips/")
 }
 
-func getHostPath() string {
+func (is *IpamService) ipPath(network, ip string) string {
+	return is.ipsPrefix(network) + ip
+}
+
+/**
+ * 已经被节点占走的网段, 每个网段一个 key, value 是占着它的主机名
+ * 比如 /testcni/ipam/10.244.0.0/16/blocks/10.244.1.0
+ */
+func getBlocksPrefix(subnet, mask string) string {
+	return getEtcdPathWithPrefix("/" + subnet + "/" + mask + "/blocks/")
+}
+
+func (is *IpamService) blocksPrefix() string {
+	return getBlocksPrefix(is.Subnet, is.MaskSegment)
+}
+
+// 没有具体容器的 ip(比如网关)的 owner 就是主机名
+func getDefaultOwner() string {
 	hostname, err := os.Hostname()
 	if err != nil {
-		return "/test-error-path"
+		return ""
+	}
+	return hostname
+}
+
+// 列出某个网段下已经被使用的全部 ip
+func (is *IpamService) listUsedIPs(network string) ([]string, error) {
+	prefix := is.ipsPrefix(network)
+	kvs, err := is.Datastore.List(prefix)
+	if err != nil {
+		return nil, err
 	}
-	return getEtcdPathWithPrefix("/" + getIpamSubnet() + "/" + getIpamMaskSegment() + "/" + hostname)
+	res := []string{}
+	for key := range kvs {
+		res = append(res, strings.TrimPrefix(key, prefix))
+	}
+	return res, nil
 }
 
-func getRecordPath(hostNetwork string) string {
-	return getHostPath() + "/" + hostNetwork
+/**
+ * 在 ip 对应的 key 还不存在的时候把它创建出来, 也就是占上这个 ip
+ * 返回 false 表示这个 ip 已经被别人先占了
+ */
+func createIPIfAbsent(store datastore.Datastore, path, owner string, ops ...datastore.Op) (bool, error) {
+	return store.Txn(
+		[]datastore.Cmp{datastore.KeyMissing(path)},
+		append([]datastore.Op{datastore.OpPut(path, owner)}, ops...)...,
+	)
+}
+
+// 记着这个网段上一次分出去的是哪个 ip, 下次从它后面接着分
+func (is *IpamService) cursorPath(network string) string {
+	return getEtcdPathWithPrefix("/" + is.Subnet + "/" + is.MaskSegment + "/" + network + "/cursor")
 }
 
-func getIpRangesPath(network string) string {
-	return getHostPath() + "/" + network + "/range"
+func (is *IpamService) ipRangesPath(network string) string {
+	return is.hostPath() + "/" + network + "/range"
 }
 
 func getIPsPoolPath(subnet, mask string) string {
@@ -150,38 +343,23 @@ func getIPsPoolPath(subnet, mask string) string {
 }
 
 func (g *Get) MaskSegment() (string, error) {
-	ipam, err := GetIpamService()
-	if err != nil {
-		return "", err
-	}
-	return ipam.MaskSegment, nil
+	return g.ipam.MaskSegment, nil
 }
 
 func (g *Get) Subnet() (string, error) {
-	ipam, err := GetIpamService()
-	if err != nil {
-		return "", err
-	}
-	return ipam.Subnet, nil
+	return g.ipam.Subnet, nil
 }
 
 func (g *Get) HostSubnetMapPath() (string, error) {
-	ipam, err := GetIpamService()
-	if err != nil {
-		return "", err
-	}
-	m := fmt.Sprintf("/%s/%s/maps", ipam.Subnet, ipam.MaskSegment)
+	m := fmt.Sprintf("/%s/%s/maps", g.ipam.Subnet, g.ipam.MaskSegment)
 	return getEtcdPathWithPrefix(m), nil
 }
 
 func (g *Get) HostSubnetMap() (map[string]string, error) {
-	ipam, err := GetIpamService()
-	if err != nil {
-		return nil, err
-	}
-	return ipam.getHostSubnetMap()
+	return g.ipam.getHostSubnetMap()
 }
 
+// 获取某台主机的网段下存放已使用 ip 的前缀, 要用 WithPrefix 去读或者监听
 func (g *Get) RecordPathByHost(hostname string) (string, error) {
 	cidr, err := g.CIDR(hostname)
 	if err != nil {
@@ -189,167 +367,186 @@ func (g *Get) RecordPathByHost(hostname string) (string, error) {
 	}
 	subnetAndMask := strings.Split(cidr, "/")
 	if len(subnetAndMask) > 1 {
-		path := fmt.Sprintf("/%s/%s/%s/%s", getIpamSubnet(), getIpamMaskSegment(), hostname, subnetAndMask[0])
-		return getEtcdPathWithPrefix(path), nil
+		return g.ipam.ipsPrefix(subnetAndMask[0]), nil
 	}
 	return "", errors.New("can not get subnet address")
 }
 
 func (g *Get) CurrentSubnet() (string, error) {
-	ipam, err := GetIpamService()
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%s/%s", ipam.Subnet, ipam.MaskSegment), nil
+	return fmt.Sprintf("%s/%s", g.ipam.Subnet, g.ipam.MaskSegment), nil
 }
 
+// 获取某台主机占着的所有网段中已经被使用的 ip
 func (g *Get) RecordByHost(hostname string) ([]string, error) {
-	path, err := g.RecordPathByHost(hostname)
+	networks, err := g.HostBlocks(hostname)
 	if err != nil {
 		return nil, err
 	}
-	str, err := g.etcdClient.Get(path)
-	if err != nil {
-		return nil, err
+	res := []string{}
+	for _, network := range networks {
+		ips, err := g.ipam.listUsedIPs(network)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ips...)
 	}
-	return strings.Split(str, ";"), nil
+	return res, nil
 }
 
-var getSet = func() func() *Set {
-	var _set *Set
-	return func() *Set {
-		if _set != nil {
-			return _set
-		}
-		_set = &Set{}
-		_set.etcdClient = getEtcdClient()
-		_set.k8sClient = getLightK8sClient()
-		return _set
-	}
-}()
-
-var getGet = func() func() *Get {
-	var _get *Get
-	return func() *Get {
-		if _get != nil {
-			return _get
-		}
-		_get = &Get{
-			cidrCache:   map[string]string{},
-			nodeIpCache: map[string]string{},
-		}
-		_get.etcdClient = getEtcdClient()
-		_get.k8sClient = getLightK8sClient()
-		return _get
+func newOperator(is *IpamService) *operator {
+	return &operator{
+		operators: &operators{
+			Get: newGet(is),
+			Set: &Set{
+				ipam:      is,
+				store:     is.Datastore,
+				k8sClient: is.K8sClient,
+			},
+			Release: &Release{
+				ipam:      is,
+				store:     is.Datastore,
+				k8sClient: is.K8sClient,
+			},
+		},
 	}
-}()
+}
 
-var getRelase = func() func() *Release {
-	var _release *Release
-	return func() *Release {
-		if _release != nil {
-			return _release
-		}
-		_release = &Release{}
-		_release.etcdClient = getEtcdClient()
-		_release.k8sClient = getLightK8sClient()
-		return _release
+// Get 里头要写 etcd 的时候用同一套客户端创建一个 Set
+func (g *Get) set() *Set {
+	return &Set{ipam: g.ipam, store: g.store, k8sClient: g.k8sClient}
+}
+
+// Release 里头要读 etcd 的时候用同一套客户端创建一个 Get
+func (r *Release) get() *Get {
+	return newGet(r.ipam)
+}
+
+// Set 里头要读 etcd 的时候用同一套客户端创建一个 Get
+func (s *Set) get() *Get {
+	return newGet(s.ipam)
+}
+
+func newGet(is *IpamService) *Get {
+	return &Get{
+		ipam:        is,
+		store:       is.Datastore,
+		k8sClient:   is.K8sClient,
+		cidrCache:   map[string]string{},
+		nodeIpCache: map[string]string{},
 	}
-}()
+}
 
-func isGatewayIP(ip string) bool {
-	// 把每个网段的 x.x.x.1 当做网关
-	if ip == "" {
-		return false
+/**
+ * 用 compare-and-swap 的方式修改 key 的值
+ * 先读出 key 当前的值以及 revision, 交给 fn 算出新的值
+ * 写回去的时候如果 key 已经被别人改过了(revision 变了)就从头再来一遍
+ * fn 的第二个返回值是 false 的话表示不需要修改
+ */
+func casUpdate(store datastore.Datastore, key string, fn func(val string) (string, bool, error)) error {
+	for i := 0; i < txnRetryTimes; i++ {
+		val, revision, err := store.GetWithRevision(key)
+		if err != nil {
+			return err
+		}
+		newVal, changed, err := fn(val)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil
+		}
+		succeeded, err := store.Txn(
+			[]datastore.Cmp{datastore.ModRevisionIs(key, revision)},
+			datastore.OpPut(key, newVal),
+		)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			return nil
+		}
+		txnBackoff()
 	}
-	_arr := strings.Split(ip, ".")
-	return _arr[3] == "1"
+	return fmt.Errorf("failed to update %s after %d retries", key, txnRetryTimes)
 }
 
-func isRetainIP(ip string) bool {
-	// 把每个网段的 x.x.x.0 当做保留
-	if ip == "" {
-		return false
+/**
+ * 网段号, 网关和广播地址都不能分给 pod
+ * /31 和 /32 这种网段太小了, 没有这些地址
+ */
+func isReservedIP(ip net.IP, blocks ...*net.IPNet) bool {
+	for _, block := range blocks {
+		ones, bits := block.Mask.Size()
+		if bits-ones < 2 {
+			continue
+		}
+		if ip.Equal(networkAddr(block)) || ip.Equal(gatewayAddr(block)) || ip.Equal(broadcastAddr(block)) {
+			return true
+		}
 	}
-	_arr := strings.Split(ip, ".")
-	return _arr[3] == "0"
+	return false
 }
 
 /**
  * 将参数的 ips 设置到 etcd 中
+ * 每个 ip 都是一个单独的 key, etcd 上已经存了的则不用再写入了
  */
 func (s *Set) IPs(ips ...string) error {
-	defer unlock()
-	// 先拿到当前主机对应的网段
-	currentNetwork, err := s.etcdClient.Get(getHostPath())
+	// 先拿到当前主机的第一个网段
+	primary, err := s.store.Get(s.ipam.hostPath())
 	if err != nil {
 		return err
 	}
-	// 拿到当前主机的网段下所有已经使用的 ip
-	allUsedIPs, err := s.etcdClient.Get(getRecordPath(currentNetwork))
-	if err != nil {
-		return err
-	}
-	_allUsedIPsArr := strings.Split(allUsedIPs, ";")
-	_tempIPs := allUsedIPs
+	g := s.get()
 	for _, ip := range ips {
-		if _tempIPs == "" {
-			_tempIPs = ip
-		} else {
-			flag := true
-			for i := 0; i < len(_allUsedIPsArr); i++ {
-				if _allUsedIPsArr[i] == ip {
-					// 如果 etcd 上已经存了则不用再写入了
-					flag = false
-					break
-				}
-			}
-			if flag {
-				_tempIPs += ";" + ip
-			}
+		// 再看这个 ip 是在当前主机的哪个网段里
+		network, err := g.networkOfIP(ip)
+		if err != nil {
+			return err
+		}
+		path := s.ipam.ipPath(network, ip)
+		_, err = s.store.Txn(
+			append(
+				[]datastore.Cmp{datastore.KeyMissing(path)},
+				s.ipam.blockOwnedCmps(network, primary)...,
+			),
+			datastore.OpPut(path, getDefaultOwner()),
+		)
+		if err != nil {
+			return err
 		}
 	}
-
-	return s.etcdClient.Set(getRecordPath(currentNetwork), _tempIPs)
+	return nil
 }
 
-// 根据主机名获取一个当前主机可用的网段
-func (is *IpamService) networkInit(hostPath, poolPath string, ranges ...string) (string, error) {
-	lock()
-	defer unlock()
-	network, err := is.EtcdClient.Get(hostPath)
-	if err != nil {
-		return "", err
-	}
-
-	// 已经存过该主机对应的网段了
-	if network != "" {
-		return network, nil
-	}
-
-	// 从可用的 ip 池中捞一个
-	pool, err := is.EtcdClient.Get(poolPath)
-	if err != nil {
-		return "", err
-	}
-
-	_tempIPs := strings.Split(pool, ";")
-	tmpRandom := utils.GetRandomNumber(len(_tempIPs))
-	// TODO: 这块还是得想办法加锁
-	currentHostNetwork := _tempIPs[tmpRandom]
-	newTmpIps := append([]string{}, _tempIPs[0:tmpRandom]...)
-	_tempIPs = append(newTmpIps, _tempIPs[tmpRandom+1:]...)
-	// 先把 pool 更新一下
-	err = is.EtcdClient.Set(poolPath, strings.Join(_tempIPs, ";"))
-	if err != nil {
-		return "", err
-	}
-	// 再把这个网段存到对应的这台主机的 key 下
-	err = is.EtcdClient.Set(hostPath, currentHostNetwork)
+/**
+ * 把 ip 在当前主机的 network 这个网段中占上坑位, 顺便把 cursor 挪到这个 ip 上
+ * 返回 false 表示这个 ip 已经被别人先占了, 或者这个网段已经被还回去了
+ */
+func (s *Set) reserveIP(network, ip string) (bool, error) {
+	primary, err := s.store.Get(s.ipam.hostPath())
 	if err != nil {
-		return "", err
-	}
+		return false, err
+	}
+	path := s.ipam.ipPath(network, ip)
+	return s.store.Txn(
+		append(
+			[]datastore.Cmp{datastore.KeyMissing(path)},
+			s.ipam.blockOwnedCmps(network, primary)...,
+		),
+		datastore.OpPut(path, getDefaultOwner()),
+		datastore.OpPut(s.ipam.cursorPath(network), ip),
+	)
+}
 
+/**
+ * 根据主机名获取一个当前主机可用的网段
+ * 所有可用的网段是根据 subnet 算出来的, 已经被占走的网段在 blocks 下各有一个 key
+ * 占网段和把网段记到主机名下是在同一个事务里做的
+ * 事务的条件是这个网段还没被别人占走并且这台主机还没有网段, 不满足的话就重新来一遍
+ * 这样不同节点同时初始化的时候也不会拿到同一个网段
+ */
+func (is *IpamService) networkInit(hostPath, blocksPrefix string, ranges ...string) (string, error) {
 	// 如果传了 ip 地址的 range 的话就创建一个 range 目录
 	start := ""
 	end := ""
@@ -360,23 +557,86 @@ func (is *IpamService) networkInit(hostPath, poolPath string, ranges ...string)
 		start = ranges[0]
 		end = ranges[1]
 	}
+	// 网段记在哪台主机名下, 就是 hostPath 的最后一段
+	hostname := hostPath[strings.LastIndex(hostPath, "/")+1:]
 
-	if start != "" && end != "" {
-		ranges := utils.GenIpRange(start, end)
-		if ranges != nil {
-			currentIpRanges := strings.Join(utils.GenIpRange(start, end), ";")
-			err = is.EtcdClient.Set(fmt.Sprintf(
-				"%s/%s/range",
-				hostPath,
-				currentHostNetwork,
-			), currentIpRanges)
-			if err != nil {
-				return "", err
+	for i := 0; i < txnRetryTimes; i++ {
+		network, err := is.Datastore.Get(hostPath)
+		if err != nil {
+			return "", err
+		}
+
+		// 已经存过该主机对应的网段了
+		if network != "" {
+			return network, nil
+		}
+
+		// 从还没被占走的网段中捞一个
+		available, err := is.availableNetworks(blocksPrefix)
+		if err != nil {
+			return "", err
+		}
+		if len(available) == 0 {
+			return "", errors.New("there is no available network in the pool")
+		}
+		currentHostNetwork := available[utils.GetRandomNumber(len(available))]
+		blockPath := blocksPrefix + currentHostNetwork
+
+		ops := []datastore.Op{
+			// 先把这个网段占上
+			datastore.OpPut(blockPath, hostname),
+			// 再把这个网段存到对应的这台主机的 key 下
+			datastore.OpPut(hostPath, currentHostNetwork),
+		}
+		if start != "" && end != "" {
+			ranges := utils.GenIpRange(start, end)
+			if ranges != nil {
+				ops = append(ops, datastore.OpPut(
+					fmt.Sprintf("%s/%s/range", hostPath, currentHostNetwork),
+					strings.Join(ranges, ";"),
+				))
 			}
 		}
+
+		succeeded, err := is.Datastore.Txn(
+			[]datastore.Cmp{
+				datastore.KeyMissing(blockPath),
+				datastore.KeyMissing(hostPath),
+			},
+			ops...,
+		)
+		if err != nil {
+			return "", err
+		}
+		if succeeded {
+			return currentHostNetwork, nil
+		}
+		txnBackoff()
 	}
+	return "", fmt.Errorf("failed to init network of %s after %d retries", hostPath, txnRetryTimes)
+}
 
-	return currentHostNetwork, nil
+// 还没有被任何节点占走的网段
+func (is *IpamService) availableNetworks(blocksPrefix string) ([]string, error) {
+	kvs, err := is.Datastore.List(blocksPrefix)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for key := range kvs {
+		used[strings.TrimPrefix(key, blocksPrefix)] = true
+	}
+	networks, err := is.allNetworks()
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, network := range networks {
+		if !used[network] {
+			res = append(res, network)
+		}
+	}
+	return res, nil
 }
 
 // 获取主机名和网段的映射
@@ -386,7 +646,7 @@ func (is *IpamService) getHostSubnetMap() (map[string]string, error) {
 		return nil, err
 	}
 
-	_maps, err := is.EtcdClient.Get(path)
+	_maps, err := is.Datastore.Get(path)
 	if err != nil {
 		return nil, err
 	}
@@ -401,97 +661,54 @@ func (is *IpamService) getHostSubnetMap() (map[string]string, error) {
 
 // 初始化
 func (is *IpamService) subnetMapInit(subnet, mask, hostname, currentSubnet string) error {
-	lock()
-	defer unlock()
 	m := fmt.Sprintf("/%s/%s/maps", subnet, mask)
 	path := getEtcdPathWithPrefix(m)
-	maps, err := is.EtcdClient.Get(path)
-	if err != nil {
-		return err
-	}
-
-	if len(maps) == 0 {
-		_maps := map[string]string{}
-		_maps[currentSubnet] = hostname
-		mapsStr, err := json.Marshal(_maps)
-		if err != nil {
-			return err
-		}
-		return is.EtcdClient.Set(path, string(mapsStr))
-	}
-
-	_tmpMaps := map[string]string{}
-	err = json.Unmarshal(([]byte)(maps), &_tmpMaps)
-	if err != nil {
-		return err
-	}
-
-	if _, ok := _tmpMaps[currentSubnet]; ok {
-		return nil
-	}
-	_tmpMaps[currentSubnet] = hostname
-	mapsStr, err := json.Marshal(_tmpMaps)
-	if err != nil {
-		return err
-	}
-	return is.EtcdClient.Set(path, string(mapsStr))
+	return addToHostSubnetMap(is.Datastore, path, currentSubnet, hostname)
 }
 
 /**
- * 用来初始化 ip 网段池
- * 比如 subnet 是 10.244.0.0, mask 是 24 的话
- * 就会在 etcd 中初始化出一个
+ * 用来算出 ip 网段池
+ * 比如 subnet 是 10.244.0.0/16, block 的掩码是 24 的话
+ * 就会得到
  * 	10.244.0.0;10.244.1.0;10.244.2.0;......;10.244.254.0;10.244.255.0
+ * block 的掩码是 26 的话就是
+ * 	10.244.0.0;10.244.0.64;10.244.0.128;......;10.244.255.128;10.244.255.192
  */
-func (is *IpamService) ipsPoolInit(poolPath string) error {
-	lock()
-	defer unlock()
-	val, err := is.EtcdClient.Get(poolPath)
+func (is *IpamService) allNetworks() ([]string, error) {
+	subnet, err := parseBlock(is.Subnet, is.MaskSegment)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(val) > 0 {
-		return nil
+	blockMask, err := strconv.Atoi(is.BlockMaskSegment)
+	if err != nil {
+		return nil, err
 	}
-	subnet := is.Subnet
-	_temp := strings.Split(subnet, ".")
-	_tempIndex := 0
-	for _i := 0; _i < len(_temp); _i++ {
-		if _temp[_i] == "0" {
-			// 找到 subnet 中第一个 0 的位置
-			_tempIndex = _i
-			break
-		}
+	blocks, err := splitSubnet(subnet, blockMask)
+	if err != nil {
+		return nil, err
 	}
-	/**
-	 * FIXME: 对于子网网段的创建, 其实可以不完全是 8 的倍数
-	 * 比如 10.244.0.0/26 这种其实也可以
-	 */
-	// 创建出 255 个备用的网段
 	// 每个节点从这些网段中选择一个还没有使用过的
-	_tempIpStr := ""
-	for _j := 0; _j <= 255; _j++ {
-		_temp[_tempIndex] = fmt.Sprintf("%d", _j)
-		_newIP := strings.Join(_temp, ".")
-		if _tempIpStr == "" {
-			_tempIpStr = _newIP
-		} else {
-			_tempIpStr += ";" + _newIP
-		}
+	res := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		res = append(res, block.IP.String())
 	}
-	return is.EtcdClient.Set(poolPath, _tempIpStr)
+	return res, nil
 }
 
 /**
  * 用来获取集群中全部的 host name
- * 这里直接从 etcd 的 key 下边查
+ * 存储是 etcd 的话直接从 etcd 的 key 下边查
  * 不调 k8s 去捞, k8s 捞一次出来的东西太多了
+ * 存储是 kubernetes 的话说明连不上 etcd, 只能调 k8s 的 api
  */
 func (g *Get) NodeNames() ([]string, error) {
-	defer unlock()
+	if g.store.Type() != datastore.DATASTORE_ETCD {
+		return g.nodeNamesFromK8s()
+	}
+
 	const _minionsNodePrefix = "/registry/minions/"
 
-	nodes, err := g.etcdClient.GetAllKey(_minionsNodePrefix, oriEtcd.WithKeysOnly(), oriEtcd.WithPrefix())
+	nodes, err := g.store.List(_minionsNodePrefix)
 
 	if err != nil {
 		utils.WriteLog("这里从 etcd 获取全部 nodes key 失败, err: ", err.Error())
@@ -499,13 +716,30 @@ func (g *Get) NodeNames() ([]string, error) {
 	}
 
 	var res []string
-	for _, node := range nodes {
+	for node := range nodes {
 		node = strings.Replace(node, _minionsNodePrefix, "", 1)
 		res = append(res, node)
 	}
 	return res, nil
 }
 
+func (g *Get) nodeNamesFromK8s() ([]string, error) {
+	if g.k8sClient == nil {
+		return nil, errors.New("k8s client not found")
+	}
+	nodes, err := g.k8sClient.Get().Nodes()
+	if err != nil {
+		utils.WriteLog("这里从 k8s 获取全部 nodes 失败, err: ", err.Error())
+		return nil, err
+	}
+
+	var res []string
+	for _, node := range nodes.Items {
+		res = append(res, node.Name)
+	}
+	return res, nil
+}
+
 /**
  * 获取集群中全部节点的网络信息
  */
@@ -532,12 +766,18 @@ func (g *Get) AllHostNetwork() ([]*Network, error) {
 			return nil, err
 		}
 
+		cidrs, err := g.CIDRs(name)
+		if err != nil {
+			return nil, err
+		}
+
 		if name == hostname {
 			res = append(res, &Network{
 				Hostname:      name,
 				IP:            ip,
 				IsCurrentHost: true,
 				CIDR:          cidr,
+				CIDRs:         cidrs,
 			})
 		} else {
 			res = append(res, &Network{
@@ -545,6 +785,7 @@ func (g *Get) AllHostNetwork() ([]*Network, error) {
 				IP:            ip,
 				IsCurrentHost: false,
 				CIDR:          cidr,
+				CIDRs:         cidrs,
 			})
 		}
 	}
@@ -581,6 +822,9 @@ func (g *Get) AllOtherHostIP() (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if g.k8sClient == nil {
+		return nil, errors.New("k8s client not found")
+	}
 	nodes, err := g.k8sClient.Get().Nodes()
 	if err != nil {
 		return nil, err
@@ -600,7 +844,7 @@ func (g *Get) AllOtherHostIP() (map[string]string, error) {
 				}
 				_hostname = addr.Address
 			}
-			if addr.Type == "InternalIP" {
+			if addr.Type == "InternalIP" && g.ipam.sameFamily(addr.Address) {
 				ip = addr.Address
 			}
 		}
@@ -621,41 +865,31 @@ func (g *Get) HostNetwork() (*Network, error) {
 		return nil, err
 	}
 
-	// 先获取一下 ipam
-	ipam, err := GetIpamService()
-	if err != nil {
-		return nil, err
-	}
-	// 然后拿本机的 hostname
+	// 先拿本机的 hostname
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 
 	// 用这个 hostname 获取本机的 ip
-	hostIP, err := ipam.Get().NodeIp(hostname)
+	hostIP, err := g.NodeIp(hostname)
 	if err != nil {
 		return nil, err
 	}
+	_hostIP := net.ParseIP(hostIP)
 	for _, link := range linkList {
 		// 就看类型是 device 的
 		if link.Type() == "device" {
-			// 找每块儿设备的地址信息
-			addr, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			// 找每块儿设备上和 subnet 同一个地址族的地址, 一块儿网卡可能绑着好几个 ip, 挨个儿和本机的 ip 比
+			addrs, err := netlink.AddrList(link, g.ipam.netlinkFamily())
 			if err != nil {
 				continue
 			}
-			if len(addr) >= 1 {
-				// TODO: 这里其实应该处理一下一块儿网卡绑定了多个 ip 的情况
-				// 数组中的每项都是这样的格式 "192.168.98.143/24 ens33"
-				_addr := strings.Split(addr[0].String(), " ")
-				ip := _addr[0]
-				name := _addr[1]
-				ip = strings.Split(ip, "/")[0]
-				if ip == hostIP {
+			for _, addr := range addrs {
+				if addr.IP.Equal(_hostIP) {
 					// 走到这儿说明主机走的就是这块儿网卡
 					return &Network{
-						Name:          name,
+						Name:          link.Attrs().Name,
 						IP:            hostIP,
 						Hostname:      hostname,
 						IsCurrentHost: true,
@@ -669,18 +903,27 @@ func (g *Get) HostNetwork() (*Network, error) {
 
 // 获取当前节点被分配到的网段 + mask
 func (g *Get) CIDR(hostName string) (string, error) {
-	defer unlock()
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
 	if val, ok := g.cidrCache[hostName]; ok {
 		return val, nil
 	}
-	_cidrPath := getEtcdPathWithPrefix("/" + getIpamSubnet() + "/" + getIpamMaskSegment() + "/" + hostName)
+	// 用 podCIDR 的话以 k8s 里节点的 spec.podCIDR(s) 为准, 节点还没跑过 testcni 也能拿到
+	if g.ipam.UsePodCIDR {
+		cidr, err := g.PodCIDR(hostName)
+		if err != nil || cidr == "" {
+			return cidr, err
+		}
+		g.cidrCache[hostName] = cidr
+		return cidr, nil
+	}
+	_cidrPath := g.ipam.hostPathByName(hostName)
 
-	etcd := getEtcdClient()
-	if etcd == nil {
-		return "", errors.New("etcd client not found")
+	if g.store == nil {
+		return "", errors.New("datastore not found")
 	}
 
-	cidr, err := etcd.Get(_cidrPath)
+	cidr, err := g.store.Get(_cidrPath)
 	if err != nil {
 		return "", err
 	}
@@ -689,12 +932,7 @@ func (g *Get) CIDR(hostName string) (string, error) {
 		return "", nil
 	}
 
-	// 先获取一下 ipam
-	ipam, err := GetIpamService()
-	if err != nil {
-		return "", err
-	}
-	cidr += ("/" + ipam.PodMaskSegment)
+	cidr += ("/" + g.ipam.BlockMaskSegment)
 	g.cidrCache[hostName] = cidr
 	return cidr, nil
 }
@@ -703,16 +941,21 @@ func (g *Get) CIDR(hostName string) (string, error) {
  * 根据 host name 获取节点 ip
  */
 func (g *Get) NodeIp(hostName string) (string, error) {
-	defer unlock()
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
 	if val, ok := g.nodeIpCache[hostName]; ok {
 		return val, nil
 	}
+	if g.k8sClient == nil {
+		return "", errors.New("k8s client not found")
+	}
 	node, err := g.k8sClient.Get().Node(hostName)
 	if err != nil {
 		return "", err
 	}
+	// 双栈的节点上 ipv4 和 ipv6 的 InternalIP 都有, 要拿和 subnet 一样的那个
 	for _, addr := range node.Status.Addresses {
-		if addr.Type == "InternalIP" {
+		if addr.Type == "InternalIP" && g.ipam.sameFamily(addr.Address) {
 			g.nodeIpCache[hostName] = addr.Address
 			return addr.Address, nil
 		}
@@ -720,195 +963,318 @@ func (g *Get) NodeIp(hostName string) (string, error) {
 	return "", errors.New("没有找到 ip")
 }
 
-func (g *Get) nextUnusedIP() (string, error) {
-	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+/**
+ * 在当前主机占着的网段里找下一个可以用的 ip, 返回 ip 所在的网段和 ip
+ * 按顺序一个网段一个网段地找, 都用完了的话就再从 pool 里占一个新的网段
+ * 当前主机一个网段都还没有的话(用到的时候才占网段的 ip 池)也是直接从 pool 里占
+ * 配置了 range 的话就只在 range 里找
+ */
+func (g *Get) nextUnusedIP() (string, string, error) {
+	networks, err := g.allocatableBlocks()
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	for _, network := range networks {
+		ip, err := g.nextUnusedIPInBlock(network)
+		if err == nil {
+			return network, ip, nil
+		}
+		if !errors.Is(err, ErrBlockExhausted) {
+			return "", "", err
+		}
+	}
+	// 用 podCIDR 的话用完了也不能去 pool 里占新的网段
+	if g.ipam.UsePodCIDR {
+		return "", "", fmt.Errorf("podCIDR of the current host is exhausted: %w", ErrBlockExhausted)
 	}
-	allUsedIPs, err := g.etcdClient.Get(getRecordPath(currentNetwork))
+
+	if len(networks) > 0 {
+		rangesIPs, err := g.store.Get(g.ipam.ipRangesPath(networks[0]))
+		if err != nil {
+			return "", "", err
+		}
+		if rangesIPs != "" {
+			return "", "", fmt.Errorf("ip range of %s is exhausted: %w", networks[0], ErrBlockExhausted)
+		}
+	}
+
+	network, err := g.set().claimBlock()
+	if err != nil {
+		return "", "", err
+	}
+	ip, err := g.nextUnusedIPInBlock(network)
+	if err != nil {
+		return "", "", err
+	}
+	return network, ip, nil
+}
+
+/**
+ * 按顺序找网段中下一个可以用的 ip
+ * 每个网段都在 etcd 中记着上一次分出去的 ip(cursor), 从它的下一个开始往后找, 找到头了就绕回来从第一个开始
+ * 最多把网段中的 ip 都看一遍, 都被用了的话就返回 ErrBlockExhausted
+ * 网段号, 网关和广播地址不会被分出去
+ */
+func (g *Get) nextUnusedIPInBlock(currentNetwork string) (string, error) {
+	ips, err := g.ipam.listUsedIPs(currentNetwork)
 	if err != nil {
 		return "", err
 	}
 
 	ipsMap := map[string]bool{}
-	ips := strings.Split(allUsedIPs, ";")
 	for _, ip := range ips {
 		ipsMap[ip] = true
 	}
 
-	if rangesPathExist, err := g.etcdClient.GetKey(getIpRangesPath(currentNetwork)); rangesPathExist != "" && err == nil {
-		if rangesIPs, err := g.etcdClient.Get(getIpRangesPath(currentNetwork)); err == nil {
-			rangeIpsArr := strings.Split(rangesIPs, ";")
-			if len(rangeIpsArr) == 0 {
-				return "", errors.New("all of the ips are used")
-			}
-			nextIp := ""
-			for {
-				if len(ipsMap) == len(rangeIpsArr) {
-					return "", errors.New("all of the ips are used")
-				}
-				nextIp = ""
-				for i, ip := range rangeIpsArr {
-					if utils.GetRandomNumber(i+1) == 0 {
-						nextIp = ip
-					}
-				}
-				if _, ok := ipsMap[nextIp]; !ok {
-					break
-				}
-			}
+	cursor, err := g.store.Get(g.ipam.cursorPath(currentNetwork))
+	if err != nil {
+		return "", err
+	}
+
+	candidates, name, err := g.candidateIPs(currentNetwork)
+	if err != nil {
+		return "", err
+	}
+	total := candidates.count()
+	if total <= 0 {
+		return "", fmt.Errorf("%s is too small to allocate ip: %w", name, ErrBlockExhausted)
+	}
 
-			return nextIp, nil
+	// 从 cursor 的下一个开始找, 没有 cursor 或者 cursor 已经不在网段里了就从头开始
+	start := int64(0)
+	if index := candidates.indexOf(cursor); index >= 0 && index+1 < total {
+		start = index + 1
+	}
+	// 连着看 len(ips)+1 个的话里头至少有一个没被用的, 不用把整个网段都看一遍, ipv6 的网段大得根本看不完
+	limit := total
+	if int64(len(ips)) < limit {
+		limit = int64(len(ips)) + 1
+	}
+	index := start
+	for i := int64(0); i < limit; i++ {
+		ip := candidates.at(index)
+		if !ipsMap[ip] {
+			return ip, nil
+		}
+		index++
+		if index == total {
+			index = 0
 		}
 	}
+	return "", fmt.Errorf("%s is exhausted: %w", name, ErrBlockExhausted)
+}
 
-	gw, err := g.Gateway()
+// 可以分配的 ip 的列表, 网段很大的时候不用真的把所有 ip 都列出来
+type ipCandidates interface {
+	count() int64
+	at(index int64) string
+	// 不在列表中的话返回 -1
+	indexOf(ip string) int64
+}
+
+// 配置了 range 的时候就在 range 里头分
+type rangeCandidates []string
+
+func (r rangeCandidates) count() int64 {
+	return int64(len(r))
+}
+
+func (r rangeCandidates) at(index int64) string {
+	return r[index]
+}
+
+func (r rangeCandidates) indexOf(ip string) int64 {
+	for i, candidate := range r {
+		if candidate == ip {
+			return int64(i)
+		}
+	}
+	return -1
+}
+
+// 没配置 range 的话就是网关之后到广播地址之前的这些地址
+type blockCandidates struct {
+	block *net.IPNet
+	first net.IP
+}
+
+func (b *blockCandidates) count() int64 {
+	return blockHostsCount(b.block)
+}
+
+func (b *blockCandidates) at(index int64) string {
+	return ipAdd(b.first, index).String()
+}
+
+func (b *blockCandidates) indexOf(ip string) int64 {
+	_ip := net.ParseIP(ip)
+	if _ip == nil || !b.block.Contains(_ip) || isReservedIP(_ip, b.block) {
+		return -1
+	}
+	index := big.NewInt(0).Sub(ipToInt(_ip), ipToInt(b.first))
+	if !index.IsInt64() || index.Int64() >= b.count() {
+		return -1
+	}
+	return index.Int64()
+}
+
+// 拿到当前网段中能分配的 ip, 第二个返回值是用来报错的时候描述这个网段的
+func (g *Get) candidateIPs(currentNetwork string) (ipCandidates, string, error) {
+	rangesIPs, err := g.store.Get(g.ipam.ipRangesPath(currentNetwork))
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
-	nextIp := ""
-	gwNum := utils.InetIP2Int(gw)
-	for {
-		n := utils.GetRandomNumber(254)
-		if n == 0 || n == 1 {
-			continue
+	if rangesIPs != "" {
+		subnet, err := parseBlock(g.ipam.Subnet, g.ipam.MaskSegment)
+		if err != nil {
+			return nil, "", err
 		}
-		nextIpNum := gwNum + int64(n)
-		nextIp = utils.InetInt2Ip(nextIpNum)
-		if _, ok := ipsMap[nextIp]; !ok {
-			break
+		// range 里头有可能包含 subnet 的网段号, 网关和广播地址, 先把它们去掉
+		res := rangeCandidates{}
+		for _, ip := range strings.Split(rangesIPs, ";") {
+			if ip != "" && !isReservedIP(net.ParseIP(ip), subnet) {
+				res = append(res, ip)
+			}
 		}
+		return res, "ip range of " + currentNetwork, nil
 	}
 
-	return nextIp, nil
+	block, err := parseBlock(currentNetwork, g.ipam.BlockMaskSegment)
+	if err != nil {
+		return nil, "", err
+	}
+	return &blockCandidates{
+		block: block,
+		first: ipAdd(gatewayAddr(block), 1),
+	}, "block " + block.String(), nil
 }
 
 func (g *Get) Gateway() (string, error) {
-	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	block, err := g.ipam.currentBlock()
 	if err != nil {
 		return "", err
 	}
+	return gatewayAddr(block).String(), nil
+}
 
-	return utils.InetInt2Ip((utils.InetIP2Int(currentNetwork) + 1)), nil
+// 某个网段的网关, 一台主机占着好几个网段的时候每个网段都有自己的网关
+func (g *Get) GatewayOf(network string) (string, error) {
+	block, err := parseBlock(network, g.ipam.BlockMaskSegment)
+	if err != nil {
+		return "", err
+	}
+	return gatewayAddr(block).String(), nil
 }
 
 func (g *Get) GatewayWithMaskSegment() (string, error) {
-	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	gw, err := g.Gateway()
 	if err != nil {
 		return "", err
 	}
-
-	return utils.InetInt2Ip((utils.InetIP2Int(currentNetwork) + 1)) + "/" + getIpamMaskSegment(), nil
+	return gw + "/" + g.ipam.MaskSegment, nil
 }
 
 func (g *Get) AllUsedIPs() ([]string, error) {
-	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
-	if err != nil {
-		return nil, err
-	}
-	allUsedIPs, err := g.etcdClient.Get(getRecordPath(currentNetwork))
-	if err != nil {
-		return nil, err
-	}
-	return strings.Split(allUsedIPs, ";"), nil
+	return g.RecordByHost(getDefaultOwner())
 }
 
 func (g *Get) AllUsedIPsByHost(hostname string) ([]string, error) {
-	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
-	if err != nil {
-		return nil, err
-	}
-	allUsedIPs, err := g.etcdClient.Get(getRecordPath(currentNetwork))
-	if err != nil {
-		return nil, err
-	}
-	return strings.Split(allUsedIPs, ";"), nil
+	return g.RecordByHost(hostname)
 }
 
 func (g *Get) UnusedIP() (string, error) {
-	defer unlock()
-	for {
-		ip, err := g.nextUnusedIP()
+	for i := 0; i < txnRetryTimes; i++ {
+		network, ip, err := g.nextUnusedIP()
 		if err != nil {
 			return "", err
 		}
-		if isGatewayIP(ip) || isRetainIP(ip) {
-			err = getSet().IPs(ip)
-			if err != nil {
-				return "", err
-			}
-			continue
-		}
 		// 先把这个 ip 占上坑位
 		// 坑位先占上不影响大局
-		// 但是如果坑位占晚了被别人抢先的话可能会导致有俩 pod 的 ip 冲突
-		err = getSet().IPs(ip)
+		// 占坑是在事务里做的, 如果被别人抢先了就换一个
+		reserved, err := g.set().reserveIP(network, ip)
 		if err != nil {
 			return "", err
 		}
-		return ip, nil
+		if reserved {
+			return ip, nil
+		}
 	}
+	return "", fmt.Errorf("failed to get an unused ip after %d retries", txnRetryTimes)
 }
 
 /**
  * 释放这堆 ip
  */
 func (r *Release) IPs(ips ...string) error {
-	defer unlock()
-	currentNetwork, err := r.etcdClient.Get(getHostPath())
-	if err != nil {
-		return err
+	g := r.get()
+	networks := map[string]bool{}
+	ops := []datastore.Op{}
+	for _, ip := range ips {
+		network, err := g.networkOfIP(ip)
+		if err != nil {
+			return err
+		}
+		networks[network] = true
+		ops = append(ops, datastore.OpDelete(r.ipam.ipPath(network, ip)))
 	}
-	allUsedIPs, err := r.etcdClient.Get(getRecordPath(currentNetwork))
+	_, err := r.store.Txn(nil, ops...)
 	if err != nil {
 		return err
 	}
-	_allUsedIP := strings.Split(allUsedIPs, ";")
-	var _newIPs []string
-	for _, usedIP := range _allUsedIP {
-		flag := false
-		for _, ip := range ips {
-			if usedIP == ip {
-				flag = true
-				break
-			}
-		}
-		if !flag {
-			_newIPs = append(_newIPs, usedIP)
+	// 多占的网段空出来了的话就还回去, 还不回去也不影响这次的释放
+	for network := range networks {
+		err = r.blockIfEmpty(network)
+		if err != nil {
+			utils.WriteLog("归还网段 ", network, " 失败: ", err.Error())
 		}
 	}
-	newIPsString := strings.Join(_newIPs, ";")
-	return r.etcdClient.Set(getRecordPath(currentNetwork), newIPsString)
+	return nil
 }
 
+/**
+ * 把当前主机占着的网段都还回去
+ */
 func (r *Release) Pool() error {
-	defer unlock()
-	currentNetwork, err := r.etcdClient.Get(getIPsPoolPath(getIpamSubnet(), getIpamMaskSegment()))
+	hostname := getDefaultOwner()
+	networks, err := r.get().HostBlocks(hostname)
 	if err != nil {
 		return err
 	}
-
-	return r.etcdClient.Set(currentNetwork, "")
+	if len(networks) == 0 {
+		return nil
+	}
+	// 路径要在删之前拿好, 删了之后再去拿的话会重新初始化又占一个网段
+	mapsPath, err := r.get().HostSubnetMapPath()
+	if err != nil {
+		return err
+	}
+	ops := []datastore.Op{datastore.OpDelete(r.ipam.hostPath())}
+	for _, network := range networks {
+		ops = append(ops, datastore.OpDelete(r.ipam.blockPath(network)))
+	}
+	_, err = r.store.Txn(nil, ops...)
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		err = delFromHostSubnetMap(r.store, mapsPath, network)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (o *operator) Get() *Get {
-	lock()
-	return getGet()
+	return o.operators.Get
 }
 
 func (o *operator) Set() *Set {
-	lock()
-	return getSet()
+	return o.operators.Set
 }
 
 func (o *operator) Release() *Release {
-	lock()
-	return getRelase()
+	return o.operators.Release
 }
 
 func getEtcdPathWithPrefix(path string) string {
@@ -918,24 +1284,28 @@ func getEtcdPathWithPrefix(path string) string {
 	return "/" + prefix + "/" + path
 }
 
-func getMaskIpFromNum(numStr string) string {
-	switch numStr {
-	case "8":
-		return "255.0.0.0"
-	case "16":
-		return "255.255.0.0"
-	case "24":
-		return "255.255.255.0"
-	case "32":
-		return "255.255.255.255"
-	default:
-		return "255.255.0.0"
+func getMaskIpFromNum(numStr string, bits int) string {
+	maskIP, err := maskNumToIP(numStr, bits)
+	if err != nil {
+		if bits == net.IPv6len*8 {
+			return net.IP(net.CIDRMask(64, bits)).String()
+		}
+		return consts.DEFAULT_MASK_IP
 	}
+	return maskIP
 }
 
-var __GetIpamService func() (*IpamService, error)
+// 默认的 ipam service 的名字, Init 和 GetIpamService 用的都是它
+const DEFAULT_SERVICE_NAME = ""
 
-func _GetIpamService(subnet string, options *IPAMOptions) func() (*IpamService, error) {
+// 双栈的时候另一个地址族的 ipam service 用这个名字
+const SECONDARY_SERVICE_NAME = "secondary"
+
+// 同一个进程里可以有好几个 ipam service, 比如双栈的时候 ipv4 和 ipv6 各一个, 按名字区分
+var __GetIpamServices = map[string]func() (*IpamService, error){}
+var ipamServicesLock sync.Mutex
+
+func _GetIpamService(name, subnet string, options *IPAMOptions) func() (*IpamService, error) {
 
 	return func() (*IpamService, error) {
 		var _ipam *IpamService
@@ -944,10 +1314,11 @@ func _GetIpamService(subnet string, options *IPAMOptions) func() (*IpamService,
 			return _ipam, nil
 		} else {
 			_subnet := subnet
-			var _maskSegment string = consts.DEFAULT_MASK_NUM
-			var _podIpMaskSegment string = consts.DEFAULT_MASK_NUM
+			var _maskSegment string = ""
+			var _podIpMaskSegment string = ""
 			var _rangeStart string = ""
 			var _rangeEnd string = ""
+			var _blockMaskSegment string = ""
 			if options != nil {
 				if options.MaskSegment != "" {
 					_maskSegment = options.MaskSegment
@@ -961,6 +1332,12 @@ func _GetIpamService(subnet string, options *IPAMOptions) func() (*IpamService,
 				if options.RangeEnd != "" {
 					_rangeEnd = options.RangeEnd
 				}
+				if options.BlockMaskSegment != "" {
+					_blockMaskSegment = options.BlockMaskSegment
+				}
+			}
+			if options != nil && strings.Contains(_subnet, ":") {
+				_blockMaskSegment = options.BlockMaskSegmentV6
 			}
 
 			// 配置文件中传参数的时候可能直接传了个子网掩码
@@ -971,43 +1348,109 @@ func _GetIpamService(subnet string, options *IPAMOptions) func() (*IpamService,
 				_maskSegment = subnetAndMask[1]
 			}
 
-			var _maskIP string = getMaskIpFromNum(_maskSegment)
-			var _podMaskIP string = getMaskIpFromNum(_podIpMaskSegment)
+			// 根据 subnet 是 ipv4 还是 ipv6 来决定掩码最多能有多少位
+			subnetIP := net.ParseIP(_subnet)
+			if subnetIP == nil {
+				return nil, fmt.Errorf("invalid subnet %s", subnet)
+			}
+			bits := net.IPv4len * 8
+			defaultMaskSegment := consts.DEFAULT_MASK_NUM
+			if subnetIP.To4() == nil {
+				bits = net.IPv6len * 8
+				defaultMaskSegment = consts.DEFAULT_MASK_NUM_V6
+			}
+			if _maskSegment == "" {
+				_maskSegment = defaultMaskSegment
+			}
+			if _podIpMaskSegment == "" {
+				_podIpMaskSegment = defaultMaskSegment
+			}
+
+			maskNum, err := strconv.Atoi(_maskSegment)
+			if err != nil || maskNum < 0 || maskNum > bits {
+				return nil, fmt.Errorf("invalid mask segment %s", _maskSegment)
+			}
+			if _blockMaskSegment == "" {
+				_blockMaskSegment = strconv.Itoa(defaultBlockMask(maskNum, bits))
+			}
+			blockMaskNum, err := strconv.Atoi(_blockMaskSegment)
+			if err != nil || blockMaskNum < maskNum || blockMaskNum > bits {
+				return nil, fmt.Errorf("invalid block mask segment %s, it must be between %d and %d", _blockMaskSegment, maskNum, bits)
+			}
+
+			var _maskIP string = getMaskIpFromNum(_maskSegment, bits)
+			var _podMaskIP string = getMaskIpFromNum(_podIpMaskSegment, bits)
 
 			// 如果不是合法的子网地址的话就强转成合法
-			// 比如 _subnet 传了个数字过来, 要给它先干成 a.b.c.d 的样子
-			// 然后 & maskIP, 给做成类似 a.b.0.0 的样子
-			_subnet = utils.InetInt2Ip(utils.InetIP2Int(_subnet) & utils.InetIP2Int(_maskIP))
+			// 比如传了个 10.244.1.1/16 过来, 要给它做成 10.244.0.0 的样子
+			subnetBlock, err := parseBlock(_subnet, _maskSegment)
+			if err != nil {
+				return nil, err
+			}
+			_subnet = subnetBlock.IP.String()
 			_ipam = &IpamService{
 				Subnet:         _subnet,           // 子网网段
 				MaskSegment:    _maskSegment,      // 掩码 10 进制
 				MaskIP:         _maskIP,           // 掩码 ip
 				PodMaskSegment: _podIpMaskSegment, // pod 的 mask 10 进制
 				PodMaskIP:      _podMaskIP,        // pod 的 mask ip
+
+				BlockMaskSegment: _blockMaskSegment, // 每个节点的网段的 mask 10 进制
+
+				name: name,
+			}
+			if options != nil && options.K8sClient != nil {
+				_ipam.K8sClient = options.K8sClient
+			} else {
+				_ipam.K8sClient = getLightK8sClient()
 			}
-			_ipam.EtcdClient = getEtcdClient()
-			_ipam.K8sClient = getLightK8sClient()
-			// 初始化一个 ip 网段的 pool
-			// 如果已经初始化过就不再初始化
-			poolPath := getEtcdPathWithPrefix("/" + _ipam.Subnet + "/" + _ipam.MaskSegment + "/" + "pool")
-			err := _ipam.ipsPoolInit(poolPath)
+			_ipam.Datastore, err = getDatastore(options, _ipam.K8sClient)
+			if err != nil {
+				return nil, err
+			}
+			if options != nil && options.UsePodCIDR {
+				if options.ClaimOnDemand {
+					return nil, errors.New("usePodCIDR can not be used with claimOnDemand")
+				}
+				_ipam.UsePodCIDR = true
+			}
+			_ipam.operator = newOperator(_ipam)
+			// 把老版本用 ; 拼起来存的 pool 和 ip 记录迁移成一个网段/ip 一个 key
+			// 如果已经迁移过就不再迁移
+			blocksPrefix := _ipam.blocksPrefix()
+			err = _ipam.migrateLegacyRecords()
 			if err != nil {
 				return nil, err
 			}
 
-			// 然后尝试去拿一个当前主机可用的网段
-			// 如果拿不到, 里面会尝试创建一个
 			hostname, err := os.Hostname()
 			if err != nil {
 				return nil, err
 			}
-			hostPath := getEtcdPathWithPrefix("/" + _ipam.Subnet + "/" + _ipam.MaskSegment + "/" + hostname)
-			currentHostNetwork, err := _ipam.networkInit(
-				hostPath,
-				poolPath,
-				_rangeStart,
-				_rangeEnd,
-			)
+			// 用到的时候才占网段的话这里只看一下当前主机是不是已经有了
+			if options != nil && options.ClaimOnDemand {
+				currentHostNetwork, err := _ipam.Datastore.Get(_ipam.hostPathByName(hostname))
+				if err != nil {
+					return nil, err
+				}
+				_ipam.CurrentHostNetwork = currentHostNetwork
+				return _ipam, nil
+			}
+
+			var currentHostNetwork string
+			if _ipam.UsePodCIDR {
+				// 网段直接用 k8s 给当前节点分的 podCIDR
+				currentHostNetwork, err = _ipam.podCIDRInit(hostname)
+			} else {
+				// 然后尝试去拿一个当前主机可用的网段
+				// 如果拿不到, 里面会尝试创建一个
+				currentHostNetwork, err = _ipam.networkInit(
+					_ipam.hostPathByName(hostname),
+					blocksPrefix,
+					_rangeStart,
+					_rangeEnd,
+				)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -1030,27 +1473,55 @@ func _GetIpamService(subnet string, options *IPAMOptions) func() (*IpamService,
 }
 
 func GetIpamService() (*IpamService, error) {
-	if __GetIpamService == nil {
+	return GetIpamServiceByName(DEFAULT_SERVICE_NAME)
+}
+
+func GetIpamServiceByName(name string) (*IpamService, error) {
+	ipamServicesLock.Lock()
+	getIpamService, ok := __GetIpamServices[name]
+	ipamServicesLock.Unlock()
+	if !ok {
 		return nil, errors.New("ipam service 需要初始化")
 	}
 
-	ipamService, err := __GetIpamService()
+	ipamService, err := getIpamService()
 	if err != nil {
 		return nil, err
 	}
 	return ipamService, nil
 }
 
+// 拿到双栈时另一个地址族的 ipam service, 单栈的时候返回 nil
+func GetSecondaryIpamService() (*IpamService, error) {
+	ipamServicesLock.Lock()
+	_, ok := __GetIpamServices[SECONDARY_SERVICE_NAME]
+	ipamServicesLock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return GetIpamServiceByName(SECONDARY_SERVICE_NAME)
+}
+
+// 只删自己这个 subnet 下的数据, 双栈的时候另一个地址族的数据不能跟着没了
 func (is *IpamService) clear() error {
-	__GetIpamService = nil
-	return is.EtcdClient.Del("/"+prefix, oriEtcd.WithPrefix())
+	ipamServicesLock.Lock()
+	delete(__GetIpamServices, is.name)
+	ipamServicesLock.Unlock()
+	_, err := is.Datastore.Txn(nil, datastore.OpDeletePrefix(getEtcdPathWithPrefix("/"+is.Subnet+"/"+is.MaskSegment+"/")))
+	return err
 }
 
 func Init(subnet string, options *IPAMOptions) func() error {
-	if __GetIpamService == nil {
-		__GetIpamService = _GetIpamService(subnet, options)
+	return InitWithName(DEFAULT_SERVICE_NAME, subnet, options)
+}
+
+func InitWithName(name, subnet string, options *IPAMOptions) func() error {
+	ipamServicesLock.Lock()
+	if _, ok := __GetIpamServices[name]; !ok {
+		__GetIpamServices[name] = _GetIpamService(name, subnet, options)
 	}
-	is, err := GetIpamService()
+	ipamServicesLock.Unlock()
+	is, err := GetIpamServiceByName(name)
 	if err != nil {
 		return func() error {
 			return err
@@ -1058,3 +1529,12 @@ func Init(subnet string, options *IPAMOptions) func() error {
 	}
 	return is.clear
 }
+
+/**
+ * 双栈的时候 subnets 里是一个 ipv4 和一个 ipv6 的网段
+ * 第一个用默认的名字初始化, 第二个用 SECONDARY_SERVICE_NAME, 两个地址族各自在 etcd 里有一套网段
+ * 只有一个的话就和 Init 一样
+ */
+func InitDualStack(subnets []string, options *IPAMOptions) func() error {
+	return InitPool(DEFAULT_POOL_NAME, subnets, options)
+}
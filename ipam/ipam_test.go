@@ -1,16 +1,1037 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"testcni/client"
+	"testcni/cni"
+	"testcni/consts"
+	"testcni/etcd"
 	"testcni/utils"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	oriEtcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	v1 "k8s.io/api/core/v1"
 )
 
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// 在本地起一个内嵌的 etcd, 不依赖真实的 k8s 集群
+func startEmbedEtcd(t *testing.T) (*etcd.EtcdClient, func()) {
+	test := assert.New(t)
+	clientPort, err := getFreePort()
+	test.Nil(err)
+	peerPort, err := getFreePort()
+	test.Nil(err)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", clientPort))
+	peerURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", peerPort))
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.ACUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+	cfg.APUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("embed etcd start timeout")
+	}
+
+	client, err := etcd.NewEtcdClient(&etcd.EtcdConfig{
+		EtcdEndpoints: clientURL.String(),
+	})
+	if err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		e.Close()
+	}
+}
+
+/**
+ * 模拟同一时间有一堆 cni 进程在抢 ip 和网段
+ * 不管怎么并发, 分出去的 ip 和网段都不能重复
+ */
+func TestIpamParallelAllocate(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := Init("10.10.0.0/16", &IPAMOptions{
+		EtcdClient: client,
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 32
+	var wg sync.WaitGroup
+	ipCh := make(chan string, workers*2)
+	errCh := make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			alloc, err := is.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "host-gw")
+			if err != nil {
+				errCh <- err
+				return
+			}
+			ipCh <- alloc.IP
+		}(i)
+		go func() {
+			defer wg.Done()
+			ip, err := is.Get().UnusedIP()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			ipCh <- ip
+		}()
+	}
+	wg.Wait()
+	close(ipCh)
+	close(errCh)
+	for err := range errCh {
+		test.Nil(err)
+	}
+
+	ips := map[string]bool{}
+	for ip := range ipCh {
+		test.False(ips[ip], "ip %s 被分配了不止一次", ip)
+		ips[ip] = true
+	}
+	test.Len(ips, workers*2)
+	usedIPs, err := is.Get().AllUsedIPs()
+	test.Nil(err)
+	for ip := range ips {
+		test.Contains(usedIPs, ip)
+	}
+
+	// 一起释放也不能把别人的记录给覆盖掉
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := is.Release().Allocation(fmt.Sprintf("container-%d", i), "eth0")
+			test.Nil(err)
+		}(i)
+	}
+	wg.Wait()
+	usedIPs, err = is.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Len(usedIPs, workers)
+
+	// 好几个节点同时来 pool 里捞网段
+	blocksPrefix := getBlocksPrefix(is.Subnet, is.MaskSegment)
+	networkCh := make(chan string, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostPath := getEtcdPathWithPrefix(fmt.Sprintf("/%s/%s/fake-node-%d", is.Subnet, is.MaskSegment, i))
+			network, err := is.networkInit(hostPath, blocksPrefix)
+			test.Nil(err)
+			networkCh <- network
+		}(i)
+	}
+	wg.Wait()
+	close(networkCh)
+	networks := map[string]bool{is.CurrentHostNetwork: true}
+	for network := range networkCh {
+		test.False(networks[network], "网段 %s 被分配了不止一次", network)
+		networks[network] = true
+	}
+	test.Len(networks, workers+1)
+	available, err := is.availableNetworks(blocksPrefix)
+	test.Nil(err)
+	test.Len(available, 256-workers-1)
+
+	// 把网段还回去之后别的节点就又能用了
+	err = is.Release().Pool()
+	test.Nil(err)
+	available, err = is.availableNetworks(blocksPrefix)
+	test.Nil(err)
+	test.Len(available, 256-workers)
+	test.Contains(available, is.CurrentHostNetwork)
+}
+
+/**
+ * 老版本的数据是用 ; 拼起来存的, 初始化的时候要迁移成一个网段/ip 一个 key
+ */
+func TestIpamMigrateLegacyRecords(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	hostname, err := os.Hostname()
+	test.Nil(err)
+	base := getEtcdPathWithPrefix("/10.20.0.0/16")
+	pool := []string{}
+	for i := 2; i <= 255; i++ {
+		pool = append(pool, fmt.Sprintf("10.20.%d.0", i))
+	}
+	test.Nil(client.Set(base+"/pool", strings.Join(pool, ";")))
+	test.Nil(client.Set(base+"/maps", fmt.Sprintf(`{"10.20.0.0":"other-node","10.20.1.0":"%s"}`, hostname)))
+	test.Nil(client.Set(base+"/other-node", "10.20.0.0"))
+	test.Nil(client.Set(base+"/other-node/10.20.0.0", "10.20.0.1;10.20.0.5"))
+	test.Nil(client.Set(base+"/"+hostname, "10.20.1.0"))
+	test.Nil(client.Set(base+"/"+hostname+"/10.20.1.0", "10.20.1.1;10.20.1.2;10.20.1.3"))
+
+	clear := Init("10.20.0.0/16", &IPAMOptions{
+		EtcdClient: client,
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Equal(is.CurrentHostNetwork, "10.20.1.0")
+
+	// 老的 key 都被删掉了
+	legacy, err := client.Get(base + "/pool")
+	test.Nil(err)
+	test.Empty(legacy)
+	legacy, err = client.Get(base + "/" + hostname + "/10.20.1.0")
+	test.Nil(err)
+	test.Empty(legacy)
+
+	usedIPs, err := is.Get().AllUsedIPs()
+	test.Nil(err)
+	test.ElementsMatch(usedIPs, []string{"10.20.1.1", "10.20.1.2", "10.20.1.3"})
+	otherIPs, err := is.listUsedIPs("10.20.0.0")
+	test.Nil(err)
+	test.ElementsMatch(otherIPs, []string{"10.20.0.1", "10.20.0.5"})
+
+	available, err := is.availableNetworks(getBlocksPrefix(is.Subnet, is.MaskSegment))
+	test.Nil(err)
+	test.Len(available, 254)
+	test.NotContains(available, "10.20.0.0")
+	test.NotContains(available, "10.20.1.0")
+
+	// 迁移过的 ip 不会再被分出去
+	ip, err := is.Get().UnusedIP()
+	test.Nil(err)
+	test.NotContains([]string{"10.20.1.1", "10.20.1.2", "10.20.1.3"}, ip)
+}
+
+/**
+ * 老版本写 maps 的时候丢了的主机, 网段按 <hostname> 这个 key 认, ip 记录也要迁
+ * 找不到是谁占的网段不写 owner, 迁移完之后可以再被占
+ */
+func TestIpamMigrateLostMaps(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	hostname, err := os.Hostname()
+	test.Nil(err)
+	base := getEtcdPathWithPrefix("/10.20.0.0/16")
+	pool := []string{}
+	// 10.20.0.0 到 10.20.3.0 都被拿走了, 10.20.4.0 还在 pool 里但是被 node-4 占着
+	for i := 4; i <= 255; i++ {
+		pool = append(pool, fmt.Sprintf("10.20.%d.0", i))
+	}
+	test.Nil(client.Set(base+"/pool", strings.Join(pool, ";")))
+	// maps 里只剩下了本机, 还有一个指错了的 node-c
+	test.Nil(client.Set(base+"/maps", fmt.Sprintf(`{"10.20.1.0":"%s","10.20.3.0":"node-c"}`, hostname)))
+	test.Nil(client.Set(base+"/"+hostname, "10.20.1.0"))
+	test.Nil(client.Set(base+"/"+hostname+"/10.20.1.0", "10.20.1.2"))
+	test.Nil(client.Set(base+"/node-a", "10.20.0.0"))
+	test.Nil(client.Set(base+"/node-a/10.20.0.0", "10.20.0.1;10.20.0.5"))
+	// node-b 和 node-c 都指着 10.20.3.0, 以 maps 里写着的 node-c 为准
+	test.Nil(client.Set(base+"/node-b", "10.20.3.0"))
+	test.Nil(client.Set(base+"/node-b/10.20.3.0", "10.20.3.7"))
+	test.Nil(client.Set(base+"/node-c", "10.20.3.0"))
+	test.Nil(client.Set(base+"/node-c/10.20.3.0", "10.20.3.8"))
+	test.Nil(client.Set(base+"/node-4", "10.20.4.0"))
+	// 10.20.2.0 不知道是谁拿走的
+
+	clear := Init("10.20.0.0/16", &IPAMOptions{
+		EtcdClient: client,
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Equal("10.20.1.0", is.CurrentHostNetwork)
+
+	blocksPrefix := getBlocksPrefix(is.Subnet, is.MaskSegment)
+	blocks, err := is.Datastore.List(blocksPrefix)
+	test.Nil(err)
+	test.Equal("node-a", blocks[blocksPrefix+"10.20.0.0"])
+	test.Equal(hostname, blocks[blocksPrefix+"10.20.1.0"])
+	test.Equal("node-c", blocks[blocksPrefix+"10.20.3.0"])
+	test.Equal("node-4", blocks[blocksPrefix+"10.20.4.0"])
+	_, ok := blocks[blocksPrefix+"10.20.2.0"]
+	test.False(ok)
+	for _, owner := range blocks {
+		test.NotEqual("unknown", owner)
+	}
+
+	// 不在 maps 里的主机的 ip 记录也迁过来了, 同一个网段两台主机的记录都迁
+	ips, err := is.listUsedIPs("10.20.0.0")
+	test.Nil(err)
+	test.ElementsMatch([]string{"10.20.0.1", "10.20.0.5"}, ips)
+	ips, err = is.listUsedIPs("10.20.3.0")
+	test.Nil(err)
+	test.ElementsMatch([]string{"10.20.3.7", "10.20.3.8"}, ips)
+	legacy, err := client.Get(base + "/node-a/10.20.0.0")
+	test.Nil(err)
+	test.Empty(legacy)
+
+	available, err := is.availableNetworks(blocksPrefix)
+	test.Nil(err)
+	test.Contains(available, "10.20.2.0")
+	test.NotContains(available, "10.20.4.0")
+}
+
+func TestCIDR(t *testing.T) {
+	test := assert.New(t)
+
+	_, subnet, _ := net.ParseCIDR("10.244.0.0/16")
+	blocks, err := splitSubnet(subnet, 26)
+	test.Nil(err)
+	test.Len(blocks, 1024)
+	test.Equal(blocks[0].String(), "10.244.0.0/26")
+	test.Equal(blocks[1].String(), "10.244.0.64/26")
+	test.Equal(blocks[1023].String(), "10.244.255.192/26")
+
+	_, subnet, _ = net.ParseCIDR("172.20.0.0/20")
+	blocks, err = splitSubnet(subnet, 24)
+	test.Nil(err)
+	test.Len(blocks, 16)
+	test.Equal(blocks[15].String(), "172.20.15.0/24")
+	_, err = splitSubnet(subnet, 16)
+	test.NotNil(err)
+
+	block, err := parseBlock("10.244.1.64", "26")
+	test.Nil(err)
+	test.Equal(networkAddr(block).String(), "10.244.1.64")
+	test.Equal(gatewayAddr(block).String(), "10.244.1.65")
+	test.Equal(broadcastAddr(block).String(), "10.244.1.127")
+	test.Equal(blockHostsCount(block), int64(61))
+	test.True(isReservedIP(net.ParseIP("10.244.1.127"), block))
+	test.False(isReservedIP(net.ParseIP("10.244.1.66"), block))
+
+	test.Equal(defaultBlockMask(16, 32), 24)
+	test.Equal(defaultBlockMask(20, 32), 24)
+	test.Equal(defaultBlockMask(24, 32), 32)
+	test.Equal(getMaskIpFromNum("20", 32), "255.255.240.0")
+	test.Equal(getMaskIpFromNum("26", 32), "255.255.255.192")
+
+	// ipv6 的网段
+	_, subnet, _ = net.ParseCIDR("fd00:10:244::/56")
+	blocks, err = splitSubnet(subnet, 64)
+	test.Nil(err)
+	test.Len(blocks, 256)
+	test.Equal(blocks[1].String(), "fd00:10:244:1::/64")
+	test.Equal(blocks[255].String(), "fd00:10:244:ff::/64")
+	_, err = splitSubnet(subnet, 80)
+	test.NotNil(err)
+
+	block, err = parseBlock("fd00:10:244:1::", "64")
+	test.Nil(err)
+	test.Equal(gatewayAddr(block).String(), "fd00:10:244:1::1")
+	test.Equal(broadcastAddr(block).String(), "fd00:10:244:1:ffff:ffff:ffff:ffff")
+	test.Equal(blockHostsCount(block), int64(math.MaxInt64))
+	test.Equal(ipAdd(gatewayAddr(block), 1).String(), "fd00:10:244:1::2")
+
+	test.Equal(defaultBlockMask(48, 128), 64)
+	test.Equal(defaultBlockMask(56, 128), 64)
+	test.Equal(defaultBlockMask(120, 128), 128)
+	test.Equal(getMaskIpFromNum("64", 128), "ffff:ffff:ffff:ffff::")
+}
+
+/**
+ * 每个节点分到的网段可以不是 /24
+ */
+func TestIpamBlockSize(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := Init("10.244.0.0/16", &IPAMOptions{
+		EtcdClient:       client,
+		BlockMaskSegment: "26",
+	})
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := parseBlock(is.CurrentHostNetwork, "26")
+	test.Nil(err)
+	test.Equal(block.IP.String(), is.CurrentHostNetwork)
+	gw, err := is.Get().Gateway()
+	test.Nil(err)
+	test.Equal(gw, gatewayAddr(block).String())
+	available, err := is.availableNetworks(getBlocksPrefix(is.Subnet, is.MaskSegment))
+	test.Nil(err)
+	test.Len(available, 1024-1)
+
+	// 一个 /26 里能分给 pod 的只有 61 个
+	for i := 0; i < 61; i++ {
+		alloc, err := is.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "host-gw")
+		test.Nil(err)
+		ip := net.ParseIP(alloc.IP)
+		test.True(block.Contains(ip), "ip %s 不在 %s 里", alloc.IP, block.String())
+		test.False(isReservedIP(ip, block))
+	}
+	// 用完了之后再分的 ip 就到新占的网段里去了
+	alloc, err := is.Get().AllocateIP("container-overflow", "eth0", "host-gw")
+	test.Nil(err)
+	test.False(block.Contains(net.ParseIP(alloc.IP)))
+	test.NotEqual(alloc.Network, is.CurrentHostNetwork)
+	clear()
+
+	clear = Init("172.20.0.0/20", &IPAMOptions{
+		EtcdClient:       client,
+		BlockMaskSegment: "24",
+	})
+	defer clear()
+	is, err = GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Equal(is.BlockMaskSegment, "24")
+	_, network, _ := net.ParseCIDR("172.20.0.0/20")
+	test.True(network.Contains(net.ParseIP(is.CurrentHostNetwork)))
+	available, err = is.availableNetworks(getBlocksPrefix(is.Subnet, is.MaskSegment))
+	test.Nil(err)
+	test.Len(available, 16-1)
+	hostname, _ := os.Hostname()
+	cidr, err := is.Get().CIDR(hostname)
+	test.Nil(err)
+	test.Equal(cidr, is.CurrentHostNetwork+"/24")
+}
+
+/**
+ * ip 是按顺序分的, 释放掉的 ip 要等绕一圈之后才会被再分出去
+ */
+func TestIpamSequentialAllocate(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	// subnet 里只有一个 block, 用完了之后没有别的网段可以占
+	clear := Init("10.30.0.0/29", &IPAMOptions{
+		EtcdClient:       client,
+		BlockMaskSegment: "29",
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := parseBlock(is.CurrentHostNetwork, "29")
+	test.Nil(err)
+	// 一个 /29 有 8 个地址, 去掉网段号, 网关和广播地址之后还剩 5 个
+	expected := []string{}
+	for i := int64(2); i <= 6; i++ {
+		expected = append(expected, ipAdd(networkAddr(block), i).String())
+	}
+
+	allocated := []string{}
+	for i := 0; i < 3; i++ {
+		alloc, err := is.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "host-gw")
+		test.Nil(err)
+		allocated = append(allocated, alloc.IP)
+	}
+	test.Equal(allocated, expected[:3])
+
+	// 释放掉中间那个, 接下来分到的还是后面的 ip
+	_, err = is.Release().Allocation("container-1", "eth0")
+	test.Nil(err)
+	ip, err := is.Get().UnusedIP()
+	test.Nil(err)
+	test.Equal(ip, expected[3])
+	alloc, err := is.Get().AllocateIP("container-4", "eth0", "host-gw")
+	test.Nil(err)
+	test.Equal(alloc.IP, expected[4])
+
+	// 走到头了再绕回来, 这时才会分到刚才释放掉的那个
+	alloc, err = is.Get().AllocateIP("container-5", "eth0", "host-gw")
+	test.Nil(err)
+	test.Equal(alloc.IP, expected[1])
+
+	// 全都用完了要很快地报错, 不能一直在那儿转
+	begin := time.Now()
+	_, err = is.Get().AllocateIP("container-6", "eth0", "host-gw")
+	test.ErrorIs(err, ErrBlockExhausted)
+	_, err = is.Get().UnusedIP()
+	test.ErrorIs(err, ErrBlockExhausted)
+	test.Less(time.Since(begin), 5*time.Second)
+}
+
+func TestIpamMultipleBlocks(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	// 一个 /28 正好能拆成两个 /29
+	clear := Init("10.31.0.0/28", &IPAMOptions{
+		EtcdClient:       client,
+		BlockMaskSegment: "29",
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname := getDefaultOwner()
+	primary := is.CurrentHostNetwork
+
+	// 先把第一个网段里的 5 个 ip 都用完
+	for i := 0; i < 5; i++ {
+		_, err := is.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "host-gw")
+		test.Nil(err)
+	}
+	blocks, err := is.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Equal([]string{primary}, blocks)
+
+	// 再分配的时候要再占一个网段
+	alloc, err := is.Get().AllocateIP("container-5", "eth0", "host-gw")
+	test.Nil(err)
+	test.NotEqual(primary, alloc.Network)
+	block, err := parseBlock(alloc.Network, "29")
+	test.Nil(err)
+	test.True(block.Contains(net.ParseIP(alloc.IP)))
+
+	blocks, err = is.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Equal([]string{primary, alloc.Network}, blocks)
+	cidrs, err := is.Get().CIDRs(hostname)
+	test.Nil(err)
+	test.Equal([]string{primary + "/29", alloc.Network + "/29"}, cidrs)
+	maps, err := is.Get().HostSubnetMap()
+	test.Nil(err)
+	test.Equal(hostname, maps[alloc.Network])
+	usedIPs, err := is.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Len(usedIPs, 6)
+
+	// 两个网段都用完了, pool 里也没有了
+	for i := 6; i < 10; i++ {
+		_, err := is.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "host-gw")
+		test.Nil(err)
+	}
+	_, err = is.Get().AllocateIP("container-10", "eth0", "host-gw")
+	test.ErrorIs(err, ErrBlockExhausted)
+
+	// 多占的网段里的 ip 都释放了之后网段要还回去
+	for i := 5; i < 10; i++ {
+		_, err := is.Release().Allocation(fmt.Sprintf("container-%d", i), "eth0")
+		test.Nil(err)
+	}
+	blocks, err = is.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Equal([]string{primary}, blocks)
+	owner, err := client.Get(is.blockPath(alloc.Network))
+	test.Nil(err)
+	test.Empty(owner)
+	maps, err = is.Get().HostSubnetMap()
+	test.Nil(err)
+	_, ok := maps[alloc.Network]
+	test.False(ok)
+	available, err := is.availableNetworks(getBlocksPrefix(is.Subnet, is.MaskSegment))
+	test.Nil(err)
+	test.Equal([]string{alloc.Network}, available)
+
+	// 第一个网段里的 ip 都释放了也不会还
+	for i := 0; i < 5; i++ {
+		_, err := is.Release().Allocation(fmt.Sprintf("container-%d", i), "eth0")
+		test.Nil(err)
+	}
+	blocks, err = is.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Equal([]string{primary}, blocks)
+}
+
+// 起一个假的 apiserver, 只会回 nodes/<name>, podCIDRs 是各个节点的 spec.podCIDRs
+func startFakeApiserver(podCIDRs map[string][]string) (*client.LightK8sClient, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, consts.KUBE_API+"/nodes/")
+		cidrs, ok := podCIDRs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","code":404}`))
+			return
+		}
+		node := v1.Node{}
+		node.Name = name
+		node.Spec.PodCIDRs = cidrs
+		if len(cidrs) > 0 {
+			node.Spec.PodCIDR = cidrs[0]
+		}
+		json.NewEncoder(w).Encode(node)
+	}))
+	return client.NewLightK8sClient(server.URL, server.Client()), server.Close
+}
+
+/**
+ * 用 node 的 podCIDR 当网段的话, 网段和路由都以 k8s 为准
+ * 网段里的 ip 用完了也不会从 pool 里再占一个
+ */
+func TestIpamPodCIDR(t *testing.T) {
+	test := assert.New(t)
+	etcdClient, stop := startEmbedEtcd(t)
+	defer stop()
+	hostname := getDefaultOwner()
+	k8sClient, stopApiserver := startFakeApiserver(map[string][]string{
+		hostname: {"10.32.5.0/29", "fd00:32:0:5::/64"},
+		"node-2": {"10.32.6.0/29"},
+		"node-3": {},
+	})
+	defer stopApiserver()
+
+	// 网段之前被一台已经删掉的节点占着, 要以 k8s 为准改过来
+	test.Nil(etcdClient.Set(getBlocksPrefix("10.32.0.0", "16")+"10.32.5.0", "old-node"))
+
+	clear := Init("10.32.0.0/16", &IPAMOptions{
+		EtcdClient:       etcdClient,
+		K8sClient:        k8sClient,
+		BlockMaskSegment: "26",
+		UsePodCIDR:       true,
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.Equal("10.32.5.0", is.CurrentHostNetwork)
+	test.Equal("29", is.BlockMaskSegment)
+	owner, err := etcdClient.Get(is.blockPath("10.32.5.0"))
+	test.Nil(err)
+	test.Equal(hostname, owner)
+
+	// 没跑过 testcni 的节点也能拿到网段, 没分 podCIDR 的节点就是空的
+	cidr, err := is.Get().CIDR("node-2")
+	test.Nil(err)
+	test.Equal("10.32.6.0/29", cidr)
+	cidrs, err := is.Get().CIDRs(hostname)
+	test.Nil(err)
+	test.Equal([]string{"10.32.5.0/29"}, cidrs)
+	cidrs, err = is.Get().CIDRs("node-3")
+	test.Nil(err)
+	test.Empty(cidrs)
+
+	block, err := parseBlock("10.32.5.0", "29")
+	test.Nil(err)
+	for i := 0; i < 5; i++ {
+		alloc, err := is.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "host-gw")
+		test.Nil(err)
+		test.Equal("10.32.5.0", alloc.Network)
+		test.True(block.Contains(net.ParseIP(alloc.IP)))
+	}
+	_, err = is.Get().AllocateIP("container-5", "eth0", "host-gw")
+	test.ErrorIs(err, ErrBlockExhausted)
+	blocks, err := is.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Equal([]string{"10.32.5.0"}, blocks)
+
+	// podCIDR 不在 subnet 里的话初始化失败
+	clearOther := InitWithName("other", "10.33.0.0/16", &IPAMOptions{
+		EtcdClient: etcdClient,
+		K8sClient:  k8sClient,
+		UsePodCIDR: true,
+	})
+	defer clearOther()
+	_, err = GetIpamServiceByName("other")
+	test.NotNil(err)
+}
+
+func TestPodCIDROfNode(t *testing.T) {
+	test := assert.New(t)
+	node := &v1.Node{}
+	node.Spec.PodCIDRs = []string{"10.244.1.0/24", "fd00:10:244:1::/64"}
+	block, err := podCIDROfNode(node, false)
+	test.Nil(err)
+	test.Equal("10.244.1.0/24", block.String())
+	block, err = podCIDROfNode(node, true)
+	test.Nil(err)
+	test.Equal("fd00:10:244:1::/64", block.String())
+
+	// 老版本的 k8s 只有 podCIDR
+	node = &v1.Node{}
+	node.Spec.PodCIDR = "10.244.2.0/24"
+	block, err = podCIDROfNode(node, false)
+	test.Nil(err)
+	test.Equal("10.244.2.0/24", block.String())
+	block, err = podCIDROfNode(node, true)
+	test.Nil(err)
+	test.Nil(block)
+
+	node.Spec.PodCIDR = "10.244.2.0"
+	_, err = podCIDROfNode(node, false)
+	test.NotNil(err)
+}
+
+/**
+ * 节点被删掉之后, 它占着的网段, 网段里的 ip 和它的记录都要清掉
+ * 别的节点的东西不能动
+ */
+func TestIpamReleaseNode(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := Init("10.32.0.0/16", &IPAMOptions{
+		EtcdClient: client,
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := is.Get().AllocateIP("container-0", "eth0", "host-gw")
+	test.Nil(err)
+
+	// 模拟另一个节点占了一个网段, 分了一个 ip
+	const fakeNode = "fake-node"
+	blocksPrefix := getBlocksPrefix(is.Subnet, is.MaskSegment)
+	network, err := is.networkInit(is.hostPathByName(fakeNode), blocksPrefix)
+	test.Nil(err)
+	mapsPath, err := is.Get().HostSubnetMapPath()
+	test.Nil(err)
+	test.Nil(addToHostSubnetMap(is.Datastore, mapsPath, network, fakeNode))
+	block, err := parseBlock(network, is.BlockMaskSegment)
+	test.Nil(err)
+	fakeIP := ipAdd(networkAddr(block), 2).String()
+	test.Nil(client.Set(is.ipPath(network, fakeIP), fakeNode))
+	test.Nil(client.Set(is.hostPathByName(fakeNode)+"/allocations/container-1/eth0", "{}"))
+
+	hosts, err := is.Get().AllocatedHosts()
+	test.Nil(err)
+	test.Contains(hosts, fakeNode)
+	test.Contains(hosts, getDefaultOwner())
+
+	test.Nil(is.Release().Node(fakeNode))
+	hosts, err = is.Get().AllocatedHosts()
+	test.Nil(err)
+	test.Equal([]string{getDefaultOwner()}, hosts)
+	ips, err := is.Get().IPsOfNetwork(network)
+	test.Nil(err)
+	test.Empty(ips)
+	keys, err := client.GetAllKey(is.hostPathByName(fakeNode), oriEtcd.WithPrefix(), oriEtcd.WithKeysOnly())
+	test.Nil(err)
+	test.Empty(keys)
+	maps, err := is.Get().HostSubnetMap()
+	test.Nil(err)
+	_, ok := maps[network]
+	test.False(ok)
+	available, err := is.availableNetworks(blocksPrefix)
+	test.Nil(err)
+	test.Contains(available, network)
+
+	// 当前节点的东西还在
+	usedIPs, err := is.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Contains(usedIPs, alloc.IP)
+	test.Equal(getDefaultOwner(), maps[is.CurrentHostNetwork])
+
+	// 再回收一次也没事
+	test.Nil(is.Release().Node(fakeNode))
+}
+
+/**
+ * 双栈的时候 ipv4 和 ipv6 各有一个 ipam service, 网段各自存各自的
+ */
+func TestIpamRequestedIP(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := Init("10.31.0.0/16", &IPAMOptions{
+		EtcdClient:       client,
+		BlockMaskSegment: "24",
+	})
+	defer clear()
+	is, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := parseBlock(is.CurrentHostNetwork, "24")
+	test.Nil(err)
+	requested := ipAdd(networkAddr(block), 100).String()
+
+	// 指定的 ip 空着的话就分它, 不会去挪 cursor
+	alloc, err := is.Get().AllocateIP("container-0", "eth0", "host-gw", requested)
+	test.Nil(err)
+	test.Equal(requested, alloc.IP)
+	test.Equal(is.CurrentHostNetwork, alloc.Network)
+	alloc, err = is.Get().AllocateIP("container-1", "eth0", "host-gw")
+	test.Nil(err)
+	test.Equal(ipAdd(networkAddr(block), 2).String(), alloc.IP)
+
+	// 重试 ADD 的时候返回之前的记录, 换了个 ip 的话报错
+	alloc, err = is.Get().AllocateIP("container-0", "eth0", "host-gw", requested)
+	test.Nil(err)
+	test.Equal(requested, alloc.IP)
+	_, err = is.Get().AllocateIP("container-0", "eth0", "host-gw", ipAdd(networkAddr(block), 101).String())
+	test.NotNil(err)
+
+	// 被别人用了的, 不在当前主机网段里的, 网关这种不能分的都报错, 不会换一个 ip 分
+	_, err = is.Get().AllocateIP("container-2", "eth0", "host-gw", requested)
+	test.ErrorIs(err, ErrIPInUse)
+	test.True(IsRequestedIPError(err))
+	_, err = is.Get().AllocateIP("container-2", "eth0", "host-gw", ipAdd(networkAddr(block), 256).String())
+	test.ErrorIs(err, ErrIPOutOfRange)
+	_, err = is.Get().AllocateIP("container-2", "eth0", "host-gw", gatewayAddr(block).String())
+	test.ErrorIs(err, ErrIPOutOfRange)
+	exist, err := is.Get().Allocation("container-2", "eth0")
+	test.Nil(err)
+	test.Nil(exist)
+
+	// 释放之后就又能指定了
+	_, err = is.Release().Allocation("container-0", "eth0")
+	test.Nil(err)
+	alloc, err = is.Get().AllocateIP("container-2", "eth0", "host-gw", requested)
+	test.Nil(err)
+	test.Equal(requested, alloc.IP)
+
+	// 别的地址族的 ip 不归这个 ipam 管
+	test.Nil(CheckRequestedIPs([]string{requested}, is, nil))
+	test.ErrorIs(CheckRequestedIPs([]string{"fd00::10"}, is, nil), ErrIPOutOfRange)
+}
+
+func TestIpamPools(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	options := &IPAMOptions{
+		EtcdClient:       client,
+		BlockMaskSegment: "28",
+	}
+	clear := InitPool(DEFAULT_POOL_NAME, []string{"10.32.0.0/16"}, options)
+	defer clear()
+	clearIngress := InitPool("ingress", []string{"192.168.32.0/24"}, options)
+	defer clearIngress()
+
+	is, secondary, err := GetPoolServices(DEFAULT_POOL_NAME)
+	test.Nil(err)
+	test.Nil(secondary)
+	test.Equal("10.32.0.0", is.Subnet)
+	ingress, secondary, err := GetPoolServices("ingress")
+	test.Nil(err)
+	test.Nil(secondary)
+	test.Equal("192.168.32.0", ingress.Subnet)
+	_, _, err = GetPoolServices("private")
+	test.NotNil(err)
+
+	// 默认的池子初始化的时候就占了网段, 具名的池子等到分 ip 的时候才占
+	hostname, err := os.Hostname()
+	test.Nil(err)
+	test.NotEmpty(is.CurrentHostNetwork)
+	blocks, err := ingress.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Empty(blocks)
+
+	alloc, err := ingress.Get().AllocateIP("container-0", "eth0", "host-gw")
+	test.Nil(err)
+	block, err := parseBlock(alloc.Network, "28")
+	test.Nil(err)
+	test.True(block.Contains(net.ParseIP(alloc.IP)))
+	_, ingressSubnet, _ := net.ParseCIDR("192.168.32.0/24")
+	test.True(ingressSubnet.Contains(block.IP))
+	maps, err := ingress.Get().HostSubnetMap()
+	test.Nil(err)
+	test.Equal(hostname, maps[alloc.Network])
+
+	// 两个池子的记录是分开存的
+	exist, err := is.Get().Allocation("container-0", "eth0")
+	test.Nil(err)
+	test.Nil(exist)
+
+	// ip 都释放了之后网段还回去
+	_, err = ingress.Release().Allocation("container-0", "eth0")
+	test.Nil(err)
+	blocks, err = ingress.Get().HostBlocks(hostname)
+	test.Nil(err)
+	test.Empty(blocks)
+
+	// 配了 range 的池子初始化的时候就占网段, 只从 range 里分
+	clearRange := InitPool("macvlan", []string{"192.168.33.0/24"}, &IPAMOptions{
+		EtcdClient: client,
+		RangeStart: "192.168.33.100",
+		RangeEnd:   "192.168.33.101",
+	})
+	defer clearRange()
+	ranged, _, err := GetPoolServices("macvlan")
+	test.Nil(err)
+	test.NotEmpty(ranged.CurrentHostNetwork)
+	ips := []string{}
+	for i := 0; i < 2; i++ {
+		alloc, err := ranged.Get().AllocateIP(fmt.Sprintf("container-%d", i), "eth0", "macvlan")
+		test.Nil(err)
+		ips = append(ips, alloc.IP)
+	}
+	test.ElementsMatch([]string{"192.168.33.100", "192.168.33.101"}, ips)
+	_, err = ranged.Get().AllocateIP("container-2", "eth0", "macvlan")
+	test.NotNil(err)
+}
+
+func TestSelectPool(t *testing.T) {
+	test := assert.New(t)
+	pools := []string{"ingress", "private"}
+
+	pool, err := selectPool(nil, nil, pools)
+	test.Nil(err)
+	test.Equal(DEFAULT_POOL_NAME, pool)
+	pool, err = selectPool(nil, map[string]string{consts.KUBE_IP_POOL_ANNOTATION: "private"}, pools)
+	test.Nil(err)
+	test.Equal("private", pool)
+	// pod 上的注解优先
+	pool, err = selectPool(
+		map[string]string{consts.KUBE_IP_POOL_ANNOTATION: "ingress"},
+		map[string]string{consts.KUBE_IP_POOL_ANNOTATION: "private"},
+		pools,
+	)
+	test.Nil(err)
+	test.Equal("ingress", pool)
+	_, err = selectPool(map[string]string{consts.KUBE_IP_POOL_ANNOTATION: "public"}, nil, pools)
+	test.NotNil(err)
+}
+
+func TestOptionsFromCNI(t *testing.T) {
+	test := assert.New(t)
+	conf := &cni.PluginConf{}
+	err := json.Unmarshal([]byte(`{
+		"subnet": "10.244.0.0/16,fd00:10:244::/56",
+		"ipam": {
+			"blockSize": 26,
+			"blockSizeV6": 64,
+			"usePodCIDR": true,
+			"datastore": "file",
+			"datastorePath": "/tmp/ipam.json",
+			"etcd": {"endpoints": "https://127.0.0.1:2379"},
+			"pools": [{"name": "ingress", "subnet": "192.168.100.0/24", "blockSize": 28}]
+		}
+	}`), conf)
+	test.Nil(err)
+
+	options := OptionsFromCNI(conf)
+	test.Equal("26", options.BlockMaskSegment)
+	test.Equal("64", options.BlockMaskSegmentV6)
+	test.True(options.UsePodCIDR)
+	test.Equal("file", options.DatastoreType)
+	test.Equal("/tmp/ipam.json", options.DatastorePath)
+	test.Equal("https://127.0.0.1:2379", options.EtcdConfig.EtcdEndpoints)
+
+	// 具名的池子用自己的 blockSize, 存储和外层的一样, 网段不从 podCIDR 里来
+	poolConf, err := cni.GetPoolConfig(conf, "ingress")
+	test.Nil(err)
+	options = OptionsFromCNI(poolConf)
+	test.Equal("28", options.BlockMaskSegment)
+	test.False(options.UsePodCIDR)
+	test.Equal("file", options.DatastoreType)
+	test.Equal("/tmp/ipam.json", options.DatastorePath)
+}
+
+func TestIpamDualStack(t *testing.T) {
+	test := assert.New(t)
+	client, stop := startEmbedEtcd(t)
+	defer stop()
+
+	clear := InitDualStack([]string{"10.50.0.0/16", "fd00:10:50::/56"}, &IPAMOptions{
+		EtcdClient:         client,
+		BlockMaskSegmentV6: "64",
+	})
+	v4, err := GetIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v6, err := GetSecondaryIpamService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.NotNil(v6)
+	test.False(v4.IsIPv6())
+	test.True(v6.IsIPv6())
+	test.Equal("24", v4.BlockMaskSegment)
+	test.Equal("fd00:10:50::", v6.Subnet)
+	test.Equal("56", v6.MaskSegment)
+	test.Equal("64", v6.BlockMaskSegment)
+	test.Equal("ffff:ffff:ffff:ff00::", v6.MaskIP)
+
+	block, err := parseBlock(v6.CurrentHostNetwork, v6.BlockMaskSegment)
+	test.Nil(err)
+	test.Equal(block.IP.String(), v6.CurrentHostNetwork)
+	gw, err := v6.Get().Gateway()
+	test.Nil(err)
+	test.Equal(gatewayAddr(block).String(), gw)
+
+	// 同一块儿网卡在两个地址族里各分一个 ip
+	alloc4, err := v4.Get().AllocateIP("container-1", "eth0", "host-gw")
+	test.Nil(err)
+	test.NotNil(net.ParseIP(alloc4.IP).To4())
+	for i := 0; i < 3; i++ {
+		alloc6, err := v6.Get().AllocateIP(fmt.Sprintf("container-%d", i+1), "eth0", "host-gw")
+		test.Nil(err)
+		test.Equal(ipAdd(gatewayAddr(block), int64(i+1)).String(), alloc6.IP)
+		test.Equal(v6.CurrentHostNetwork, alloc6.Network)
+	}
+	ips, err := v6.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Len(ips, 3)
+	ips, err = v4.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Equal([]string{alloc4.IP}, ips)
+
+	alloc6, err := v6.Release().Allocation("container-1", "eth0")
+	test.Nil(err)
+	test.Equal(ipAdd(gatewayAddr(block), 1).String(), alloc6.IP)
+	alloc, err := v4.Get().Allocation("container-1", "eth0")
+	test.Nil(err)
+	test.Equal(alloc4.IP, alloc.IP)
+
+	available, err := v6.availableNetworks(v6.blocksPrefix())
+	test.Nil(err)
+	test.Len(available, 255)
+
+	test.Nil(clear())
+	v6, err = GetSecondaryIpamService()
+	test.Nil(err)
+	test.Nil(v6)
+
+	// 掩码超出了 ipv6 的范围
+	err = InitWithName("invalid", "fd00:10:50::/129", &IPAMOptions{EtcdClient: client})()
+	test.NotNil(err)
+}
+
 func TestIpam(t *testing.T) {
 	test := assert.New(t)
 	clear := Init("192.168.64.0/24", &IPAMOptions{
@@ -39,6 +1060,43 @@ func TestIpam(t *testing.T) {
 	test.Nil(err)
 	test.Len(usedIPs, 3)
 	test.Contains(usedIPs, ip1, ip2, ip3)
+
+	/********** test allocation **********/
+	alloc, err := is2.Get().AllocateIP("test-container", "eth0", "host-gw")
+	test.Nil(err)
+	test.Equal(alloc.ContainerID, "test-container")
+	test.Equal(alloc.IfName, "eth0")
+	test.NotEqual(alloc.Timestamp, int64(0))
+	usedIPs, err = is2.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Len(usedIPs, 4)
+	test.Contains(usedIPs, alloc.IP)
+	// 同一块儿网卡再分配一次拿到的还是同一个 ip
+	again, err := is2.Get().AllocateIP("test-container", "eth0", "host-gw")
+	test.Nil(err)
+	test.Equal(again.IP, alloc.IP)
+	alloc.HostIfName = "veth12345678"
+	alloc.Gateway = "192.168.64.1"
+	err = is2.Set().Allocation(alloc)
+	test.Nil(err)
+	record, err := is2.Get().Allocation("test-container", "eth0")
+	test.Nil(err)
+	test.Equal(record.HostIfName, "veth12345678")
+	test.Equal(record.Gateway, "192.168.64.1")
+	released, err := is2.Release().Allocation("test-container", "eth0")
+	test.Nil(err)
+	test.Equal(released.IP, alloc.IP)
+	record, err = is2.Get().Allocation("test-container", "eth0")
+	test.Nil(err)
+	test.Nil(record)
+	usedIPs, err = is2.Get().AllUsedIPs()
+	test.Nil(err)
+	test.Len(usedIPs, 3)
+	test.NotContains(usedIPs, alloc.IP)
+	// 释放过了再释放也不报错
+	released, err = is2.Release().Allocation("test-container", "eth0")
+	test.Nil(err)
+	test.Nil(released)
 	clear()
 
 	Init("10.244.0.0", &IPAMOptions{
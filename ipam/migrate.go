@@ -0,0 +1,242 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testcni/datastore"
+	"testcni/utils"
+)
+
+/**
+ * etcd 中 ipam 数据的版本
+ * 1: 网段池是 pool 这一个 key 里用 ; 拼起来的字符串, 每台主机用过的 ip 也是 ; 拼起来存在 <hostname>/<network> 下
+ * 2: 被占走的网段在 blocks/<network> 下各有一个 key, 用过的 ip 在 <network>/ips/<ip> 下各有一个 key
+ */
+const ipamDataVersion = "2"
+
+func getIpamVersionPath(subnet, mask string) string {
+	return getEtcdPathWithPrefix("/" + subnet + "/" + mask + "/version")
+}
+
+/**
+ * 把老版本的 pool 和 ip 记录迁移成一个网段/ip 一个 key
+ * 迁移的每一步都可以重复做, 中途挂了的话下次初始化的时候接着迁
+ * 全部迁完之后写上版本号, 之后就不会再迁了
+ */
+func (is *IpamService) migrateLegacyRecords() error {
+	versionPath := getIpamVersionPath(is.Subnet, is.MaskSegment)
+	version, err := is.Datastore.Get(versionPath)
+	if err != nil {
+		return err
+	}
+	if version == ipamDataVersion {
+		return nil
+	}
+
+	maps := map[string]string{}
+	mapsStr, err := is.Datastore.Get(getEtcdPathWithPrefix("/" + is.Subnet + "/" + is.MaskSegment + "/maps"))
+	if err != nil {
+		return err
+	}
+	if mapsStr != "" {
+		err = json.Unmarshal(([]byte)(mapsStr), &maps)
+		if err != nil {
+			return err
+		}
+	}
+
+	hostNetworks, err := is.legacyHostNetworks()
+	if err != nil {
+		return err
+	}
+
+	err = is.migrateLegacyPool(hostNetworks, maps)
+	if err != nil {
+		return err
+	}
+
+	// <hostname> 和 maps 里能找到的每一对儿主机和网段都迁一遍, 没有这条记录的话直接跳过
+	for hostname, network := range hostNetworks {
+		err = is.migrateLegacyRecord(hostname, network)
+		if err != nil {
+			return err
+		}
+	}
+	for network, hostname := range maps {
+		err = is.migrateLegacyRecord(hostname, network)
+		if err != nil {
+			return err
+		}
+	}
+
+	utils.WriteLog("ipam 的数据已经迁移到了版本 ", ipamDataVersion)
+	return is.Datastore.Set(versionPath, ipamDataVersion)
+}
+
+// <subnet>/<mask> 下边除了主机名之外的单层的 key
+var legacyReservedKeys = map[string]bool{"pool": true, "maps": true, "version": true}
+
+/**
+ * 老版本中每台主机拿到的网段存在 <hostname> 这个 key 下, 返回 map[hostname]network
+ * 这个 key 只有主机自己会写, 不像 maps 那样是大家一起读改写的, 几个节点一起初始化的时候 maps 里可能丢了某台主机
+ * 所以网段是谁的先看这个, 这里找不到的再看 maps
+ */
+func (is *IpamService) legacyHostNetworks() (map[string]string, error) {
+	networks, err := is.allNetworks()
+	if err != nil {
+		return nil, err
+	}
+	valid := map[string]bool{}
+	for _, network := range networks {
+		valid[network] = true
+	}
+
+	basePrefix := getEtcdPathWithPrefix("/" + is.Subnet + "/" + is.MaskSegment + "/")
+	kvs, err := is.Datastore.List(basePrefix)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	for key, value := range kvs {
+		name := strings.TrimPrefix(key, basePrefix)
+		// <hostname>/<network> 和 blocks/<network> 这种多层的 key 不是
+		if strings.Contains(name, "/") || legacyReservedKeys[name] || !valid[value] {
+			continue
+		}
+		res[name] = value
+	}
+	return res, nil
+}
+
+/**
+ * 网段是谁的, 以 <hostname> 这个 key 为准, 都没有的话再看 maps
+ * 好几台主机的 key 都指着同一个网段的话, 和 maps 对得上的那个优先, 都对不上就取主机名最小的那个
+ */
+func legacyBlockOwners(hostNetworks, maps map[string]string) map[string]string {
+	hostnames := []string{}
+	for hostname := range hostNetworks {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	owners := map[string]string{}
+	for _, hostname := range hostnames {
+		network := hostNetworks[hostname]
+		owner, ok := owners[network]
+		if !ok {
+			owners[network] = hostname
+			continue
+		}
+		utils.WriteLog("老版本的数据里 ", owner, " 和 ", hostname, " 都占着网段 ", network)
+		if maps[network] == hostname {
+			owners[network] = hostname
+		}
+	}
+	return owners
+}
+
+/**
+ * 老的 pool 里存的是还没被占走的网段, 那么不在 pool 里的网段就都是已经被占走的
+ * 给被占走的网段各创建一个 blocks 下的 key, 然后把 pool 删掉
+ * 老版本从 pool 里拿走网段和写 <hostname>, maps 都不是原子的, 所以:
+ *		1. 有主机的 <hostname> 指着的网段就算还在 pool 里也是被这台主机占着的
+ *		2. 不在 pool 里但是找不到是谁占的网段, 只能是拿走网段的节点还没写 <hostname> 就挂了, 没有 pod 在用, 不创建 key, 迁移完之后就又能被占了
+ * 不能随便写一个 owner, 不然 agent 找不到这个节点, 过了宽限期就会把网段回收掉
+ */
+func (is *IpamService) migrateLegacyPool(hostNetworks, maps map[string]string) error {
+	poolPath := getIPsPoolPath(is.Subnet, is.MaskSegment)
+	pool, revision, err := is.Datastore.GetWithRevision(poolPath)
+	if err != nil {
+		return err
+	}
+	if revision == 0 {
+		return nil
+	}
+
+	available := map[string]bool{}
+	for _, network := range strings.Split(pool, ";") {
+		available[network] = true
+	}
+	networks, err := is.allNetworks()
+	if err != nil {
+		return err
+	}
+	owners := legacyBlockOwners(hostNetworks, maps)
+	blocksPrefix := getBlocksPrefix(is.Subnet, is.MaskSegment)
+	for _, network := range networks {
+		owner := owners[network]
+		if owner == "" {
+			if available[network] {
+				continue
+			}
+			owner = maps[network]
+		}
+		if owner == "" {
+			utils.WriteLog("老版本的数据里找不到网段 ", network, " 是谁占的, 当成没被占")
+			continue
+		}
+		blockPath := blocksPrefix + network
+		_, err = is.Datastore.Txn(
+			[]datastore.Cmp{datastore.KeyMissing(blockPath)},
+			datastore.OpPut(blockPath, owner),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// pool 在迁移的过程中被老版本的节点改过的话, 下次初始化的时候再迁一遍
+	succeeded, err := is.Datastore.Txn(
+		[]datastore.Cmp{datastore.ModRevisionIs(poolPath, revision)},
+		datastore.OpDelete(poolPath),
+	)
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return fmt.Errorf("the legacy pool %s changed during migration", poolPath)
+	}
+	return nil
+}
+
+/**
+ * 把某台主机用 ; 拼起来的 ip 记录拆成一个 ip 一个 key, 然后把老的记录删掉
+ */
+func (is *IpamService) migrateLegacyRecord(hostname, network string) error {
+	recordPath := getLegacyRecordPath(is.Subnet, is.MaskSegment, hostname, network)
+	ipsPrefix := getIPsPrefixWithSubnet(is.Subnet, is.MaskSegment, network)
+	for i := 0; i < txnRetryTimes; i++ {
+		record, revision, err := is.Datastore.GetWithRevision(recordPath)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			return nil
+		}
+
+		for _, ip := range strings.Split(record, ";") {
+			if ip == "" {
+				continue
+			}
+			_, err = createIPIfAbsent(is.Datastore, ipsPrefix+ip, hostname)
+			if err != nil {
+				return err
+			}
+		}
+
+		succeeded, err := is.Datastore.Txn(
+			[]datastore.Cmp{datastore.ModRevisionIs(recordPath, revision)},
+			datastore.OpDelete(recordPath),
+		)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			return nil
+		}
+		txnBackoff()
+	}
+	return fmt.Errorf("failed to migrate %s after %d retries", recordPath, txnRetryTimes)
+}
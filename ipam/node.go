@@ -0,0 +1,136 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testcni/datastore"
+	"testcni/utils"
+)
+
+/**
+ * 节点从集群里删掉之后, 它在 etcd 里留下的东西都要清掉
+ * 包括它占着的网段(blocks/<network>), 网段下的 ip 和 cursor, 主机名下的 allocation 和 range, 以及 maps 里它的那几项
+ * 其他节点上的 watcher 监听到这些 ip 被删掉之后会把它们从 ding_ip 里删掉
+ */
+
+// 所有占着网段的主机名, 按字母顺序排
+func (g *Get) AllocatedHosts() ([]string, error) {
+	blocksPrefix := g.ipam.blocksPrefix()
+	kvs, err := g.store.List(blocksPrefix)
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{}
+	for _, owner := range kvs {
+		if owner != "" {
+			hosts[owner] = true
+		}
+	}
+
+	res := []string{}
+	for host := range hosts {
+		res = append(res, host)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 某台主机在 blocks 下占着的所有网段, 和 HostBlocks 不一样的是不看 <hostname> 这个 key
+func (g *Get) ownedBlocks(hostname string) ([]string, error) {
+	blocksPrefix := g.ipam.blocksPrefix()
+	kvs, err := g.store.List(blocksPrefix)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for key, owner := range kvs {
+		if owner == hostname {
+			res = append(res, strings.TrimPrefix(key, blocksPrefix))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+/**
+ * 把某台主机占着的网段都还回 pool 里, 网段里的 ip 和这台主机的记录也一起删掉
+ * 网段在这期间被别人改了的话(比如那台主机又回来了)就重新读一遍再来
+ */
+func (r *Release) Node(hostname string) error {
+	if hostname == "" {
+		return fmt.Errorf("hostname is empty")
+	}
+	// 路径要在删之前拿好, 删了之后再去拿的话会重新初始化
+	mapsPath, err := r.get().HostSubnetMapPath()
+	if err != nil {
+		return err
+	}
+	hostPath := r.ipam.hostPathByName(hostname)
+
+	for i := 0; i < txnRetryTimes; i++ {
+		// 只管 blocks 下记着被这台主机占着的网段, 别的主机的网段不能动
+		networks, err := r.get().ownedBlocks(hostname)
+		if err != nil {
+			return err
+		}
+
+		cmps := []datastore.Cmp{}
+		ops := []datastore.Op{
+			datastore.OpDelete(hostPath),
+			// allocations 和 range 都在 <hostname>/ 下边
+			datastore.OpDeletePrefix(hostPath + "/"),
+		}
+		for _, network := range networks {
+			blockPath := r.ipam.blockPath(network)
+			cmps = append(cmps, datastore.ValueIs(blockPath, hostname))
+			ops = append(ops,
+				datastore.OpDeletePrefix(r.ipam.ipsPrefix(network)),
+				datastore.OpDelete(r.ipam.cursorPath(network)),
+				datastore.OpDelete(blockPath),
+			)
+		}
+
+		succeeded, err := r.store.Txn(cmps, ops...)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			utils.WriteLog("节点 ", hostname, " 已经不在集群中了, 把它的网段还回到 pool 中: ", strings.Join(networks, ","))
+			return delHostFromHostSubnetMap(r.store, mapsPath, hostname)
+		}
+		txnBackoff()
+	}
+	return fmt.Errorf("failed to release the blocks of node %s after %d retries", hostname, txnRetryTimes)
+}
+
+// 把主机名和网段的映射里属于某台主机的网段都删掉
+func delHostFromHostSubnetMap(store datastore.Datastore, mapsPath, hostname string) error {
+	return casUpdate(store, mapsPath, func(maps string) (string, bool, error) {
+		if len(maps) == 0 {
+			return "", false, nil
+		}
+		_tmpMaps := map[string]string{}
+		err := json.Unmarshal(([]byte)(maps), &_tmpMaps)
+		if err != nil {
+			return "", false, err
+		}
+
+		changed := false
+		for network, owner := range _tmpMaps {
+			if owner == hostname {
+				delete(_tmpMaps, network)
+				changed = true
+			}
+		}
+		if !changed {
+			return "", false, nil
+		}
+		mapsStr, err := json.Marshal(_tmpMaps)
+		if err != nil {
+			return "", false, err
+		}
+		return string(mapsStr), true, nil
+	})
+}
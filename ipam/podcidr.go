@@ -0,0 +1,134 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"testcni/datastore"
+	"testcni/utils"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+/**
+ * 直接用 k8s 给节点分的 spec.podCIDR(s) 当做节点的网段
+ * kube-controller-manager 开了 --allocate-node-cidrs 之后每个节点都会分到一个网段, 双栈的话两个地址族各一个
+ * 这种模式下 ipam 不再自己从 pool 里挑网段, 初始化的时候把节点的 podCIDR 记成当前主机的网段
+ * 网段里的 ip 用完了也不会再去 pool 里占新的网段, 节点之间的路由也都按 podCIDR 来
+ */
+
+// 从节点的 podCIDRs 里挑出和 subnet 同一个地址族的那个, 老版本的 k8s 只有 podCIDR, 没有的话返回 nil
+func podCIDROfNode(node *v1.Node, ipv6 bool) (*net.IPNet, error) {
+	cidrs := node.Spec.PodCIDRs
+	if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+		cidrs = []string{node.Spec.PodCIDR}
+	}
+	for _, cidr := range cidrs {
+		ip, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid podCIDR %s of node %s: %v", cidr, node.Name, err)
+		}
+		if (ip.To4() == nil) == ipv6 {
+			return block, nil
+		}
+	}
+	return nil, nil
+}
+
+// 节点的 podCIDR, 比如 10.244.1.0/24, 还没分到的话返回空字符串
+func (g *Get) PodCIDR(hostName string) (string, error) {
+	if g.k8sClient == nil {
+		return "", errors.New("k8s client not found")
+	}
+	node, err := g.k8sClient.Get().Node(hostName)
+	if err != nil {
+		return "", err
+	}
+	block, err := podCIDROfNode(node, g.ipam.IsIPv6())
+	if err != nil {
+		return "", err
+	}
+	if block == nil {
+		return "", nil
+	}
+	return block.String(), nil
+}
+
+// 当前主机能分 ip 的网段, 用 podCIDR 的话只有 podCIDR 这一个, 别的节点上只有到 podCIDR 的路由
+func (g *Get) allocatableBlocks() ([]string, error) {
+	networks, err := g.HostBlocks(getDefaultOwner())
+	if err != nil {
+		return nil, err
+	}
+	if g.ipam.UsePodCIDR && len(networks) > 1 {
+		networks = networks[:1]
+	}
+	return networks, nil
+}
+
+/**
+ * 把当前节点的 podCIDR 记成当前主机的网段
+ * podCIDR 必须在 subnet 里面, 每个节点的网段的掩码也跟着 podCIDR 走
+ * 这个网段之前记在别的主机名下的话(比如那台主机已经被删掉了, k8s 把网段分给了新的节点)就以 k8s 为准改过来
+ */
+func (is *IpamService) podCIDRInit(hostname string) (string, error) {
+	cidr, err := is.Get().PodCIDR(hostname)
+	if err != nil {
+		return "", err
+	}
+	if cidr == "" {
+		return "", fmt.Errorf("node %s has no podCIDR for subnet %s, is kube-controller-manager running with --allocate-node-cidrs", hostname, is.Subnet)
+	}
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	subnet, err := parseBlock(is.Subnet, is.MaskSegment)
+	if err != nil {
+		return "", err
+	}
+	blockOnes, _ := block.Mask.Size()
+	subnetOnes, _ := subnet.Mask.Size()
+	if !subnet.Contains(block.IP) || blockOnes < subnetOnes {
+		return "", fmt.Errorf("podCIDR %s of node %s is not inside subnet %s", cidr, hostname, subnet.String())
+	}
+	is.BlockMaskSegment = strconv.Itoa(blockOnes)
+
+	network := block.IP.String()
+	hostPath := is.hostPathByName(hostname)
+	blockPath := is.blockPath(network)
+	for i := 0; i < txnRetryTimes; i++ {
+		recorded, hostRevision, err := is.Datastore.GetWithRevision(hostPath)
+		if err != nil {
+			return "", err
+		}
+		owner, blockRevision, err := is.Datastore.GetWithRevision(blockPath)
+		if err != nil {
+			return "", err
+		}
+		if recorded == network && owner == hostname {
+			return network, nil
+		}
+		if owner != "" && owner != hostname {
+			utils.WriteLog("网段 ", network, " 之前记在 ", owner, " 名下, 按照 k8s 分的 podCIDR 改记到 ", hostname, " 名下")
+		}
+
+		succeeded, err := is.Datastore.Txn(
+			[]datastore.Cmp{
+				datastore.ModRevisionIs(hostPath, hostRevision),
+				datastore.ModRevisionIs(blockPath, blockRevision),
+			},
+			datastore.OpPut(blockPath, hostname),
+			datastore.OpPut(hostPath, network),
+		)
+		if err != nil {
+			return "", err
+		}
+		if succeeded {
+			return network, nil
+		}
+		txnBackoff()
+	}
+	return "", fmt.Errorf("failed to record podCIDR %s of %s after %d retries", cidr, hostname, txnRetryTimes)
+}
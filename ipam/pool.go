@@ -0,0 +1,122 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"testcni/consts"
+)
+
+/**
+ * 除了配置里的 subnet 这个默认的池子之外还可以配置好几个具名的 ip 池
+ * pod 或者它所在的 namespace 上打了 testcni.io/ip-pool 注解的话就从对应的池子里分 ip, pod 上的优先
+ * 每个池子都是一个(双栈的时候是两个)单独的 ipam service, 在 etcd 中按自己的 subnet 存着一套网段
+ */
+
+// 默认的池子, 也就是配置里的 subnet
+const DEFAULT_POOL_NAME = ""
+
+// 具名的 ip 池在 ipam service 里的名字, 和默认的以及双栈的 secondary 区分开
+func poolServiceName(pool string) string {
+	if pool == DEFAULT_POOL_NAME {
+		return DEFAULT_SERVICE_NAME
+	}
+	return "pool/" + pool
+}
+
+func poolSecondaryServiceName(pool string) string {
+	if pool == DEFAULT_POOL_NAME {
+		return SECONDARY_SERVICE_NAME
+	}
+	return poolServiceName(pool) + "/" + SECONDARY_SERVICE_NAME
+}
+
+/**
+ * 初始化一个 ip 池, 双栈的时候和 InitDualStack 一样是两个 ipam service
+ * 具名的池子都是用到的时候才占网段, 节点上没有这个池子的 pod 的话就不会占着它的网段
+ * 配了 range 的池子(ipvlan 和 macvlan 模式)除外, range 是初始化的时候和网段一起记在主机名下的, 所以和默认的池子一样初始化的时候就占
+ */
+func InitPool(pool string, subnets []string, options *IPAMOptions) func() error {
+	if len(subnets) == 0 {
+		return func() error {
+			return errors.New("subnet is empty")
+		}
+	}
+	if pool != DEFAULT_POOL_NAME && (options == nil || options.RangeStart == "") {
+		_options := IPAMOptions{}
+		if options != nil {
+			_options = *options
+		}
+		_options.ClaimOnDemand = true
+		options = &_options
+	}
+	clear := InitWithName(poolServiceName(pool), subnets[0], options)
+	if len(subnets) == 1 {
+		return clear
+	}
+	clearSecondary := InitWithName(poolSecondaryServiceName(pool), subnets[1], options)
+	return func() error {
+		err := clearSecondary()
+		if err != nil {
+			return err
+		}
+		return clear()
+	}
+}
+
+// 拿到 ip 池的 ipam service, 第二个是双栈时另一个地址族的, 单栈的时候是 nil
+func GetPoolServices(pool string) (*IpamService, *IpamService, error) {
+	is, err := GetIpamServiceByName(poolServiceName(pool))
+	if err != nil {
+		return nil, nil, err
+	}
+	ipamServicesLock.Lock()
+	_, ok := __GetIpamServices[poolSecondaryServiceName(pool)]
+	ipamServicesLock.Unlock()
+	if !ok {
+		return is, nil, nil
+	}
+	secondary, err := GetIpamServiceByName(poolSecondaryServiceName(pool))
+	if err != nil {
+		return nil, nil, err
+	}
+	return is, secondary, nil
+}
+
+/**
+ * 根据 pod 和 namespace 上的注解挑出 pod 要用的 ip 池, 没有注解的话就是默认的池子
+ * 没配置具名的池子的话就不去问 k8s 了, 不是 k8s 拉起来的容器(没有 K8S_POD_NAME)也一样
+ */
+func PoolOfPod(namespace, podName string, pools []string) (string, error) {
+	if len(pools) == 0 || namespace == "" || podName == "" {
+		return DEFAULT_POOL_NAME, nil
+	}
+	k8sClient := getLightK8sClient()
+	if k8sClient == nil {
+		return "", errors.New("k8s client is required to select the ip pool")
+	}
+	pod, err := k8sClient.Get().Pod(namespace, podName)
+	if err != nil {
+		return "", err
+	}
+	ns, err := k8sClient.Get().Namespace(namespace)
+	if err != nil {
+		return "", err
+	}
+	return selectPool(pod.Annotations, ns.Annotations, pools)
+}
+
+func selectPool(podAnnotations, namespaceAnnotations map[string]string, pools []string) (string, error) {
+	pool := podAnnotations[consts.KUBE_IP_POOL_ANNOTATION]
+	if pool == "" {
+		pool = namespaceAnnotations[consts.KUBE_IP_POOL_ANNOTATION]
+	}
+	if pool == "" {
+		return DEFAULT_POOL_NAME, nil
+	}
+	for _, name := range pools {
+		if name == pool {
+			return pool, nil
+		}
+	}
+	return "", fmt.Errorf("ip pool %q in the annotation %s is not configured", pool, consts.KUBE_IP_POOL_ANNOTATION)
+}
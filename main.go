@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
+	"testcni/agent"
 	"testcni/cni"
 	"testcni/helper"
 
@@ -107,5 +109,21 @@ func cmdCheck(args *skel.CmdArgs) error {
 }
 
 func main() {
+	// testcni agent 是每个节点上的常驻进程, 不是 kubelet 调用的, 不走 cni 那一套
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		if err := agent.Main(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	// testcni nodes 列出所有节点的心跳情况
+	if len(os.Args) > 1 && os.Args[1] == "nodes" {
+		if err := agent.NodesMain(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("testcni"))
 }
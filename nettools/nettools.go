@@ -13,6 +13,9 @@ import (
 	"testcni/ipam"
 	"testcni/utils"
 
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
@@ -203,17 +206,17 @@ func DelVxlan(name string) error {
 	return delInterfaceByName(name)
 }
 
-func CreateMacVlan(ifname, parentName string) (*netlink.Macvlan, error) {
+// holder 是要用这个 macvlan 的 pod 的网卡, 用 PromiscHolder 生成, 删的时候用同一个 holder 把混杂模式还回去
+func CreateMacVlan(ifname, parentName, holder string) (*netlink.Macvlan, error) {
 	// macvlan 多一步, 要先把网卡给开启混杂模式
 	link, err := netlink.LinkByName(parentName)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: 这里应该先把 parent 网卡的当前状态记录下来
-	// 然后等删除这个 macvlan 设备的时候再给恢复
-	// 这里暂时先直接开启
-	err = netlink.SetPromiscOn(link)
+	// 先把 parent 网卡当前的状态记录下来再开启
+	// 等最后一个 macvlan 设备被删除的时候再给恢复
+	err = AcquireParentPromisc(link, holder)
 	if err != nil {
 		return nil, err
 	}
@@ -237,6 +240,9 @@ func CreateMacVlan(ifname, parentName string) (*netlink.Macvlan, error) {
 
 	err = netlink.LinkAdd(macvlan)
 	if err != nil {
+		if releaseErr := ReleaseParentPromisc(parentName, holder); releaseErr != nil {
+			utils.WriteLog("恢复 parent 网卡的混杂模式失败, err: ", releaseErr.Error())
+		}
 		return nil, err
 	}
 
@@ -309,6 +315,65 @@ func DelIPVlan(name string) error {
 	return delInterfaceByName(name)
 }
 
+// 删除还留在主机上的 ipvlan 或者 macvlan 设备, 比如塞到 pod 里之前就出错了, 找不到的话就当已经删过了
+func DelXVlan(name string) error {
+	err := delInterfaceByName(name)
+	if IsLinkNotFoundErr(err) {
+		return nil
+	}
+	return err
+}
+
+/**
+ * 删除 pod(netns) 中的 ipvlan 或者 macvlan 设备, linkType 就是 "ipvlan" 或者 "macvlan"
+ * 只按 ifName 去找, pod 里可能还有别的插件(比如 multus 挂的第二块儿网卡)建的同类型的设备, 不能动
+ * 找不到或者 ifName 不是这个类型的设备的话就当已经删过了
+ * 返回值分别是 pod 中的 ip 地址以及 parent 网卡的名字, 设备本来就没有的话都返回空
+ */
+func DelXVlanInNs(netns ns.NetNS, ifName string, linkType string) (string, string, error) {
+	podIP := ""
+	parentName := ""
+	err := netns.Do(func(hostNs ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if IsLinkNotFoundErr(err) {
+				return nil
+			}
+			return err
+		}
+		if link.Type() != linkType {
+			utils.WriteLog("pod 中的 ", ifName, " 是 ", link.Type(), " 不是 ", linkType, ", 不删")
+			return nil
+		}
+
+		podIP, err = GetDeviceIPv4(link)
+		if err != nil {
+			return err
+		}
+
+		// 子设备的 ParentIndex 是 parent 网卡在主机上的 index
+		parentIndex := link.Attrs().ParentIndex
+		if parentIndex != 0 {
+			hostNs.Do(func(_ ns.NetNS) error {
+				parent, err := netlink.LinkByIndex(parentIndex)
+				if err == nil {
+					parentName = parent.Attrs().Name
+				}
+				return nil
+			})
+		}
+
+		if err = netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %s %q in netns: %v", linkType, link.Attrs().Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return podIP, parentName, nil
+}
+
 func CreateBridge(brName, gw string, mtu int) (*netlink.Bridge, error) {
 	l, err := netlink.LinkByName(brName)
 	if err != nil {
@@ -317,6 +382,11 @@ func CreateBridge(brName, gw string, mtu int) (*netlink.Bridge, error) {
 
 	br, ok := l.(*netlink.Bridge)
 	if ok && br != nil {
+		// 网桥已经有了, 不过主机多占了网段的话网桥上还得再加一个这个网段的网关
+		err = addAddrIfNotExist(br, gw)
+		if err != nil {
+			return nil, err
+		}
 		return br, nil
 	}
 
@@ -354,7 +424,7 @@ func CreateBridge(brName, gw string, mtu int) (*netlink.Bridge, error) {
 		return nil, fmt.Errorf("transform the gatewayIP error %q: %v", gw, err)
 	}
 	ipnet.IP = ipaddr
-	addr := &netlink.Addr{IPNet: ipnet}
+	addr := newAddr(ipnet)
 	if err = netlink.AddrAdd(br, addr); err != nil {
 		utils.WriteLog("将 gw 添加到 bridge 失败, err: ", err.Error())
 		return nil, fmt.Errorf("can not add the gw %q to bridge %q, err: %v", addr, brName, err)
@@ -484,6 +554,224 @@ func DelVethPair(ifName string) error {
 	return delInterfaceByName(ifName)
 }
 
+// 判断是不是 netns 已经不存在了
+// kubelet 在多次调用 StopPodSandbox 时, 后几次传过来的 netns 有可能已经被删掉了
+func IsNsNotExistErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(ns.NSPathNotExistErr)
+	return ok
+}
+
+// 判断是不是找不到设备
+func IsLinkNotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(netlink.LinkNotFoundError)
+	return ok
+}
+
+// 看设备上有没有绑着 ip 这个地址
+func DeviceHasIP(link netlink.Link, ip string) (bool, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	target := net.ParseIP(ip)
+	for _, addr := range addrs {
+		if addr.IP.Equal(target) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 给设备绑上 cidr 这个地址, 已经绑过了的话就跳过
+func addAddrIfNotExist(link netlink.Link, cidr string) error {
+	ipaddr, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	exist, err := DeviceHasIP(link, ipaddr.String())
+	if err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+	ipnet.IP = ipaddr
+	err = netlink.AddrAdd(link, newAddr(ipnet))
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("can not add %q to %q, err: %v", cidr, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// 把设备上绑着的 ip 这个地址删掉, 本来就没有的话就跳过
+func DelAddrIfExist(link netlink.Link, ip string) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	target := net.ParseIP(ip)
+	for _, addr := range addrs {
+		if addr.IP.Equal(target) {
+			return netlink.AddrDel(link, &addr)
+		}
+	}
+	return nil
+}
+
+// 获取某个设备上的第一个 ipv4 地址, 不带掩码
+func GetDeviceIPv4(link netlink.Link) (string, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", nil
+	}
+	return addrs[0].IP.String(), nil
+}
+
+/**
+ * 找到 pod(netns) 中名为 ifName 的 veth
+ * 返回值分别是它在 pod 中的 ip 地址以及它留在主机上的那半拉 veth 的名字
+ * 如果 pod 中压根儿就没有这块儿网卡(比如之前已经删过了)则直接返回空
+ */
+func GetVethInfoInNs(netns ns.NetNS, ifName string) (string, string, error) {
+	podIP := ""
+	hostVethName := ""
+	err := netns.Do(func(hostNs ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if IsLinkNotFoundErr(err) {
+				return nil
+			}
+			return err
+		}
+
+		podIP, err = GetDeviceIPv4(link)
+		if err != nil {
+			return err
+		}
+
+		veth, ok := link.(*netlink.Veth)
+		if !ok {
+			return nil
+		}
+		peerIndex, err := netlink.VethPeerIndex(veth)
+		if err != nil {
+			utils.WriteLog("获取 veth peer 的 index 失败, err: ", err.Error())
+			return nil
+		}
+		return hostNs.Do(func(_ ns.NetNS) error {
+			hostVeth, err := netlink.LinkByIndex(peerIndex)
+			if err == nil {
+				hostVethName = hostVeth.Attrs().Name
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return podIP, hostVethName, nil
+}
+
+/**
+ * 删除 pod(netns) 中名为 ifName 的 veth
+ * veth pair 中的一头被删掉的话另一头也会被内核一起删掉
+ * 所以删完之后留在主机上的那半拉 veth 也就没了
+ * 返回值和 GetVethInfoInNs 一样, 方便调用方做后续的清理
+ */
+func DelVethInNs(netns ns.NetNS, ifName string) (string, string, error) {
+	podIP, hostVethName, err := GetVethInfoInNs(netns, ifName)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if IsLinkNotFoundErr(err) {
+				return nil
+			}
+			return err
+		}
+		if err = netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete %q in netns: %v", ifName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if hostVethName == "" {
+		return podIP, "", nil
+	}
+
+	// 正常情况下主机上那头已经跟着一起没了, 这里再确认一下
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err == nil {
+		if err = netlink.LinkDel(hostVeth); err != nil && !IsLinkNotFoundErr(err) {
+			return podIP, hostVethName, fmt.Errorf("failed to delete host veth %q: %v", hostVethName, err)
+		}
+	}
+	return podIP, hostVethName, nil
+}
+
+// 删除主机上的那半拉 veth, 已经没了的话直接忽略
+func DelHostVeth(name string) error {
+	err := delInterfaceByName(name)
+	if err != nil && !IsLinkNotFoundErr(err) {
+		return err
+	}
+	return nil
+}
+
+/**
+ * 检查 pod(netns) 中名为 ifName 的网卡是不是还和 ADD 时返回的结果一样
+ *		1. 网卡得在, 并且得是 up 的
+ *		2. ips 中的地址都得在这块儿网卡上
+ *		3. routes 中的路由都得在 pod 的路由表里
+ * 返回的 error 里会写清楚是哪一项对不上
+ */
+func CheckPodInterface(netns ns.NetNS, ifName string, ips []*types.IPConfig, routes []*cniTypes.Route) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("interface %q not found in netns %q: %v", ifName, netns.Path(), err)
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("interface %q in netns %q is down", ifName, netns.Path())
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+		}
+		for _, ipc := range ips {
+			found := false
+			for _, addr := range addrs {
+				if addr.IPNet.IP.Equal(ipc.Address.IP) &&
+					addr.IPNet.Mask.String() == ipc.Address.Mask.String() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("address %s not found on interface %q", ipc.Address.String(), ifName)
+			}
+		}
+
+		return ip.ValidateExpectedRoute(routes)
+	})
+}
+
 func setIpForDevice(name string, ip string, mode ...string) error {
 	deviceType := ""
 	if len(mode) != 0 {
@@ -499,7 +787,7 @@ func setIpForDevice(name string, ip string, mode ...string) error {
 		return fmt.Errorf("failed to transform the ip %q, error : %v", ip, err)
 	}
 	ipnet.IP = ipaddr
-	err = netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet})
+	err = netlink.AddrAdd(link, newAddr(ipnet))
 	if err != nil {
 		return fmt.Errorf("can not add the ip %q to %s device %q, error: %v", ip, deviceType, name, err)
 	}
@@ -590,13 +878,13 @@ func SetDefaultRouteToVeth(gwIP net.IP, veth netlink.Link) error {
 func SetOtherHostRouteToCurrentHost(networks []*ipam.Network, currentNetwork *ipam.Network) error {
 
 	link, err := netlink.LinkByName(currentNetwork.Name)
-
-	list, _ := netlink.RouteList(link, netlink.FAMILY_V4)
-
 	if err != nil {
 		return err
 	}
 
+	// 双栈的时候 ipv4 和 ipv6 的网段都要加路由
+	list, _ := netlink.RouteList(link, netlink.FAMILY_ALL)
+
 	for _, network := range networks {
 		if !network.IsCurrentHost {
 			// 对于其他主机, 需要获取到其他主机的对外网卡 ip, 以及它的 pods 们所占用的网段的 cidr
@@ -605,29 +893,35 @@ func SetOtherHostRouteToCurrentHost(networks []*ipam.Network, currentNetwork *ip
 				return err
 			}
 
-			_, cidr, err := net.ParseCIDR(network.CIDR)
-			if err != nil {
-				return err
+			// 其他主机可能占着好几个网段, 每个网段都要加一条路由
+			cidrs := network.CIDRs
+			if len(cidrs) == 0 && network.CIDR != "" {
+				cidrs = []string{network.CIDR}
 			}
-
-			isSkip := false
-			for _, l := range list {
-				if l.Dst != nil && l.Dst.String() == network.CIDR {
-					isSkip = true
-					break
+			ip := net.ParseIP(network.IP)
+			for _, _cidr := range cidrs {
+				_, cidr, err := net.ParseCIDR(_cidr)
+				if err != nil {
+					return err
 				}
-			}
 
-			if isSkip {
-				// fmt.Println(network.CIDR, " 已存在路由表中, 直接跳过")
-				continue
-			}
+				isSkip := false
+				for _, l := range list {
+					if l.Dst != nil && l.Dst.String() == cidr.String() {
+						isSkip = true
+						break
+					}
+				}
 
-			ip := net.ParseIP(network.IP)
+				if isSkip {
+					// fmt.Println(_cidr, " 已存在路由表中, 直接跳过")
+					continue
+				}
 
-			err = AddHostRoute(cidr, ip, link)
-			if err != nil {
-				return err
+				err = AddHostRoute(cidr, ip, link)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -659,6 +953,18 @@ func AddHostRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
 	})
 }
 
+// 删除一条路由, 路由本来就不存在的话直接忽略
+func DelRoute(ipn *net.IPNet, dev netlink.Link) error {
+	err := netlink.RouteDel(&netlink.Route{
+		LinkIndex: dev.Attrs().Index,
+		Dst:       ipn,
+	})
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
 func AddHostRouteWithVia(ipn *net.IPNet, via *netlink.Via, dev netlink.Link) error {
 	return netlink.RouteAdd(&netlink.Route{
 		LinkIndex: dev.Attrs().Index,
@@ -670,8 +976,81 @@ func AddHostRouteWithVia(ipn *net.IPNet, via *netlink.Via, dev netlink.Link) err
 
 // forked from plugins/pkg/ip/route_linux.go
 func AddDefaultRoute(gw net.IP, dev netlink.Link) error {
+	return AddRoute(DefaultRouteDst(gw), gw, dev)
+}
+
+// 默认路由的目的地址, gw 是 ipv6 的话就是 ::/0
+func DefaultRouteDst(gw net.IP) *net.IPNet {
+	if gw.To4() == nil {
+		_, defNet, _ := net.ParseCIDR("::/0")
+		return defNet
+	}
 	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
-	return AddRoute(defNet, gw, dev)
+	return defNet
+}
+
+// 主机上 ipv4 的默认路由走的那块儿网卡的名字
+func DefaultRouteLinkName() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex <= 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", errors.New("no default route found")
+}
+
+/**
+ * 生成要绑到设备上的地址
+ * ipv6 的地址默认要先做一遍重复地址检测(DAD), 检测完之前地址是 tentative 的, 用不了
+ * pod 和网桥上的地址都是 ipam 分的, 不会重复, 所以直接跳过检测
+ */
+func newAddr(ipnet *net.IPNet) *netlink.Addr {
+	addr := &netlink.Addr{IPNet: ipnet}
+	if ipnet.IP.To4() == nil {
+		addr.Flags = syscall.IFA_F_NODAD
+	}
+	return addr
+}
+
+/**
+ * 双栈的时候 pod 里的网卡在已经有了一个地址族的 ip 之后
+ * 再给它加上另一个地址族的 ip 以及走 gw 的默认路由
+ */
+func AddPodAddressAndDefaultRoute(netns ns.NetNS, ifName, podIP string, gw net.IP) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		err = addAddrIfNotExist(link, podIP)
+		if err != nil {
+			return err
+		}
+		err = AddDefaultRoute(gw, link)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// 打开主机上 ipv6 的转发, 不开的话 pod 的 ipv6 流量出不了主机
+func SetUpIPv6Forwarding() error {
+	processInfo := exec.Command(
+		"/bin/sh", "-c",
+		"echo 1 > /proc/sys/net/ipv6/conf/all/forwarding",
+	)
+	_, err := processInfo.Output()
+	return err
 }
 
 // forked from /plugins/pkg/ip/link_linux.go
@@ -688,12 +1067,21 @@ func RandomVethName() (string, error) {
 }
 
 func SetIptablesForToForwardAccept(link netlink.Link) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	return setForwardAccept(iptables.ProtocolIPv4, link.Attrs().Name)
+}
+
+// ipv6 的转发规则在 ip6tables 里, 双栈的时候两边都得放开
+func SetIp6tablesForToForwardAccept(link netlink.Link) error {
+	return setForwardAccept(iptables.ProtocolIPv6, link.Attrs().Name)
+}
+
+func setForwardAccept(protocol iptables.Protocol, name string) error {
+	ipt, err := iptables.NewWithProtocol(protocol)
 	if err != nil {
 		utils.WriteLog("这里 NewWithProtocol 失败, err: ", err.Error())
 		return err
 	}
-	err = ipt.Append("filter", "FORWARD", "-i", link.Attrs().Name, "-j", "ACCEPT")
+	err = ipt.Append("filter", "FORWARD", forwardAcceptRule(name)...)
 	if err != nil {
 		utils.WriteLog("这里 ipt.Append 失败, err: ", err.Error())
 		return err
@@ -701,6 +1089,78 @@ func SetIptablesForToForwardAccept(link netlink.Link) error {
 	return nil
 }
 
+func DelIp6tablesForToForwardAccept(name string) error {
+	return delForwardAccept(iptables.ProtocolIPv6, name)
+}
+
+func DelIptablesForToForwardAccept(name string) error {
+	return delForwardAccept(iptables.ProtocolIPv4, name)
+}
+
+func delForwardAccept(protocol iptables.Protocol, name string) error {
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		utils.WriteLog("这里 NewWithProtocol 失败, err: ", err.Error())
+		return err
+	}
+	err = ipt.DeleteIfExists("filter", "FORWARD", forwardAcceptRule(name)...)
+	if err != nil {
+		utils.WriteLog("这里 ipt.DeleteIfExists 失败, err: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+/**
+ * 看看 FORWARD 链上有没有放开从 name 进来的转发的规则
+ * CHECK 的时候用, 只看 name 自己的那条, 别的设备的规则不管
+ */
+func HasIptablesForToForwardAccept(name string) (bool, error) {
+	return hasForwardAccept(iptables.ProtocolIPv4, name)
+}
+
+func HasIp6tablesForToForwardAccept(name string) (bool, error) {
+	return hasForwardAccept(iptables.ProtocolIPv6, name)
+}
+
+func hasForwardAccept(protocol iptables.Protocol, name string) (bool, error) {
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		utils.WriteLog("这里 NewWithProtocol 失败, err: ", err.Error())
+		return false, err
+	}
+	rules, err := ipt.List("filter", "FORWARD")
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if isForwardAcceptRule(rule, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 放开从 name 进来的转发的规则, 加, 删和查用的都是这一条
+func forwardAcceptRule(name string) []string {
+	return []string{"-i", name, "-j", "ACCEPT"}
+}
+
+// ipt.List 列出来的规则长这样: "-A FORWARD -i vethxxxx -j ACCEPT", 看看是不是放开 name 的那条
+func isForwardAcceptRule(rule, name string) bool {
+	fields := strings.Fields(rule)
+	spec := forwardAcceptRule(name)
+	if len(fields) != len(spec)+2 || fields[0] != "-A" || fields[1] != "FORWARD" {
+		return false
+	}
+	for i, field := range spec {
+		if fields[i+2] != field {
+			return false
+		}
+	}
+	return true
+}
+
 func SetIptablesForDeviceToFarwordAccept(device *netlink.Device) error {
 	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
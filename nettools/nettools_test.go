@@ -216,3 +216,26 @@ func TestNettools(t *testing.T) {
 	}
 	clear()
 }
+
+func TestIsForwardAcceptRule(t *testing.T) {
+	test := assert.New(t)
+	cases := []struct {
+		rule string
+		name string
+		want bool
+	}{
+		{"-A FORWARD -i veth1234 -j ACCEPT", "veth1234", true},
+		// 名字是前缀的不算, 别的工具建的同前缀的设备的规则不能被当成自己的
+		{"-A FORWARD -i veth12345 -j ACCEPT", "veth1234", false},
+		{"-A FORWARD -i veth1234 -j ACCEPT", "veth12345", false},
+		{"-A FORWARD -i veth1234 -j DROP", "veth1234", false},
+		{"-A FORWARD -o veth1234 -j ACCEPT", "veth1234", false},
+		{"-A FORWARD -i veth1234 -m comment --comment docker -j ACCEPT", "veth1234", false},
+		{"-A INPUT -i veth1234 -j ACCEPT", "veth1234", false},
+		{"-P FORWARD ACCEPT", "veth1234", false},
+		{"", "veth1234", false},
+	}
+	for _, c := range cases {
+		test.Equal(c.want, isForwardAcceptRule(c.rule, c.name), c.rule)
+	}
+}
@@ -0,0 +1,177 @@
+package nettools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testcni/consts"
+	"testcni/utils"
+
+	"github.com/vishvananda/netlink"
+)
+
+/**
+ * macvlan 需要把 parent 网卡开启混杂模式
+ * 这里要把 parent 网卡原本的状态记下来, 等最后一个 macvlan 子设备被删掉的时候再给恢复回去
+ * 每块儿 parent 网卡对应 KUBE_TEST_CNI_DEFAULT_PROMISC_PATH 下的一个文件
+ * 因为同一个节点上可能同时有好几个 cni 进程在跑, 所以读写的时候要加文件锁
+ * 记的不是子设备的个数而是都有谁(containerID/ifName), 这样 ADD 和 DEL 重试多少次都只算一次
+ */
+type promiscState struct {
+	// 第一次开启混杂模式之前 parent 网卡是不是已经开着了
+	PrevPromisc bool `json:"prevPromisc"`
+	// 当前还需要混杂模式的子设备, 按加进来的顺序排
+	Holders []string `json:"holders"`
+}
+
+// 子设备在状态文件里的名字
+func PromiscHolder(containerID, ifName string) string {
+	return containerID + "/" + ifName
+}
+
+func (state *promiscState) indexOf(holder string) int {
+	for i, h := range state.Holders {
+		if h == holder {
+			return i
+		}
+	}
+	return -1
+}
+
+// 状态文件所在的目录, 测试的时候会换成临时目录
+var promiscStateDir = consts.KUBE_TEST_CNI_DEFAULT_PROMISC_PATH
+
+func getPromiscStatePath(parentName string) string {
+	return filepath.Join(promiscStateDir, parentName)
+}
+
+/**
+ * 多了一个子设备之后的状态, currentPromisc 是 parent 网卡现在是不是开着混杂模式
+ * 第一个子设备来的时候记下 parent 网卡原本的状态, 之后的只记下是谁, 已经记过的不再记
+ */
+func acquirePromiscState(state *promiscState, exist bool, currentPromisc bool, holder string) *promiscState {
+	if !exist {
+		state = &promiscState{PrevPromisc: currentPromisc}
+	}
+	next := *state
+	if state.indexOf(holder) < 0 {
+		next.Holders = append(append([]string{}, state.Holders...), holder)
+	}
+	return &next
+}
+
+/**
+ * 少了一个子设备之后的状态, 返回 nil 说明已经没有子设备了, 状态文件可以删了
+ * restore 为 true 的话要把 parent 网卡的混杂模式关掉, 本来就开着的网卡不用关
+ * holder 不在里头的话(比如 DEL 重试)什么都不变
+ */
+func releasePromiscState(state *promiscState, exist bool, holder string) (next *promiscState, restore bool) {
+	if !exist {
+		return nil, false
+	}
+	i := state.indexOf(holder)
+	if i < 0 {
+		return state, false
+	}
+	if len(state.Holders) > 1 {
+		next := *state
+		next.Holders = append(append([]string{}, state.Holders[:i]...), state.Holders[i+1:]...)
+		return &next, false
+	}
+	return nil, !state.PrevPromisc
+}
+
+// 拿着 parent 网卡对应的状态文件的锁去执行 fn
+func withPromiscState(parentName string, fn func(state *promiscState, exist bool) (*promiscState, error)) error {
+	if !utils.PathExists(promiscStateDir) {
+		err := utils.CreateDir(promiscStateDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	lockFile, err := os.OpenFile(getPromiscStatePath(parentName)+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockFile.Close()
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	path := getPromiscStatePath(parentName)
+	state := &promiscState{}
+	exist := utils.FileIsExisted(path)
+	if exist {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(content, state); err != nil {
+			// 文件坏了的话就当没有
+			utils.WriteLog("解析混杂模式的状态文件失败, err: ", err.Error())
+			exist = false
+			state = &promiscState{}
+		}
+	}
+
+	newState, err := fn(state, exist)
+	if err != nil {
+		return err
+	}
+
+	if newState == nil {
+		return utils.DeleteFile(path)
+	}
+	content, err := json.Marshal(newState)
+	if err != nil {
+		return err
+	}
+	return utils.CreateFile(path, content, 0600)
+}
+
+// 给 parent 网卡开启混杂模式, 并且把 holder 记到需要混杂模式的子设备里
+func AcquireParentPromisc(parent netlink.Link, holder string) error {
+	return acquirePromisc(parent.Attrs().Name, parent.Attrs().Promisc != 0, holder, func() error {
+		return netlink.SetPromiscOn(parent)
+	})
+}
+
+func acquirePromisc(parentName string, currentPromisc bool, holder string, setOn func() error) error {
+	return withPromiscState(parentName, func(state *promiscState, exist bool) (*promiscState, error) {
+		if err := setOn(); err != nil {
+			return nil, err
+		}
+		return acquirePromiscState(state, exist, currentPromisc, holder), nil
+	})
+}
+
+// 把 holder 从需要混杂模式的子设备里去掉, 最后一个子设备也没了的话就把 parent 网卡恢复成原来的状态, 重复调用也没关系
+func ReleaseParentPromisc(parentName, holder string) error {
+	return releasePromisc(parentName, holder, func() error {
+		parent, err := netlink.LinkByName(parentName)
+		if err != nil {
+			if IsLinkNotFoundErr(err) {
+				return nil
+			}
+			return err
+		}
+		return netlink.SetPromiscOff(parent)
+	})
+}
+
+// 恢复失败的话状态文件不动, 下次 DEL 重试的时候还能再恢复一遍
+func releasePromisc(parentName, holder string, setOff func() error) error {
+	return withPromiscState(parentName, func(state *promiscState, exist bool) (*promiscState, error) {
+		next, restore := releasePromiscState(state, exist, holder)
+		if restore {
+			if err := setOff(); err != nil {
+				return nil, err
+			}
+		}
+		return next, nil
+	})
+}
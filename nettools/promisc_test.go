@@ -0,0 +1,160 @@
+package nettools
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testcni/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromiscStateTransitions(t *testing.T) {
+	test := assert.New(t)
+	acquireCases := []struct {
+		name           string
+		state          *promiscState
+		exist          bool
+		currentPromisc bool
+		holder         string
+		want           promiscState
+	}{
+		// 第一个子设备把 parent 网卡原本的状态记下来
+		{"first child of a normal nic", &promiscState{}, false, false, "a", promiscState{PrevPromisc: false, Holders: []string{"a"}}},
+		{"first child of a promisc nic", &promiscState{}, false, true, "a", promiscState{PrevPromisc: true, Holders: []string{"a"}}},
+		// 之后的子设备来的时候网卡已经被我们开了混杂模式, 不能再当成原本的状态
+		{"second child", &promiscState{Holders: []string{"a"}}, true, true, "b", promiscState{PrevPromisc: false, Holders: []string{"a", "b"}}},
+		// ADD 重试的时候不会多记一次
+		{"retried child", &promiscState{Holders: []string{"a", "b"}}, true, true, "a", promiscState{PrevPromisc: false, Holders: []string{"a", "b"}}},
+	}
+	for _, c := range acquireCases {
+		test.Equal(c.want, *acquirePromiscState(c.state, c.exist, c.currentPromisc, c.holder), c.name)
+	}
+
+	releaseCases := []struct {
+		name        string
+		state       *promiscState
+		exist       bool
+		holder      string
+		want        *promiscState
+		wantRestore bool
+	}{
+		{"not the last child", &promiscState{Holders: []string{"a", "b"}}, true, "a", &promiscState{Holders: []string{"b"}}, false},
+		{"last child restores a normal nic", &promiscState{Holders: []string{"a"}}, true, "a", nil, true},
+		{"last child keeps a promisc nic", &promiscState{PrevPromisc: true, Holders: []string{"a"}}, true, "a", nil, false},
+		// DEL 重试的时候已经去掉了的子设备不会再去掉一次, 别的子设备还在用着
+		{"retried child", &promiscState{Holders: []string{"b"}}, true, "a", &promiscState{Holders: []string{"b"}}, false},
+		// 状态文件没有的话说明不是我们开的, 不动网卡
+		{"no state", &promiscState{}, false, "a", nil, false},
+	}
+	for _, c := range releaseCases {
+		next, restore := releasePromiscState(c.state, c.exist, c.holder)
+		test.Equal(c.want, next, c.name)
+		test.Equal(c.wantRestore, restore, c.name)
+	}
+}
+
+// 一块儿假的网卡, 记着现在是不是开着混杂模式
+type fakePromiscNic struct {
+	lock    sync.Mutex
+	promisc bool
+	failOff bool
+}
+
+func (nic *fakePromiscNic) get() bool {
+	nic.lock.Lock()
+	defer nic.lock.Unlock()
+	return nic.promisc
+}
+
+func (nic *fakePromiscNic) acquire(name, holder string) error {
+	return acquirePromisc(name, nic.get(), holder, func() error {
+		nic.lock.Lock()
+		defer nic.lock.Unlock()
+		nic.promisc = true
+		return nil
+	})
+}
+
+func (nic *fakePromiscNic) release(name, holder string) error {
+	return releasePromisc(name, holder, func() error {
+		nic.lock.Lock()
+		defer nic.lock.Unlock()
+		if nic.failOff {
+			return errors.New("failed to set promisc off")
+		}
+		nic.promisc = false
+		return nil
+	})
+}
+
+func TestParentPromisc(t *testing.T) {
+	test := assert.New(t)
+	dir := promiscStateDir
+	promiscStateDir = t.TempDir()
+	defer func() { promiscStateDir = dir }()
+
+	// 第一个子设备打开, 最后一个子设备恢复
+	nic := &fakePromiscNic{}
+	test.Nil(nic.acquire("eth0", "pod-a/eth0"))
+	test.Nil(nic.acquire("eth0", "pod-b/eth0"))
+	test.True(nic.get())
+	test.Nil(nic.release("eth0", "pod-a/eth0"))
+	test.True(nic.get())
+	// 同一个 pod 的 DEL 重试好几次也不会把别的 pod 还要用的混杂模式关掉
+	test.Nil(nic.release("eth0", "pod-a/eth0"))
+	test.Nil(nic.release("eth0", "pod-a/eth0"))
+	test.True(nic.get())
+	test.Nil(nic.release("eth0", "pod-b/eth0"))
+	test.False(nic.get())
+	test.False(utils.FileIsExisted(getPromiscStatePath("eth0")))
+	// 多删一次不会出错, 也不动网卡
+	test.Nil(nic.release("eth0", "pod-b/eth0"))
+
+	// ADD 重试的时候不会多记一次, 删一次就恢复了
+	nic = &fakePromiscNic{}
+	test.Nil(nic.acquire("eth0", "pod-a/eth0"))
+	test.Nil(nic.acquire("eth0", "pod-a/eth0"))
+	test.Nil(nic.release("eth0", "pod-a/eth0"))
+	test.False(nic.get())
+
+	// 本来就开着混杂模式的网卡一直开着
+	nic = &fakePromiscNic{promisc: true}
+	test.Nil(nic.acquire("eth1", "pod-a/eth0"))
+	test.Nil(nic.release("eth1", "pod-a/eth0"))
+	test.True(nic.get())
+
+	// 恢复失败的话状态还留着, 重试的时候再恢复
+	nic = &fakePromiscNic{}
+	test.Nil(nic.acquire("eth2", "pod-a/eth0"))
+	nic.failOff = true
+	test.NotNil(nic.release("eth2", "pod-a/eth0"))
+	test.True(nic.get())
+	nic.failOff = false
+	test.Nil(nic.release("eth2", "pod-a/eth0"))
+	test.False(nic.get())
+
+	// 好几个 cni 进程一起加减也不会乱
+	nic = &fakePromiscNic{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			test.Nil(nic.acquire("eth3", fmt.Sprintf("pod-%d/eth0", i)))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 19; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			test.Nil(nic.release("eth3", fmt.Sprintf("pod-%d/eth0", i)))
+		}(i)
+	}
+	wg.Wait()
+	test.True(nic.get())
+	test.Nil(nic.release("eth3", "pod-19/eth0"))
+	test.False(nic.get())
+}
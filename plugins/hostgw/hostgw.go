@@ -1,7 +1,9 @@
 package hostgw
 
 import (
+	"fmt"
 	"net"
+	"os"
 	"testcni/cni"
 	"testcni/consts"
 	"testcni/ipam"
@@ -9,47 +11,105 @@ import (
 	"testcni/skel"
 	"testcni/utils"
 
+	cniTypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
-	// "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
 )
 
 const MODE = consts.MODE_HOST_GW
 
+const DEFAULT_BRIDGE_NAME = "testcni0"
+
 type HostGatewayCNI struct{}
 
+// 没配网桥名的话就用默认的 testcni0
+func getBridgeName(pluginConfig *cni.PluginConf) string {
+	if pluginConfig.Bridge != "" {
+		return pluginConfig.Bridge
+	}
+	return DEFAULT_BRIDGE_NAME
+}
+
+/**
+ * 使用 kubelet(containerd) 传过来的 subnet 地址初始化 ipam
+ * 配置了具名的 ip 池的话按 pod 和它所在的 namespace 上的注解挑一个池子
+ * 双栈的时候 subnet 里的两个网段各有一个 ipam, 第二个返回值在单栈的时候是 nil
+ */
+func initIpam(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, *ipam.IpamService, error) {
+	pool, err := ipam.PoolOfPod(
+		cni.GetCNIArg(args, "K8S_POD_NAMESPACE"),
+		cni.GetCNIArg(args, "K8S_POD_NAME"),
+		cni.GetPoolNames(pluginConfig),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return initPool(pluginConfig, pool)
+}
+
+func initPool(pluginConfig *cni.PluginConf, pool string) (*ipam.IpamService, *ipam.IpamService, error) {
+	err := cni.CheckBuiltinIPAM(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, err
+	}
+	poolConfig, err := cni.GetPoolConfig(pluginConfig, pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	subnets, err := cni.GetSubnets(poolConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipam.InitPool(pool, subnets, ipam.OptionsFromCNI(poolConfig))
+	return ipam.GetPoolServices(pool)
+}
+
+/**
+ * DEL 和 CHECK 的时候 pod 可能已经被删了, 读不到注解
+ * 所以挨个具名的池子去找这块儿网卡的分配记录, 都没有的话就是默认的池子
+ */
+func initIpamOfAllocation(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, *ipam.IpamService, error) {
+	for _, pool := range cni.GetPoolNames(pluginConfig) {
+		ipamClient, secondaryClient, err := initPool(pluginConfig, pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if alloc != nil {
+			return ipamClient, secondaryClient, nil
+		}
+	}
+	return initPool(pluginConfig, ipam.DEFAULT_POOL_NAME)
+}
+
 func (hostGW *HostGatewayCNI) Bootstrap(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) (*types.Result, error) {
-	// 使用 kubelet(containerd) 传过来的 subnet 地址初始化 ipam
-	ipam.Init(pluginConfig.Subnet, nil)
-	ipamClient, err := ipam.GetIpamService()
+	ipamClient, secondaryClient, err := initIpam(args, pluginConfig)
 	if err != nil {
 		utils.WriteLog("创建 ipam 客户端出错, err: ", err.Error())
 		return nil, err
 	}
 
-	// 根据 subnet 网段来得到网关, 表示所有的节点上的 pod 的 ip 都在这个网关范围内
-	gateway, err := ipamClient.Get().Gateway()
+	// pod 通过 runtimeConfig 或者 CNI_ARGS 指定了 ip 的话就只分指定的 ip
+	requestedIPs, err := cni.GetRequestedIPs(args, pluginConfig)
 	if err != nil {
-		utils.WriteLog("获取 gateway 出错, err: ", err.Error())
+		utils.WriteLog("解析 pod 指定的 ip 出错, err: ", err.Error())
 		return nil, err
 	}
-
-	// 获取网关＋网段号
-	gatewayWithMaskSegment, err := ipamClient.Get().GatewayWithMaskSegment()
+	err = ipam.CheckRequestedIPs(requestedIPs, ipamClient, secondaryClient)
 	if err != nil {
-		utils.WriteLog("获取 gatewayWithMaskSegment 出错, err: ", err.Error())
-		return nil, err
+		utils.WriteLog("pod 指定的 ip 不能用, err: ", err.Error())
+		return nil, cni.NewRequestedIPError(err.Error())
 	}
 
 	// 获取网桥名字
-	bridgeName := pluginConfig.Bridge
-	if bridgeName != "" {
-		bridgeName = "testcni0"
-	}
+	bridgeName := getBridgeName(pluginConfig)
 
 	// 这里如果不同节点间通信的方式使用 vxlan 的话, 这里需要变成 1450
 	// 因为 vxlan 设备会给报头中加一个 50 字节的 vxlan 头部
@@ -63,20 +123,50 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 		return nil, err
 	}
 
-	// 从 ipam 中拿到一个未使用的 ip 地址
-	podIP, err := ipamClient.Get().UnusedIP()
+	// 从 ipam 中给这个容器的这块儿网卡分配一个未使用的 ip 地址
+	alloc, err := ipamClient.Get().AllocateIP(args.ContainerID, ifName, MODE, requestedIPs...)
 	if err != nil {
 		utils.WriteLog("获取 podIP 出错, err: ", err.Error())
+		if ipam.IsRequestedIPError(err) {
+			return nil, cni.NewRequestedIPError(err.Error())
+		}
+		return nil, err
+	}
+	podIP := alloc.IP
+
+	/**
+	 * 走到这儿的话说明这个 podIP 已经在存储中占上坑位了, 占坑和写分配记录是在 Get().AllocateIP() 的时候一起做的
+	 * 后边不管哪一步出错了, 都按 DEL 的流程把已经做了的撤掉: 删掉 veth, 两个地址族的 ip 都还回去, 多占的网段的网关也从网桥上摘掉
+	 * 不然 runtime 看到 ADD 失败不会再调 DEL, ip 和 veth 就一直泄露着
+	 */
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		rollbackErr := hostGW.Unmount(args, pluginConfig)
+		if rollbackErr != nil {
+			utils.WriteLog("ADD 失败之后回滚失败, podIP: ", podIP, ", err: ", rollbackErr.Error())
+		}
+	}()
+
+	// 根据 pod ip 所在的网段来得到网关, 一台主机可能占着好几个网段, 每个网段的网关都会被绑到网桥上
+	gateway := ""
+	if alloc.Network != "" {
+		gateway, err = ipamClient.Get().GatewayOf(alloc.Network)
+	} else {
+		gateway, err = ipamClient.Get().Gateway()
+	}
+	if err != nil {
+		utils.WriteLog("获取 gateway 出错, err: ", err.Error())
 		return nil, err
 	}
 
-	// 走到这儿的话说明这个 podIP 已经在 etcd 中占上坑位了
-	// 占坑的操作是直接在 Get().UnusedIP() 的时候就做了
-	// 后续如果有什么 error 的话可以再 release
+	// 获取网关＋网段号
+	gatewayWithMaskSegment := gateway + "/" + ipamClient.MaskSegment
 
-	// 这里拼接 pod 的 cidr
-	// podIP = podIP + "/" + ipamClient.MaskSegment
-	podIP = podIP + "/" + "24"
+	// 这里拼接 pod 的 cidr, pod 的掩码和当前节点分到的网段一致
+	podIP = podIP + "/" + ipamClient.BlockMaskSegment
 
 	/**
 	 * 准备操作做完之后就可以调用网络工具来创建网络了
@@ -93,9 +183,43 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 	err = nettools.CreateBridgeAndCreateVethAndSetNetworkDeviceStatusAndSetVethMaster(bridgeName, gatewayWithMaskSegment, ifName, podIP, mtu, netns)
 	if err != nil {
 		utils.WriteLog("执行创建网桥, 创建 veth 设备, 添加默认路由等操作失败, err: ", err.Error())
-		err = ipamClient.Release().IPs(podIP)
+		return nil, err
+	}
+
+	// 网卡都创建好了, 把网关和主机上那半拉 veth 的名字补到分配记录里
+	_, hostVethName, err := nettools.GetVethInfoInNs(netns, ifName)
+	if err != nil {
+		utils.WriteLog("获取主机上的 veth 失败, err: ", err.Error())
+		return nil, err
+	}
+	alloc.Gateway = gateway
+	alloc.HostIfName = hostVethName
+	err = ipamClient.Set().Allocation(alloc)
+	if err != nil {
+		utils.WriteLog("更新分配记录失败, err: ", err.Error())
+		return nil, err
+	}
+
+	// subnet 是 ipv6 的话网桥上的转发还得在 ip6tables 里放开
+	br, err := netlink.LinkByName(bridgeName)
+	if err == nil {
+		err = setUpFamilyForwarding(ipamClient, br)
+	}
+	if err != nil {
+		utils.WriteLog("设置网桥转发规则失败, err: ", err.Error())
+		return nil, err
+	}
+
+	// 双栈的时候再从另一个地址族的 ipam 里分一个 ip, 绑到同一块儿网卡上
+	var secondaryIPConfig *types.IPConfig
+	if secondaryClient != nil {
+		secondaryIPConfig, err = setUpSecondaryAddress(secondaryClient, args, requestedIPs, bridgeName, hostVethName, mtu, netns)
 		if err != nil {
-			utils.WriteLog("释放 podIP", podIP, " 失败: ", err.Error())
+			utils.WriteLog("给 pod 配置另一个地址族的 ip 失败, err: ", err.Error())
+			if ipam.IsRequestedIPError(err) {
+				return nil, cni.NewRequestedIPError(err.Error())
+			}
+			return nil, err
 		}
 	}
 
@@ -118,67 +242,402 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 	 * 以上手动操作可成功
 	 */
 
+	// 不管 pod 用的是哪个 ip 池, 主机上到其他节点的每个池子的网段的路由都得有
+	err = setAllPoolRoutes(pluginConfig)
+	if err != nil {
+		utils.WriteLog("设置到其他节点的路由失败, err: ", err.Error())
+		return nil, err
+	}
+
+	_gw := net.ParseIP(gateway)
+
+	_ip, _podIP, _ := net.ParseCIDR(podIP)
+	_podIP.IP = _ip
+	defNet := nettools.DefaultRouteDst(_gw)
+
+	// CHECK 的时候会拿这个结果和 pod 里的实际情况做对比, 所以这里要把网卡, ip 以及路由都写全
+	result := &types.Result{
+		CNIVersion: pluginConfig.CNIVersion,
+		Interfaces: []*types.Interface{
+			{
+				Name:    ifName,
+				Sandbox: args.Netns,
+			},
+		},
+		IPs: []*types.IPConfig{
+			{
+				Interface: types.Int(0),
+				Address:   *_podIP,
+				Gateway:   _gw,
+			},
+		},
+		Routes: []*cniTypes.Route{
+			{
+				Dst: *defNet,
+				GW:  _gw,
+			},
+		},
+	}
+	if secondaryIPConfig != nil {
+		result.IPs = append(result.IPs, secondaryIPConfig)
+		result.Routes = append(result.Routes, &cniTypes.Route{
+			Dst: *nettools.DefaultRouteDst(secondaryIPConfig.Gateway),
+			GW:  secondaryIPConfig.Gateway,
+		})
+	}
+	succeeded = true
+	return result, nil
+}
+
+/**
+ * 双栈的时候给 pod 配上另一个地址族的 ip:
+ *		1. 从这个地址族的 ipam 里分一个 ip
+ *		2. 把这个 ip 所在网段的网关也绑到网桥上
+ *		3. 把 ip 加到 pod 里的网卡上, 再加一条走这个网关的默认路由
+ * 返回的是要放到结果里的那一项 ip, 出错的话分到的 ip 由 Bootstrap 统一回滚
+ */
+func setUpSecondaryAddress(
+	ipamClient *ipam.IpamService,
+	args *skel.CmdArgs,
+	requestedIPs []string,
+	bridgeName, hostVethName string,
+	mtu int,
+	netns ns.NetNS,
+) (*types.IPConfig, error) {
+	alloc, err := ipamClient.Get().AllocateIP(args.ContainerID, args.IfName, MODE, requestedIPs...)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := ipamClient.Get().GatewayOf(alloc.Network)
+	if err != nil {
+		return nil, err
+	}
+	// 网桥已经有了, 这里只会把网关加上去
+	br, err := nettools.CreateBridge(bridgeName, gateway+"/"+ipamClient.MaskSegment, mtu)
+	if err != nil {
+		return nil, err
+	}
+	err = setUpFamilyForwarding(ipamClient, br)
+	if err != nil {
+		return nil, err
+	}
+
+	podIP := alloc.IP + "/" + ipamClient.BlockMaskSegment
+	_gw := net.ParseIP(gateway)
+	err = nettools.AddPodAddressAndDefaultRoute(netns, args.IfName, podIP, _gw)
+	if err != nil {
+		return nil, err
+	}
+
+	alloc.Gateway = gateway
+	alloc.HostIfName = hostVethName
+	err = ipamClient.Set().Allocation(alloc)
+	if err != nil {
+		return nil, err
+	}
+
+	_ip, _podIP, _ := net.ParseCIDR(podIP)
+	_podIP.IP = _ip
+	return &types.IPConfig{
+		Interface: types.Int(0),
+		Address:   *_podIP,
+		Gateway:   _gw,
+	}, nil
+}
+
+// ipv6 的转发得整个打开, 并且 ip6tables 里也得放开, ipv4 的在创建网桥的时候已经放开了
+func setUpFamilyForwarding(ipamClient *ipam.IpamService, link netlink.Link) error {
+	if !ipamClient.IsIPv6() {
+		return nil
+	}
+	err := nettools.SetUpIPv6Forwarding()
+	if err != nil {
+		return err
+	}
+	return nettools.SetIp6tablesForToForwardAccept(link)
+}
+
+// 默认的池子和每个具名的池子都来一遍 setOtherHostRoutes
+func setAllPoolRoutes(pluginConfig *cni.PluginConf) error {
+	pools := append([]string{ipam.DEFAULT_POOL_NAME}, cni.GetPoolNames(pluginConfig)...)
+	for _, pool := range pools {
+		ipamClient, secondaryClient, err := initPool(pluginConfig, pool)
+		if err != nil {
+			return err
+		}
+		err = setOtherHostRoutes(ipamClient)
+		if err != nil {
+			return err
+		}
+		if secondaryClient != nil {
+			err = setOtherHostRoutes(secondaryClient)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 把其他节点上的 pods 的 cidr 和其主机的网卡 ip 作为一条路由规则创建到当前主机上, 双栈的时候每个地址族都要来一遍
+func setOtherHostRoutes(ipamClient *ipam.IpamService) error {
 	// 首先通过 ipam 获取到 etcd 中存放的集群中所有节点的相关网络信息
 	networks, err := ipamClient.Get().AllHostNetwork()
 	if err != nil {
 		utils.WriteLog("这里的获取所有节点的网络信息失败, err: ", err.Error())
-		return nil, err
+		return err
 	}
 
 	// 然后获取一下本机的网卡信息
 	currentNetwork, err := ipamClient.Get().HostNetwork()
 	if err != nil {
 		utils.WriteLog("获取本机网卡信息失败, err: ", err.Error())
-		return nil, err
+		return err
 	}
 
 	// 这里面要做的就是把其他节点上的 pods 的 cidr 和其主机的网卡 ip 作为一条路由规则创建到当前主机上
 	err = nettools.SetOtherHostRouteToCurrentHost(networks, currentNetwork)
 	if err != nil {
 		utils.WriteLog("给主机添加其他节点网络信息失败, err: ", err.Error())
-		return nil, err
+		return err
 	}
 
 	link, err := netlink.LinkByName(currentNetwork.Name)
 	if err != nil {
 		utils.WriteLog("获取本机网卡失败, err: ", err.Error())
-		return nil, err
+		return err
+	}
+	if ipamClient.IsIPv6() {
+		err = setUpFamilyForwarding(ipamClient, link)
+	} else {
+		err = nettools.SetIptablesForDeviceToFarwordAccept(link.(*netlink.Device))
 	}
-	err = nettools.SetIptablesForDeviceToFarwordAccept(link.(*netlink.Device))
 	if err != nil {
 		utils.WriteLog("设置本机网卡转发规则失败")
-		return nil, err
-	}
-
-	_gw := net.ParseIP(gateway)
-
-	_, _podIP, _ := net.ParseCIDR(podIP)
-
-	result := &types.Result{
-		CNIVersion: pluginConfig.CNIVersion,
-		IPs: []*types.IPConfig{
-			{
-				Address: *_podIP,
-				Gateway: _gw,
-			},
-		},
+		return err
 	}
-	return result, nil
+	return nil
 }
 
+/**
+ * 卸载的时候主要干两件事儿:
+ *		1. 把 pod(netns) 中的 veth 删掉, 留在主机上挂在网桥上的另一半会跟着一起没了
+ *		2. 把这个 pod 占着的 ip 还给 ipam
+ * 要删的东西优先从 ADD 时留下的分配记录里找, 这样 netns 已经没了也能清理干净
+ * kubelet 可能会对同一个 pod 调用好几次 StopPodSandbox
+ * 所以这里 netns 已经没了或者 ip 压根儿就没分配过的情况都要直接返回 nil
+ * 否则 kubelet 会一直重试
+ */
 func (hostGW *HostGatewayCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
+	ipamClient, secondaryClient, err := initIpamOfAllocation(args, pluginConfig)
+	if err != nil {
+		utils.WriteLog("创建 ipam 客户端出错, err: ", err.Error())
+		return err
+	}
+
+	alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+	if err != nil {
+		utils.WriteLog("获取分配记录失败, err: ", err.Error())
+		return err
+	}
+	podIP := ""
+	hostVethName := ""
+	if alloc != nil {
+		podIP = alloc.IP
+		hostVethName = alloc.HostIfName
+	}
+
+	netnsExist := false
+	if args.Netns != "" {
+		netns, err := ns.GetNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			netnsExist = true
+			_podIP, _hostVethName, err := nettools.DelVethInNs(netns, args.IfName)
+			if err != nil {
+				utils.WriteLog("删除 pod 中的 veth 失败, err: ", err.Error())
+				return err
+			}
+			utils.WriteLog("删除了 pod 的 veth, podIP: ", _podIP, " hostVeth: ", _hostVethName)
+			if podIP == "" {
+				podIP = _podIP
+			}
+		} else if !nettools.IsNsNotExistErr(err) {
+			utils.WriteLog("获取 ns 失败: ", err.Error())
+			return err
+		}
+	}
+
+	// netns 没了的话 veth 一般也跟着没了, 这里按记录里的名字再确认一下
+	if !netnsExist && hostVethName != "" {
+		err = nettools.DelHostVeth(hostVethName)
+		if err != nil {
+			utils.WriteLog("删除主机上的 veth ", hostVethName, " 失败, err: ", err.Error())
+			return err
+		}
+	}
+
+	if alloc != nil {
+		_, err = ipamClient.Release().Allocation(args.ContainerID, args.IfName)
+	} else if podIP != "" {
+		// 老版本分配的 ip 没有分配记录, 只能按 pod 网卡上的 ip 去释放
+		err = ipamClient.Release().IPs(podIP)
+	}
+	if err != nil {
+		utils.WriteLog("释放 podIP ", podIP, " 失败: ", err.Error())
+		return err
+	}
+
+	// 多占的网段被还回去了的话, 网桥上这个网段的网关也得摘掉, 免得和之后占了这个网段的节点冲突
+	if alloc != nil && alloc.Network != "" {
+		releaseBridgeGateway(ipamClient, getBridgeName(pluginConfig), alloc.Network)
+	}
+
+	// 双栈的时候另一个地址族的 ip 是单独一条分配记录
+	if secondaryClient != nil {
+		secondaryAlloc, err := secondaryClient.Release().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			utils.WriteLog("释放另一个地址族的 podIP 失败: ", err.Error())
+			return err
+		}
+		if secondaryAlloc != nil && secondaryAlloc.Network != "" {
+			releaseBridgeGateway(secondaryClient, getBridgeName(pluginConfig), secondaryAlloc.Network)
+		}
+	}
 	return nil
 }
 
+func releaseBridgeGateway(ipamClient *ipam.IpamService, bridgeName, network string) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	networks, err := ipamClient.Get().HostBlocks(hostname)
+	if err != nil {
+		utils.WriteLog("获取当前主机的网段失败, err: ", err.Error())
+		return
+	}
+	for _, n := range networks {
+		if n == network {
+			return
+		}
+	}
+	gateway, err := ipamClient.Get().GatewayOf(network)
+	if err != nil {
+		return
+	}
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return
+	}
+	err = nettools.DelAddrIfExist(br, gateway)
+	if err != nil {
+		utils.WriteLog("从网桥上删除网关 ", gateway, " 失败, err: ", err.Error())
+	}
+}
+
+/**
+ * 拿 ADD 时返回的结果和当前实际的网络做对比:
+ *		1. pod 中的网卡, ip 以及路由
+ *		2. 主机上的网桥得在, 并且得有网关的 ip
+ *		3. pod 的 veth 留在主机上的那头得挂在这个网桥上
+ *		4. ipam 中的分配记录得和上边这些对得上
+ */
 func (hostGW *HostGatewayCNI) Check(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
+	result, err := cni.GetPrevResult(pluginConfig)
+	if err != nil {
+		utils.WriteLog("获取 prevResult 失败, err: ", err.Error())
+		return cni.NewCheckError("failed to parse prevResult", err.Error())
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		utils.WriteLog("获取 ns 失败: ", err.Error())
+		return cni.NewCheckError(fmt.Sprintf("netns %q not found", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	ips := cni.GetIPConfigsOfInterface(result, args.IfName)
+	err = nettools.CheckPodInterface(netns, args.IfName, ips, result.Routes)
+	if err != nil {
+		utils.WriteLog("检查 pod 中的网卡失败, err: ", err.Error())
+		return cni.NewCheckError("pod interface drifted", err.Error())
+	}
+
+	bridgeName := getBridgeName(pluginConfig)
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return cni.NewCheckError(fmt.Sprintf("bridge %q not found", bridgeName), err.Error())
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return cni.NewCheckError(fmt.Sprintf("device %q is not a bridge", bridgeName), br.Type())
+	}
+	for _, ipc := range ips {
+		if ipc.Gateway == nil {
+			continue
+		}
+		// 网桥上可能绑着好几个网段的网关, 有这个 pod 的网关就行
+		exist, err := nettools.DeviceHasIP(br, ipc.Gateway.String())
+		if err != nil {
+			return cni.NewCheckError(fmt.Sprintf("failed to get address of bridge %q", bridgeName), err.Error())
+		}
+		if !exist {
+			return cni.NewCheckError(
+				fmt.Sprintf("gateway of bridge %q drifted", bridgeName),
+				fmt.Sprintf("expected %s on the bridge", ipc.Gateway.String()),
+			)
+		}
+	}
+
+	_, hostVethName, err := nettools.GetVethInfoInNs(netns, args.IfName)
+	if err != nil {
+		return cni.NewCheckError("failed to get host veth of pod", err.Error())
+	}
+	if hostVethName == "" {
+		return cni.NewCheckError(fmt.Sprintf("host veth of %q not found", args.IfName))
+	}
+
+	// ADD 时留下的分配记录得和现在的网络对得上, 双栈的时候两个地址族的都得对得上
+	ipamClient, secondaryClient, err := initIpamOfAllocation(args, pluginConfig)
+	if err != nil {
+		return cni.NewCheckError("failed to init ipam", err.Error())
+	}
+	ipamClients := []*ipam.IpamService{ipamClient}
+	if secondaryClient != nil {
+		ipamClients = append(ipamClients, secondaryClient)
+	}
+	for _, client := range ipamClients {
+		alloc, err := client.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			return cni.NewCheckError("failed to get allocation record", err.Error())
+		}
+		if alloc == nil {
+			return cni.NewCheckError(fmt.Sprintf("allocation record of %s/%s not found", args.ContainerID, args.IfName))
+		}
+		if checkErr := cni.CheckAllocatedIP(ips, alloc.IP); checkErr != nil {
+			return checkErr
+		}
+		if alloc.HostIfName != "" && alloc.HostIfName != hostVethName {
+			return cni.NewCheckError(
+				"host veth drifted",
+				fmt.Sprintf("allocation record has %q, but pod is connected to %q", alloc.HostIfName, hostVethName),
+			)
+		}
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return cni.NewCheckError(fmt.Sprintf("host veth %q not found", hostVethName), err.Error())
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return cni.NewCheckError(fmt.Sprintf("host veth %q is not attached to bridge %q", hostVethName, bridgeName))
+	}
 	return nil
 }
 
@@ -1,14 +1,49 @@
 package bird
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
+	"syscall"
 	"testcni/consts"
 	"testcni/utils"
 )
 
+/**
+ * 从 KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH 中读出 bird 的 pid, 然后看这个 pid 当前是不是真的在运行
+ * 在运行的话返回它的 pid, 否则返回 -1
+ */
+func GetRunningBirdPid() (int, error) {
+	if !utils.PathExists(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH) {
+		return -1, nil
+	}
+	pid, err := utils.ReadContentFromFile(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH)
+	if err != nil {
+		return -1, err
+	}
+	if !utils.FileIsExisted(fmt.Sprintf("/proc/%s", pid)) {
+		return -1, nil
+	}
+	return strconv.Atoi(pid)
+}
+
+/**
+ * 让正在运行的 bird 重新加载配置文件
+ * bird 收到 SIGHUP 之后会重新读配置, 只有配置发生了变化的 protocol 才会重启
+ */
+func ReloadBirdDaemon() error {
+	pid, err := GetRunningBirdPid()
+	if err != nil {
+		return err
+	}
+	if pid <= 0 {
+		return errors.New("bird is not running")
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
 func StartBirdDaemon(configPath string) (int, error) {
 	if !utils.FileIsExisted(configPath) {
 		return -1, fmt.Errorf("the config path %s not exist", configPath)
@@ -16,15 +51,13 @@ func StartBirdDaemon(configPath string) (int, error) {
 
 	// 先看 bird deamon 这个路径是否存在
 	if utils.PathExists(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH) {
-		// 如果该路径存在
-		pid, err := utils.ReadContentFromFile(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH)
+		pid, err := GetRunningBirdPid()
 		if err != nil {
 			return -1, err
 		}
-		// 尝试读出里头的 pid, 然后看这个 pid 当前是不是真的在运行
-		if utils.FileIsExisted(fmt.Sprintf("/proc/%s", pid)) {
+		if pid > 0 {
 			// 说明当前 host 上的 bird 正在运行可以直接返回
-			return strconv.Atoi(pid)
+			return pid, nil
 		} else {
 			// 说明当前 host 上的 bird 已经退出了, 那就删掉这个文件
 			utils.DeleteFile(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH)
@@ -1,12 +1,20 @@
 package bird
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testcni/client"
+	"testcni/consts"
+	"testcni/datastore"
 	"testcni/ipam"
 	"testcni/utils"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
 )
 
 func TestBird(t *testing.T) {
@@ -39,3 +47,81 @@ func TestBird(t *testing.T) {
 	test.Nil(err)
 	fmt.Println("bird 的子进程 pid 是: ", pid)
 }
+
+// 假的 apiserver, 集群里只有本机和 node-2 两个节点
+func startFakeApiserver(hostname string) *httptest.Server {
+	nodes := v1.NodeList{}
+	for name, ip := range map[string]string{hostname: "192.168.64.10", "node-2": "192.168.64.11"} {
+		node := v1.Node{}
+		node.Name = name
+		node.Status.Addresses = []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: name},
+			{Type: v1.NodeInternalIP, Address: ip},
+		}
+		nodes.Items = append(nodes.Items, node)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == consts.KUBE_API+"/nodes" {
+			json.NewEncoder(w).Encode(nodes)
+			return
+		}
+		for _, node := range nodes.Items {
+			if r.URL.Path == consts.KUBE_API+"/nodes/"+node.Name {
+				json.NewEncoder(w).Encode(node)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+// 数据存在内存里, 不依赖真实的集群和 etcd
+func TestBirdConfig(t *testing.T) {
+	test := assert.New(t)
+	hostname, err := os.Hostname()
+	test.Nil(err)
+	server := startFakeApiserver(hostname)
+	defer server.Close()
+
+	clear := ipam.InitWithName("bird-test", "10.244.0.0/16", &ipam.IPAMOptions{
+		Datastore: datastore.NewMemoryDatastore(),
+		K8sClient: client.NewLightK8sClient(server.URL, server.Client()),
+	})
+	defer clear()
+	is, err := ipam.GetIpamServiceByName("bird-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := getBirdConfig(is)
+	test.Nil(err)
+	test.Equal("192.168.64.10", config.HostIP)
+	test.Equal(is.CurrentHostNetwork+"/24", config.HostCIDR)
+	test.Equal([]string{config.HostCIDR}, config.HostCIDRs)
+	test.Equal("10.244.0.0/16", config.Subnet)
+	test.Equal([]BgpNeighbor{{Name: "Mesh_192_168_64_11", IP: "192.168.64.11", Hostname: "node-2"}}, config.Neighbors)
+
+	// 具名的 ip 池占着的网段和池子的网段也都要写到配置里, 节点的 ip 和邻居还是以默认的池子为准
+	clearPool := ipam.InitWithName("bird-test-pool", "192.168.100.0/24", &ipam.IPAMOptions{
+		Datastore:        datastore.NewMemoryDatastore(),
+		K8sClient:        client.NewLightK8sClient(server.URL, server.Client()),
+		BlockMaskSegment: "28",
+	})
+	defer clearPool()
+	pool, err := ipam.GetIpamServiceByName("bird-test-pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = getBirdConfig(is, pool)
+	test.Nil(err)
+	test.Equal(is.CurrentHostNetwork+"/24", config.HostCIDR)
+	test.Equal([]string{config.HostCIDR, pool.CurrentHostNetwork + "/28"}, config.HostCIDRs)
+	test.Equal("10.244.0.0/16", config.Subnet)
+	test.Equal([]string{"10.244.0.0/16", "192.168.100.0/24"}, config.Subnets)
+	test.Equal("192.168.64.10", config.HostIP)
+
+	content, err := GenConfig(is, pool)
+	test.Nil(err)
+	test.Contains(content, "route "+pool.CurrentHostNetwork+"/28 blackhole;")
+	test.Contains(content, "if ( net ~ 192.168.100.0/24 ) then {\n    krt_tunnel = \"tunl0\";")
+}
@@ -21,9 +21,18 @@ type BirdConfig struct {
 	Subnet     string
 	VethPrefix string
 	Neighbors  []BgpNeighbor
+
+	// 当前主机占着的所有网段, 第一个和 HostCIDR 是一样的, 具名的 ip 池占着的也在里头
+	HostCIDRs []string
+	// 所有池子的网段, 第一个和 Subnet 是一样的
+	Subnets []string
 }
 
-func getBirdConfig(is *ipam.IpamService) (*BirdConfig, error) {
+/**
+ * is 是默认的池子, 节点的 ip, 邻居以及 tunl0 的网段都以它为准
+ * pools 是具名的 ip 池, 本机在这些池子里占着的网段以及池子的网段也都要写到配置里
+ */
+func getBirdConfig(is *ipam.IpamService, pools ...*ipam.IpamService) (*BirdConfig, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
@@ -33,6 +42,11 @@ func getBirdConfig(is *ipam.IpamService) (*BirdConfig, error) {
 		return nil, err
 	}
 
+	cidrs, err := is.Get().CIDRs(hostname)
+	if err != nil {
+		return nil, err
+	}
+
 	nodeIP, err := is.Get().NodeIp(hostname)
 	if err != nil {
 		return nil, err
@@ -48,10 +62,26 @@ func getBirdConfig(is *ipam.IpamService) (*BirdConfig, error) {
 		return nil, err
 	}
 
+	subnets := []string{subnet}
+	for _, pool := range pools {
+		poolCIDRs, err := pool.Get().CIDRs(hostname)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, poolCIDRs...)
+		poolSubnet, err := pool.Get().CurrentSubnet()
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, poolSubnet)
+	}
+
 	tmp := BirdConfig{
 		HostIP:     nodeIP,
 		HostCIDR:   cidr,
+		HostCIDRs:  cidrs,
 		Subnet:     subnet,
+		Subnets:    subnets,
 		VethPrefix: "veth",
 	}
 
@@ -70,8 +100,8 @@ func getBirdConfig(is *ipam.IpamService) (*BirdConfig, error) {
 	return &tmp, nil
 }
 
-func GenConfig(is *ipam.IpamService) (string, error) {
-	config, err := getBirdConfig(is)
+func GenConfig(is *ipam.IpamService, pools ...*ipam.IpamService) (string, error) {
+	config, err := getBirdConfig(is, pools...)
 	if err != nil {
 		return "", err
 	}
@@ -87,39 +117,62 @@ func GenConfig(is *ipam.IpamService) (string, error) {
 	return buf.String(), nil
 }
 
-func GenConfigFile(is *ipam.IpamService) error {
-	config, err := GenConfig(is)
+func GenConfigFile(is *ipam.IpamService, pools ...*ipam.IpamService) error {
+	_, err := UpdateConfigFile(is, pools...)
+	return err
+}
+
+/**
+ * 重新生成 bird 的配置文件, 返回值表示配置文件的内容有没有发生变化
+ * 比如当前主机又多占了一个网段的时候就会变, 这时候正在跑的 bird 需要重新加载配置
+ */
+func UpdateConfigFile(is *ipam.IpamService, pools ...*ipam.IpamService) (bool, error) {
+	config, err := GenConfig(is, pools...)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if utils.FileIsExisted("/opt/testcni/bird.cfg") {
+		prev, err := utils.ReadContentFromFile("/opt/testcni/bird.cfg")
+		if err == nil && prev == config {
+			return false, nil
+		}
 	}
-	return utils.CreateFile("/opt/testcni/bird.cfg", ([]byte)(config), 0766)
+	return true, utils.CreateFile("/opt/testcni/bird.cfg", ([]byte)(config), 0766)
 }
 
 var cfgTpl = `
 router id {{.HostIP}};
 
 protocol static {
-  route {{.HostCIDR}} blackhole;
+{{- range .HostCIDRs}}
+  route {{.}} blackhole;
+{{- end}}
 }
 
 function calico_aggr() {
-  if ( net = {{.HostCIDR}} ) then { accept; }
-  if ( net ~ {{.HostCIDR}} ) then { reject; }
+{{- range .HostCIDRs}}
+  if ( net = {{.}} ) then { accept; }
+  if ( net ~ {{.}} ) then { reject; }
+{{- end}}
 }
 
 filter calico_export_to_bgp_peers {
   calico_aggr();
-  if ( net ~ {{.Subnet}} ) then {
+{{- range .Subnets}}
+  if ( net ~ {{.}} ) then {
     accept;
   }
+{{- end}}
   reject;
 }
 
 filter calico_kernel_programming {
-  if ( net ~ {{.Subnet}} ) then {
+{{- range .Subnets}}
+  if ( net ~ {{.}} ) then {
     krt_tunnel = "tunl0";
     accept;
   }
+{{- end}}
   accept;
 }
 
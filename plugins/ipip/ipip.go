@@ -14,6 +14,7 @@ import (
 	"testcni/skel"
 	"testcni/utils"
 
+	cniTypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
@@ -22,16 +23,100 @@ import (
 const MODE = consts.MODE_IPIP
 const DEFAULT_POST_GW = "169.254.1.1/32"
 
+// ipv6 的 pod 的网关, 会绑在主机上那半拉 veth 上, 每块儿 veth 都是单独的一条链路, 所以都用同一个也不冲突
+const DEFAULT_POST_GW_V6 = "fe80::1/64"
+
 type IpipCNI struct{}
 
-func initEveryClient(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, error) {
-	ipam.Init(pluginConfig.Subnet, nil)
-	ipam, err := ipam.GetIpamService()
+/**
+ * 双栈的时候第二个返回值是 ipv6 的 ipam, 单栈的时候是 nil
+ * tunl0 只能装 ipv4 的包, 所以第一个网段必须是 ipv4 的
+ * ipv6 的包不走隧道, 直接按路由发到对端节点的 ipv6 地址上, 节点之间的 ipv6 网络得是通的
+ * 配置了具名的 ip 池的话按 pod 和它所在的 namespace 上的注解挑一个池子
+ */
+func initIpam(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, *ipam.IpamService, error) {
+	pool, err := ipam.PoolOfPod(
+		cni.GetCNIArg(args, "K8S_POD_NAMESPACE"),
+		cni.GetCNIArg(args, "K8S_POD_NAME"),
+		cni.GetPoolNames(pluginConfig),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return initPool(pluginConfig, pool)
+}
+
+// 具名的池子和默认的池子一样, 第一个网段也必须是 ipv4 的
+func initPool(pluginConfig *cni.PluginConf, pool string) (*ipam.IpamService, *ipam.IpamService, error) {
+	err := cni.CheckBuiltinIPAM(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cni.CheckPools(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, err
+	}
+	poolConfig, err := cni.GetPoolConfig(pluginConfig, pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	subnets, err := cni.GetSubnets(poolConfig)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("初始化 ipam 客户端失败: %s", err.Error()))
+		return nil, nil, err
 	}
+	if strings.Contains(subnets[0], ":") {
+		return nil, nil, fmt.Errorf("the first subnet must be ipv4 in the %s mode", MODE)
+	}
+	ipam.InitPool(pool, subnets, ipam.OptionsFromCNI(poolConfig))
+	_ipam, secondary, err := ipam.GetPoolServices(pool)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("初始化 ipam 客户端失败: %s", err.Error()))
+	}
+
+	return _ipam, secondary, nil
+}
 
-	return ipam, nil
+/**
+ * DEL 和 CHECK 的时候 pod 可能已经被删了, 读不到注解
+ * 所以挨个具名的池子去找这块儿网卡的分配记录, 都没有的话就是默认的池子
+ */
+func initIpamOfAllocation(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, *ipam.IpamService, error) {
+	for _, pool := range cni.GetPoolNames(pluginConfig) {
+		ipamClient, secondaryClient, err := initPool(pluginConfig, pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if alloc != nil {
+			return ipamClient, secondaryClient, nil
+		}
+	}
+	return initPool(pluginConfig, ipam.DEFAULT_POOL_NAME)
+}
+
+/**
+ * 默认的池子和每个具名的池子的 ipam, 第一个是默认的池子
+ * 第二个返回值是双栈的池子的 ipv6 的 ipam
+ * bird 要把本机在所有池子里占着的网段都通告出去, 其他节点在所有池子里的 ipv6 网段也都得有路由
+ */
+func initAllPools(pluginConfig *cni.PluginConf) ([]*ipam.IpamService, []*ipam.IpamService, error) {
+	clients := []*ipam.IpamService{}
+	secondaryClients := []*ipam.IpamService{}
+	pools := append([]string{ipam.DEFAULT_POOL_NAME}, cni.GetPoolNames(pluginConfig)...)
+	for _, pool := range pools {
+		ipamClient, secondaryClient, err := initPool(pluginConfig, pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		clients = append(clients, ipamClient)
+		if secondaryClient != nil {
+			secondaryClients = append(secondaryClients, secondaryClient)
+		}
+	}
+	return clients, secondaryClients, nil
 }
 
 func setFibTalbeIntoNs(gw string, veth *netlink.Veth) error {
@@ -211,17 +296,50 @@ func (ipip *IpipCNI) Bootstrap(
 	pluginConfig *cni.PluginConf,
 ) (*types.Result, error) {
 	// 初始化 ipam
-	ipamClient, err := initEveryClient(args, pluginConfig)
+	ipamClient, secondaryClient, err := initIpam(args, pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// pod 通过 runtimeConfig 或者 CNI_ARGS 指定了 ip 的话就只分指定的 ip
+	requestedIPs, err := cni.GetRequestedIPs(args, pluginConfig)
 	if err != nil {
+		utils.WriteLog("解析 pod 指定的 ip 出错, err: ", err.Error())
 		return nil, err
 	}
+	err = ipam.CheckRequestedIPs(requestedIPs, ipamClient, secondaryClient)
+	if err != nil {
+		utils.WriteLog("pod 指定的 ip 不能用, err: ", err.Error())
+		return nil, cni.NewRequestedIPError(err.Error())
+	}
 
-	// 从 ipam 中拿到一个未使用的 ip 地址
-	podIP, err := ipamClient.Get().UnusedIP()
+	// 从 ipam 中给这个容器的这块儿网卡分配一个未使用的 ip 地址
+	alloc, err := ipamClient.Get().AllocateIP(args.ContainerID, args.IfName, MODE, requestedIPs...)
 	if err != nil {
 		utils.WriteLog("获取 podIP 出错, err: ", err.Error())
+		if ipam.IsRequestedIPError(err) {
+			return nil, cni.NewRequestedIPError(err.Error())
+		}
 		return nil, err
 	}
+	podIP := alloc.IP
+
+	/**
+	 * 走到这儿的话说明这个 podIP 已经在存储中占上坑位了, 后边不管哪一步出错了, 都按 DEL 的流程把已经做了的撤掉:
+	 * 删掉主机上的路由和 FORWARD 规则, 删掉 veth, 两个地址族的 ip 都还回去
+	 * tunl0 和 bird 是整个节点共用的, 不用撤
+	 * 不然 runtime 看到 ADD 失败不会再调 DEL, ip 和 veth 就一直泄露着
+	 */
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		rollbackErr := ipip.Unmount(args, pluginConfig)
+		if rollbackErr != nil {
+			utils.WriteLog("ADD 失败之后回滚失败, podIP: ", podIP, ", err: ", rollbackErr.Error())
+		}
+	}()
 
 	// calico 内部的 pod 的 ip 都是 32 掩码的
 	podIP = podIP + "/" + "32"
@@ -264,53 +382,474 @@ func (ipip *IpipCNI) Bootstrap(
 		return nil, err
 	}
 
+	// pod 不管是哪个池子的, tunl0 的 ip 都是从默认的池子里来的, bird 也得把所有池子的网段都通告出去
+	poolClients, secondaryPoolClients, err := initAllPools(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	// 给 tunnel 设备设置 ip
-	tunlCIDR, err := setIpForIpip(ipamClient, iptunl)
+	tunlCIDR, err := setIpForIpip(poolClients[0], iptunl)
 	if err != nil {
 		return nil, err
 	}
 
 	// 创建 bgp 协议需要的 bird config
-	err = bird.GenConfigFile(ipamClient)
+	// 当前主机新占了网段的话配置文件会发生变化
+	configChanged, err := bird.UpdateConfigFile(poolClients[0], poolClients[1:]...)
 	if err != nil {
 		return nil, err
 	}
 
 	// 启动 bird
-	_, err = bird.StartBirdDaemon(consts.KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH)
+	pid, err := bird.StartBirdDaemon(consts.KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH)
 	if err != nil {
 		return nil, err
 	}
+	if configChanged && pid > 0 {
+		// bird 已经在跑了的话要让它把新的网段通告出去
+		err = bird.ReloadBirdDaemon()
+		if err != nil {
+			utils.WriteLog("bird 重新加载配置失败: ", err.Error())
+		}
+	}
 
 	// 获取网关地址和 podIP 准备返回给外边
 	tunlIP := strings.Split(tunlCIDR, "/")[0]
 	_gw := net.ParseIP(tunlIP)
-	_, _podIP, _ := net.ParseCIDR(podIP)
+
+	// 把网关和主机上那半拉 veth 的名字补到分配记录里
+	alloc.Gateway = tunlIP
+	alloc.HostIfName = hostVeth.Attrs().Name
+	err = ipamClient.Set().Allocation(alloc)
+	if err != nil {
+		return nil, err
+	}
+	_ip, _podIP, _ := net.ParseCIDR(podIP)
+	_podIP.IP = _ip
+	_postGw, _postGwNet, _ := net.ParseCIDR(DEFAULT_POST_GW)
+	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
 	result := &types.Result{
 		CNIVersion: pluginConfig.CNIVersion,
+		Interfaces: []*types.Interface{
+			{
+				Name:    args.IfName,
+				Sandbox: args.Netns,
+			},
+		},
 		IPs: []*types.IPConfig{
 			{
-				Address: *_podIP,
-				Gateway: _gw,
+				Interface: types.Int(0),
+				Address:   *_podIP,
+				Gateway:   _gw,
 			},
 		},
+		// 和 setFibTalbeIntoNs 中设置的那两条路由一致
+		Routes: []*cniTypes.Route{
+			{
+				Dst: *_postGwNet,
+			},
+			{
+				Dst: *defNet,
+				GW:  _postGw,
+			},
+		},
+	}
+
+	// 双栈的时候再给 pod 配一个 ipv6 的地址
+	if secondaryClient != nil {
+		ipConfig, err := setUpIPv6Network(secondaryClient, secondaryPoolClients, args, requestedIPs, netns, hostVeth)
+		if err != nil {
+			utils.WriteLog("给 pod 配置 ipv6 地址失败, err: ", err.Error())
+			if ipam.IsRequestedIPError(err) {
+				return nil, cni.NewRequestedIPError(err.Error())
+			}
+			return nil, err
+		}
+		result.IPs = append(result.IPs, ipConfig)
+		result.Routes = append(result.Routes, &cniTypes.Route{
+			Dst: *nettools.DefaultRouteDst(ipConfig.Gateway),
+			GW:  ipConfig.Gateway,
+		})
 	}
+	succeeded = true
 	return result, nil
 }
 
+/**
+ * 双栈的时候给 pod 配上 ipv6 的地址:
+ *		1. 从 ipv6 的 ipam 里分一个 ip, 和 ipv4 一样是 /128 的
+ *		2. 主机上那半拉 veth 绑上 fe80::1 当网关, pod 里加一条走它的默认路由
+ *		3. 主机上加一条 podIP/128 → host veth 的路由
+ *		4. 其他节点的 ipv6 网段直接走对端节点的 ipv6 地址, 不走 tunl0, 每个池子的 ipv6 网段都要
+ * 返回的是要放到结果里的那一项 ip
+ */
+func setUpIPv6Network(
+	ipamClient *ipam.IpamService,
+	poolClients []*ipam.IpamService,
+	args *skel.CmdArgs,
+	requestedIPs []string,
+	netns ns.NetNS,
+	hostVeth *netlink.Veth,
+) (*types.IPConfig, error) {
+	alloc, err := ipamClient.Get().AllocateIP(args.ContainerID, args.IfName, MODE, requestedIPs...)
+	if err != nil {
+		return nil, err
+	}
+	podIP := alloc.IP + "/128"
+
+	_hostVeth, err := netlink.LinkByName(hostVeth.Attrs().Name)
+	if err != nil {
+		return nil, err
+	}
+	_gw, _, _ := net.ParseCIDR(DEFAULT_POST_GW_V6)
+	exist, err := nettools.DeviceHasIP(_hostVeth, _gw.String())
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		err = nettools.SetIpForVeth(_hostVeth.Attrs().Name, DEFAULT_POST_GW_V6)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = nettools.AddPodAddressAndDefaultRoute(netns, args.IfName, podIP, _gw)
+	if err != nil {
+		return nil, err
+	}
+
+	_ip, _podIP, _ := net.ParseCIDR(podIP)
+	_podIP.IP = _ip
+	err = nettools.AddRoute(_podIP, nil, _hostVeth, netlink.SCOPE_LINK)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	err = nettools.SetUpIPv6Forwarding()
+	if err != nil {
+		return nil, err
+	}
+	err = nettools.SetIp6tablesForToForwardAccept(_hostVeth)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, poolClient := range poolClients {
+		networks, err := poolClient.Get().AllHostNetwork()
+		if err != nil {
+			return nil, err
+		}
+		currentNetwork, err := poolClient.Get().HostNetwork()
+		if err != nil {
+			return nil, err
+		}
+		err = nettools.SetOtherHostRouteToCurrentHost(networks, currentNetwork)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	alloc.Gateway = _gw.String()
+	alloc.HostIfName = _hostVeth.Attrs().Name
+	err = ipamClient.Set().Allocation(alloc)
+	if err != nil {
+		return nil, err
+	}
+	return &types.IPConfig{
+		Interface: types.Int(0),
+		Address:   *_podIP,
+		Gateway:   _gw,
+	}, nil
+}
+
+// pod 的 ip 在主机上的路由都是单个地址的, ipv4 是 /32, ipv6 是 /128
+func podHostRoute(podIP string) (*net.IPNet, error) {
+	mask := "/32"
+	if strings.Contains(podIP, ":") {
+		mask = "/128"
+	}
+	_, podNet, err := net.ParseCIDR(podIP + mask)
+	return podNet, err
+}
+
+func delLocalFibTable(podIP string, hostVethName string) error {
+	podNet, err := podHostRoute(podIP)
+	if err != nil {
+		return err
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		if nettools.IsLinkNotFoundErr(err) {
+			return nil
+		}
+		return err
+	}
+	return nettools.DelRoute(podNet, hostVeth)
+}
+
+/**
+ * 卸载的时候要把 Bootstrap 时干的事儿反着来一遍:
+ *		1. 删掉主机上那条 podIP/32 → host veth 的路由
+ *		2. 删掉这个 host veth 对应的 FORWARD ACCEPT 规则
+ *		3. 删掉 veth pair(proxy_arp 和 forwarding 是挂在设备上的, 跟着一起没了)
+ *		4. 把 ip 还给 ipam
+ * pod ip 和主机上的 veth 优先从 ADD 时留下的分配记录里找, 这样 netns 已经没了也能清理干净
+ * tunl0 和 bird 是整个节点共用的, 不能删
+ */
 func (ipip *IpipCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
+	ipamClient, secondaryClient, err := initIpamOfAllocation(args, pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+	if err != nil {
+		utils.WriteLog("获取分配记录失败, err: ", err.Error())
+		return err
+	}
+	podIP := ""
+	hostVethName := ""
+	if alloc != nil {
+		podIP = alloc.IP
+		hostVethName = alloc.HostIfName
+	}
+
+	var netns ns.NetNS
+	if args.Netns != "" {
+		netns, err = ns.GetNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			_podIP, _hostVethName, err := nettools.GetVethInfoInNs(netns, args.IfName)
+			if err != nil {
+				utils.WriteLog("获取 pod 中的 veth 信息失败, err: ", err.Error())
+				return err
+			}
+			if podIP == "" {
+				podIP = _podIP
+			}
+			if hostVethName == "" {
+				hostVethName = _hostVethName
+			}
+		} else if nettools.IsNsNotExistErr(err) {
+			netns = nil
+		} else {
+			utils.WriteLog("获取 ns 失败: ", err.Error())
+			return err
+		}
+	}
+
+	// 双栈的时候 ipv6 的地址是单独的一条分配记录
+	var secondaryAlloc *ipam.Allocation
+	if secondaryClient != nil {
+		secondaryAlloc, err = secondaryClient.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			utils.WriteLog("获取 ipv6 的分配记录失败, err: ", err.Error())
+			return err
+		}
+	}
+
+	if hostVethName != "" {
+		if podIP != "" {
+			err = delLocalFibTable(podIP, hostVethName)
+			if err != nil {
+				utils.WriteLog("删除 pod 的路由失败, err: ", err.Error())
+				return err
+			}
+		}
+		err = nettools.DelIptablesForToForwardAccept(hostVethName)
+		if err != nil {
+			return err
+		}
+		if secondaryAlloc != nil {
+			err = delLocalFibTable(secondaryAlloc.IP, hostVethName)
+			if err != nil {
+				utils.WriteLog("删除 pod 的 ipv6 路由失败, err: ", err.Error())
+				return err
+			}
+			err = nettools.DelIp6tablesForToForwardAccept(hostVethName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if netns != nil {
+		_, _, err = nettools.DelVethInNs(netns, args.IfName)
+		if err != nil {
+			utils.WriteLog("删除 pod 中的 veth 失败, err: ", err.Error())
+			return err
+		}
+	} else if hostVethName != "" {
+		err = nettools.DelHostVeth(hostVethName)
+		if err != nil {
+			utils.WriteLog("删除主机上的 veth ", hostVethName, " 失败, err: ", err.Error())
+			return err
+		}
+	}
+
+	if alloc != nil {
+		_, err = ipamClient.Release().Allocation(args.ContainerID, args.IfName)
+	} else if podIP != "" {
+		err = ipamClient.Release().IPs(podIP)
+	}
+	if err != nil {
+		utils.WriteLog("释放 podIP ", podIP, " 失败: ", err.Error())
+		return err
+	}
+	if secondaryAlloc != nil {
+		_, err = secondaryClient.Release().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			utils.WriteLog("释放 ipv6 的 podIP ", secondaryAlloc.IP, " 失败: ", err.Error())
+			return err
+		}
+	}
 	return nil
 }
 
+// 检查主机上是不是还有 podIP/32(ipv6 的话是 /128) → 主机上那半拉 veth 的路由
+func checkLocalFibTable(podIP string, hostVeth netlink.Link) error {
+	podNet, err := podHostRoute(podIP)
+	if err != nil {
+		return err
+	}
+	routes, err := netlink.RouteListFiltered(
+		netlink.FAMILY_ALL,
+		&netlink.Route{Dst: podNet, LinkIndex: hostVeth.Attrs().Index},
+		netlink.RT_FILTER_DST|netlink.RT_FILTER_OIF,
+	)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("route %s dev %s not found on host", podNet.String(), hostVeth.Attrs().Name)
+	}
+	return nil
+}
+
+// 主机上的 veth 对应的 FORWARD ACCEPT 规则得在, 不然 pod 的流量出不去
+func checkForwardAccept(hostVethName string, has func(string) (bool, error)) error {
+	ok, err := has(hostVethName)
+	if err != nil {
+		return cni.NewCheckError("failed to list FORWARD rules", err.Error())
+	}
+	if !ok {
+		return cni.NewCheckError(fmt.Sprintf("FORWARD ACCEPT rule of host veth %q not found", hostVethName))
+	}
+	return nil
+}
+
+/**
+ * 拿 ADD 时返回的结果和当前实际的网络做对比:
+ *		1. pod 中的网卡, ip 以及路由
+ *		2. 主机上得有 podIP/32 到那半拉 veth 的路由, 以及放开这半拉 veth 转发的 FORWARD 规则
+ *		3. tunl0 得在, 并且得是 up 的
+ *		4. bird 得还活着, 不然其他节点就学不到本节点的路由了
+ *		5. ipam 中的分配记录得和上边这些对得上
+ */
 func (ipip *IpipCNI) Check(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
+	result, err := cni.GetPrevResult(pluginConfig)
+	if err != nil {
+		utils.WriteLog("获取 prevResult 失败, err: ", err.Error())
+		return cni.NewCheckError("failed to parse prevResult", err.Error())
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		utils.WriteLog("获取 ns 失败: ", err.Error())
+		return cni.NewCheckError(fmt.Sprintf("netns %q not found", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	ips := cni.GetIPConfigsOfInterface(result, args.IfName)
+	err = nettools.CheckPodInterface(netns, args.IfName, ips, result.Routes)
+	if err != nil {
+		utils.WriteLog("检查 pod 中的网卡失败, err: ", err.Error())
+		return cni.NewCheckError("pod interface drifted", err.Error())
+	}
+
+	podIP, hostVethName, err := nettools.GetVethInfoInNs(netns, args.IfName)
+	if err != nil {
+		return cni.NewCheckError("failed to get host veth of pod", err.Error())
+	}
+	if hostVethName == "" {
+		return cni.NewCheckError(fmt.Sprintf("host veth of %q not found", args.IfName))
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return cni.NewCheckError(fmt.Sprintf("host veth %q not found", hostVethName), err.Error())
+	}
+	// ADD 时留下的分配记录得和现在的网络对得上
+	ipamClient, secondaryClient, err := initIpamOfAllocation(args, pluginConfig)
+	if err != nil {
+		return cni.NewCheckError("failed to init ipam", err.Error())
+	}
+	alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+	if err != nil {
+		return cni.NewCheckError("failed to get allocation record", err.Error())
+	}
+	if alloc == nil {
+		return cni.NewCheckError(fmt.Sprintf("allocation record of %s/%s not found", args.ContainerID, args.IfName))
+	}
+	if checkErr := cni.CheckAllocatedIP(ips, alloc.IP); checkErr != nil {
+		return checkErr
+	}
+	if alloc.HostIfName != "" && alloc.HostIfName != hostVethName {
+		return cni.NewCheckError(
+			"host veth drifted",
+			fmt.Sprintf("allocation record has %q, but pod is connected to %q", alloc.HostIfName, hostVethName),
+		)
+	}
+
+	err = checkLocalFibTable(podIP, hostVeth)
+	if err != nil {
+		utils.WriteLog("检查主机路由失败, err: ", err.Error())
+		return cni.NewCheckError("host route of pod drifted", err.Error())
+	}
+	if checkErr := checkForwardAccept(hostVethName, nettools.HasIptablesForToForwardAccept); checkErr != nil {
+		return checkErr
+	}
+
+	// 双栈的时候 ipv6 的分配记录和主机路由也得对得上
+	if secondaryClient != nil {
+		secondaryAlloc, err := secondaryClient.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			return cni.NewCheckError("failed to get allocation record", err.Error())
+		}
+		if secondaryAlloc == nil {
+			return cni.NewCheckError(fmt.Sprintf("ipv6 allocation record of %s/%s not found", args.ContainerID, args.IfName))
+		}
+		if checkErr := cni.CheckAllocatedIP(ips, secondaryAlloc.IP); checkErr != nil {
+			return checkErr
+		}
+		err = checkLocalFibTable(secondaryAlloc.IP, hostVeth)
+		if err != nil {
+			return cni.NewCheckError("host route of pod drifted", err.Error())
+		}
+		if checkErr := checkForwardAccept(hostVethName, nettools.HasIp6tablesForToForwardAccept); checkErr != nil {
+			return checkErr
+		}
+	}
+
+	tunl, err := netlink.LinkByName("tunl0")
+	if err != nil {
+		return cni.NewCheckError("ipip device \"tunl0\" not found", err.Error())
+	}
+	if tunl.Attrs().Flags&net.FlagUp == 0 {
+		return cni.NewCheckError("ipip device \"tunl0\" is down")
+	}
+
+	pid, err := bird.GetRunningBirdPid()
+	if err != nil {
+		return cni.NewCheckError("failed to read pid of bird daemon", err.Error())
+	}
+	if pid < 0 {
+		return cni.NewCheckError("bird daemon is not running")
+	}
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package bpf_map
 
 import (
+	"errors"
 	"testcni/utils"
 	"unsafe"
 
@@ -22,6 +23,23 @@ func (mm *MapsManager) DeleteAllPodMap() (int, error) {
 	return BatchDelKey(m, keys)
 }
 
+// 拿到 pod map 中所有的 key, 也就是集群中其他节点上的 pod ip
+func (mm *MapsManager) AllPodMapKeys() ([]PodNodeMapKey, error) {
+	m := mm.GetPodMap()
+	if m == nil {
+		return nil, errors.New("pod map not found")
+	}
+	itor := m.Iterate()
+	keys := []PodNodeMapKey{}
+
+	var key PodNodeMapKey
+	var value PodNodeMapValue
+	for itor.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+	return keys, itor.Err()
+}
+
 func (mm *MapsManager) BatchDelLxcMap(keys []EndpointMapKey) (int, error) {
 	m := mm.GetLxcMap()
 	return BatchDelKey(m, keys)
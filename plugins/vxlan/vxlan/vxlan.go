@@ -7,8 +7,7 @@ import (
 	"strconv"
 	"testcni/cni"
 	"testcni/consts"
-	_etcd "testcni/etcd"
-	"testcni/ipam"
+	"testcni/datastore"
 	_ipam "testcni/ipam"
 	"testcni/nettools"
 	bpf_map "testcni/plugins/vxlan/map"
@@ -17,8 +16,9 @@ import (
 	"testcni/skel"
 	"testcni/utils"
 
+	"github.com/cilium/ebpf"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
-	// "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
 )
@@ -32,7 +32,7 @@ func (vx *VxlanCNI) GetMode() string {
 	return MODE
 }
 
-func startWatchNodeChange(ipam *_ipam.IpamService, etcd *_etcd.EtcdClient) error {
+func startWatchNodeChange(ipam *_ipam.IpamService, store datastore.Watchable) error {
 	// 如果这个默认端口已经正在使用了, 则认为之前已经有 pod 在在调用 cni 时启动过监听进程了, 这里可直接跳过
 	pidInt, pidStr, err := utils.GetPidByPort(consts.DEFAULT_TMP_PORT)
 	if err == nil && pidInt != -1 {
@@ -53,31 +53,56 @@ func startWatchNodeChange(ipam *_ipam.IpamService, etcd *_etcd.EtcdClient) error
 		utils.CreateFile(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH, ([]byte)(pidStr), 0766)
 		return nil
 	}
-	// 走到这里说明还没有一条子进程能监听 etcd 中 node 上的 pod ip 的变换
+	// 走到这里说明还没有一条子进程能监听 ipam 中 node 上的 pod ip 的变换
 	// 这里就启动监听
-	return watcher.StartMapWatcher(ipam, etcd)
+	return watcher.StartMapWatcher(ipam, store)
 }
 
-func initEveryClient(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*_ipam.IpamService, *_etcd.EtcdClient, *bpf_map.MapsManager, error) {
-	_ipam.Init(pluginConfig.Subnet, &ipam.IPAMOptions{
-		MaskSegment:      "16",
-		PodIpMaskSegment: "32",
-	})
+func initEveryClient(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*_ipam.IpamService, datastore.Watchable, *bpf_map.MapsManager, error) {
+	err := cni.CheckBuiltinIPAM(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = cni.CheckPodCIDR(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = cni.CheckPools(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// 其他节点上的 pod ip 是直接监听 ipam 的存储拿到的, 存成 crd 的话监听不了
+	datastoreType, err := datastore.CheckType(cni.GetDatastoreType(pluginConfig))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if datastoreType == datastore.DATASTORE_KUBERNETES {
+		return nil, nil, nil, fmt.Errorf("the %s datastore is not supported in the %s mode", datastoreType, MODE)
+	}
+	// ding_ip 这些 ebpf map 的 key 都是 ipv4 的地址, vxlan 模式暂时只支持 ipv4
+	subnet, err := cni.GetIPv4Subnet(pluginConfig, MODE)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	options := _ipam.OptionsFromCNI(pluginConfig)
+	options.MaskSegment = "16"
+	options.PodIpMaskSegment = "32"
+	options.DatastoreType = datastoreType
+	_ipam.Init(subnet, options)
 	ipam, err := _ipam.GetIpamService()
 	if err != nil {
 		return nil, nil, nil, errors.New(fmt.Sprintf("初始化 ipam 客户端失败: %s", err.Error()))
 	}
-	_etcd.Init()
-	etcd, err := _etcd.GetEtcdClient()
-	if err != nil {
-		return nil, nil, nil, errors.New(fmt.Sprintf("初始化 etcd 客户端失败: %s", err.Error()))
+	store, ok := ipam.Datastore.(datastore.Watchable)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("the %s datastore is not supported in the %s mode", ipam.Datastore.Type(), MODE)
 	}
 
 	bpfmap, err := bpf_map.GetMapsManager()
 	if err != nil {
 		return nil, nil, nil, errors.New(fmt.Sprintf("初始化 ebpf map 失败: %s", err.Error()))
 	}
-	return ipam, etcd, bpfmap, nil
+	return ipam, store, bpfmap, nil
 }
 
 func createHostVethPair(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*netlink.Veth, *netlink.Veth, error) {
@@ -149,20 +174,20 @@ func setHostVethIntoHost(ipam *_ipam.IpamService, veth *netlink.Veth, netns ns.N
 	return nil
 }
 
-func setIpIntoNsPair(ipam *_ipam.IpamService, veth *netlink.Veth) (string, error) {
-	// 从 ipam 中拿到一个未使用的 ip 地址
-	podIP, err := ipam.Get().UnusedIP()
+func setIpIntoNsPair(ipam *_ipam.IpamService, args *skel.CmdArgs, requestedIPs []string, veth *netlink.Veth) (*_ipam.Allocation, string, error) {
+	// 从 ipam 中给这个容器的这块儿网卡分配一个未使用的 ip 地址, pod 指定了 ip 的话就只分指定的
+	alloc, err := ipam.Get().AllocateIP(args.ContainerID, args.IfName, MODE, requestedIPs...)
 	if err != nil {
 		utils.WriteLog("获取 podIP 出错, err: ", err.Error())
-		return "", err
+		return nil, "", err
 	}
-	podIP = fmt.Sprintf("%s/%s", podIP, "32")
+	podIP := fmt.Sprintf("%s/%s", alloc.IP, "32")
 	err = nettools.SetIpForVxlan(veth.Name, podIP)
 	if err != nil {
 		utils.WriteLog("给 ns veth 设置 ip 失败, err: ", err.Error())
-		return "", err
+		return alloc, "", err
 	}
-	return podIP, nil
+	return alloc, podIP, nil
 }
 
 func setUpVeth(veth *netlink.Veth) error {
@@ -345,13 +370,23 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 	utils.WriteLog("进到了 vxlan 模式了")
 
 	// 0. 先把各种能用的上的客户端初始化咯
-	ipam, etcd, bpfmap, err := initEveryClient(args, pluginConfig)
+	ipam, store, bpfmap, err := initEveryClient(args, pluginConfig)
 	if err != nil {
 		return nil, err
 	}
 
+	// pod 通过 runtimeConfig 或者 CNI_ARGS 指定了 ip 的话就只分指定的 ip
+	requestedIPs, err := cni.GetRequestedIPs(args, pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = _ipam.CheckRequestedIPs(requestedIPs, ipam)
+	if err != nil {
+		return nil, cni.NewRequestedIPError(err.Error())
+	}
+
 	// 1. 开始监听 etcd 中 pod 和 subnet map 的变化, 注意该行为只能有一次
-	err = startWatchNodeChange(ipam, etcd)
+	err = startWatchNodeChange(ipam, store)
 	if err != nil {
 		return nil, err
 	}
@@ -382,6 +417,25 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 
 	var nsPair, hostPair *netlink.Veth
 	var podIP string
+	var alloc *_ipam.Allocation
+
+	/**
+	 * 从这儿开始就要在 pod 里建 veth 以及去 ipam 里占 ip 了, 后边不管哪一步出错了, 都按 DEL 的流程把已经做了的撤掉:
+	 * 删掉 pod 的 veth pair, 把 ding_lxc 中的记录删了, ip 还回去
+	 * veth_host/veth_net 和 ding_vxlan 是整个节点共用的, 不用撤
+	 * 不然 runtime 看到 ADD 失败不会再调 DEL, ip 和 veth 就一直泄露着
+	 */
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		rollbackErr := vx.Unmount(args, pluginConfig)
+		if rollbackErr != nil {
+			utils.WriteLog("ADD 失败之后回滚失败, podIP: ", podIP, ", err: ", rollbackErr.Error())
+		}
+	}()
+
 	err = (*netns).Do(func(hostNs ns.NetNS) error {
 		// 5. 创建一对儿 veth pair 作为 pod 的 veth
 		nsPair, hostPair, err = createNsVethPair(args, pluginConfig)
@@ -395,7 +449,7 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 		}
 
 		// 7. 给 ns 中的 veth 创建 ip/32, etcd 会自动通知其他 node
-		podIP, err = setIpIntoNsPair(ipam, nsPair)
+		alloc, podIP, err = setIpIntoNsPair(ipam, args, requestedIPs, nsPair)
 		if err != nil {
 			return err
 		}
@@ -433,6 +487,9 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 	})
 
 	if err != nil {
+		if _ipam.IsRequestedIPError(err) {
+			return nil, cni.NewRequestedIPError(err.Error())
+		}
 		return nil, err
 	}
 
@@ -460,34 +517,247 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 		return nil, err
 	}
 
+	// 15. 把网关和主机上那半拉 veth 的名字补到分配记录里
+	_gw, _gwNet, _ := net.ParseCIDR(gw)
+	alloc.Gateway = _gw.String()
+	alloc.HostIfName = hostPair.Attrs().Name
+	err = ipam.Set().Allocation(alloc)
+	if err != nil {
+		return nil, err
+	}
+
 	// 最后交给外头去打印到标准输出
-	_gw, _, _ := net.ParseCIDR(gw)
-	_, _podIP, _ := net.ParseCIDR(podIP)
+	_ip, _podIP, _ := net.ParseCIDR(podIP)
+	_podIP.IP = _ip
+	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
 	result := &types.Result{
 		CNIVersion: pluginConfig.CNIVersion,
+		Interfaces: []*types.Interface{
+			{
+				Name:    args.IfName,
+				Sandbox: args.Netns,
+			},
+		},
 		IPs: []*types.IPConfig{
 			{
-				Address: *_podIP,
-				Gateway: _gw,
+				Interface: types.Int(0),
+				Address:   *_podIP,
+				Gateway:   _gw,
+			},
+		},
+		// 和 setFibTalbeIntoNs 中设置的那两条路由一致
+		Routes: []*cniTypes.Route{
+			{
+				Dst: *_gwNet,
+			},
+			{
+				Dst: *defNet,
+				GW:  _gw,
 			},
 		},
 	}
+	succeeded = true
 	return result, nil
 }
 
-func (hostGW *VxlanCNI) Unmount(
+func delVethPairInfoFromLxcMap(bpfmap *bpf_map.MapsManager, podIP string) error {
+	// map 都还没被 pin 过的话说明压根儿就没写进去过
+	if !utils.PathExists(bpf_map.LXC_MAP_DEFAULT_PATH) {
+		return nil
+	}
+	err := bpfmap.DelLxcMap(bpf_map.EndpointMapKey{IP: utils.InetIpToUInt32(podIP)})
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+/**
+ * 卸载的时候要把 Bootstrap 时干的事儿反着来一遍:
+ *		1. 删掉 pod 的 veth pair, 主机上的 ding_lxc_xxx 跟着一起没了, 上边挂的 tc ingress 也就没了
+ *		2. 把 ding_lxc 这个 map 中这个 pod 的 EndpointMapKey 删掉
+ *		3. 把 pod ip 还给 ipam, 其他节点上的 watcher 监听到之后会把它从 ding_ip 中删掉
+ * 注意 veth_host/veth_net 以及 ding_vxlan 是整个节点共用的, 这里不能删
+ * pod ip 和主机上的 veth 优先从 ADD 时留下的分配记录里找, 这样 netns 已经没了也能清理干净
+ * 任何一步要删的东西已经不在了的话都直接跳过
+ */
+func (vx *VxlanCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
+	ipam, _, bpfmap, err := initEveryClient(args, pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	alloc, err := ipam.Get().Allocation(args.ContainerID, args.IfName)
+	if err != nil {
+		utils.WriteLog("获取分配记录失败, err: ", err.Error())
+		return err
+	}
+	podIP := ""
+	hostVethName := ""
+	if alloc != nil {
+		podIP = alloc.IP
+		hostVethName = alloc.HostIfName
+	}
+
+	// 1. 删除 veth pair
+	netnsExist := false
+	if args.Netns != "" {
+		netns, err := ns.GetNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			netnsExist = true
+			_podIP, _hostVethName, err := nettools.DelVethInNs(netns, args.IfName)
+			if err != nil {
+				utils.WriteLog("删除 pod 中的 veth 失败, err: ", err.Error())
+				return err
+			}
+			utils.WriteLog("删除了 pod 的 veth, podIP: ", _podIP, " hostVeth: ", _hostVethName)
+			if podIP == "" {
+				podIP = _podIP
+			}
+		} else if !nettools.IsNsNotExistErr(err) {
+			utils.WriteLog("获取 ns 失败: ", err.Error())
+			return err
+		}
+	}
+	if !netnsExist && hostVethName != "" {
+		err = nettools.DelHostVeth(hostVethName)
+		if err != nil {
+			utils.WriteLog("删除主机上的 veth ", hostVethName, " 失败, err: ", err.Error())
+			return err
+		}
+	}
+	if podIP == "" {
+		return nil
+	}
+
+	// 2. 从 ding_lxc 中删掉这个 pod
+	err = delVethPairInfoFromLxcMap(bpfmap, podIP)
+	if err != nil {
+		utils.WriteLog("从 lxc map 中删除 ", podIP, " 失败, err: ", err.Error())
+		return err
+	}
+
+	// 3. 释放 ip
+	if alloc != nil {
+		_, err = ipam.Release().Allocation(args.ContainerID, args.IfName)
+	} else {
+		err = ipam.Release().IPs(podIP)
+	}
+	if err != nil {
+		utils.WriteLog("释放 podIP ", podIP, " 失败: ", err.Error())
+		return err
+	}
 	return nil
 }
 
-func (hostGW *VxlanCNI) Check(
+// 检查 ding_lxc 中这个 pod 的那条记录是不是还指着它现在的 veth pair
+func checkVethPairInfoInLxcMap(bpfmap *bpf_map.MapsManager, podIP string, hostVeth netlink.Link) error {
+	if !utils.PathExists(bpf_map.LXC_MAP_DEFAULT_PATH) {
+		return fmt.Errorf("lxc map %q not found", bpf_map.LXC_MAP_DEFAULT_PATH)
+	}
+	info, err := bpfmap.GetLxcMapValue(bpf_map.EndpointMapKey{IP: utils.InetIpToUInt32(podIP)})
+	if err != nil {
+		return fmt.Errorf("entry of %s not found in lxc map: %v", podIP, err)
+	}
+	if info.LxcIfIndex != uint32(hostVeth.Attrs().Index) {
+		return fmt.Errorf(
+			"entry of %s in lxc map points to ifindex %d, but host veth %q is %d",
+			podIP, info.LxcIfIndex, hostVeth.Attrs().Name, hostVeth.Attrs().Index,
+		)
+	}
+	return nil
+}
+
+/**
+ * 拿 ADD 时返回的结果和当前实际的网络做对比:
+ *		1. pod 中的网卡, ip 以及路由
+ *		2. ding_lxc 中得有这个 pod 的记录, 并且指着它留在主机上的那半拉 veth
+ *		3. 主机上的那半拉 veth 得有 tc ingress
+ *		4. ding_vxlan 得在, 并且 tc 的 ingress 和 egress 都得在
+ *		5. ipam 中的分配记录得和上边这些对得上
+ */
+func (vx *VxlanCNI) Check(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
+	result, err := cni.GetPrevResult(pluginConfig)
+	if err != nil {
+		utils.WriteLog("获取 prevResult 失败, err: ", err.Error())
+		return cni.NewCheckError("failed to parse prevResult", err.Error())
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		utils.WriteLog("获取 ns 失败: ", err.Error())
+		return cni.NewCheckError(fmt.Sprintf("netns %q not found", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	ips := cni.GetIPConfigsOfInterface(result, args.IfName)
+	err = nettools.CheckPodInterface(netns, args.IfName, ips, result.Routes)
+	if err != nil {
+		utils.WriteLog("检查 pod 中的网卡失败, err: ", err.Error())
+		return cni.NewCheckError("pod interface drifted", err.Error())
+	}
+
+	podIP, hostVethName, err := nettools.GetVethInfoInNs(netns, args.IfName)
+	if err != nil {
+		return cni.NewCheckError("failed to get host veth of pod", err.Error())
+	}
+	if hostVethName == "" {
+		return cni.NewCheckError(fmt.Sprintf("host veth of %q not found", args.IfName))
+	}
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return cni.NewCheckError(fmt.Sprintf("host veth %q not found", hostVethName), err.Error())
+	}
+
+	ipam, _, bpfmap, err := initEveryClient(args, pluginConfig)
+	if err != nil {
+		return cni.NewCheckError("failed to init clients", err.Error())
+	}
+
+	// ADD 时留下的分配记录得和现在的网络对得上
+	alloc, err := ipam.Get().Allocation(args.ContainerID, args.IfName)
+	if err != nil {
+		return cni.NewCheckError("failed to get allocation record", err.Error())
+	}
+	if alloc == nil {
+		return cni.NewCheckError(fmt.Sprintf("allocation record of %s/%s not found", args.ContainerID, args.IfName))
+	}
+	if checkErr := cni.CheckAllocatedIP(ips, alloc.IP); checkErr != nil {
+		return checkErr
+	}
+	if alloc.HostIfName != "" && alloc.HostIfName != hostVethName {
+		return cni.NewCheckError(
+			"host veth drifted",
+			fmt.Sprintf("allocation record has %q, but pod is connected to %q", alloc.HostIfName, hostVethName),
+		)
+	}
+
+	err = checkVethPairInfoInLxcMap(bpfmap, podIP, hostVeth)
+	if err != nil {
+		utils.WriteLog("检查 lxc map 失败, err: ", err.Error())
+		return cni.NewCheckError("lxc map entry drifted", err.Error())
+	}
+
+	if !tc.ExistIngress(hostVethName) {
+		return cni.NewCheckError(fmt.Sprintf("tc ingress filter not found on host veth %q", hostVethName))
+	}
+
+	if _, err = netlink.LinkByName("ding_vxlan"); err != nil {
+		return cni.NewCheckError("vxlan device \"ding_vxlan\" not found", err.Error())
+	}
+	if !tc.ExistIngress("ding_vxlan") {
+		return cni.NewCheckError("tc ingress filter not found on \"ding_vxlan\"")
+	}
+	if !tc.ExistEgress("ding_vxlan") {
+		return cni.NewCheckError("tc egress filter not found on \"ding_vxlan\"")
+	}
 	return nil
 }
 
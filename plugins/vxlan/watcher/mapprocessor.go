@@ -1,16 +1,18 @@
 package watcher
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"testcni/consts"
+	"testcni/datastore"
 	"testcni/ipam"
 	bpfmap "testcni/plugins/vxlan/map"
 	"testcni/utils"
 
-	"go.etcd.io/etcd/api/v3/mvccpb"
+	"github.com/cilium/ebpf"
 )
 
 type tmpKV struct {
@@ -30,14 +32,16 @@ func startHealthServer() {
 	}
 }
 
-func getHostnameFromKey(key string) string {
-	tmp := utils.GetParentDirectory(key)
-	tmpArr := strings.Split(tmp, "/")
-	return tmpArr[len(tmpArr)-1]
-}
-
-func getIpsFromValue(value string) []string {
-	return strings.Split(value, ";")
+/**
+ * key 的格式是 /testcni/ipam/<subnet>/<mask>/<network>/ips/<ip>
+ * 从里头拿到 ip 以及这个 ip 所在的网段
+ */
+func getNetworkAndIPFromKey(key string) (string, string) {
+	tmpArr := strings.Split(key, "/")
+	if len(tmpArr) < 3 || tmpArr[len(tmpArr)-2] != "ips" {
+		return "", ""
+	}
+	return tmpArr[len(tmpArr)-3], tmpArr[len(tmpArr)-1]
 }
 
 // 这里的 initData 是 map[ip]hostname 的形式
@@ -72,7 +76,7 @@ func transformTmpKV2PodNodeMapKV(tmp []tmpKV) ([]bpfmap.PodNodeMapKey, []bpfmap.
 	return keys, values
 }
 
-func InitRecordSyncProcessor(ipam *ipam.IpamService, initData map[string]string) func(_type mvccpb.Event_EventType, key, value []byte) {
+func InitRecordSyncProcessor(ipam *ipam.IpamService, initData map[string]string) datastore.WatchCallback {
 	mm, err := bpfmap.GetMapsManager()
 	if err != nil {
 		utils.WriteLog("(RecordSyncProcessor) 获取 bpf maps manager 失败: ", err.Error())
@@ -83,7 +87,7 @@ func InitRecordSyncProcessor(ipam *ipam.IpamService, initData map[string]string)
 		utils.WriteLog("(RecordSyncProcessor) 创建 pod map 失败: ", err.Error())
 		return nil
 	}
-	// 获取当前 etcd 中已经存在的 node 和 pod ip 的对应关系
+	// 获取当前 ipam 中已经存在的 node 和 pod ip 的对应关系
 	prevData := getBatchMapKV(ipam, initData)
 	// 然后转成 keys 和 values 的数据
 	prevKeys, prevValues := transformTmpKV2PodNodeMapKV(prevData)
@@ -94,30 +98,20 @@ func InitRecordSyncProcessor(ipam *ipam.IpamService, initData map[string]string)
 		return nil
 	}
 	utils.WriteLog("(RecordSyncProcessor) 初始化 node-pod maps 成功, 数量: ", strconv.Itoa(res))
-	return func(_type mvccpb.Event_EventType, key, value []byte) {
+
+	return func(_type datastore.EventType, key, value string) {
 		utils.WriteLog(fmt.Sprintf("进到了 Processor: %s, %q, %q\n", _type, key, value))
 		/**
-		 * 进到这里, 一定是监听到了其他节点上的网段已经对应的 pod ip 的关系变化
+		 * 进到这里, 一定是监听到了其他节点上的某个 pod ip 的变化
 		 * 比如其他节点添加了或者删除某个 pod, 这里能感知到其变化
 		 * 将其存入到 POD_MAP_DEFAULT_PATH 中
 		 */
-		// 先从 key 中拿到 hostname
-		hostname := getHostnameFromKey(string(key))
-		if hostname == "" {
-			utils.WriteLog("(RecordSyncProcessor) 获取 hostname 失败")
+		// 先从 key 中拿到网段和 ip
+		network, ip := getNetworkAndIPFromKey(key)
+		if network == "" || ip == "" {
+			utils.WriteLog("(RecordSyncProcessor) 解析 key 失败: ", key)
 			return
 		}
-		// 从 value 获取到这次更新的 node 对应的所有 pod ip 地址
-		ips := getIpsFromValue(string(value))
-		// 存储格式 map[ip]hostname
-		_maps := map[string]string{}
-		for _, ip := range ips {
-			_maps[ip] = hostname
-		}
-		// 把当前的 ips 和 node ip 的对应关系搞出来
-		prevData = getBatchMapKV(ipam, _maps)
-		// 然后转成 keys 和 values 的数据
-		prevKeys, prevValues = transformTmpKV2PodNodeMapKV(prevData)
 
 		mm, err := bpfmap.GetMapsManager()
 		if err != nil {
@@ -125,17 +119,37 @@ func InitRecordSyncProcessor(ipam *ipam.IpamService, initData map[string]string)
 			return
 		}
 
-		// 先删除当前 pod node map 中的所有
-		_, err = mm.DeleteAllPodMap()
+		// delete 事件说明这个 ip 已经被释放掉了, 从 pod node map 中删掉就行
+		if _type == datastore.EventDelete {
+			err = mm.DelPodMap(bpfmap.PodNodeMapKey{IP: utils.InetIpToUInt32(ip)})
+			if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				utils.WriteLog("(RecordSyncProcessor) 删除已释放的 ip 失败: ", err.Error())
+				return
+			}
+			utils.WriteLog("(RecordSyncProcessor) 删除 node-pod maps 成功: ", ip)
+			return
+		}
+
+		// 再通过网段找到这个 ip 在哪个节点上
+		maps, err := ipam.Get().HostSubnetMap()
 		if err != nil {
-			utils.WriteLog("(RecordSyncProcessor) 批量删除上次 key 失败: ", err.Error())
-			// return
+			utils.WriteLog("(RecordSyncProcessor) 获取 hostname 和网段的映射失败: ", err.Error())
+			return
+		}
+		hostname, ok := maps[network]
+		if !ok {
+			utils.WriteLog("(RecordSyncProcessor) 获取 hostname 失败, 网段: ", network)
+			return
 		}
 
-		// 然后再把本次的都批量更新到 map
-		_, err = mm.BatchSetPodMap(prevKeys, prevValues)
+		currentData := getBatchMapKV(ipam, map[string]string{ip: hostname})
+		if len(currentData) == 0 {
+			return
+		}
+		currentKeys, currentValues := transformTmpKV2PodNodeMapKV(currentData)
+		res, err := mm.BatchSetPodMap(currentKeys, currentValues)
 		if err != nil {
-			utils.WriteLog("(RecordSyncProcessor) 批量更新 node-pod maps 失败: ", err.Error())
+			utils.WriteLog("(RecordSyncProcessor) 更新 node-pod maps 失败: ", err.Error())
 			return
 		}
 		utils.WriteLog("(RecordSyncProcessor) 更新 node-pod maps 成功, 数量: ", strconv.Itoa(res))
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"testcni/consts"
-	"testcni/etcd"
+	"testcni/datastore"
 	"testcni/ipam"
 	"testcni/utils"
 )
@@ -24,13 +24,16 @@ func getAllInitPath(ipam *ipam.IpamService) (map[string]string, error) {
 			return nil, err
 		}
 		for _, ip := range ips {
+			if ip == "" {
+				continue
+			}
 			maps[ip] = network.Hostname
 		}
 	}
 	return maps, nil
 }
 
-func StartMapWatcher(ipam *ipam.IpamService, etcd *etcd.EtcdClient) error {
+func StartMapWatcher(ipam *ipam.IpamService, store datastore.Watchable) error {
 	/**
 	 * 这里要负责监听各个节点的变换
 	 * 并把得到的结果给塞到 ebpf 的 map 中
@@ -44,7 +47,7 @@ func StartMapWatcher(ipam *ipam.IpamService, etcd *etcd.EtcdClient) error {
 	handlers := &Handlers{
 		SubnetRecordHandler: InitRecordSyncProcessor(ipam, initMaps),
 	}
-	watcher, err := GetWatcher(ipam, etcd, handlers)
+	watcher, err := GetWatcher(ipam, store, handlers)
 	if err != nil {
 		return err
 	}
@@ -3,38 +3,42 @@ package watcher
 import (
 	"encoding/json"
 	"os"
-	"testcni/etcd"
+	"sync"
+	"testcni/datastore"
 	"testcni/ipam"
 	"testcni/utils"
-	"time"
-
-	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 type WatcherProcess struct {
 	ipam                *ipam.IpamService
-	etcd                *etcd.EtcdClient
-	watcher             *etcd.Watcher
-	subnetRecordHandler etcd.WatchCallback
+	store               datastore.Watchable
+	subnetRecordHandler datastore.WatchCallback
 	isWatching          bool
-	watchingMap         map[string]bool
-	mapsPath            string
+	// maps 的回调和 StartWatch 可能同时在加监听
+	lock        sync.Mutex
+	watchingMap map[string]bool
+	cancels     []func()
+	mapsPath    string
 }
 
 type Handlers struct {
-	// HostnameAndSubnetMapsHandler etcd.WatchCallback
-	SubnetRecordHandler etcd.WatchCallback
+	SubnetRecordHandler datastore.WatchCallback
 }
 
 func (wp *WatcherProcess) doWatch(promise []string) {
 	for _, path := range promise {
-		wp.watcher.Watch(path, wp.subnetRecordHandler)
+		// 每个 ip 都是这个前缀下的一个 key
+		cancel, err := wp.store.Watch(path, true, wp.subnetRecordHandler)
+		if err != nil {
+			utils.WriteLog("监听 ", path, " 失败: ", err.Error())
+			continue
+		}
+		wp.cancels = append(wp.cancels, cancel)
 		wp.watchingMap[path] = true
-		time.Sleep(1 * time.Second)
 	}
 }
 
-// watching 是监听中的 hostname 和网段的映射, promise 是要希望要被监听的地址
+// watching 是监听中的路径, promise 是网段和 hostname 的映射, 一台主机可能占着好几个网段
 func (wp *WatcherProcess) getShouldWatchPath(watching map[string]bool, promise map[string]string) ([]string, error) {
 	res := []string{}
 	hostname, err := os.Hostname()
@@ -42,16 +46,13 @@ func (wp *WatcherProcess) getShouldWatchPath(watching map[string]bool, promise m
 		return nil, err
 	}
 
-	for _, v := range promise {
+	for network, v := range promise {
 		// 不用监听自己这台主机
 		if hostname == v {
 			continue
 		}
-		path, err := wp.ipam.Get().RecordPathByHost(v)
-		if err != nil {
-			return nil, err
-		}
-		// 看该 ip 当前是否已经被监听
+		path := wp.ipam.Get().RecordPathByNetwork(network)
+		// 看该网段当前是否已经被监听
 		if watched, ok := watching[path]; ok && watched {
 			continue
 		}
@@ -74,60 +75,71 @@ func (wp *WatcherProcess) StartWatch() (func(), error) {
 		return utils.Noop, err
 	}
 
+	wp.lock.Lock()
 	paths, err := wp.getShouldWatchPath(wp.watchingMap, maps)
 	if err != nil {
+		wp.lock.Unlock()
 		return utils.Noop, err
 	}
 	// 开始监听这些路径
 	wp.doWatch(paths)
+	wp.lock.Unlock()
 
 	// 然后再开始监听 hostname 和网段关系映射的地址
-	wp.watcher.Watch(wp.mapsPath, func(_type mvccpb.Event_EventType, key, value []byte) {
+	cancel, err := wp.store.Watch(wp.mapsPath, false, func(_type datastore.EventType, key, value string) {
 		// 每次监听到 maps 路径的变化时应该就多监听一个新加进来的 key
 		newMaps := map[string]string{}
-		err := json.Unmarshal(value, &newMaps)
+		err := json.Unmarshal([]byte(value), &newMaps)
 		if err != nil {
 			return
 		}
+		wp.lock.Lock()
+		defer wp.lock.Unlock()
 		paths, err := wp.getShouldWatchPath(wp.watchingMap, newMaps)
 		if err != nil {
 			return
 		}
 		wp.doWatch(paths)
 	})
+	if err != nil {
+		wp.CancelWatch()
+		return utils.Noop, err
+	}
+	wp.lock.Lock()
+	wp.cancels = append(wp.cancels, cancel)
+	wp.isWatching = true
+	wp.lock.Unlock()
 	return wp.CancelWatch, nil
 }
 
 func (wp *WatcherProcess) CancelWatch() {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
 	wp.isWatching = false
-	cancel := wp.watcher.Cancel
-	cancel()
+	for _, cancel := range wp.cancels {
+		cancel()
+	}
+	wp.cancels = nil
+	wp.watchingMap = map[string]bool{}
 }
 
-var GetWatcher = func() func(ipam *ipam.IpamService, etcd *etcd.EtcdClient, handlers *Handlers) (*WatcherProcess, error) {
+var GetWatcher = func() func(ipam *ipam.IpamService, store datastore.Watchable, handlers *Handlers) (*WatcherProcess, error) {
 	var wp *WatcherProcess
-	return func(ipam *ipam.IpamService, etcd *etcd.EtcdClient, handlers *Handlers) (*WatcherProcess, error) {
+	return func(ipam *ipam.IpamService, store datastore.Watchable, handlers *Handlers) (*WatcherProcess, error) {
 		if wp != nil {
 			return wp, nil
 		}
-		wp = &WatcherProcess{
-			ipam:                ipam,
-			etcd:                etcd,
-			watchingMap:         map[string]bool{},
-			subnetRecordHandler: handlers.SubnetRecordHandler,
-		}
-
 		mapsPath, err := ipam.Get().HostSubnetMapPath()
 		if err != nil {
 			return nil, err
 		}
-		wp.mapsPath = mapsPath
-
-		watcher, err := etcd.GetWatcher()
-		if err != nil {
-			return nil, err
+		wp = &WatcherProcess{
+			ipam:                ipam,
+			store:               store,
+			watchingMap:         map[string]bool{},
+			subnetRecordHandler: handlers.SubnetRecordHandler,
+			mapsPath:            mapsPath,
 		}
-		wp.watcher = watcher
 		return wp, nil
 	}
 }()
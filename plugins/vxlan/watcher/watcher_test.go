@@ -1,59 +1,80 @@
 package watcher
 
 import (
-	"fmt"
-	"sync"
-	"testcni/etcd"
+	"testcni/datastore"
 	"testcni/ipam"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
+type watchedEvent struct {
+	_type datastore.EventType
+	key   string
+}
+
 func TestWatcher(t *testing.T) {
 	test := assert.New(t)
+	store := datastore.NewMemoryDatastore()
 	clear := ipam.Init("10.244.0.0", &ipam.IPAMOptions{
 		MaskSegment:      "16",
 		PodIpMaskSegment: "32",
+		Datastore:        store,
 	})
-	// ipam.Init("10.244.0.0", "16", "32")
-	etcd.Init()
+	defer clear()
 	i, err := ipam.GetIpamService()
 	test.Nil(err)
 	test.NotNil(i)
-	e, err := etcd.GetEtcdClient()
-	test.Nil(err)
-	test.NotNil(e)
-
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	nums := 0
-	var testHandler = func(_type mvccpb.Event_EventType, key, value []byte) {
-		fmt.Printf("%s, %q, %q\n", _type, key, value)
-		nums++
-		wg.Done()
-	}
 
+	events := make(chan watchedEvent, 10)
 	testHandlers := &Handlers{
-		SubnetRecordHandler: testHandler,
+		SubnetRecordHandler: func(_type datastore.EventType, key, value string) {
+			events <- watchedEvent{_type: _type, key: key}
+		},
 	}
-	w, err := GetWatcher(i, e, testHandlers)
+	w, err := GetWatcher(i, store, testHandlers)
 	test.Nil(err)
 	test.NotNil(w)
-	w.StartWatch()
-	// hostname, err := os.Hostname()
+	cancel, err := w.StartWatch()
+	test.Nil(err)
+	defer cancel()
+
+	// 别的主机占了 1.1.1.0 这个网段, 要开始监听这个网段下的 ip
+	mapsPath, err := i.Get().HostSubnetMapPath()
 	test.Nil(err)
-	// 增加一个 /testcni/ipam/10.244.0.0/16/cni-test-666: 1.1.1.1
-	e.Set("/testcni/ipam/10.244.0.0/16/cni-test-666", "1.1.1.1")
-	// /testcni/ipam/10.244.0.0/16/maps: {1.1.1.1: cni-test-666, 10.244.71.6: cni-test-1}
-	e.Set("/testcni/ipam/10.244.0.0/16/maps", "{\"1.1.1.1\":\"cni-test-666\",\"10.244.71.6\":\"cni-test-1\"}")
-	time.Sleep(2 * time.Second)
-	// 增加一个 /testcni/ipam/10.244.0.0/16/cni-test-666/1.1.1.1: 2.2.2.2
-	e.Set("/testcni/ipam/10.244.0.0/16/cni-test-666/1.1.1.1", "2.2.2.2")
-	e.Set("/testcni/ipam/10.244.0.0/16/cni-test-666/1.1.1.1", "3.4.5.6")
-	wg.Wait()
-	test.Equal(nums, 2)
-	clear()
+	test.Nil(store.Set(mapsPath, `{"1.1.1.0":"cni-test-666"}`))
+	ipsPrefix := i.Get().RecordPathByNetwork("1.1.1.0")
+	test.Eventually(func() bool {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.watchingMap[ipsPrefix]
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// 网段 1.1.1.0 上的 ip 都存在 /testcni/ipam/10.244.0.0/16/1.1.1.0/ips/ 下, 一个 ip 一个 key
+	ipPath := ipsPrefix + "1.1.1.2"
+	test.Nil(store.Set(ipPath, "cni-test-666"))
+	_, err = store.Txn(nil, datastore.OpDelete(ipPath))
+	test.Nil(err)
+	for _, expected := range []watchedEvent{{datastore.EventPut, ipPath}, {datastore.EventDelete, ipPath}} {
+		select {
+		case ev := <-events:
+			test.Equal(expected, ev)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for the watch event")
+		}
+	}
+
+	// 取消之后就收不到了
+	cancel()
+	test.Nil(store.Set(ipPath, "cni-test-666"))
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event after cancel: %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	network, ip := getNetworkAndIPFromKey(ipPath)
+	test.Equal(network, "1.1.1.0")
+	test.Equal(ip, "1.1.1.2")
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"testcni/cni"
+	"testcni/consts"
 	"testcni/ipam"
 	"testcni/nettools"
 	"testcni/skel"
@@ -20,28 +21,91 @@ const (
 	MODE_MACVlan
 )
 
-func initEveryClient(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, error) {
-	if pluginConfig.IPAM == nil {
-		return nil, errors.New("a range of ip addresses must be specified in the ipvlan mode")
+func getModeName(mode xvlan_mode) string {
+	if mode == MODE_MACVlan {
+		return consts.MODE_MACVLAN
+	}
+	return consts.MODE_IPVLAN
+}
+
+/**
+ * 使用配置里的 subnet 和 range 初始化 ipam
+ * 配置了具名的 ip 池的话按 pod 和它所在的 namespace 上的注解挑一个池子
+ * 对 ipvlan 和 macvlan 来说池子就是 parent 网卡所在的网络里的另一段 subnet 和 range
+ */
+func initIpam(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, error) {
+	pool, err := ipam.PoolOfPod(
+		cni.GetCNIArg(args, "K8S_POD_NAMESPACE"),
+		cni.GetCNIArg(args, "K8S_POD_NAME"),
+		cni.GetPoolNames(pluginConfig),
+	)
+	if err != nil {
+		return nil, err
 	}
-	if pluginConfig.IPAM.RangeStart == "" || pluginConfig.IPAM.RangeEnd == "" {
+	return initPool(pluginConfig, pool)
+}
+
+func initPool(pluginConfig *cni.PluginConf, pool string) (*ipam.IpamService, error) {
+	err := cni.CheckPodCIDR(pluginConfig, pluginConfig.Mode)
+	if err != nil {
+		return nil, err
+	}
+	err = cni.CheckPools(pluginConfig, pluginConfig.Mode)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig, err := cni.GetPoolConfig(pluginConfig, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	if poolConfig.IPAM == nil || poolConfig.IPAM.RangeStart == "" || poolConfig.IPAM.RangeEnd == "" {
+		if pool != ipam.DEFAULT_POOL_NAME {
+			return nil, fmt.Errorf("a range of ip addresses must be specified in the ip pool %q", pool)
+		}
 		return nil, errors.New("a range of ip addresses must be specified in the ipvlan mode")
 	}
 
-	if !utils.CheckIP(pluginConfig.IPAM.RangeStart) || !utils.CheckIP(pluginConfig.IPAM.RangeEnd) {
+	if !utils.CheckIP(poolConfig.IPAM.RangeStart) || !utils.CheckIP(poolConfig.IPAM.RangeEnd) {
 		return nil, errors.New("ipam's ip address is invalid")
 	}
 
-	ipam.Init(pluginConfig.Subnet, &ipam.IPAMOptions{
-		RangeStart: pluginConfig.IPAM.RangeStart,
-		RangeEnd:   pluginConfig.IPAM.RangeEnd,
-	})
-	ipam, err := ipam.GetIpamService()
+	// ipvlan 和 macvlan 模式下的 ip 是从 range 里分的, 暂时只支持 ipv4
+	subnet, err := cni.GetIPv4Subnet(poolConfig, pluginConfig.Mode)
+	if err != nil {
+		return nil, err
+	}
+	options := ipam.OptionsFromCNI(poolConfig)
+	options.RangeStart = poolConfig.IPAM.RangeStart
+	options.RangeEnd = poolConfig.IPAM.RangeEnd
+	ipam.InitPool(pool, []string{subnet}, options)
+	ipamClient, _, err := ipam.GetPoolServices(pool)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init ipam client: %s", err.Error())
 	}
 
-	return ipam, nil
+	return ipamClient, nil
+}
+
+/**
+ * DEL 和 CHECK 的时候 pod 可能已经被删了, 读不到注解
+ * 所以挨个具名的池子去找这块儿网卡的分配记录, 都没有的话就是默认的池子
+ */
+func initIpamOfAllocation(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*ipam.IpamService, error) {
+	for _, pool := range cni.GetPoolNames(pluginConfig) {
+		ipamClient, err := initPool(pluginConfig, pool)
+		if err != nil {
+			return nil, err
+		}
+		alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			return nil, err
+		}
+		if alloc != nil {
+			return ipamClient, nil
+		}
+	}
+	return initPool(pluginConfig, ipam.DEFAULT_POOL_NAME)
 }
 
 func SetXVlanDevice(
@@ -50,11 +114,21 @@ func SetXVlanDevice(
 	pluginConfig *cni.PluginConf,
 ) (string, string, error) {
 	// 初始化 ipam
-	ipamClient, err := initEveryClient(args, pluginConfig)
+	ipamClient, err := initIpam(args, pluginConfig)
 	if err != nil {
 		return "", "", err
 	}
 
+	// pod 通过 runtimeConfig 或者 CNI_ARGS 指定了 ip 的话就只分指定的 ip, 配置了 range 的话得在 range 里
+	requestedIPs, err := cni.GetRequestedIPs(args, pluginConfig)
+	if err != nil {
+		return "", "", err
+	}
+	err = ipam.CheckRequestedIPs(requestedIPs, ipamClient)
+	if err != nil {
+		return "", "", cni.NewRequestedIPError(err.Error())
+	}
+
 	// 获取本机网卡信息
 	currentNetwork, err := ipamClient.Get().HostNetwork()
 	if err != nil {
@@ -76,14 +150,42 @@ func SetXVlanDevice(
 			return "", "", err
 		}
 	} else {
-		device, err = nettools.CreateMacVlan(ifname, currentNetwork.Name)
+		device, err = nettools.CreateMacVlan(ifname, currentNetwork.Name, nettools.PromiscHolder(args.ContainerID, args.IfName))
 		if err != nil {
 			return "", "", err
 		}
 	}
 
+	/**
+	 * 从这儿往后哪一步出错了, 都把子设备删掉, macvlan 的话把混杂模式还回去, 分了 ip 的话把 ip 也还回去
+	 * 分配记录还没写或者设备还没改成 args.IfName 的时候, DEL 按记录和名字都找不到它们, 不在这儿撤掉的话就一直泄露着
+	 */
+	deviceName := device.Attrs().Name
+	var netns ns.NetNS
+	inNs := false
+	allocated := false
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if allocated {
+				_, releaseErr := ipamClient.Release().Allocation(args.ContainerID, args.IfName)
+				if releaseErr != nil {
+					utils.WriteLog("释放 ", args.ContainerID, "/", args.IfName, " 的 ip 失败, err: ", releaseErr.Error())
+				}
+			}
+			var deviceNs ns.NetNS
+			if inNs {
+				deviceNs = netns
+			}
+			rollbackXVlanDevice(mode, args, currentNetwork.Name, deviceName, deviceNs)
+		}
+		if netns != nil {
+			netns.Close()
+		}
+	}()
+
 	// 获取到 netns
-	netns, err := ns.GetNS(args.Netns)
+	netns, err = ns.GetNS(args.Netns)
 	if err != nil {
 		return "", "", err
 	}
@@ -93,9 +195,21 @@ func SetXVlanDevice(
 	if err != nil {
 		return "", "", err
 	}
+	inNs = true
 
-	// 获取一个未使用的 ip 地址
-	ip, err := ipamClient.Get().UnusedIP()
+	// 给这个容器的这块儿网卡分配一个未使用的 ip 地址
+	// 对于 ipvlan/macvlan 来说留在主机上的网卡就是 parent 网卡
+	alloc, err := ipamClient.Get().AllocateIP(args.ContainerID, args.IfName, getModeName(mode), requestedIPs...)
+	if err != nil {
+		if ipam.IsRequestedIPError(err) {
+			return "", "", cni.NewRequestedIPError(err.Error())
+		}
+		return "", "", err
+	}
+	allocated = true
+	ip := alloc.IP
+	alloc.HostIfName = currentNetwork.Name
+	err = ipamClient.Set().Allocation(alloc)
 	if err != nil {
 		return "", "", err
 	}
@@ -105,24 +219,213 @@ func SetXVlanDevice(
 		return "", "", err
 	}
 	err = netns.Do(func(hostNs ns.NetNS) error {
-		_device, err := netlink.LinkByName(device.Attrs().Name)
+		_device, err := netlink.LinkByName(deviceName)
 		if err != nil {
 			return err
 		}
 
+		// 把设备的名字改成 kubelet 传过来的网卡名, 卸载的时候就能直接按名字找到了
+		err = netlink.LinkSetName(_device, args.IfName)
+		if err != nil {
+			return err
+		}
+		deviceName = args.IfName
+
 		mask, err := ipamClient.Get().MaskSegment()
 		if err != nil {
 			return err
 		}
 		ip = fmt.Sprintf("%s/%s", ip, mask)
 		// 设置 ip 给这个 ipvlan 设备
-		err = nettools.SetIpForIPVlan(_device.Attrs().Name, ip)
+		err = nettools.SetIpForIPVlan(args.IfName, ip)
 		if err != nil {
 			return err
 		}
 		// 启动这个 ipvlan 设备
-		return nettools.SetUpIPVlan(_device.Attrs().Name)
+		return nettools.SetUpIPVlan(args.IfName)
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	succeeded = true
+	return ip, subnet, nil
+}
+
+/**
+ * 卸载 ipvlan/macvlan 设备:
+ *		1. 把 pod(netns) 中的子设备删掉
+ *		2. 把它的 ip 还给 ipam
+ *		3. 如果是 macvlan 的话, 把这块儿网卡从 parent 网卡的混杂模式里去掉, 最后一个子设备没了的时候要把混杂模式恢复回去
+ * ip 和 parent 网卡优先从 ADD 时留下的分配记录里找
+ * 这样 netns 已经没了(子设备跟着一起没了)的时候也能把 ip 和混杂模式还回去
+ * netns 或者设备已经不存在的话都直接返回 nil, 否则 kubelet 会一直重试
+ */
+func UnsetXVlanDevice(
+	mode xvlan_mode,
+	args *skel.CmdArgs,
+	pluginConfig *cni.PluginConf,
+) error {
+	if cni.IsDelegatedIPAM(pluginConfig) {
+		return unsetXVlanDeviceWithIPAMPlugin(mode, args, pluginConfig)
+	}
+
+	ipamClient, err := initIpamOfAllocation(args, pluginConfig)
+	if err != nil {
+		return err
+	}
+
+	alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	linkType := "ipvlan"
+	if mode == MODE_MACVlan {
+		linkType = "macvlan"
+	}
+
+	podIP := ""
+	parentName := ""
+	if args.Netns != "" {
+		netns, err := ns.GetNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			podIP, parentName, err = nettools.DelXVlanInNs(netns, args.IfName, linkType)
+			if err != nil {
+				return err
+			}
+		} else if !nettools.IsNsNotExistErr(err) {
+			return err
+		} else {
+			utils.WriteLog("netns ", args.Netns, " 已经不存在了, 子设备跟着一起没了")
+		}
+	}
+
+	// 有分配记录的话以记录为准, 先把 ip 还回去
+	if alloc != nil {
+		podIP = alloc.IP
+		if alloc.HostIfName != "" {
+			parentName = alloc.HostIfName
+		}
+		_, err = ipamClient.Release().Allocation(args.ContainerID, args.IfName)
+	} else if podIP != "" {
+		// 老版本分配的 ip 没有分配记录, 只能按 pod 网卡上的 ip 去释放
+		err = ipamClient.Release().IPs(podIP)
+	}
+	if err != nil {
+		utils.WriteLog("释放 podIP ", podIP, " 失败: ", err.Error())
+		return err
+	}
+
+	if mode != MODE_MACVlan {
+		return nil
+	}
+	/**
+	 * 混杂模式是按 containerID/ifName 记的, 重复 DEL 也只会去掉一次
+	 * 所以设备和记录都已经没了的时候也再去一遍, 上一次 DEL 在这一步失败了的话这次接着还
+	 * 设备和记录都没了拿不到 parent 网卡的话用本机的网卡, 和 ADD 的时候是同一块儿
+	 */
+	if parentName == "" {
+		currentNetwork, err := ipamClient.Get().HostNetwork()
+		if err != nil {
+			return err
+		}
+		parentName = currentNetwork.Name
+	}
+	err = releaseParentPromisc(mode, args, parentName)
+	if err != nil {
+		utils.WriteLog("恢复 parent 网卡 ", parentName, " 的混杂模式失败, err: ", err.Error())
+		return err
+	}
+	return nil
+}
+
+/**
+ * 拿 ADD 时返回的结果和当前实际的网络做对比:
+ *		1. pod 中的网卡得在, 并且得是 ipvlan 或者 macvlan 类型的
+ *		2. 网卡上的 ip 以及 pod 中的路由
+ *		3. ipam 中的分配记录得和上边这些对得上
+ *		4. 如果是 macvlan 的话, parent 网卡得还开着混杂模式
+ */
+func CheckXVlanDevice(
+	mode xvlan_mode,
+	args *skel.CmdArgs,
+	pluginConfig *cni.PluginConf,
+) error {
+	result, err := cni.GetPrevResult(pluginConfig)
+	if err != nil {
+		utils.WriteLog("获取 prevResult 失败, err: ", err.Error())
+		return cni.NewCheckError("failed to parse prevResult", err.Error())
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		utils.WriteLog("获取 ns 失败: ", err.Error())
+		return cni.NewCheckError(fmt.Sprintf("netns %q not found", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	linkType := "ipvlan"
+	if mode == MODE_MACVlan {
+		linkType = "macvlan"
+	}
+
+	parentIndex := 0
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("interface %q not found in netns %q: %v", args.IfName, args.Netns, err)
+		}
+		if link.Type() != linkType {
+			return fmt.Errorf("interface %q is %s, expected %s", args.IfName, link.Type(), linkType)
+		}
+		parentIndex = link.Attrs().ParentIndex
+		return nil
 	})
+	if err != nil {
+		return cni.NewCheckError("pod interface drifted", err.Error())
+	}
 
-	return ip, subnet, err
+	ips := cni.GetIPConfigsOfInterface(result, args.IfName)
+	err = nettools.CheckPodInterface(netns, args.IfName, ips, result.Routes)
+	if err != nil {
+		utils.WriteLog("检查 pod 中的网卡失败, err: ", err.Error())
+		return cni.NewCheckError("pod interface drifted", err.Error())
+	}
+
+	if cni.IsDelegatedIPAM(pluginConfig) {
+		// ip 是 ipam 插件分的, 让它自己检查
+		err = cni.DelegateIPAMCheck(args, pluginConfig)
+		if err != nil {
+			return err
+		}
+	} else {
+		// ADD 时留下的分配记录得和现在的网络对得上
+		ipamClient, err := initIpamOfAllocation(args, pluginConfig)
+		if err != nil {
+			return cni.NewCheckError("failed to init ipam", err.Error())
+		}
+		alloc, err := ipamClient.Get().Allocation(args.ContainerID, args.IfName)
+		if err != nil {
+			return cni.NewCheckError("failed to get allocation record", err.Error())
+		}
+		if alloc == nil {
+			return cni.NewCheckError(fmt.Sprintf("allocation record of %s/%s not found", args.ContainerID, args.IfName))
+		}
+		if checkErr := cni.CheckAllocatedIP(ips, alloc.IP); checkErr != nil {
+			return checkErr
+		}
+	}
+
+	if mode == MODE_MACVlan {
+		parent, err := netlink.LinkByIndex(parentIndex)
+		if err != nil {
+			return cni.NewCheckError(fmt.Sprintf("parent of %q not found", args.IfName), err.Error())
+		}
+		if parent.Attrs().Promisc == 0 {
+			return cni.NewCheckError(fmt.Sprintf("promisc mode of parent %q is off", parent.Attrs().Name))
+		}
+	}
+	return nil
 }
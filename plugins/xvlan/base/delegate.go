@@ -0,0 +1,202 @@
+package xvlan_bash
+
+import (
+	"errors"
+	"testcni/cni"
+	"testcni/nettools"
+	"testcni/skel"
+	"testcni/utils"
+
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+/**
+ * ipam.type 配了别的 ipam 插件(比如 dhcp)的时候, ip 不从 etcd 里分, 交给这个插件
+ * 比如裸金属的 vlan 里已经有 dhcp 服务了, macvlan/ipvlan 的 pod 直接从那儿拿 ip
+ * 这时候用不到 etcd 和 k8s, parent 网卡用配置里的 master, 没配的话用默认路由走的那块儿网卡
+ */
+
+func getParentName(pluginConfig *cni.PluginConf) (string, error) {
+	if pluginConfig.Master != "" {
+		return pluginConfig.Master, nil
+	}
+	return nettools.DefaultRouteLinkName()
+}
+
+/**
+ * macvlan 的话把这块儿网卡从 parent 网卡的混杂模式里去掉
+ * 混杂模式是按 containerID/ifName 记的, 重复调用也只会去掉一次
+ */
+func releaseParentPromisc(mode xvlan_mode, args *skel.CmdArgs, parentName string) error {
+	if mode != MODE_MACVlan {
+		return nil
+	}
+	return nettools.ReleaseParentPromisc(parentName, nettools.PromiscHolder(args.ContainerID, args.IfName))
+}
+
+/**
+ * ADD 中途失败的时候把建了一半的子设备删掉, macvlan 的话把混杂模式也还回去
+ * 子设备可能还在主机上, 也可能已经塞到 pod 里了(这时候 netns 不是 nil), 改名之前叫的还是 macvlan.xxx 这种临时的名字
+ * 所以调用方得告诉这里子设备现在在哪儿, 叫什么
+ */
+func rollbackXVlanDevice(mode xvlan_mode, args *skel.CmdArgs, parentName, deviceName string, netns ns.NetNS) {
+	var err error
+	if netns == nil {
+		err = nettools.DelXVlan(deviceName)
+	} else {
+		_, _, err = nettools.DelXVlanInNs(netns, deviceName, getModeName(mode))
+	}
+	if err != nil {
+		utils.WriteLog("删除 ", getModeName(mode), " 设备 ", deviceName, " 失败, err: ", err.Error())
+	}
+	err = releaseParentPromisc(mode, args, parentName)
+	if err != nil {
+		utils.WriteLog("恢复 parent 网卡 ", parentName, " 的混杂模式失败, err: ", err.Error())
+	}
+}
+
+/**
+ * 1. 创建子设备塞到 pod 里, 改名成 kubelet 传过来的网卡名并启动, dhcp 之类的插件得在网卡已经在了的时候才能分 ip
+ * 2. 调用 ipam 插件拿到 ip
+ * 3. 把 ip 和路由配到 pod 的网卡上, 插件返回的结果就是要返回给 runtime 的结果
+ */
+func SetXVlanDeviceWithIPAMPlugin(
+	mode xvlan_mode,
+	args *skel.CmdArgs,
+	pluginConfig *cni.PluginConf,
+) (*types.Result, error) {
+	parentName, err := getParentName(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var device netlink.Link
+	if mode == MODE_IPVLAN {
+		device, err = nettools.CreateIPVlan("ipvlan", parentName)
+	} else {
+		device, err = nettools.CreateMacVlan("macvlan", parentName, nettools.PromiscHolder(args.ContainerID, args.IfName))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 从这儿往后哪一步出错了, 都把子设备删掉, macvlan 的话把混杂模式还回去, 分了 ip 的话把 ip 也还给 ipam 插件
+	deviceName := device.Attrs().Name
+	var netns ns.NetNS
+	inNs := false
+	allocated := false
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if allocated {
+				if delErr := cni.DelegateIPAMDel(args, pluginConfig); delErr != nil {
+					utils.WriteLog("调用 ipam 插件 ", pluginConfig.IPAM.Type, " 释放 ip 失败, err: ", delErr.Error())
+				}
+			}
+			var deviceNs ns.NetNS
+			if inNs {
+				deviceNs = netns
+			}
+			rollbackXVlanDevice(mode, args, parentName, deviceName, deviceNs)
+		}
+		if netns != nil {
+			netns.Close()
+		}
+	}()
+
+	netns, err = ns.GetNS(args.Netns)
+	if err != nil {
+		return nil, err
+	}
+
+	err = nettools.SetDeviceToNS(device, netns)
+	if err != nil {
+		return nil, err
+	}
+	inNs = true
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		_device, err := netlink.LinkByName(deviceName)
+		if err != nil {
+			return err
+		}
+		err = netlink.LinkSetName(_device, args.IfName)
+		if err != nil {
+			return err
+		}
+		deviceName = args.IfName
+		return netlink.LinkSetUp(_device)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := cni.DelegateIPAMAdd(args, pluginConfig)
+	if err != nil {
+		utils.WriteLog("调用 ipam 插件 ", pluginConfig.IPAM.Type, " 分配 ip 失败, err: ", err.Error())
+		return nil, err
+	}
+	allocated = true
+	if len(result.IPs) == 0 {
+		return nil, errors.New("ipam plugin " + pluginConfig.IPAM.Type + " returned no ip")
+	}
+
+	result.CNIVersion = pluginConfig.CNIVersion
+	result.Interfaces = []*types.Interface{
+		{
+			Name:    args.IfName,
+			Sandbox: args.Netns,
+		},
+	}
+	for _, ipc := range result.IPs {
+		ipc.Interface = types.Int(0)
+	}
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIface(args.IfName, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	succeeded = true
+	return result, nil
+}
+
+/**
+ * 删掉 pod 里的子设备, 再让 ipam 插件把 ip 收回去, netns 已经没了的话子设备也跟着没了
+ * macvlan 的话最后把混杂模式还回去, 子设备没了拿不到 parent 网卡的话用配置里的, 和 ADD 的时候是同一块儿
+ */
+func unsetXVlanDeviceWithIPAMPlugin(
+	mode xvlan_mode,
+	args *skel.CmdArgs,
+	pluginConfig *cni.PluginConf,
+) error {
+	parentName := ""
+	if args.Netns != "" {
+		netns, err := ns.GetNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			_, parentName, err = nettools.DelXVlanInNs(netns, args.IfName, getModeName(mode))
+			if err != nil {
+				return err
+			}
+		} else if !nettools.IsNsNotExistErr(err) {
+			return err
+		} else {
+			utils.WriteLog("netns ", args.Netns, " 已经不存在了, 子设备跟着一起没了")
+		}
+	}
+	err := cni.DelegateIPAMDel(args, pluginConfig)
+	if err != nil {
+		return err
+	}
+	if parentName == "" {
+		parentName, err = getParentName(pluginConfig)
+		if err != nil {
+			return err
+		}
+	}
+	return releaseParentPromisc(mode, args, parentName)
+}
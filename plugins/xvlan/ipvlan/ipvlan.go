@@ -19,6 +19,11 @@ func (ipvlan *IPVlanCNI) Bootstrap(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) (*types.Result, error) {
+	// ipam.type 配了别的 ipam 插件的话, ip 和路由都是插件给的, 结果也直接用插件的
+	if cni.IsDelegatedIPAM(pluginConfig) {
+		return base.SetXVlanDeviceWithIPAMPlugin(base.MODE_IPVLAN, args, pluginConfig)
+	}
+
 	podIP, gw, err := base.SetXVlanDevice(base.MODE_IPVLAN, args, pluginConfig)
 	if err != nil {
 		return nil, err
@@ -26,13 +31,21 @@ func (ipvlan *IPVlanCNI) Bootstrap(
 
 	// 获取网关地址和 podIP 准备返回给外边
 	_gw := net.ParseIP(gw)
-	_, _podIP, _ := net.ParseCIDR(podIP)
+	_ip, _podIP, _ := net.ParseCIDR(podIP)
+	_podIP.IP = _ip
 	result := &types.Result{
 		CNIVersion: pluginConfig.CNIVersion,
+		Interfaces: []*types.Interface{
+			{
+				Name:    args.IfName,
+				Sandbox: args.Netns,
+			},
+		},
 		IPs: []*types.IPConfig{
 			{
-				Address: *_podIP,
-				Gateway: _gw,
+				Interface: types.Int(0),
+				Address:   *_podIP,
+				Gateway:   _gw,
 			},
 		},
 	}
@@ -43,16 +56,14 @@ func (ipvlan *IPVlanCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
-	return nil
+	return base.UnsetXVlanDevice(base.MODE_IPVLAN, args, pluginConfig)
 }
 
 func (ipvlan *IPVlanCNI) Check(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
-	// TODO
-	return nil
+	return base.CheckXVlanDevice(base.MODE_IPVLAN, args, pluginConfig)
 }
 
 func (ipvlan *IPVlanCNI) GetMode() string {
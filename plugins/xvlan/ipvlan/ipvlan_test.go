@@ -62,6 +62,22 @@ func TestIPVlan(t *testing.T) {
 	res, err := ipvlan.Bootstrap(args, pluginConfig)
 	test.Nil(err)
 	fmt.Println(res)
+
+	// ADD 之后的网络和返回的结果应该是一致的
+	pluginConfig.PrevResult = res
+	err = ipvlan.Check(args, pluginConfig)
+	test.Nil(err)
+
+	// 卸载之后 pod 里的设备就没了, 再卸载一次也不能报错
+	err = ipvlan.Unmount(args, pluginConfig)
+	test.Nil(err)
+	err = ipvlan.Unmount(args, pluginConfig)
+	test.Nil(err)
+
+	// 设备都没了, CHECK 一定得报错
+	err = ipvlan.Check(args, pluginConfig)
+	test.NotNil(err)
+
 	err = TmpDeleteNS("ns1")
 	test.Nil(err)
 	nsexist = utils.FileIsExisted("/var/run/netns/ns1")
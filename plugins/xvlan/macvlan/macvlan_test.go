@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os/exec"
 	"testcni/cni"
+	"testcni/consts"
 	"testcni/skel"
 	"testcni/utils"
 	"testing"
@@ -61,6 +62,15 @@ func TestMacVlan(t *testing.T) {
 	macvlan := MacVlanCNI{}
 	_, err = macvlan.Bootstrap(args, pluginConfig)
 	test.Nil(err)
+
+	// 卸载之后 pod 里的设备就没了, 再卸载一次也不能报错
+	err = macvlan.Unmount(args, pluginConfig)
+	test.Nil(err)
+	err = macvlan.Unmount(args, pluginConfig)
+	test.Nil(err)
+	// 这个测试只创建了一个 macvlan, 卸载完之后状态文件就该被删掉了
+	test.False(utils.FileIsExisted(consts.KUBE_TEST_CNI_DEFAULT_PROMISC_PATH + "/" + "ens33"))
+
 	err = TmpDeleteNS("ns1")
 	test.Nil(err)
 	nsexist = utils.FileIsExisted("/var/run/netns/ns1")
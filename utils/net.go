@@ -48,29 +48,63 @@ func InetIP2Int(ip string) int64 {
 	return ret.Int64()
 }
 
+// ip 转成大整数, ipv4 和 ipv6 都能用, 不是合法的 ip 的话返回 nil
+func inetIPToBigInt(ip string) (*big.Int, bool) {
+	_ip := net.ParseIP(ip)
+	if _ip == nil {
+		return nil, false
+	}
+	if v4 := _ip.To4(); v4 != nil {
+		return big.NewInt(0).SetBytes(v4), true
+	}
+	return big.NewInt(0).SetBytes(_ip.To16()), false
+}
+
+func inetBigIntToIP(i *big.Int, isV4 bool) string {
+	size := net.IPv6len
+	if isV4 {
+		size = net.IPv4len
+	}
+	res := make(net.IP, size)
+	i.FillBytes(res)
+	return res.String()
+}
+
+// range 里最多放这么多个 ip, ipv6 的 range 随便写写就能大到把内存撑爆
+const maxIpRangeSize = 1 << 16
+
+/**
+ * 生成 start 到 end 之间(包括两头)的所有 ip
+ * start 和 end 得是同一个地址族的, 并且 start 要比 end 小
+ */
 func GenIpRange(start, end string) []string {
-	startInt, endInt := InetIpToUInt32(start), InetIpToUInt32(end)
-	if startInt >= endInt {
+	startInt, startIsV4 := inetIPToBigInt(start)
+	endInt, endIsV4 := inetIPToBigInt(end)
+	if startInt == nil || endInt == nil || startIsV4 != endIsV4 || startInt.Cmp(endInt) >= 0 {
+		return nil
+	}
+	size := big.NewInt(0).Sub(endInt, startInt)
+	if !size.IsInt64() || size.Int64() >= maxIpRangeSize {
 		return nil
 	}
-	res := make([]string, endInt-startInt+1)
+	res := make([]string, size.Int64()+1)
 	for index := range res {
-		_tmp := startInt + uint32(index)
-		res[index] = InetUint32ToIp(_tmp)
+		_tmp := big.NewInt(0).Add(startInt, big.NewInt(int64(index)))
+		res[index] = inetBigIntToIP(_tmp, startIsV4)
 	}
 	return res
 }
 
 func GetMaxIP(ips []string) string {
-	var _ips []int64
-	for _, ip := range ips {
-		_ips = append(_ips, InetIP2Int(ip))
-	}
-	maxNum := _ips[0]
+	var maxNum *big.Int
 	var maxArrayIndex int
-	for i := 1; i < len(_ips); i++ {
-		if _ips[i] > maxNum {
-			maxNum = _ips[i]
+	for i, ip := range ips {
+		ipInt, _ := inetIPToBigInt(ip)
+		if ipInt == nil {
+			continue
+		}
+		if maxNum == nil || ipInt.Cmp(maxNum) > 0 {
+			maxNum = ipInt
 			maxArrayIndex = i
 		}
 	}